@@ -0,0 +1,348 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/barelyhuman/caddy-ui/appsfile"
+	"github.com/barelyhuman/caddy-ui/auth"
+	"github.com/barelyhuman/caddy-ui/data"
+	"github.com/barelyhuman/caddy-ui/data/models/apps"
+)
+
+// JSON API for scripts and other tools, everything lives under /api/v1
+// and is authenticated the same way as the UI (session or API token)
+
+const Prefix = auth.APIPrefix
+
+const (
+	defaultPerPage = 50
+	maxPerPage     = 200
+)
+
+// limit for request bodies, nothing in the API comes close
+const maxBodySize = 1 << 20
+
+type Server struct {
+	// Sync pushes the app's routes to caddy and RemoveRoutes drops the
+	// routes of hosts no app has anymore, they're injected so the API
+	// changes caddy the same way as the UI
+	Sync         func(appId string) error
+	RemoveRoutes func(hosts []string) error
+}
+
+// operation is one endpoint, the same table registers the routes and
+// generates the OpenAPI document so the two can't drift apart
+type operation struct {
+	Method  string
+	Path    string
+	Role    auth.Role
+	Handler func(*Server, http.ResponseWriter, *http.Request)
+	Tag     string
+	Summary string
+	// Request and Response are zero values of the body types, nil when
+	// there is no body
+	Request  any
+	Response any
+	Status   int
+	// Paginated adds the page and per_page query params
+	Paginated bool
+	// Query are the other optional query params
+	Query []queryParam
+	// Errors are the error statuses the handler can respond with, besides
+	// the 401/403 every endpoint has
+	Errors []int
+}
+
+type queryParam struct {
+	Name        string
+	Description string
+	Enum        []string
+}
+
+var operations = []operation{
+	{Method: http.MethodGet, Path: "/apps", Role: auth.RoleViewer, Handler: (*Server).listApps, Tag: "apps",
+		Summary: "List apps", Response: List[App]{}, Status: http.StatusOK, Paginated: true,
+		Errors: []int{http.StatusUnprocessableEntity}},
+	{Method: http.MethodPost, Path: "/apps", Role: auth.RoleOperator, Handler: (*Server).createApp, Tag: "apps",
+		Summary: "Create an app with its domains and upstreams", Request: CreateAppRequest{}, Response: App{}, Status: http.StatusCreated,
+		Errors: []int{http.StatusBadRequest, http.StatusConflict, http.StatusUnprocessableEntity}},
+	{Method: http.MethodGet, Path: "/apps/{id}", Role: auth.RoleViewer, Handler: (*Server).getApp, Tag: "apps",
+		Summary: "Get an app", Response: App{}, Status: http.StatusOK,
+		Errors: []int{http.StatusNotFound}},
+	{Method: http.MethodPatch, Path: "/apps/{id}", Role: auth.RoleOperator, Handler: (*Server).updateApp, Tag: "apps",
+		Summary: "Update an app", Request: UpdateAppRequest{}, Response: App{}, Status: http.StatusOK,
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity}},
+	{Method: http.MethodDelete, Path: "/apps/{id}", Role: auth.RoleOperator, Handler: (*Server).deleteApp, Tag: "apps",
+		Summary: "Delete an app with its domains, upstreams and options", Status: http.StatusNoContent,
+		Errors: []int{http.StatusNotFound, http.StatusConflict, http.StatusBadGateway}},
+
+	{Method: http.MethodGet, Path: "/apps/{id}/domains", Role: auth.RoleViewer, Handler: (*Server).listDomains, Tag: "domains",
+		Summary: "List the domains of an app", Response: List[Domain]{}, Status: http.StatusOK, Paginated: true,
+		Errors: []int{http.StatusNotFound, http.StatusUnprocessableEntity}},
+	{Method: http.MethodPost, Path: "/apps/{id}/domains", Role: auth.RoleOperator, Handler: (*Server).createDomain, Tag: "domains",
+		Summary: "Add a domain to an app", Request: DomainRequest{}, Response: Domain{}, Status: http.StatusCreated,
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity}},
+	{Method: http.MethodGet, Path: "/apps/{id}/domains/{domainId}", Role: auth.RoleViewer, Handler: (*Server).getDomain, Tag: "domains",
+		Summary: "Get a domain", Response: Domain{}, Status: http.StatusOK,
+		Errors: []int{http.StatusNotFound}},
+	{Method: http.MethodPatch, Path: "/apps/{id}/domains/{domainId}", Role: auth.RoleOperator, Handler: (*Server).updateDomain, Tag: "domains",
+		Summary: "Change a domain", Request: DomainRequest{}, Response: Domain{}, Status: http.StatusOK,
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity, http.StatusBadGateway}},
+	{Method: http.MethodDelete, Path: "/apps/{id}/domains/{domainId}", Role: auth.RoleOperator, Handler: (*Server).deleteDomain, Tag: "domains",
+		Summary: "Remove a domain", Status: http.StatusNoContent,
+		Errors: []int{http.StatusNotFound, http.StatusConflict, http.StatusBadGateway}},
+
+	{Method: http.MethodGet, Path: "/apps/{id}/upstreams", Role: auth.RoleViewer, Handler: (*Server).listUpstreams, Tag: "upstreams",
+		Summary: "List the upstreams of an app", Response: List[Upstream]{}, Status: http.StatusOK, Paginated: true,
+		Errors: []int{http.StatusNotFound, http.StatusUnprocessableEntity}},
+	{Method: http.MethodPost, Path: "/apps/{id}/upstreams", Role: auth.RoleOperator, Handler: (*Server).createUpstream, Tag: "upstreams",
+		Summary: "Add an upstream to an app", Request: UpstreamRequest{}, Response: Upstream{}, Status: http.StatusCreated,
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity}},
+	{Method: http.MethodGet, Path: "/apps/{id}/upstreams/{upstreamId}", Role: auth.RoleViewer, Handler: (*Server).getUpstream, Tag: "upstreams",
+		Summary: "Get an upstream", Response: Upstream{}, Status: http.StatusOK,
+		Errors: []int{http.StatusNotFound}},
+	{Method: http.MethodPatch, Path: "/apps/{id}/upstreams/{upstreamId}", Role: auth.RoleOperator, Handler: (*Server).updateUpstream, Tag: "upstreams",
+		Summary: "Change an upstream", Request: UpstreamRequest{}, Response: Upstream{}, Status: http.StatusOK,
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity}},
+	{Method: http.MethodDelete, Path: "/apps/{id}/upstreams/{upstreamId}", Role: auth.RoleOperator, Handler: (*Server).deleteUpstream, Tag: "upstreams",
+		Summary: "Remove an upstream", Status: http.StatusNoContent,
+		Errors: []int{http.StatusNotFound, http.StatusConflict}},
+
+	{Method: http.MethodGet, Path: "/ports", Role: auth.RoleViewer, Handler: (*Server).listPorts, Tag: "ports",
+		Summary: "List the upstreams of every app, the port range and its next free port", Response: PortRegistry{}, Status: http.StatusOK},
+
+	{Method: http.MethodGet, Path: "/export", Role: auth.RoleViewer, Handler: (*Server).exportApps, Tag: "export",
+		Summary: "Export every app as an apps file, it can be applied with apps_file or apps apply", Response: appsfile.File{}, Status: http.StatusOK,
+		Query:  []queryParam{{Name: "format", Description: "yaml sends application/yaml instead", Enum: []string{appsfile.FormatJSON, appsfile.FormatYAML}}},
+		Errors: []int{http.StatusUnprocessableEntity}},
+
+	{Method: http.MethodPost, Path: "/apps/{id}/sync", Role: auth.RoleOperator, Handler: (*Server).syncApp, Tag: "sync",
+		Summary: "Push the routes of an app to caddy", Response: Message{}, Status: http.StatusOK,
+		Errors: []int{http.StatusNotFound, http.StatusConflict, http.StatusBadGateway}},
+	{Method: http.MethodPost, Path: "/sync", Role: auth.RoleOperator, Handler: (*Server).syncAll, Tag: "sync",
+		Summary: "Push the routes of every app the caller can edit to caddy, 502 if any of them failed", Response: SyncResults{}, Status: http.StatusOK,
+		Errors: []int{http.StatusBadGateway}},
+}
+
+// Register adds the API routes to the mux, each route is wrapped with
+// the minimum role it needs, per app checks happen in the handlers
+func (s *Server) Register(mux *http.ServeMux) {
+	for _, op := range operations {
+		handler := op.Handler
+		mux.HandleFunc(op.Method+" "+Prefix+op.Path, auth.Allow(op.Role, func(w http.ResponseWriter, r *http.Request) {
+			handler(s, w, r)
+		}))
+	}
+
+	mux.HandleFunc("GET "+Prefix+"/openapi.json", auth.Allow(auth.RoleViewer, s.openAPI))
+
+	// anything else under the prefix gets a JSON error instead of the
+	// home page, this pattern also hides the mux's own 405s so they are
+	// worked out here
+	mux.HandleFunc(Prefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		allowed := []string{}
+		for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodDelete} {
+			probe := r.Clone(r.Context())
+			probe.Method = method
+			if _, pattern := mux.Handler(probe); pattern != Prefix+"/" {
+				allowed = append(allowed, method)
+			}
+		}
+		if len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %v is not allowed here", r.Method))
+			return
+		}
+		writeError(w, http.StatusNotFound, "no such endpoint")
+	})
+}
+
+type Error struct {
+	Error string `json:"error"`
+	// Fields has a message per invalid field for validation errors
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+type Pagination struct {
+	Page       int `json:"page"`
+	PerPage    int `json:"per_page"`
+	Total      int `json:"total"`
+	TotalPages int `json:"total_pages"`
+}
+
+type List[T any] struct {
+	Data       []T        `json:"data"`
+	Pagination Pagination `json:"pagination"`
+}
+
+type Message struct {
+	Message string `json:"message"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, Error{Error: message})
+}
+
+func writeValidationError(w http.ResponseWriter, fields map[string]string) {
+	writeJSON(w, http.StatusUnprocessableEntity, Error{
+		Error:  "validation failed",
+		Fields: fields,
+	})
+}
+
+// writeConflict is for values that are valid but already taken
+func writeConflict(w http.ResponseWriter, fields map[string]string) {
+	writeJSON(w, http.StatusConflict, Error{
+		Error:  "conflict",
+		Fields: fields,
+	})
+}
+
+// writeFieldErrors sends the validation errors if there are any, else
+// the conflicts, ok is true when there was nothing to send
+func writeFieldErrors(w http.ResponseWriter, fields map[string]string, conflicts map[string]string) bool {
+	if len(fields) > 0 {
+		writeValidationError(w, fields)
+		return false
+	}
+	if len(conflicts) > 0 {
+		writeConflict(w, conflicts)
+		return false
+	}
+	return true
+}
+
+func writeInternalError(w http.ResponseWriter, err error) {
+	log.Printf("failed with error: %v", err)
+	writeError(w, http.StatusInternalServerError, "something went wrong, please try again later")
+}
+
+// decode reads the JSON body into v, unknown fields are rejected so
+// typos don't silently do nothing
+func decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		if errors.Is(err, io.EOF) {
+			writeError(w, http.StatusBadRequest, "request body is empty")
+			return false
+		}
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid JSON body: %v", err))
+		return false
+	}
+	if decoder.More() {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: expected a single object")
+		return false
+	}
+	return true
+}
+
+// paginate slices the items for the `page` and `per_page` query params,
+// ok is false when the params are invalid and the error was written
+func paginate[T any](w http.ResponseWriter, r *http.Request, items []T) (List[T], bool) {
+	fields := map[string]string{}
+	page := 1
+	perPage := defaultPerPage
+
+	query := r.URL.Query()
+	if value := query.Get("page"); len(value) > 0 {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			fields["page"] = "must be a number greater than 0"
+		}
+		page = parsed
+	}
+	if value := query.Get("per_page"); len(value) > 0 {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxPerPage {
+			fields["per_page"] = fmt.Sprintf("must be a number between 1 and %v", maxPerPage)
+		}
+		perPage = parsed
+	}
+	if len(fields) > 0 {
+		writeValidationError(w, fields)
+		return List[T]{}, false
+	}
+
+	start := min((page-1)*perPage, len(items))
+	end := min(start+perPage, len(items))
+
+	return List[T]{
+		Data: items[start:end],
+		Pagination: Pagination{
+			Page:       page,
+			PerPage:    perPage,
+			Total:      len(items),
+			TotalPages: int(math.Ceil(float64(len(items)) / float64(perPage))),
+		},
+	}, true
+}
+
+func database(w http.ResponseWriter) (*sql.DB, bool) {
+	db, err := data.GetDatabaseHandle()
+	if err != nil {
+		writeInternalError(w, err)
+		return nil, false
+	}
+	return db, true
+}
+
+// findApp loads the app from the `id` path param and checks the request
+// can see it, the error is written when ok is false
+func findApp(w http.ResponseWriter, r *http.Request, db *sql.DB) (*apps.AppsWithIdentifier, bool) {
+	id := r.PathValue("id")
+	appID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("app %v not found", id))
+		return nil, false
+	}
+	app, err := apps.NewStore(db).FindById(r.Context(), appID)
+	if errors.Is(err, data.ErrNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("app %v not found", id))
+		return nil, false
+	}
+	if err != nil {
+		writeInternalError(w, err)
+		return nil, false
+	}
+	if !auth.AppAllowed(r.Context(), id) {
+		auth.Forbidden(w, r)
+		return nil, false
+	}
+	return app, true
+}
+
+// findEditableApp is findApp for mutations, the user also has to be
+// allowed to edit the app and the app can't come from an apps file
+func findEditableApp(w http.ResponseWriter, r *http.Request, db *sql.DB) (*apps.AppsWithIdentifier, bool) {
+	app, ok := findApp(w, r, db)
+	if !ok {
+		return nil, false
+	}
+	if !auth.CanEditApp(r, db, r.PathValue("id")) {
+		auth.Forbidden(w, r)
+		return nil, false
+	}
+	if app.ManagedBy.Valid {
+		writeError(w, http.StatusConflict, fmt.Sprintf("app %v is managed by %v, change it there", app.ID, app.ManagedBy.String))
+		return nil, false
+	}
+	return app, true
+}
@@ -0,0 +1,509 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/barelyhuman/caddy-ui/audit"
+	"github.com/barelyhuman/caddy-ui/auth"
+	"github.com/barelyhuman/caddy-ui/caddy"
+	"github.com/barelyhuman/caddy-ui/data"
+	"github.com/barelyhuman/caddy-ui/data/models/app_options"
+	"github.com/barelyhuman/caddy-ui/data/models/app_ports"
+	"github.com/barelyhuman/caddy-ui/data/models/apps"
+	"github.com/barelyhuman/caddy-ui/data/models/domains"
+	"github.com/barelyhuman/caddy-ui/data/store"
+	"github.com/barelyhuman/caddy-ui/ports"
+)
+
+type App struct {
+	ID      int64             `json:"id"`
+	Name    string            `json:"name"`
+	Type    string            `json:"type"`
+	Team    string            `json:"team"`
+	Options map[string]string `json:"options"`
+	// ManagedBy is the apps file the app is applied from, those apps
+	// are read-only
+	ManagedBy string    `json:"managed_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Warnings are set on create, ex: a domain overlaps a wildcard
+	// domain of another app
+	Warnings []string `json:"warnings,omitempty"`
+	// AllocatedPort is set on create when allocate_port was asked
+	AllocatedPort int `json:"allocated_port,omitempty"`
+}
+
+type CreateAppRequest struct {
+	Name string `json:"name" required:"true"`
+	// Type defaults to reverse-proxy
+	Type string `json:"type"`
+	// Team defaults to the team of the user, only admins can pick
+	// another one
+	Team      string            `json:"team"`
+	Options   map[string]string `json:"options"`
+	Domains   []string          `json:"domains"`
+	Upstreams []string          `json:"upstreams"`
+	// AllocatePort adds an upstream on the next free port of the
+	// configured port range
+	AllocatePort bool `json:"allocate_port"`
+	// AllocatedPort is filled in by CreateApp
+	AllocatedPort int `json:"-"`
+}
+
+// UpdateAppRequest only changes the fields that are set, an option set
+// to null is removed
+type UpdateAppRequest struct {
+	Name    *string            `json:"name"`
+	Type    *string            `json:"type"`
+	Team    *string            `json:"team"`
+	Options map[string]*string `json:"options"`
+}
+
+func toApp(db *sql.DB, app *apps.AppsWithIdentifier) (App, error) {
+	options, err := app_options.FindByAppId(db, strconv.FormatInt(app.ID, 10))
+	if err != nil {
+		return App{}, err
+	}
+	appType := app.Type.String
+	if len(appType) == 0 {
+		appType = string(caddy.RouteKindReverseProxy)
+	}
+	return App{
+		ID:        app.ID,
+		Name:      app.Name,
+		Type:      appType,
+		Team:      app.Team.String,
+		Options:   options,
+		ManagedBy: app.ManagedBy.String,
+		CreatedAt: app.CreatedAt,
+		UpdatedAt: app.UpdatedAt,
+	}, nil
+}
+
+func (s *Server) listApps(w http.ResponseWriter, r *http.Request) {
+	db, ok := database(w)
+	if !ok {
+		return
+	}
+
+	all, err := apps.FindAll(db)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	visible := []apps.AppsWithIdentifier{}
+	for _, app := range all {
+		if auth.AppAllowed(r.Context(), strconv.FormatInt(app.ID, 10)) {
+			visible = append(visible, app)
+		}
+	}
+
+	page, ok := paginate(w, r, visible)
+	if !ok {
+		return
+	}
+
+	result := List[App]{Data: []App{}, Pagination: page.Pagination}
+	for _, app := range page.Data {
+		item, err := toApp(db, &app)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		result.Data = append(result.Data, item)
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) getApp(w http.ResponseWriter, r *http.Request) {
+	db, ok := database(w)
+	if !ok {
+		return
+	}
+	app, ok := findApp(w, r, db)
+	if !ok {
+		return
+	}
+	result, err := toApp(db, app)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) createApp(w http.ResponseWriter, r *http.Request) {
+	db, ok := database(w)
+	if !ok {
+		return
+	}
+
+	var body CreateAppRequest
+	if !decode(w, r, &body) {
+		return
+	}
+
+	team, err := auth.NewAppTeam(r.Context(), body.Team)
+	if err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	body.Team = team
+	// a token limited to some apps can't reach the app it would create
+	if token := auth.TokenFromContext(r.Context()); token != nil && token.Apps() != nil {
+		writeError(w, http.StatusForbidden, "tokens limited to specific apps can't create apps")
+		return
+	}
+
+	fields, conflicts, warnings, err := body.Check(db)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if !writeFieldErrors(w, fields, conflicts) {
+		return
+	}
+
+	appID, err := CreateApp(r.Context(), db, &body)
+	if errors.Is(err, ports.ErrExhausted) {
+		writeConflict(w, map[string]string{"allocate_port": err.Error()})
+		return
+	}
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	app, err := apps.FindById(db, strconv.FormatInt(appID, 10))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	result, err := toApp(db, app)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	audit.Record(r, audit.Entry{
+		Action:     "app.create",
+		TargetType: "app",
+		TargetID:   appID,
+		After:      audit.App(db, strconv.FormatInt(appID, 10)),
+	})
+
+	result.Warnings = warnings
+	result.AllocatedPort = body.AllocatedPort
+	w.Header().Set("Location", fmt.Sprintf("%v/apps/%v", Prefix, appID))
+	writeJSON(w, http.StatusCreated, result)
+}
+
+// Validate normalizes the request and checks the values that don't
+// depend on the other apps, keyed like the JSON fields (ex: domains.0)
+func (body *CreateAppRequest) Validate() map[string]string {
+	body.Name = strings.TrimSpace(body.Name)
+	if len(body.Type) == 0 {
+		body.Type = string(caddy.RouteKindReverseProxy)
+	}
+	if body.Options == nil {
+		body.Options = map[string]string{}
+	}
+
+	fields := map[string]string{}
+	if msg := validateName(body.Name); len(msg) > 0 {
+		fields["name"] = msg
+	}
+	if msg := validateType(body.Type); len(msg) > 0 {
+		fields["type"] = msg
+	}
+	validateOptions(body.Type, body.Options, fields)
+
+	for i, domain := range body.Domains {
+		body.Domains[i] = normalizeDomain(domain)
+		if msg := validateDomain(body.Domains[i]); len(msg) > 0 {
+			fields[fmt.Sprintf("domains.%v", i)] = msg
+		}
+	}
+	for i, upstream := range body.Upstreams {
+		body.Upstreams[i] = strings.TrimSpace(upstream)
+		if msg := validateUpstream(body.Upstreams[i]); len(msg) > 0 {
+			fields[fmt.Sprintf("upstreams.%v", i)] = msg
+		}
+	}
+	if len(body.Upstreams) > 0 && body.Type != string(caddy.RouteKindReverseProxy) {
+		fields["upstreams"] = "are only used by reverse-proxy apps"
+	}
+	if body.AllocatePort && body.Type != string(caddy.RouteKindReverseProxy) {
+		fields["allocate_port"] = "is only used by reverse-proxy apps"
+	}
+	return fields
+}
+
+// Check normalizes the request and validates it against the existing
+// apps, fields are invalid values, conflicts are values already in use
+// and warnings are domain overlaps that don't stop the app from being
+// created
+func (body *CreateAppRequest) Check(db *sql.DB) (map[string]string, map[string]string, []string, error) {
+	fields := body.Validate()
+	conflicts := map[string]string{}
+
+	domainCheck, err := CheckDomains(db, 0, body.Domains)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	body.Domains = domainCheck.Domains
+	for key, msg := range domainCheck.Fields {
+		fields[key] = msg
+	}
+	for key, msg := range domainCheck.Conflicts {
+		conflicts[key] = msg
+	}
+	existingUpstreams, err := app_ports.AppIdsByDial(db)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	seenUpstreams := map[string]bool{}
+	for i, upstream := range body.Upstreams {
+		key := fmt.Sprintf("upstreams.%v", i)
+		dial := app_ports.DialKey(upstream)
+		if _, invalid := fields[key]; invalid {
+			continue
+		}
+		if _, taken := existingUpstreams[dial]; taken || seenUpstreams[dial] {
+			conflicts[key] = "is already in use"
+		}
+		seenUpstreams[dial] = true
+	}
+
+	if _, found, err := apps.FindByName(db, body.Name); err != nil {
+		return nil, nil, nil, err
+	} else if found {
+		conflicts["name"] = "is already in use"
+	}
+	return fields, conflicts, domainCheck.Warnings, nil
+}
+
+// CreateApp saves a checked request, everything goes in one transaction
+// so a failure doesn't leave half an app behind. A port allocated for
+// the app is added to body.Upstreams and set in body.AllocatedPort
+func CreateApp(ctx context.Context, db *sql.DB, body *CreateAppRequest) (int64, error) {
+	var appID int64
+	err := store.New(db).Atomic(ctx, func(tx *store.Store) error {
+		instanceID, err := tx.PrimaryInstanceID(ctx)
+		if err != nil {
+			return err
+		}
+		app := apps.New()
+		app.Name = body.Name
+		app.InstanceID = instanceID
+		app.Type = sql.NullString{String: body.Type, Valid: true}
+		app.Team = sql.NullString{String: body.Team, Valid: len(body.Team) > 0}
+		created, err := tx.Apps.Create(ctx, app)
+		if err != nil {
+			return err
+		}
+		appID = created.ID
+
+		for _, value := range body.Domains {
+			domain := domains.New()
+			domain.Domain = value
+			domain.AppID = appID
+			if _, err := tx.Domains.Create(ctx, domain); err != nil {
+				return err
+			}
+		}
+		if body.AllocatePort {
+			allocated, err := ports.Allocate(ctx, tx)
+			if err != nil {
+				return err
+			}
+			body.AllocatedPort = allocated
+			body.Upstreams = append(body.Upstreams, strconv.Itoa(allocated))
+		}
+		for _, upstream := range body.Upstreams {
+			port := app_ports.New()
+			port.Port = upstream
+			port.AppId = appID
+			if _, err := tx.Ports.Create(ctx, port); err != nil {
+				return err
+			}
+		}
+		for name, value := range body.Options {
+			option := app_options.New()
+			option.AppId = appID
+			option.Name = name
+			option.Value = sql.NullString{String: value, Valid: true}
+			if _, err := tx.Options.Save(ctx, option); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return appID, err
+}
+
+func (s *Server) updateApp(w http.ResponseWriter, r *http.Request) {
+	db, ok := database(w)
+	if !ok {
+		return
+	}
+	app, ok := findEditableApp(w, r, db)
+	if !ok {
+		return
+	}
+
+	var body UpdateAppRequest
+	if !decode(w, r, &body) {
+		return
+	}
+
+	id := strconv.FormatInt(app.ID, 10)
+	before := audit.App(db, id)
+	current, err := toApp(db, app)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	fields := map[string]string{}
+	conflicts := map[string]string{}
+	if body.Name != nil {
+		name := strings.TrimSpace(*body.Name)
+		if msg := validateName(name); len(msg) > 0 {
+			fields["name"] = msg
+		} else if existing, found, err := apps.FindByName(db, name); err != nil {
+			writeInternalError(w, err)
+			return
+		} else if found && existing.ID != app.ID {
+			conflicts["name"] = "is already in use"
+		}
+		app.Name = name
+	}
+	appType := current.Type
+	if body.Type != nil {
+		appType = *body.Type
+		if msg := validateType(appType); len(msg) > 0 {
+			fields["type"] = msg
+		}
+		app.Type = sql.NullString{String: appType, Valid: true}
+	}
+	if body.Team != nil && *body.Team != app.Team.String {
+		user := auth.UserFromContext(r.Context())
+		if !auth.Role(user.Role).Includes(auth.RoleAdmin) {
+			writeError(w, http.StatusForbidden, "only admins can change the team of an app")
+			return
+		}
+		team := strings.TrimSpace(*body.Team)
+		app.Team = sql.NullString{String: team, Valid: len(team) > 0}
+	}
+
+	options := current.Options
+	for name, value := range body.Options {
+		if value == nil {
+			delete(options, name)
+		} else {
+			options[name] = *value
+		}
+	}
+	validateOptions(appType, options, fields)
+
+	if !writeFieldErrors(w, fields, conflicts) {
+		return
+	}
+
+	// the app and its options change together or not at all
+	ctx := r.Context()
+	err = store.New(db).Atomic(ctx, func(tx *store.Store) error {
+		if err := tx.Apps.Update(ctx, app); err != nil {
+			return err
+		}
+		for name, value := range body.Options {
+			if value == nil {
+				if err := tx.Options.Delete(ctx, app.ID, name); err != nil && !errors.Is(err, data.ErrNotFound) {
+					return err
+				}
+				continue
+			}
+			option := app_options.New()
+			option.AppId = app.ID
+			option.Name = name
+			option.Value = sql.NullString{String: *value, Valid: true}
+			if _, err := tx.Options.Save(ctx, option); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	audit.Record(r, audit.Entry{
+		Action:     "app.update",
+		TargetType: "app",
+		TargetID:   app.ID,
+		Before:     before,
+		After:      audit.App(db, id),
+	})
+
+	updated, err := apps.FindById(db, id)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	result, err := toApp(db, updated)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) deleteApp(w http.ResponseWriter, r *http.Request) {
+	db, ok := database(w)
+	if !ok {
+		return
+	}
+	app, ok := findEditableApp(w, r, db)
+	if !ok {
+		return
+	}
+
+	before := audit.App(db, strconv.FormatInt(app.ID, 10))
+	hosts, err := AppHosts(db, app.ID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	if err := store.New(db).DeleteApp(r.Context(), app.ID); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	audit.Record(r, audit.Entry{
+		Action:     "app.delete",
+		TargetType: "app",
+		TargetID:   app.ID,
+		Before:     before,
+	})
+
+	// caddy would keep serving the app's domains otherwise
+	if err := s.RemoveRoutes(hosts); err != nil {
+		log.Printf("failed to remove the routes of app %v: %v", app.ID, err)
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("app deleted but caddy refused to remove its routes: %v", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
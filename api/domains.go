@@ -0,0 +1,366 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/barelyhuman/caddy-ui/audit"
+	"github.com/barelyhuman/caddy-ui/data"
+	"github.com/barelyhuman/caddy-ui/data/models/apps"
+	"github.com/barelyhuman/caddy-ui/data/models/domains"
+	"github.com/barelyhuman/caddy-ui/data/store"
+)
+
+type Domain struct {
+	ID        int64     `json:"id"`
+	AppID     int64     `json:"app_id"`
+	Domain    string    `json:"domain"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Warnings are set on create and update, ex: the domain overlaps a
+	// wildcard domain of another app
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+type DomainRequest struct {
+	Domain string `json:"domain" required:"true"`
+}
+
+func toDomain(d domains.DomainsWithIdentifier) Domain {
+	return Domain{
+		ID:        d.ID,
+		AppID:     d.AppID,
+		Domain:    d.Domain,
+		CreatedAt: d.CreatedAt,
+		UpdatedAt: d.UpdatedAt,
+	}
+}
+
+// findDomain loads the `domainId` path param, domains of other apps are
+// treated as missing
+func findDomain(w http.ResponseWriter, r *http.Request, db *sql.DB, app *apps.AppsWithIdentifier) (*domains.DomainsWithIdentifier, bool) {
+	id := r.PathValue("domainId")
+	domain, err := domains.FindById(db, id)
+	if errors.Is(err, data.ErrNotFound) || (err == nil && domain.AppID != app.ID) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("domain %v not found", id))
+		return nil, false
+	}
+	if err != nil {
+		writeInternalError(w, err)
+		return nil, false
+	}
+	return domain, true
+}
+
+// validateDomainRequest returns the normalized domain and the overlap
+// warnings, ok is false when a response was already written
+func validateDomainRequest(w http.ResponseWriter, db *sql.DB, body DomainRequest, appID int64) (string, []string, bool) {
+	domain := normalizeDomain(body.Domain)
+	if msg := validateDomain(domain); len(msg) > 0 {
+		writeValidationError(w, map[string]string{"domain": msg})
+		return "", nil, false
+	}
+
+	index, err := LoadHostIndex(db)
+	if err != nil {
+		writeInternalError(w, err)
+		return "", nil, false
+	}
+	conflict, warnings := index.Check(domain, appID)
+	if len(conflict) > 0 {
+		writeConflict(w, map[string]string{"domain": conflict})
+		return "", nil, false
+	}
+	return domain, append(index.Warnings, warnings...), true
+}
+
+// DomainCheck is the result of CheckDomains, Fields are invalid values,
+// Conflicts are hosts already in use and Warnings are wildcard overlaps
+// that are allowed but probably a mistake
+type DomainCheck struct {
+	Domains   []string
+	Fields    map[string]string
+	Conflicts map[string]string
+	Warnings  []string
+}
+
+// CheckDomains normalizes and validates the full list of domains for an
+// app against the other apps and the live config, domains already used
+// by the app itself aren't conflicts
+func CheckDomains(db *sql.DB, appID int64, list []string) (DomainCheck, error) {
+	check := DomainCheck{
+		Domains:   []string{},
+		Fields:    map[string]string{},
+		Conflicts: map[string]string{},
+	}
+	index, err := LoadHostIndex(db)
+	if err != nil {
+		return check, err
+	}
+	check.Warnings = append(check.Warnings, index.Warnings...)
+
+	seen := map[string]bool{}
+	for i, domain := range list {
+		domain = normalizeDomain(domain)
+		key := fmt.Sprintf("domains.%v", i)
+		if msg := validateDomain(domain); len(msg) > 0 {
+			check.Fields[key] = msg
+		} else if seen[domain] {
+			check.Conflicts[key] = "is listed twice"
+		} else if conflict, warnings := index.Check(domain, appID); len(conflict) > 0 {
+			check.Conflicts[key] = conflict
+		} else {
+			check.Warnings = append(check.Warnings, warnings...)
+		}
+		seen[domain] = true
+		check.Domains = append(check.Domains, domain)
+	}
+	return check, nil
+}
+
+// AppHosts lists the domains of the app, the hosts its caddy route
+// matches
+func AppHosts(db *sql.DB, appID int64) ([]string, error) {
+	list, err := domains.FindAllByAppId(db, strconv.FormatInt(appID, 10))
+	if err != nil {
+		return nil, err
+	}
+	hosts := []string{}
+	for _, d := range list {
+		hosts = append(hosts, d.Domain)
+	}
+	return hosts, nil
+}
+
+// ReleasedHosts lists the hosts of before that aren't in after, their
+// routes have to be removed since a sync only replaces the route of the
+// hosts the app still has
+func ReleasedHosts(before, after []string) []string {
+	released := []string{}
+	for _, host := range before {
+		if !slices.Contains(after, host) {
+			released = append(released, host)
+		}
+	}
+	return released
+}
+
+// SetDomains replaces every domain of the app with the checked list and
+// returns the hosts the app no longer has, see ReleasedHosts
+func SetDomains(ctx context.Context, db *sql.DB, appID int64, list []string) ([]string, error) {
+	released := []string{}
+	err := store.New(db).Atomic(ctx, func(tx *store.Store) error {
+		existing, err := tx.Domains.FindAllByAppId(ctx, appID)
+		if err != nil {
+			return err
+		}
+		before := []string{}
+		for _, d := range existing {
+			before = append(before, d.Domain)
+		}
+		released = ReleasedHosts(before, list)
+
+		if err := tx.Domains.DeleteByAppId(ctx, appID); err != nil {
+			return err
+		}
+		for _, value := range list {
+			domain := domains.New()
+			domain.Domain = value
+			domain.AppID = appID
+			if _, err := tx.Domains.Create(ctx, domain); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return released, nil
+}
+
+func (s *Server) listDomains(w http.ResponseWriter, r *http.Request) {
+	db, ok := database(w)
+	if !ok {
+		return
+	}
+	app, ok := findApp(w, r, db)
+	if !ok {
+		return
+	}
+
+	all, err := domains.FindAllByAppId(db, strconv.FormatInt(app.ID, 10))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	page, ok := paginate(w, r, all)
+	if !ok {
+		return
+	}
+	result := List[Domain]{Data: []Domain{}, Pagination: page.Pagination}
+	for _, d := range page.Data {
+		result.Data = append(result.Data, toDomain(d))
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) getDomain(w http.ResponseWriter, r *http.Request) {
+	db, ok := database(w)
+	if !ok {
+		return
+	}
+	app, ok := findApp(w, r, db)
+	if !ok {
+		return
+	}
+	domain, ok := findDomain(w, r, db, app)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, toDomain(*domain))
+}
+
+func (s *Server) createDomain(w http.ResponseWriter, r *http.Request) {
+	db, ok := database(w)
+	if !ok {
+		return
+	}
+	app, ok := findEditableApp(w, r, db)
+	if !ok {
+		return
+	}
+
+	var body DomainRequest
+	if !decode(w, r, &body) {
+		return
+	}
+	value, warnings, ok := validateDomainRequest(w, db, body, app.ID)
+	if !ok {
+		return
+	}
+
+	record := domains.New()
+	record.Domain = value
+	record.AppID = app.ID
+	created, err := record.Save(db)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	domain, err := domains.FindById(db, strconv.FormatInt(created.ID, 10))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	audit.Record(r, audit.Entry{
+		Action:     "domain.create",
+		TargetType: "domain",
+		TargetID:   domain.ID,
+		After:      toDomain(*domain),
+	})
+
+	result := toDomain(*domain)
+	result.Warnings = warnings
+	w.Header().Set("Location", fmt.Sprintf("%v/apps/%v/domains/%v", Prefix, app.ID, domain.ID))
+	writeJSON(w, http.StatusCreated, result)
+}
+
+func (s *Server) updateDomain(w http.ResponseWriter, r *http.Request) {
+	db, ok := database(w)
+	if !ok {
+		return
+	}
+	app, ok := findEditableApp(w, r, db)
+	if !ok {
+		return
+	}
+	domain, ok := findDomain(w, r, db, app)
+	if !ok {
+		return
+	}
+
+	var body DomainRequest
+	if !decode(w, r, &body) {
+		return
+	}
+	value, warnings, ok := validateDomainRequest(w, db, body, app.ID)
+	if !ok {
+		return
+	}
+
+	before := toDomain(*domain)
+	released := ReleasedHosts([]string{before.Domain}, []string{value})
+	domain.Domain = value
+	if err := domain.Update(db); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	updated, err := domains.FindById(db, strconv.FormatInt(domain.ID, 10))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	audit.Record(r, audit.Entry{
+		Action:     "domain.update",
+		TargetType: "domain",
+		TargetID:   domain.ID,
+		Before:     before,
+		After:      toDomain(*updated),
+	})
+
+	// the route of the old domain would keep it from being used again,
+	// the new one is routed on the next sync
+	if err := s.RemoveRoutes(released); err != nil {
+		log.Printf("failed to remove the route of %v: %v", before.Domain, err)
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("domain updated but caddy refused to remove the route of %v: %v", before.Domain, err))
+		return
+	}
+
+	result := toDomain(*updated)
+	result.Warnings = warnings
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) deleteDomain(w http.ResponseWriter, r *http.Request) {
+	db, ok := database(w)
+	if !ok {
+		return
+	}
+	app, ok := findEditableApp(w, r, db)
+	if !ok {
+		return
+	}
+	domain, ok := findDomain(w, r, db, app)
+	if !ok {
+		return
+	}
+
+	if err := domains.DeleteById(db, domain.ID); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	audit.Record(r, audit.Entry{
+		Action:     "domain.delete",
+		TargetType: "domain",
+		TargetID:   domain.ID,
+		Before:     toDomain(*domain),
+	})
+
+	if err := s.RemoveRoutes([]string{domain.Domain}); err != nil {
+		log.Printf("failed to remove the route of %v: %v", domain.Domain, err)
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("domain deleted but caddy refused to remove its route: %v", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/barelyhuman/caddy-ui/appsfile"
+	"github.com/barelyhuman/caddy-ui/auth"
+	"github.com/barelyhuman/caddy-ui/data/store"
+)
+
+// exportApps writes the apps the user can see as an apps file, JSON
+// unless ?format=yaml, as a download named apps.json or apps.yaml
+func (s *Server) exportApps(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if len(format) == 0 {
+		format = appsfile.FormatJSON
+	}
+	if format != appsfile.FormatJSON && format != appsfile.FormatYAML {
+		writeValidationError(w, map[string]string{"format": "must be json or yaml"})
+		return
+	}
+
+	db, ok := database(w)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	file, err := appsfile.Export(ctx, store.New(db), func(appID int64) bool {
+		return auth.AppAllowed(ctx, strconv.FormatInt(appID, 10))
+	})
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	contents, err := appsfile.Marshal(file, format)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/"+format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"apps.%v\"", format))
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/barelyhuman/caddy-ui/caddy"
+	"github.com/barelyhuman/caddy-ui/data/models/domains"
+)
+
+// hostOwner is either an app or a route of the live config that no app
+// owns
+type hostOwner struct {
+	AppID int64
+	Route string
+}
+
+func (o hostOwner) String() string {
+	if o.AppID > 0 {
+		return fmt.Sprintf("app %v", o.AppID)
+	}
+	return fmt.Sprintf("caddy route %v", o.Route)
+}
+
+// HostIndex is every hostname in use, by the apps and by the routes of
+// the live caddy config that aren't managed by caddy-ui. A route belongs
+// to an app when one of its hosts is a domain of the app, the same way
+// a sync finds the route to replace
+type HostIndex struct {
+	owners map[string]hostOwner
+	// Warnings are about the index itself, ex: caddy couldn't be reached
+	// so only the apps were checked
+	Warnings []string
+}
+
+// LoadHostIndex reads the domains of every app and the live config, an
+// unreachable caddy is a warning rather than an error so apps can still
+// be edited while caddy is down
+func LoadHostIndex(db *sql.DB) (*HostIndex, error) {
+	byDomain, err := domains.AppIdsByDomain(db)
+	if err != nil {
+		return nil, err
+	}
+	index := &HostIndex{owners: map[string]hostOwner{}}
+	for domain, appID := range byDomain {
+		index.owners[domain] = hostOwner{AppID: appID}
+	}
+
+	servers, err := caddy.GetServersConfig()
+	if err != nil {
+		index.Warnings = append(index.Warnings, fmt.Sprintf("caddy's live config wasn't checked: %v", err))
+		return index, nil
+	}
+	for _, route := range caddy.WalkRoutes(servers) {
+		owned := false
+		for _, host := range route.Hosts {
+			if _, ok := byDomain[caddy.NormalizeHost(host)]; ok {
+				owned = true
+				break
+			}
+		}
+		if owned {
+			continue
+		}
+		for _, host := range route.Hosts {
+			host = caddy.NormalizeHost(host)
+			if _, ok := index.owners[host]; !ok {
+				index.owners[host] = hostOwner{Route: route.ID()}
+			}
+		}
+	}
+	return index, nil
+}
+
+// Release frees the hosts of the apps, for changes that replace the
+// domains of several apps at once (ex: a domain moving between two apps
+// of an apps file)
+func (index *HostIndex) Release(appIDs map[int64]bool) {
+	for host, owner := range index.owners {
+		if owner.AppID > 0 && appIDs[owner.AppID] {
+			delete(index.owners, host)
+		}
+	}
+}
+
+// hostsOverlap tells if a request could match both hosts, a `*` label
+// matches exactly one label like caddy's host matcher
+func hostsOverlap(a, b string) bool {
+	aLabels := strings.Split(a, ".")
+	bLabels := strings.Split(b, ".")
+	if len(aLabels) != len(bLabels) {
+		return false
+	}
+	for i := range aLabels {
+		if aLabels[i] != bLabels[i] && aLabels[i] != "*" && bLabels[i] != "*" {
+			return false
+		}
+	}
+	return true
+}
+
+// Check returns a conflict when another app or an unmanaged route uses
+// the exact same host, and a warning for every wildcard overlap (ex:
+// `*.example.com` and `api.example.com`) since caddy picks whichever
+// route comes first. Hosts of appID itself are ignored
+func (index *HostIndex) Check(host string, appID int64) (string, []string) {
+	if owner, ok := index.owners[host]; ok && (owner.AppID == 0 || owner.AppID != appID) {
+		if owner.AppID == 0 {
+			return fmt.Sprintf("is already used by %v, import or remove it first", owner), nil
+		}
+		return "is already in use", nil
+	}
+
+	others := make([]string, 0, len(index.owners))
+	for other := range index.owners {
+		others = append(others, other)
+	}
+	sort.Strings(others)
+
+	warnings := []string{}
+	for _, other := range others {
+		owner := index.owners[other]
+		if other == host || (owner.AppID > 0 && owner.AppID == appID) {
+			continue
+		}
+		if hostsOverlap(host, other) {
+			warnings = append(warnings, fmt.Sprintf("%v overlaps %v of %v", host, other, owner))
+		}
+	}
+	return "", warnings
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestHostsOverlap(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "example.org", false},
+		{"*.example.com", "api.example.com", true},
+		{"api.example.com", "*.example.com", true},
+		{"*.example.com", "*.example.com", true},
+		{"*.example.com", "*.example.org", false},
+		// a wildcard matches exactly one label
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "v1.api.example.com", false},
+		{"*.*.example.com", "v1.api.example.com", true},
+		{"api.*.com", "api.example.com", true},
+		{"api.*.com", "www.example.com", false},
+		{"*", "localhost", true},
+	}
+	for _, tt := range tests {
+		if got := hostsOverlap(tt.a, tt.b); got != tt.want {
+			t.Errorf("hostsOverlap(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestHostIndexCheck(t *testing.T) {
+	index := &HostIndex{owners: map[string]hostOwner{
+		"app.example.com":    {AppID: 1},
+		"*.example.com":      {AppID: 2},
+		"legacy.example.org": {Route: "srv0/0"},
+	}}
+
+	tests := []struct {
+		name         string
+		host         string
+		appID        int64
+		wantConflict bool
+		wantWarnings int
+	}{
+		{"host of another app", "app.example.com", 3, true, 0},
+		{"own host", "app.example.com", 1, false, 1},
+		{"unmanaged route", "legacy.example.org", 1, true, 0},
+		{"wildcard overlap", "new.example.com", 3, false, 1},
+		{"own wildcard", "new.example.com", 2, false, 0},
+		{"free host", "example.net", 3, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conflict, warnings := index.Check(tt.host, tt.appID)
+			if (len(conflict) > 0) != tt.wantConflict {
+				t.Errorf("conflict = %q, want one: %v", conflict, tt.wantConflict)
+			}
+			if len(warnings) != tt.wantWarnings {
+				t.Errorf("warnings = %v, want %v of them", warnings, tt.wantWarnings)
+			}
+		})
+	}
+
+	index.Release(map[int64]bool{1: true})
+	if conflict, _ := index.Check("app.example.com", 3); len(conflict) > 0 {
+		t.Errorf("released host still conflicts: %v", conflict)
+	}
+}
+
+func TestReleasedHosts(t *testing.T) {
+	got := ReleasedHosts([]string{"a.com", "b.com", "c.com"}, []string{"b.com", "d.com"})
+	if want := []string{"a.com", "c.com"}; !slices.Equal(got, want) {
+		t.Errorf("ReleasedHosts() = %v, want %v", got, want)
+	}
+	if got := ReleasedHosts(nil, []string{"a.com"}); len(got) != 0 {
+		t.Errorf("ReleasedHosts() = %v, want none", got)
+	}
+}
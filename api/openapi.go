@@ -0,0 +1,261 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/barelyhuman/caddy-ui/auth"
+)
+
+// The OpenAPI document is built from the operations table and the
+// request/response types with reflection, a field added to a type shows
+// up in the document without touching this file. Fields tagged
+// `required:"true"` are required in requests, response fields are
+// required unless they are omitempty
+
+var pathParam = regexp.MustCompile(`\{([^}]+)\}`)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// apiPackage is the import path of this package, its types keep their name
+var apiPackage = reflect.TypeOf(Error{}).PkgPath()
+
+var (
+	specOnce sync.Once
+	spec     map[string]any
+)
+
+func (s *Server) openAPI(w http.ResponseWriter, r *http.Request) {
+	specOnce.Do(func() {
+		spec = OpenAPI()
+	})
+	writeJSON(w, http.StatusOK, spec)
+}
+
+// OpenAPI returns the OpenAPI 3 document of the API
+func OpenAPI() map[string]any {
+	schemas := map[string]any{}
+	paths := map[string]any{}
+
+	errorRef := schemaRef(reflect.TypeOf(Error{}), schemas, false)
+
+	for _, op := range operations {
+		item, ok := paths[op.Path].(map[string]any)
+		if !ok {
+			item = map[string]any{}
+			paths[op.Path] = item
+		}
+
+		parameters := []any{}
+		for _, match := range pathParam.FindAllStringSubmatch(op.Path, -1) {
+			parameters = append(parameters, map[string]any{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]any{"type": "integer", "format": "int64"},
+			})
+		}
+		if op.Paginated {
+			parameters = append(parameters,
+				map[string]any{
+					"name":   "page",
+					"in":     "query",
+					"schema": map[string]any{"type": "integer", "minimum": 1, "default": 1},
+				},
+				map[string]any{
+					"name":   "per_page",
+					"in":     "query",
+					"schema": map[string]any{"type": "integer", "minimum": 1, "maximum": maxPerPage, "default": defaultPerPage},
+				},
+			)
+		}
+
+		for _, param := range op.Query {
+			schema := map[string]any{"type": "string"}
+			if len(param.Enum) > 0 {
+				schema["enum"] = param.Enum
+				schema["default"] = param.Enum[0]
+			}
+			parameters = append(parameters, map[string]any{
+				"name":        param.Name,
+				"in":          "query",
+				"description": param.Description,
+				"schema":      schema,
+			})
+		}
+
+		success := map[string]any{"description": http.StatusText(op.Status)}
+		if op.Response != nil {
+			success["content"] = map[string]any{
+				"application/json": map[string]any{
+					"schema": schemaRef(reflect.TypeOf(op.Response), schemas, false),
+				},
+			}
+		}
+		responses := map[string]any{strconv.Itoa(op.Status): success}
+		for _, status := range append([]int{http.StatusUnauthorized, http.StatusForbidden}, op.Errors...) {
+			responses[strconv.Itoa(status)] = map[string]any{
+				"description": http.StatusText(status),
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": errorRef},
+				},
+			}
+		}
+
+		operation := map[string]any{
+			"operationId": operationID(op.Handler),
+			"summary":     op.Summary,
+			"description": "Needs at least the " + string(op.Role) + " role.",
+			"tags":        []string{op.Tag},
+			"parameters":  parameters,
+			"responses":   responses,
+		}
+		if op.Request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json": map[string]any{
+						"schema": schemaRef(reflect.TypeOf(op.Request), schemas, true),
+					},
+				},
+			}
+		}
+		item[strings.ToLower(op.Method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "caddy-ui",
+			"version": "1",
+		},
+		"servers": []any{map[string]any{"url": Prefix}},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"token": map[string]any{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "API token created on the Tokens page",
+				},
+				"session": map[string]any{
+					"type":        "apiKey",
+					"in":          "cookie",
+					"name":        auth.CookieName,
+					"description": "Login session, unsafe methods also need the " + auth.CSRFHeader + " header",
+				},
+			},
+		},
+		"security": []any{
+			map[string]any{"token": []string{}},
+			map[string]any{"session": []string{}},
+		},
+	}
+}
+
+// operationID is the handler's method name, ex: listApps
+func operationID(handler func(*Server, http.ResponseWriter, *http.Request)) string {
+	name := runtime.FuncForPC(reflect.ValueOf(handler).Pointer()).Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// schemaName turns List[.../api.App] into AppList, types of other
+// packages get the package as a prefix so appsfile.App is AppsfileApp
+func schemaName(t reflect.Type) string {
+	name := t.Name()
+	if open := strings.Index(name, "["); open >= 0 {
+		inner := strings.TrimSuffix(name[open+1:], "]")
+		inner = inner[strings.LastIndex(inner, ".")+1:]
+		return inner + name[:open]
+	}
+	if t.PkgPath() != apiPackage {
+		pkg := t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:]
+		return strings.ToUpper(pkg[:1]) + pkg[1:] + name
+	}
+	return name
+}
+
+// schemaRef returns the schema of t, named structs are added to schemas
+// and referenced. request picks how required fields are worked out, a
+// type is only ever used on one side
+func schemaRef(t reflect.Type, schemas map[string]any, request bool) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := schemaRef(t.Elem(), schemas, request)
+		if _, isRef := schema["$ref"]; isRef {
+			return map[string]any{"allOf": []any{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int32:
+		return map[string]any{"type": "integer"}
+	case reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemaRef(t.Elem(), schemas, request)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaRef(t.Elem(), schemas, request)}
+	case reflect.Struct:
+		if t == timeType {
+			return map[string]any{"type": "string", "format": "date-time"}
+		}
+		name := schemaName(t)
+		if _, exists := schemas[name]; !exists {
+			// placeholder first so self referencing types terminate
+			schemas[name] = map[string]any{}
+			schemas[name] = structSchema(t, schemas, request)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+func structSchema(t reflect.Type, schemas map[string]any, request bool) map[string]any {
+	properties := map[string]any{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if len(name) == 0 {
+			name = field.Name
+		}
+		properties[name] = schemaRef(field.Type, schemas, request)
+
+		if request {
+			if field.Tag.Get("required") == "true" {
+				required = append(required, name)
+			}
+		} else if !strings.Contains(options, "omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]any{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/barelyhuman/caddy-ui/auth"
+	"github.com/barelyhuman/caddy-ui/config"
+	"github.com/barelyhuman/caddy-ui/data/store"
+	"github.com/barelyhuman/caddy-ui/ports"
+)
+
+type Port struct {
+	ID    int64  `json:"id"`
+	Port  string `json:"port"`
+	Dial  string `json:"dial"`
+	AppID int64  `json:"app_id"`
+	App   string `json:"app"`
+	// Bound is only set for upstreams on this host, true when something
+	// listens on the port
+	Bound *bool `json:"bound,omitempty"`
+}
+
+type PortRegistry struct {
+	// Range is where ports are allocated from, ex: 10000-10999
+	Range string `json:"range"`
+	// Next is the port the next allocation would get, 0 when the range is
+	// exhausted
+	Next int    `json:"next"`
+	Data []Port `json:"data"`
+}
+
+func (s *Server) listPorts(w http.ResponseWriter, r *http.Request) {
+	db, ok := database(w)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	registry := store.New(db)
+	entries, err := ports.List(ctx, registry)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	next, err := ports.Allocate(ctx, registry)
+	if err != nil && !errors.Is(err, ports.ErrExhausted) {
+		writeInternalError(w, err)
+		return
+	}
+
+	result := PortRegistry{Range: config.Get().PortRange, Next: next, Data: []Port{}}
+	for _, entry := range entries {
+		if !auth.AppAllowed(ctx, strconv.FormatInt(entry.AppID, 10)) {
+			continue
+		}
+		port := Port{
+			ID:    entry.ID,
+			Port:  entry.Port,
+			Dial:  entry.Dial,
+			AppID: entry.AppID,
+			App:   entry.AppName,
+		}
+		if entry.Local {
+			bound := entry.Bound
+			port.Bound = &bound
+		}
+		result.Data = append(result.Data, port)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/barelyhuman/caddy-ui/audit"
+	"github.com/barelyhuman/caddy-ui/auth"
+	"github.com/barelyhuman/caddy-ui/caddy"
+	"github.com/barelyhuman/caddy-ui/data/models/app_ports"
+	"github.com/barelyhuman/caddy-ui/data/models/apps"
+	"github.com/barelyhuman/caddy-ui/data/models/domains"
+)
+
+type SyncResult struct {
+	AppID  int64 `json:"app_id"`
+	Synced bool  `json:"synced"`
+	// Skipped is set for apps that can't be routed yet (no domain or
+	// upstream), Error says why
+	Skipped bool   `json:"skipped"`
+	Error   string `json:"error,omitempty"`
+}
+
+type SyncResults struct {
+	Data []SyncResult `json:"data"`
+}
+
+// notRoutable explains why the app can't be synced yet, empty when it
+// can
+func notRoutable(db *sql.DB, app *apps.AppsWithIdentifier) (string, error) {
+	id := strconv.FormatInt(app.ID, 10)
+
+	appDomains, err := domains.FindAllByAppId(db, id)
+	if err != nil {
+		return "", err
+	}
+	if len(appDomains) == 0 {
+		return "app has no domain, add one before syncing", nil
+	}
+
+	if app.Type.String == "" || caddy.RouteKind(app.Type.String) == caddy.RouteKindReverseProxy {
+		ports, err := app_ports.FindAllByAppId(db, id)
+		if err != nil {
+			return "", err
+		}
+		if len(ports) == 0 {
+			return "app has no upstream, add one before syncing", nil
+		}
+	}
+	return "", nil
+}
+
+func (s *Server) syncApp(w http.ResponseWriter, r *http.Request) {
+	db, ok := database(w)
+	if !ok {
+		return
+	}
+	app, ok := findApp(w, r, db)
+	if !ok {
+		return
+	}
+	// apps from an apps file can still be synced, findEditableApp would
+	// refuse them
+	if !auth.CanEditApp(r, db, r.PathValue("id")) {
+		auth.Forbidden(w, r)
+		return
+	}
+
+	reason, err := notRoutable(db, app)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if len(reason) > 0 {
+		writeError(w, http.StatusConflict, reason)
+		return
+	}
+
+	err = s.Sync(strconv.FormatInt(app.ID, 10))
+	entry := audit.Entry{
+		Action:     "app.sync",
+		TargetType: "app",
+		TargetID:   app.ID,
+	}
+	if err != nil {
+		entry.After = map[string]string{"error": err.Error()}
+	}
+	audit.Record(r, entry)
+	if err != nil {
+		log.Printf("failed to sync app %v: %v", app.ID, err)
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("failed to sync with caddy: %v", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Message{Message: "synced"})
+}
+
+// syncAll syncs every app the request can edit, the response is a 502
+// if any of them failed to sync
+func (s *Server) syncAll(w http.ResponseWriter, r *http.Request) {
+	db, ok := database(w)
+	if !ok {
+		return
+	}
+
+	all, err := apps.FindAll(db)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	results := []SyncResult{}
+	for _, app := range all {
+		id := strconv.FormatInt(app.ID, 10)
+		if !auth.CanEditApp(r, db, id) {
+			continue
+		}
+
+		result := SyncResult{AppID: app.ID}
+		reason, err := notRoutable(db, &app)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		if len(reason) > 0 {
+			result.Skipped = true
+			result.Error = reason
+		} else if err := s.Sync(id); err != nil {
+			log.Printf("failed to sync app %v: %v", app.ID, err)
+			result.Error = err.Error()
+			status = http.StatusBadGateway
+		} else {
+			result.Synced = true
+		}
+		results = append(results, result)
+	}
+
+	audit.Record(r, audit.Entry{
+		Action:     "sync.all",
+		TargetType: "app",
+		After:      results,
+	})
+	writeJSON(w, status, SyncResults{Data: results})
+}
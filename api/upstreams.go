@@ -0,0 +1,249 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/barelyhuman/caddy-ui/audit"
+	"github.com/barelyhuman/caddy-ui/data"
+	"github.com/barelyhuman/caddy-ui/data/models/app_ports"
+	"github.com/barelyhuman/caddy-ui/data/models/apps"
+)
+
+// Upstream is an app port, a bare port is proxied to on localhost
+type Upstream struct {
+	ID        int64     `json:"id"`
+	AppID     int64     `json:"app_id"`
+	Address   string    `json:"address"`
+	Dial      string    `json:"dial"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type UpstreamRequest struct {
+	// Address is a port or host:port
+	Address string `json:"address" required:"true"`
+}
+
+func toUpstream(p app_ports.AppPortsWithIdentifier) Upstream {
+	return Upstream{
+		ID:        p.ID,
+		AppID:     p.AppId,
+		Address:   p.Port,
+		Dial:      p.Dial(),
+		CreatedAt: p.CreatedAt,
+		UpdatedAt: p.UpdatedAt,
+	}
+}
+
+// findUpstream loads the `upstreamId` path param, upstreams of other
+// apps are treated as missing
+func findUpstream(w http.ResponseWriter, r *http.Request, db *sql.DB, app *apps.AppsWithIdentifier) (*app_ports.AppPortsWithIdentifier, bool) {
+	id := r.PathValue("upstreamId")
+	port, err := app_ports.FindById(db, id)
+	if errors.Is(err, data.ErrNotFound) || (err == nil && port.AppId != app.ID) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("upstream %v not found", id))
+		return nil, false
+	}
+	if err != nil {
+		writeInternalError(w, err)
+		return nil, false
+	}
+	return port, true
+}
+
+func decodeUpstream(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body UpstreamRequest
+	if !decode(w, r, &body) {
+		return "", false
+	}
+	address := strings.TrimSpace(body.Address)
+	if msg := validateUpstream(address); len(msg) > 0 {
+		writeValidationError(w, map[string]string{"address": msg})
+		return "", false
+	}
+	return address, true
+}
+
+// checkUpstreamConflict writes a conflict when another upstream (of any
+// app) already dials the same address, ignoreID is the upstream being
+// updated
+func checkUpstreamConflict(w http.ResponseWriter, db *sql.DB, address string, ignoreID int64) bool {
+	rows, err := db.Query(`select id, port from app_ports where id != ?`, ignoreID)
+	if err != nil {
+		writeInternalError(w, err)
+		return false
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var port string
+		if err := rows.Scan(&id, &port); err != nil {
+			writeInternalError(w, err)
+			return false
+		}
+		if app_ports.DialKey(port) == app_ports.DialKey(address) {
+			writeConflict(w, map[string]string{"address": "is already in use"})
+			return false
+		}
+	}
+	if err := rows.Err(); err != nil {
+		writeInternalError(w, err)
+		return false
+	}
+	return true
+}
+
+func (s *Server) listUpstreams(w http.ResponseWriter, r *http.Request) {
+	db, ok := database(w)
+	if !ok {
+		return
+	}
+	app, ok := findApp(w, r, db)
+	if !ok {
+		return
+	}
+
+	all, err := app_ports.FindAllByAppId(db, strconv.FormatInt(app.ID, 10))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	page, ok := paginate(w, r, all)
+	if !ok {
+		return
+	}
+	result := List[Upstream]{Data: []Upstream{}, Pagination: page.Pagination}
+	for _, p := range page.Data {
+		result.Data = append(result.Data, toUpstream(p))
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) getUpstream(w http.ResponseWriter, r *http.Request) {
+	db, ok := database(w)
+	if !ok {
+		return
+	}
+	app, ok := findApp(w, r, db)
+	if !ok {
+		return
+	}
+	port, ok := findUpstream(w, r, db, app)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, toUpstream(*port))
+}
+
+func (s *Server) createUpstream(w http.ResponseWriter, r *http.Request) {
+	db, ok := database(w)
+	if !ok {
+		return
+	}
+	app, ok := findEditableApp(w, r, db)
+	if !ok {
+		return
+	}
+	address, ok := decodeUpstream(w, r)
+	if !ok || !checkUpstreamConflict(w, db, address, 0) {
+		return
+	}
+
+	record := app_ports.New()
+	record.AppId = app.ID
+	record.Port = address
+	created, err := record.Save(db)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	port, err := app_ports.FindById(db, strconv.FormatInt(created.ID, 10))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	audit.Record(r, audit.Entry{
+		Action:     "upstream.create",
+		TargetType: "upstream",
+		TargetID:   port.ID,
+		After:      toUpstream(*port),
+	})
+
+	w.Header().Set("Location", fmt.Sprintf("%v/apps/%v/upstreams/%v", Prefix, app.ID, port.ID))
+	writeJSON(w, http.StatusCreated, toUpstream(*port))
+}
+
+func (s *Server) updateUpstream(w http.ResponseWriter, r *http.Request) {
+	db, ok := database(w)
+	if !ok {
+		return
+	}
+	app, ok := findEditableApp(w, r, db)
+	if !ok {
+		return
+	}
+	port, ok := findUpstream(w, r, db, app)
+	if !ok {
+		return
+	}
+	address, ok := decodeUpstream(w, r)
+	if !ok || !checkUpstreamConflict(w, db, address, port.ID) {
+		return
+	}
+
+	before := toUpstream(*port)
+	port.Port = address
+	if err := port.Update(db); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	updated, err := app_ports.FindById(db, strconv.FormatInt(port.ID, 10))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	audit.Record(r, audit.Entry{
+		Action:     "upstream.update",
+		TargetType: "upstream",
+		TargetID:   port.ID,
+		Before:     before,
+		After:      toUpstream(*updated),
+	})
+	writeJSON(w, http.StatusOK, toUpstream(*updated))
+}
+
+func (s *Server) deleteUpstream(w http.ResponseWriter, r *http.Request) {
+	db, ok := database(w)
+	if !ok {
+		return
+	}
+	app, ok := findEditableApp(w, r, db)
+	if !ok {
+		return
+	}
+	port, ok := findUpstream(w, r, db, app)
+	if !ok {
+		return
+	}
+
+	if err := app_ports.DeleteById(db, port.ID); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	audit.Record(r, audit.Entry{
+		Action:     "upstream.delete",
+		TargetType: "upstream",
+		TargetID:   port.ID,
+		Before:     toUpstream(*port),
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
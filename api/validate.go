@@ -0,0 +1,130 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/barelyhuman/caddy-ui/caddy"
+	"github.com/barelyhuman/caddy-ui/data/models/app_options"
+)
+
+var appTypes = []caddy.RouteKind{
+	caddy.RouteKindReverseProxy,
+	caddy.RouteKindFileServer,
+	caddy.RouteKindRedirect,
+}
+
+var optionNames = []string{
+	app_options.Root,
+	app_options.RedirectTo,
+	app_options.RedirectStatusCode,
+}
+
+func validateName(name string) string {
+	if len(strings.TrimSpace(name)) == 0 {
+		return "is required"
+	}
+	if len(name) > 100 {
+		return "must be at most 100 characters"
+	}
+	return ""
+}
+
+func validateType(appType string) string {
+	for _, t := range appTypes {
+		if string(t) == appType {
+			return ""
+		}
+	}
+	names := []string{}
+	for _, t := range appTypes {
+		names = append(names, string(t))
+	}
+	return "must be one of " + strings.Join(names, ", ")
+}
+
+// validateOptions checks the options the app's type needs, options holds
+// the final set of options (existing ones merged with the request)
+func validateOptions(appType string, options map[string]string, fields map[string]string) {
+	for name := range options {
+		known := false
+		for _, n := range optionNames {
+			known = known || n == name
+		}
+		if !known {
+			fields["options."+name] = "unknown option, expected one of " + strings.Join(optionNames, ", ")
+		}
+	}
+
+	switch caddy.RouteKind(appType) {
+	case caddy.RouteKindFileServer:
+		if len(options[app_options.Root]) == 0 {
+			fields["options."+app_options.Root] = "is required for file-server apps"
+		}
+	case caddy.RouteKindRedirect:
+		if len(options[app_options.RedirectTo]) == 0 {
+			fields["options."+app_options.RedirectTo] = "is required for redirect apps"
+		}
+	}
+
+	if code := options[app_options.RedirectStatusCode]; len(code) > 0 {
+		if parsed, err := strconv.Atoi(code); err != nil || parsed < 300 || parsed > 399 {
+			fields["options."+app_options.RedirectStatusCode] = "must be a 3xx status code"
+		}
+	}
+}
+
+// validateDomain allows plain hostnames and a leading wildcard label,
+// the same subset caddy accepts in a host matcher
+func validateDomain(domain string) string {
+	if len(domain) == 0 {
+		return "is required"
+	}
+	if len(domain) > 253 {
+		return "must be at most 253 characters"
+	}
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if label == "*" && i == 0 && len(labels) > 1 {
+			continue
+		}
+		if len(label) == 0 || len(label) > 63 {
+			return "is not a valid hostname"
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return "is not a valid hostname"
+			}
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return "is not a valid hostname"
+		}
+	}
+	return ""
+}
+
+// validateUpstream accepts a bare port (dialed on localhost) or host:port
+func validateUpstream(address string) string {
+	if len(address) == 0 {
+		return "is required"
+	}
+	port := address
+	if strings.Contains(address, ":") {
+		host, p, err := net.SplitHostPort(address)
+		if err != nil || len(host) == 0 {
+			return "must be a port or host:port"
+		}
+		port = p
+	}
+	parsed, err := strconv.Atoi(port)
+	if err != nil || parsed < 1 || parsed > 65535 {
+		return fmt.Sprintf("port %v must be a number between 1 and 65535", port)
+	}
+	return ""
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSpace(domain))
+}
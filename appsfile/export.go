@@ -0,0 +1,103 @@
+package appsfile
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/barelyhuman/caddy-ui/caddy"
+	"github.com/barelyhuman/caddy-ui/data/models/apps"
+	"github.com/barelyhuman/caddy-ui/data/store"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+)
+
+// Current reads the state of an app in the shape of the file. Domains
+// and upstreams keep the order they were added in, the first domain
+// stays the primary one
+func Current(ctx context.Context, s *store.Store, app *apps.AppsWithIdentifier) (*App, error) {
+	state := &App{
+		Name:      app.Name,
+		Type:      app.Type.String,
+		Team:      app.Team.String,
+		Domains:   []string{},
+		Upstreams: []string{},
+	}
+	if len(state.Type) == 0 {
+		state.Type = string(caddy.RouteKindReverseProxy)
+	}
+	list, err := s.Domains.FindAllByAppId(ctx, app.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range list {
+		state.Domains = append(state.Domains, d.Domain)
+	}
+	ports, err := s.Ports.FindAllByAppId(ctx, app.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range ports {
+		state.Upstreams = append(state.Upstreams, p.Port)
+	}
+	state.Options, err = s.Options.FindByAppId(ctx, app.ID)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Export reads the apps allowed keeps (all of them when nil) into a
+// file. The apps are sorted by name and the options by key, exporting
+// the same apps twice gives the same file
+func Export(ctx context.Context, s *store.Store, allowed func(appID int64) bool) (*File, error) {
+	existing, err := s.Apps.FindAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	file := &File{Version: Version, Apps: []App{}}
+	for i := range existing {
+		if allowed != nil && !allowed(existing[i].ID) {
+			continue
+		}
+		app, err := Current(ctx, s, &existing[i])
+		if err != nil {
+			return nil, err
+		}
+		file.Apps = append(file.Apps, *app)
+	}
+	sort.SliceStable(file.Apps, func(i, j int) bool { return file.Apps[i].Name < file.Apps[j].Name })
+	return file, nil
+}
+
+// Marshal writes file as YAML or JSON, both are indented by two spaces
+// and end with a newline
+func Marshal(file *File, format string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	switch format {
+	case FormatYAML:
+		encoder := yaml.NewEncoder(buf)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(file); err != nil {
+			return nil, err
+		}
+		if err := encoder.Close(); err != nil {
+			return nil, err
+		}
+	case FormatJSON:
+		encoder := json.NewEncoder(buf)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(file); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %q, use %v or %v", format, FormatYAML, FormatJSON)
+	}
+	return buf.Bytes(), nil
+}
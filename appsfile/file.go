@@ -0,0 +1,143 @@
+// Package appsfile reads and writes apps files: a YAML or JSON
+// description of apps, their domains, upstreams and options. gitops
+// applies them, Export writes one from the database
+package appsfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Version of the apps file format this build reads and writes
+const Version = 1
+
+// File is an apps file, a directory of them is merged into one
+type File struct {
+	Version int   `json:"version" yaml:"version"`
+	Apps    []App `json:"apps" yaml:"apps"`
+}
+
+// App is the whole desired state of an app, what isn't listed is
+// removed from it
+type App struct {
+	Name string `json:"name" yaml:"name"`
+	// Type defaults to reverse-proxy
+	Type      string            `json:"type,omitempty" yaml:"type,omitempty"`
+	Team      string            `json:"team,omitempty" yaml:"team,omitempty"`
+	Domains   []string          `json:"domains,omitempty" yaml:"domains,omitempty"`
+	Upstreams []string          `json:"upstreams,omitempty" yaml:"upstreams,omitempty"`
+	Options   map[string]string `json:"options,omitempty" yaml:"options,omitempty"`
+
+	// where the app was read from, for error messages
+	file  string
+	index int
+}
+
+// Key prefixes the problems of the app, ex: apps.yaml: apps.2.domains.0
+func (a App) Key(field string) string {
+	key := fmt.Sprintf("apps.%v", a.index)
+	if len(field) > 0 {
+		key += "." + field
+	}
+	if len(a.file) > 0 {
+		key = a.file + ": " + key
+	}
+	return key
+}
+
+// Parse reads an apps file, JSON when name ends in .json and YAML
+// otherwise. Unknown keys are rejected so typos don't go unnoticed
+func Parse(name string, contents []byte) (*File, error) {
+	file := &File{}
+	if strings.EqualFold(filepath.Ext(name), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(contents))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(file); err != nil {
+			return nil, fmt.Errorf("invalid apps file %v: %w", name, err)
+		}
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(contents))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(file); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("invalid apps file %v: %w", name, err)
+		}
+	}
+	// an empty file would delete every managed app, the version has to
+	// be there to say it is on purpose
+	if file.Version != Version {
+		return nil, fmt.Errorf("apps file %v must have version: %v", name, Version)
+	}
+	for i := range file.Apps {
+		file.Apps[i].file = filepath.Base(name)
+		file.Apps[i].index = i
+	}
+	return file, nil
+}
+
+// isAppsFile picks the files of a directory that are read
+func isAppsFile(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// Load reads the apps file at path, or every .yaml, .yml and .json file
+// of the directory at path (sub directories aren't read). The digest
+// changes whenever one of the files does
+func Load(path string) (*File, string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, "", err
+	}
+	names := []string{path}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, "", err
+		}
+		names = []string{}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() && isAppsFile(entry.Name()) {
+				names = append(names, filepath.Join(path, entry.Name()))
+			}
+		}
+		if len(names) == 0 {
+			return nil, "", fmt.Errorf("%v has no apps file (.yaml, .yml or .json)", path)
+		}
+		sort.Strings(names)
+	}
+
+	merged := &File{Version: Version, Apps: []App{}}
+	hash := sha256.New()
+	for _, name := range names {
+		contents, err := os.ReadFile(name)
+		if err != nil {
+			return nil, "", err
+		}
+		fmt.Fprintf(hash, "%v\n%v\n", filepath.Base(name), len(contents))
+		hash.Write(contents)
+
+		file, err := Parse(name, contents)
+		if err != nil {
+			return nil, "", err
+		}
+		merged.Apps = append(merged.Apps, file.Apps...)
+	}
+	return merged, hex.EncodeToString(hash.Sum(nil)), nil
+}
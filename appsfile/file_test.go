@@ -0,0 +1,102 @@
+package appsfile
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMarshalParse(t *testing.T) {
+	file := &File{Version: Version, Apps: []App{
+		{
+			Name:      "api",
+			Type:      "reverse-proxy",
+			Team:      "backend",
+			Domains:   []string{"api.example.com", "*.api.example.com"},
+			Upstreams: []string{"3000", "10.0.0.2:3000"},
+		},
+		{
+			Name:    "docs",
+			Type:    "file-server",
+			Domains: []string{"docs.example.com"},
+			// values YAML would read as something else without quotes
+			Options: map[string]string{
+				"root":   "/srv/docs: v2",
+				"browse": "yes",
+				"index":  "01",
+				"note":   "# not a comment",
+				"empty":  "",
+			},
+		},
+		{Name: "bare"},
+	}}
+
+	for _, format := range []string{FormatYAML, FormatJSON} {
+		t.Run(format, func(t *testing.T) {
+			contents, err := Marshal(file, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasSuffix(contents, []byte("\n")) || bytes.Contains(contents, []byte("\t")) {
+				t.Errorf("%v isn't indented with spaces and ended by a newline:\n%s", format, contents)
+			}
+			parsed, err := Parse("apps."+format, contents)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := *file
+			want.Apps = append([]App{}, file.Apps...)
+			for i := range want.Apps {
+				want.Apps[i].file = "apps." + format
+				want.Apps[i].index = i
+			}
+			if !reflect.DeepEqual(parsed, &want) {
+				t.Errorf("parsed %+v, want %+v", parsed, &want)
+			}
+
+			again, err := Marshal(parsed, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(again, contents) {
+				t.Errorf("marshalled again as\n%s\nwant\n%s", again, contents)
+			}
+		})
+	}
+
+	if _, err := Marshal(file, "toml"); err == nil {
+		t.Error("marshalled an unknown format")
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		err      string
+	}{
+		{"apps.yaml", "version: 1\napps: []\n", ""},
+		{"apps.json", `{"version": 1, "apps": []}`, ""},
+		{"apps.yml", "", "must have version: 1"},
+		{"apps.yaml", "apps: []\n", "must have version: 1"},
+		{"apps.yaml", "version: 2\napps: []\n", "must have version: 1"},
+		{"apps.yaml", "version: 1\napps:\n  - name: web\n    domain: web.example.com\n", "field domain not found"},
+		{"apps.json", `{"version": 1, "apps": [{"name": "web", "upstream": "3000"}]}`, `unknown field "upstream"`},
+		{"apps.json", "version: 1\n", "invalid apps file apps.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" "+tt.contents, func(t *testing.T) {
+			_, err := Parse(tt.name, []byte(tt.contents))
+			if len(tt.err) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package audit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/barelyhuman/caddy-ui/auth"
+	"github.com/barelyhuman/caddy-ui/config"
+	"github.com/barelyhuman/caddy-ui/data"
+	"github.com/barelyhuman/caddy-ui/data/models/api_tokens"
+	"github.com/barelyhuman/caddy-ui/data/models/app_options"
+	"github.com/barelyhuman/caddy-ui/data/models/app_ports"
+	"github.com/barelyhuman/caddy-ui/data/models/apps"
+	"github.com/barelyhuman/caddy-ui/data/models/audit_log"
+	"github.com/barelyhuman/caddy-ui/data/models/domains"
+	"github.com/barelyhuman/caddy-ui/data/models/users"
+)
+
+type Entry struct {
+	// Actor defaults to the user of the request, set it for requests
+	// without one (ex: logins)
+	Actor      string
+	Action     string
+	TargetType string
+	TargetID   any
+	// Before and After are stored as JSON, json.RawMessage and []byte
+	// are kept as is
+	Before any
+	After  any
+}
+
+// Record appends the entry for the request, failures are only logged so
+// a problem with the audit log never blocks the change itself
+func Record(r *http.Request, entry Entry) {
+	if len(entry.Actor) == 0 {
+		entry.Actor = Actor(r)
+	}
+	write(entry, sql.NullString{String: ClientIP(r), Valid: true})
+}
+
+// Log appends an entry for changes made outside of a request, ex: from
+// the command line
+func Log(entry Entry) {
+	if len(entry.Actor) == 0 {
+		entry.Actor = "cli"
+	}
+	write(entry, sql.NullString{})
+}
+
+func write(entry Entry, clientIP sql.NullString) {
+	db, err := data.GetDatabaseHandle()
+	if err != nil {
+		log.Printf("failed to write audit log: %v", err)
+		return
+	}
+
+	row := audit_log.New()
+	row.Actor = entry.Actor
+	row.Action = entry.Action
+	row.TargetType = entry.TargetType
+	if entry.TargetID != nil {
+		row.TargetID = sql.NullString{String: fmt.Sprint(entry.TargetID), Valid: true}
+	}
+	row.Before = toJSON(entry.Before)
+	row.After = toJSON(entry.After)
+	row.ClientIP = clientIP
+	row.CreatedAt = time.Now()
+
+	if _, err := row.Save(db); err != nil {
+		log.Printf("failed to write audit log for %v: %v", entry.Action, err)
+	}
+}
+
+// Actor names the user of the request, requests made with a personal
+// token mention the token
+func Actor(r *http.Request) string {
+	user := auth.UserFromContext(r.Context())
+	if user == nil {
+		return "anonymous"
+	}
+	if token := auth.TokenFromContext(r.Context()); token != nil && token.UserID.Valid {
+		return user.Username + " via " + token.Prefix
+	}
+	return user.Username
+}
+
+// ClientIP is the address the request came from, X-Forwarded-For is only
+// trusted with trust_proxy=true since anyone can send it
+func ClientIP(r *http.Request) string {
+	if config.Get().TrustProxy == "true" {
+		if forwarded := r.Header.Get("X-Forwarded-For"); len(forwarded) > 0 {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func toJSON(v any) sql.NullString {
+	switch value := v.(type) {
+	case nil:
+		return sql.NullString{}
+	case json.RawMessage:
+		if len(value) == 0 {
+			return sql.NullString{}
+		}
+		return sql.NullString{String: string(value), Valid: true}
+	case []byte:
+		if len(value) == 0 {
+			return sql.NullString{}
+		}
+		if !json.Valid(value) {
+			encoded, _ := json.Marshal(string(value))
+			return sql.NullString{String: string(encoded), Valid: true}
+		}
+		return sql.NullString{String: string(value), Valid: true}
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("failed to encode audit state: %v", err)
+		return sql.NullString{}
+	}
+	return sql.NullString{String: string(encoded), Valid: true}
+}
+
+// AppState is the app with everything that belongs to it, used as the
+// before/after of app changes
+type AppState struct {
+	ID        int64             `json:"id"`
+	Name      string            `json:"name"`
+	Type      string            `json:"type"`
+	Team      string            `json:"team"`
+	Domains   []string          `json:"domains"`
+	Upstreams []string          `json:"upstreams"`
+	Options   map[string]string `json:"options"`
+}
+
+// App loads the state of the app, nil when it doesn't exist
+func App(db *sql.DB, appId string) *AppState {
+	app, err := apps.FindById(db, appId)
+	if err != nil || app.ID == 0 {
+		return nil
+	}
+	state := &AppState{
+		ID:        app.ID,
+		Name:      app.Name,
+		Type:      app.Type.String,
+		Team:      app.Team.String,
+		Domains:   []string{},
+		Upstreams: []string{},
+	}
+	if list, err := domains.FindAllByAppId(db, appId); err == nil {
+		for _, d := range list {
+			state.Domains = append(state.Domains, d.Domain)
+		}
+	}
+	if list, err := app_ports.FindAllByAppId(db, appId); err == nil {
+		for _, p := range list {
+			state.Upstreams = append(state.Upstreams, p.Port)
+		}
+	}
+	state.Options, _ = app_options.FindByAppId(db, appId)
+	return state
+}
+
+// UserState leaves out the password hash
+type UserState struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	Team     string `json:"team"`
+	SSO      bool   `json:"sso"`
+}
+
+func User(user *users.UsersWithIdentifier) *UserState {
+	if user == nil {
+		return nil
+	}
+	return &UserState{
+		ID:       user.ID,
+		Username: user.Username,
+		Role:     user.Role,
+		Team:     user.Team.String,
+		SSO:      user.OIDCSubject.Valid,
+	}
+}
+
+// TokenState leaves out the token hash
+type TokenState struct {
+	ID        int64      `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	Kind      string     `json:"kind"`
+	UserID    *int64     `json:"user_id"`
+	Scope     string     `json:"scope"`
+	Apps      []string   `json:"apps"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func Token(id int64, token *api_tokens.ApiTokens) *TokenState {
+	if token == nil {
+		return nil
+	}
+	state := &TokenState{
+		ID:     id,
+		Name:   token.Name,
+		Prefix: token.Prefix,
+		Kind:   token.Kind,
+		Scope:  token.Scope,
+		Apps:   token.Apps(),
+	}
+	if token.UserID.Valid {
+		state.UserID = &token.UserID.Int64
+	}
+	if token.ExpiresAt.Valid {
+		state.ExpiresAt = &token.ExpiresAt.Time
+	}
+	return state
+}
@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/barelyhuman/caddy-ui/config"
+	"github.com/barelyhuman/caddy-ui/data"
+	"github.com/barelyhuman/caddy-ui/data/models/sessions"
+	"github.com/barelyhuman/caddy-ui/data/models/users"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const CookieName = "caddy_ui_session"
+
+const SessionTTL = 7 * 24 * time.Hour
+
+// paths that are reachable without a session
+var publicPaths = []string{"/login", "/logout", "/setup", "/login/oidc", "/login/oidc/callback"}
+
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+type contextKey struct{}
+
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("caddy-ui"), bcrypt.DefaultCost)
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func CheckPassword(hash, password string) error {
+	if len(hash) == 0 {
+		return ErrInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+// NeedsSetup is true till the first run setup has created the admin
+// user
+func NeedsSetup(db *sql.DB) (bool, error) {
+	count, err := users.Count(db)
+	if err != nil {
+		return false, err
+	}
+	return count == 0, nil
+}
+
+// Login checks the credentials and returns the matching user
+func Login(db *sql.DB, username, password string) (*users.UsersWithIdentifier, error) {
+	user, err := users.FindByUsername(db, username)
+	if errors.Is(err, data.ErrNotFound) {
+		// keep the timing the same as a wrong password
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckPassword(user.Password, password); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// StartSession creates the session row and sets the cookie on the
+// response
+func StartSession(w http.ResponseWriter, r *http.Request, db *sql.DB, userID int64) error {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	sessions.DeleteExpired(db, time.Now())
+
+	session := sessions.New()
+	session.TokenHash = hashToken(token)
+	session.UserID = userID
+	session.ExpiresAt = time.Now().Add(SessionTTL)
+	if _, err := session.Save(db); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		MaxAge:   int(SessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// EndSession removes the session for the request (if any) and clears
+// the cookie
+func EndSession(w http.ResponseWriter, r *http.Request, db *sql.DB) error {
+	var err error
+	if cookie, cookieErr := r.Cookie(CookieName); cookieErr == nil {
+		err = sessions.DeleteByTokenHash(db, hashToken(cookie.Value))
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return err
+}
+
+// EndOtherSessions logs the user out of every session but the one of
+// the request, after their password changed. API tokens are left alone,
+// they are revoked on their own from the tokens page
+func EndOtherSessions(r *http.Request, db *sql.DB, userID int64) error {
+	current := ""
+	if cookie, err := r.Cookie(CookieName); err == nil {
+		current = hashToken(cookie.Value)
+	}
+	return sessions.DeleteByUserId(db, userID, current)
+}
+
+// SessionFromRequest returns the valid, unexpired session for the
+// request's cookie
+func SessionFromRequest(db *sql.DB, r *http.Request) (*sessions.SessionsWithIdentifier, error) {
+	cookie, err := r.Cookie(CookieName)
+	if err != nil {
+		return nil, err
+	}
+	session, err := sessions.FindByTokenHash(db, hashToken(cookie.Value))
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(session.ExpiresAt) {
+		sessions.DeleteByTokenHash(db, session.TokenHash)
+		return nil, errors.New("session expired")
+	}
+	return session, nil
+}
+
+// UserFromContext returns the user that Require attached to the request
+func UserFromContext(ctx context.Context) *users.UsersWithIdentifier {
+	user, _ := ctx.Value(contextKey{}).(*users.UsersWithIdentifier)
+	return user
+}
+
+// Require wraps the handler so every path other than the login and
+// setup pages needs a session, or an API token under APIPrefix. Pages
+// are redirected to /login while everything else gets a 401
+func Require(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(publicPaths, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		db, err := data.GetDatabaseHandle()
+		if err != nil {
+			http.Error(w, "failed to connect to database", http.StatusInternalServerError)
+			return
+		}
+
+		if plain, ok := bearerToken(r); ok {
+			if !isAPIPath(r.URL.Path) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error": "API tokens only work under ` + APIPrefix + `/"}`))
+				return
+			}
+			user, token, err := authenticateToken(db, plain)
+			if errors.Is(err, ErrInvalidToken) {
+				unauthorized(w, r, "/login")
+				return
+			}
+			if err != nil {
+				log.Printf("failed to check API token: %v", err)
+				http.Error(w, "failed to check the token", http.StatusInternalServerError)
+				return
+			}
+			ctx := context.WithValue(r.Context(), contextKey{}, user)
+			ctx = context.WithValue(ctx, tokenContextKey{}, token)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		if needsSetup, err := NeedsSetup(db); err == nil && needsSetup {
+			unauthorized(w, r, "/setup")
+			return
+		}
+
+		session, err := SessionFromRequest(db, r)
+		if err != nil {
+			unauthorized(w, r, "/login")
+			return
+		}
+
+		user, err := users.FindById(db, session.UserID)
+		if err != nil {
+			unauthorized(w, r, "/login")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, user)))
+	})
+}
+
+// Allow wraps a handler so only users with at least the given role can
+// reach it, it expects Require to have run before it
+func Allow(role Role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := UserFromContext(r.Context())
+		if user == nil {
+			unauthorized(w, r, "/login")
+			return
+		}
+		if !Role(user.Role).Includes(role) {
+			Forbidden(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func Forbidden(w http.ResponseWriter, r *http.Request) {
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Error(w, "You do not have access to this page", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(`{"error": "Forbidden, your role does not allow this action"}`))
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request, redirectTo string) {
+	if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, redirectTo, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte(`{"error": "Unauthorized, login to continue"}`))
+}
+
+// secureCookies marks cookies as Secure when the request came over
+// https, directly or through a proxy, cookie_secure=true forces it
+func secureCookies(r *http.Request) bool {
+	if config.Get().CookieSecure == "true" {
+		return true
+	}
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
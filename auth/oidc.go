@@ -0,0 +1,555 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	cfg "github.com/barelyhuman/caddy-ui/config"
+	"github.com/barelyhuman/caddy-ui/data"
+	"github.com/barelyhuman/caddy-ui/data/models/users"
+)
+
+// Minimal OpenID Connect relying party (authorization code + PKCE), kept
+// in house for the same reason the caddy package doesn't pull in caddy,
+// the few endpoints needed don't justify the deps
+
+const oidcCookieName = "caddy_ui_oidc"
+
+const oidcFlowTTL = 10 * time.Minute
+
+// clock skew allowed when checking exp/iat
+const oidcLeeway = time.Minute
+
+var ErrOIDCNotConfigured = errors.New("oidc is not configured")
+
+var ErrOIDCNoRole = errors.New("none of your groups have access to caddy-ui")
+
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	GroupsClaim  string
+	// RoleMap maps a group to the role its members get, the highest role
+	// wins when a user is in multiple groups
+	RoleMap       map[string]Role
+	DefaultRole   Role
+	AutoProvision bool
+}
+
+// LoadOIDCConfig reads the oidc_* settings, ok is false when oidc_issuer
+// or oidc_client_id is missing
+func LoadOIDCConfig() (OIDCConfig, bool) {
+	settings := cfg.Get()
+	config := OIDCConfig{
+		Issuer:        strings.TrimRight(settings.OIDCIssuer, "/"),
+		ClientID:      settings.OIDCClientID,
+		ClientSecret:  settings.OIDCClientSecret,
+		RedirectURL:   settings.OIDCRedirectURL,
+		Scopes:        strings.Fields(settings.OIDCScopes),
+		GroupsClaim:   settings.OIDCGroupsClaim,
+		RoleMap:       map[string]Role{},
+		DefaultRole:   Role(settings.OIDCDefaultRole),
+		AutoProvision: settings.OIDCAutoProvision == "true",
+	}
+
+	// oidc_role_map=caddy-admins=admin,ops=operator
+	for _, pair := range strings.Split(settings.OIDCRoleMap, ",") {
+		group, role, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if found && Role(role).Valid() {
+			config.RoleMap[group] = Role(role)
+		}
+	}
+
+	return config, len(config.Issuer) > 0 && len(config.ClientID) > 0
+}
+
+func OIDCEnabled() bool {
+	_, ok := LoadOIDCConfig()
+	return ok
+}
+
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	keys map[string]crypto.PublicKey
+}
+
+var (
+	providerMu    sync.Mutex
+	providerCache = map[string]*oidcProvider{}
+)
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+func discover(issuer string) (*oidcProvider, error) {
+	providerMu.Lock()
+	defer providerMu.Unlock()
+
+	if p, ok := providerCache[issuer]; ok {
+		return p, nil
+	}
+
+	resp, err := oidcClient.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc discovery failed with status %v", resp.StatusCode)
+	}
+
+	provider := &oidcProvider{}
+	if err := json.NewDecoder(resp.Body).Decode(provider); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(provider.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("oidc discovery returned issuer %v, expected %v", provider.Issuer, issuer)
+	}
+
+	providerCache[issuer] = provider
+	return provider, nil
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+	providerMu.Lock()
+	defer providerMu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	// unknown kid, the provider might have rotated its keys
+	resp, err := oidcClient.Get(p.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	p.keys = map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		p.keys[k.Kid] = key
+	}
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("no signing key with kid %q", kid)
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %v", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %v", k.Kty)
+}
+
+func randomString() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// StartOIDCLogin redirects to the provider, the state, nonce and PKCE
+// verifier are kept in a short lived cookie till the callback
+func StartOIDCLogin(w http.ResponseWriter, r *http.Request) error {
+	config, ok := LoadOIDCConfig()
+	if !ok {
+		return ErrOIDCNotConfigured
+	}
+	provider, err := discover(config.Issuer)
+	if err != nil {
+		return err
+	}
+
+	state, err := randomString()
+	if err != nil {
+		return err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return err
+	}
+	verifier, err := randomString()
+	if err != nil {
+		return err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    strings.Join([]string{state, nonce, verifier}, "."),
+		Path:     "/login/oidc",
+		MaxAge:   int(oidcFlowTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", config.ClientID)
+	query.Set("redirect_uri", config.RedirectURL)
+	query.Set("scope", strings.Join(config.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	target := provider.AuthorizationEndpoint
+	if strings.Contains(target, "?") {
+		target += "&" + query.Encode()
+	} else {
+		target += "?" + query.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+	return nil
+}
+
+type oidcClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"`
+	Expiry            int64           `json:"exp"`
+	IssuedAt          int64           `json:"iat"`
+	Nonce             string          `json:"nonce"`
+	PreferredUsername string          `json:"preferred_username"`
+	Email             string          `json:"email"`
+
+	raw map[string]json.RawMessage
+}
+
+// groups reads the configured claim, providers send it either as a list
+// or as a single string
+func (c oidcClaims) groups(claim string) []string {
+	value, ok := c.raw[claim]
+	if !ok {
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(value, &list); err == nil {
+		return list
+	}
+	var single string
+	if err := json.Unmarshal(value, &single); err == nil && len(single) > 0 {
+		return []string{single}
+	}
+	return nil
+}
+
+func (c oidcClaims) hasAudience(clientID string) bool {
+	var list []string
+	if err := json.Unmarshal(c.Audience, &list); err == nil {
+		for _, aud := range list {
+			if aud == clientID {
+				return true
+			}
+		}
+		return false
+	}
+	var single string
+	json.Unmarshal(c.Audience, &single)
+	return single == clientID
+}
+
+// FinishOIDCLogin handles the provider's callback, it exchanges the code,
+// verifies the id token and returns the matching (or newly provisioned)
+// user with the role from their groups
+func FinishOIDCLogin(w http.ResponseWriter, r *http.Request, db *sql.DB) (*users.UsersWithIdentifier, error) {
+	config, ok := LoadOIDCConfig()
+	if !ok {
+		return nil, ErrOIDCNotConfigured
+	}
+
+	cookie, err := r.Cookie(oidcCookieName)
+	if err != nil {
+		return nil, errors.New("login flow expired, try again")
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   oidcCookieName,
+		Value:  "",
+		Path:   "/login/oidc",
+		MaxAge: -1,
+	})
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid login flow, try again")
+	}
+	state, nonce, verifier := parts[0], parts[1], parts[2]
+
+	query := r.URL.Query()
+	if errorCode := query.Get("error"); len(errorCode) > 0 {
+		return nil, fmt.Errorf("identity provider returned %v: %v", errorCode, query.Get("error_description"))
+	}
+	if query.Get("state") != state {
+		return nil, errors.New("state mismatch, try again")
+	}
+
+	provider, err := discover(config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	idToken, err := exchangeCode(config, provider, query.Get("code"), verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := verifyIDToken(config, provider, idToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return provisionOIDCUser(db, config, claims)
+}
+
+func exchangeCode(config OIDCConfig, provider *oidcProvider, code, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", config.RedirectURL)
+	form.Set("client_id", config.ClientID)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest(http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if len(config.ClientSecret) > 0 {
+		req.SetBasicAuth(url.QueryEscape(config.ClientID), url.QueryEscape(config.ClientSecret))
+	}
+
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to read token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || len(body.Error) > 0 {
+		return "", fmt.Errorf("token exchange failed: %v %v", body.Error, body.ErrorDescription)
+	}
+	if len(body.IDToken) == 0 {
+		return "", errors.New("token response has no id_token")
+	}
+	return body.IDToken, nil
+}
+
+func verifyIDToken(config OIDCConfig, provider *oidcProvider, token, nonce string) (oidcClaims, error) {
+	var claims oidcClaims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed id token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, errors.New("malformed id token header")
+	}
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return claims, errors.New("malformed id token header")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errors.New("malformed id token signature")
+	}
+
+	key, err := provider.key(header.Kid)
+	if err != nil {
+		return claims, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch header.Alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) != nil {
+			return claims, errors.New("invalid id token signature")
+		}
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return claims, errors.New("invalid id token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return claims, errors.New("invalid id token signature")
+		}
+	default:
+		return claims, fmt.Errorf("unsupported id token algorithm %v", header.Alg)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, errors.New("malformed id token payload")
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, errors.New("malformed id token payload")
+	}
+	json.Unmarshal(payload, &claims.raw)
+
+	now := time.Now()
+	switch {
+	case strings.TrimRight(claims.Issuer, "/") != config.Issuer:
+		return claims, errors.New("id token issuer mismatch")
+	case !claims.hasAudience(config.ClientID):
+		return claims, errors.New("id token audience mismatch")
+	case now.After(time.Unix(claims.Expiry, 0).Add(oidcLeeway)):
+		return claims, errors.New("id token expired")
+	case claims.IssuedAt > 0 && time.Unix(claims.IssuedAt, 0).After(now.Add(oidcLeeway)):
+		return claims, errors.New("id token issued in the future")
+	case claims.Nonce != nonce:
+		return claims, errors.New("id token nonce mismatch")
+	case len(claims.Subject) == 0:
+		return claims, errors.New("id token has no subject")
+	}
+
+	return claims, nil
+}
+
+// roleForGroups picks the highest role mapped from the user's groups
+func roleForGroups(config OIDCConfig, groups []string) Role {
+	role := config.DefaultRole
+	for _, group := range groups {
+		if mapped, ok := config.RoleMap[group]; ok && !role.Includes(mapped) {
+			role = mapped
+		}
+	}
+	return role
+}
+
+func provisionOIDCUser(db *sql.DB, config OIDCConfig, claims oidcClaims) (*users.UsersWithIdentifier, error) {
+	role := roleForGroups(config, claims.groups(config.GroupsClaim))
+	if !role.Valid() {
+		return nil, ErrOIDCNoRole
+	}
+
+	user, err := users.FindByOIDCSubject(db, claims.Subject)
+	if err == nil {
+		// groups are the source of truth, roles follow them on every login
+		if user.Role != string(role) {
+			user.Role = string(role)
+			if err := user.Update(db); err != nil {
+				return nil, err
+			}
+		}
+		return user, nil
+	}
+	if !errors.Is(err, data.ErrNotFound) {
+		return nil, err
+	}
+
+	if !config.AutoProvision {
+		return nil, errors.New("no caddy-ui user is linked to this account, ask an admin to create one")
+	}
+
+	username := claims.PreferredUsername
+	if len(username) == 0 {
+		username = claims.Email
+	}
+	if len(username) == 0 {
+		username = claims.Subject
+	}
+
+	// never link to an existing local account by name, that would let
+	// anyone who can pick their username at the provider take it over
+	if _, err := users.FindByUsername(db, username); err == nil {
+		return nil, fmt.Errorf("a user named %v already exists", username)
+	} else if !errors.Is(err, data.ErrNotFound) {
+		return nil, err
+	}
+
+	newUser := users.New()
+	newUser.Username = username
+	newUser.Role = string(role)
+	newUser.OIDCSubject = sql.NullString{String: claims.Subject, Valid: true}
+	return newUser.Save(db)
+}
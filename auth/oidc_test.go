@@ -0,0 +1,456 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/barelyhuman/caddy-ui/config"
+	"github.com/barelyhuman/caddy-ui/data/models/apps"
+	"github.com/barelyhuman/caddy-ui/data/models/instances"
+	"github.com/barelyhuman/caddy-ui/data/models/users"
+	"github.com/barelyhuman/caddy-ui/data/store"
+	"github.com/barelyhuman/caddy-ui/migrate"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const testClientID = "caddy-ui"
+
+// fakeIdP is an identity provider with an RSA and an EC signing key, its
+// token endpoint only accepts the code "good-code" with the verifier of
+// the last authorization request
+type fakeIdP struct {
+	server *httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	mu        sync.Mutex
+	alg       string
+	challenge string
+	nonce     string
+	claims    map[string]any
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &fakeIdP{rsaKey: rsaKey, ecKey: ecKey, alg: "RS256", claims: map[string]any{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		encode := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{
+				"kid": "rsa",
+				"kty": "RSA",
+				"n":   encode(rsaKey.N.Bytes()),
+				"e":   encode(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kid": "ec",
+				"kty": "EC",
+				"crv": "P-256",
+				"x":   encode(ecKey.X.FillBytes(make([]byte, 32))),
+				"y":   encode(ecKey.Y.FillBytes(make([]byte, 32))),
+			},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		r.ParseForm()
+		challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("code") != "good-code" || base64.RawURLEncoding.EncodeToString(challenge[:]) != idp.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims := idp.validClaims(idp.nonce)
+		for k, v := range idp.claims {
+			claims[k] = v
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(t, idp.alg, claims)})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// use makes the token endpoint sign with alg and override claims till
+// the end of the test
+func (idp *fakeIdP) use(t *testing.T, alg string, claims map[string]any) {
+	idp.mu.Lock()
+	idp.alg, idp.claims = alg, claims
+	idp.mu.Unlock()
+	t.Cleanup(func() {
+		idp.mu.Lock()
+		idp.alg, idp.claims = "RS256", map[string]any{}
+		idp.mu.Unlock()
+	})
+}
+
+func (idp *fakeIdP) validClaims(nonce string) map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":                idp.server.URL,
+		"sub":                "user-1",
+		"aud":                testClientID,
+		"exp":                now.Add(time.Hour).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              nonce,
+		"preferred_username": "jane",
+		"groups":             []string{"ops"},
+	}
+}
+
+// sign builds an id token, RS256 tokens use the "rsa" key and ES256 ones
+// the "ec" key
+func (idp *fakeIdP) sign(t *testing.T, alg string, claims map[string]any) string {
+	return signToken(t, alg, map[string]string{"RS256": "rsa", "ES256": "ec"}[alg], idp.rsaKey, idp.ecKey, claims)
+}
+
+func signToken(t *testing.T, alg, kid string, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey, claims map[string]any) string {
+	t.Helper()
+	encode := func(v any) string {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+	signed := encode(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch alg {
+	case "RS256":
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp := newFakeIdP(t)
+	provider, err := discover(idp.server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := OIDCConfig{Issuer: idp.server.URL, ClientID: testClientID}
+	otherRSA, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	with := func(changes map[string]any) map[string]any {
+		claims := idp.validClaims("nonce-1")
+		for k, v := range changes {
+			claims[k] = v
+		}
+		return claims
+	}
+	tests := []struct {
+		name  string
+		token string
+		// wantErr is part of the error message, empty when the token is
+		// valid
+		wantErr string
+	}{
+		{"RS256", idp.sign(t, "RS256", with(nil)), ""},
+		{"ES256", idp.sign(t, "ES256", with(nil)), ""},
+		{"audience list", idp.sign(t, "RS256", with(map[string]any{"aud": []string{"other", testClientID}})), ""},
+		{"expired within the leeway", idp.sign(t, "RS256", with(map[string]any{"exp": now.Add(-30 * time.Second).Unix()})), ""},
+		{"wrong audience", idp.sign(t, "RS256", with(map[string]any{"aud": "other"})), "audience mismatch"},
+		{"wrong audience list", idp.sign(t, "ES256", with(map[string]any{"aud": []string{"other"}})), "audience mismatch"},
+		{"expired", idp.sign(t, "RS256", with(map[string]any{"exp": now.Add(-time.Hour).Unix()})), "expired"},
+		{"no expiry", idp.sign(t, "RS256", with(map[string]any{"exp": 0})), "expired"},
+		{"issued in the future", idp.sign(t, "ES256", with(map[string]any{"iat": now.Add(time.Hour).Unix()})), "future"},
+		{"bad nonce", idp.sign(t, "RS256", with(map[string]any{"nonce": "nonce-2"})), "nonce mismatch"},
+		{"wrong issuer", idp.sign(t, "RS256", with(map[string]any{"iss": "https://evil.example"})), "issuer mismatch"},
+		{"no subject", idp.sign(t, "RS256", with(map[string]any{"sub": ""})), "no subject"},
+		{"signed by another key", signToken(t, "RS256", "rsa", otherRSA, nil, with(nil)), "invalid id token signature"},
+		{"RS256 with the EC key", signToken(t, "RS256", "ec", idp.rsaKey, nil, with(nil)), "invalid id token signature"},
+		{"unknown kid", signToken(t, "RS256", "gone", idp.rsaKey, nil, with(nil)), "no signing key"},
+		{"alg none", signToken(t, "none", "rsa", nil, nil, with(nil)), "unsupported id token algorithm"},
+		{"malformed", "not-a-token", "malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifyIDToken(config, provider, tt.token, "nonce-1")
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if claims.Subject != "user-1" {
+					t.Errorf("subject = %q, want user-1", claims.Subject)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// a tampered payload keeps the signature of the original one
+	parts := strings.Split(idp.sign(t, "ES256", with(nil)), ".")
+	forged, _ := json.Marshal(with(map[string]any{"sub": "admin"}))
+	parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+	if _, err := verifyIDToken(config, provider, strings.Join(parts, "."), "nonce-1"); err == nil {
+		t.Error("a tampered payload was accepted")
+	}
+}
+
+func openTestDatabase(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db")+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := migrate.MigrateUp(db, migrate.Source(db, "")); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// startLogin runs StartOIDCLogin and tells the IdP about the challenge
+// and nonce like the authorization endpoint would, it returns the flow
+// cookie and the state
+func startLogin(t *testing.T, idp *fakeIdP) (*http.Cookie, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	if err := StartOIDCLogin(rec, httptest.NewRequest(http.MethodGet, "/login/oidc", nil)); err != nil {
+		t.Fatal(err)
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(location.String(), idp.server.URL+"/authorize?") {
+		t.Fatalf("redirected to %v", location)
+	}
+	query := location.Query()
+	if query.Get("client_id") != testClientID || query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected authorization request %v", query)
+	}
+
+	idp.mu.Lock()
+	idp.challenge = query.Get("code_challenge")
+	idp.nonce = query.Get("nonce")
+	idp.mu.Unlock()
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcCookieName {
+		t.Fatalf("cookies = %v", cookies)
+	}
+	return cookies[0], query.Get("state")
+}
+
+func callback(cookie *http.Cookie, query string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/login/oidc/callback?"+query, nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	return r
+}
+
+func TestFinishOIDCLogin(t *testing.T) {
+	idp := newFakeIdP(t)
+	previous := config.Get()
+	c := previous
+	c.OIDCIssuer = idp.server.URL
+	c.OIDCClientID = testClientID
+	c.OIDCRoleMap = "ops=operator,admins=admin"
+	config.Set(c)
+	t.Cleanup(func() { config.Set(previous) })
+	db := openTestDatabase(t)
+
+	finish := func(r *http.Request) (*users.UsersWithIdentifier, error) {
+		return FinishOIDCLogin(httptest.NewRecorder(), r, db)
+	}
+
+	t.Run("provisions the user", func(t *testing.T) {
+		cookie, state := startLogin(t, idp)
+		user, err := finish(callback(cookie, "code=good-code&state="+url.QueryEscape(state)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Username != "jane" || user.Role != string(RoleOperator) || user.OIDCSubject.String != "user-1" {
+			t.Errorf("got %+v", user.Users)
+		}
+	})
+
+	// the first user came in through SSO, /setup never ran
+	t.Run("apps can be created after the first SSO login", func(t *testing.T) {
+		ctx := context.Background()
+		var appID int64
+		err := store.New(db).Atomic(ctx, func(tx *store.Store) error {
+			instanceID, err := tx.PrimaryInstanceID(ctx)
+			if err != nil {
+				return err
+			}
+			app := apps.New()
+			app.Name = "web"
+			app.InstanceID = instanceID
+			created, err := tx.Apps.Create(ctx, app)
+			if err != nil {
+				return err
+			}
+			appID = created.ID
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		primary, err := instances.FindPrimary(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		app, err := apps.NewStore(db).FindById(ctx, appID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if app.InstanceID != primary.ID {
+			t.Errorf("app is attached to instance %v, want the primary one %v", app.InstanceID, primary.ID)
+		}
+		// and the next app reuses the instance
+		if id, err := store.New(db).PrimaryInstanceID(ctx); err != nil || id != primary.ID {
+			t.Errorf("primary instance = %v, %v, want %v", id, err, primary.ID)
+		}
+	})
+
+	t.Run("ES256 and role follows the groups", func(t *testing.T) {
+		idp.use(t, "ES256", map[string]any{"groups": []string{"ops", "admins"}})
+
+		cookie, state := startLogin(t, idp)
+		user, err := finish(callback(cookie, "code=good-code&state="+url.QueryEscape(state)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Role != string(RoleAdmin) {
+			t.Errorf("role = %v, want admin", user.Role)
+		}
+		all, err := users.FindAll(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 1 {
+			t.Errorf("%v users, the second login should reuse the first one", len(all))
+		}
+	})
+
+	t.Run("bad state", func(t *testing.T) {
+		cookie, _ := startLogin(t, idp)
+		if _, err := finish(callback(cookie, "code=good-code&state=forged")); err == nil || !strings.Contains(err.Error(), "state mismatch") {
+			t.Fatalf("error = %v, want a state mismatch", err)
+		}
+	})
+
+	t.Run("no flow cookie", func(t *testing.T) {
+		_, state := startLogin(t, idp)
+		if _, err := finish(callback(nil, "code=good-code&state="+url.QueryEscape(state))); err == nil {
+			t.Fatal("a callback without the flow cookie was accepted")
+		}
+	})
+
+	t.Run("wrong PKCE verifier", func(t *testing.T) {
+		cookie, state := startLogin(t, idp)
+		parts := strings.Split(cookie.Value, ".")
+		parts[2] = "another-verifier"
+		cookie.Value = strings.Join(parts, ".")
+		if _, err := finish(callback(cookie, "code=good-code&state="+url.QueryEscape(state))); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+			t.Fatalf("error = %v, want invalid_grant", err)
+		}
+	})
+
+	t.Run("bad nonce", func(t *testing.T) {
+		cookie, state := startLogin(t, idp)
+		idp.mu.Lock()
+		idp.nonce = "replayed"
+		idp.mu.Unlock()
+		if _, err := finish(callback(cookie, "code=good-code&state="+url.QueryEscape(state))); err == nil || !strings.Contains(err.Error(), "nonce mismatch") {
+			t.Fatalf("error = %v, want a nonce mismatch", err)
+		}
+	})
+
+	t.Run("wrong audience", func(t *testing.T) {
+		idp.use(t, "RS256", map[string]any{"aud": "another-client"})
+		cookie, state := startLogin(t, idp)
+		if _, err := finish(callback(cookie, "code=good-code&state="+url.QueryEscape(state))); err == nil || !strings.Contains(err.Error(), "audience mismatch") {
+			t.Fatalf("error = %v, want an audience mismatch", err)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		idp.use(t, "RS256", map[string]any{"exp": time.Now().Add(-time.Hour).Unix()})
+		cookie, state := startLogin(t, idp)
+		if _, err := finish(callback(cookie, "code=good-code&state="+url.QueryEscape(state))); err == nil || !strings.Contains(err.Error(), "expired") {
+			t.Fatalf("error = %v, want an expired token", err)
+		}
+	})
+
+	t.Run("no mapped group", func(t *testing.T) {
+		idp.use(t, "RS256", map[string]any{"sub": "user-2", "preferred_username": "joe", "groups": []string{"sales"}})
+		cookie, state := startLogin(t, idp)
+		if _, err := finish(callback(cookie, "code=good-code&state="+url.QueryEscape(state))); !errors.Is(err, ErrOIDCNoRole) {
+			t.Fatalf("error = %v, want ErrOIDCNoRole", err)
+		}
+	})
+
+	t.Run("existing local user with the same name", func(t *testing.T) {
+		local := users.New()
+		local.Username = "joe"
+		local.Role = string(RoleViewer)
+		if _, err := local.Save(db); err != nil {
+			t.Fatal(err)
+		}
+		idp.use(t, "RS256", map[string]any{"sub": "user-3", "preferred_username": "joe"})
+		cookie, state := startLogin(t, idp)
+		if _, err := finish(callback(cookie, "code=good-code&state="+url.QueryEscape(state))); err == nil || !strings.Contains(err.Error(), "already exists") {
+			t.Fatalf("error = %v, the local account must not be taken over", err)
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/barelyhuman/caddy-ui/data/models/api_tokens"
+	"github.com/barelyhuman/caddy-ui/data/models/apps"
+)
+
+type Role string
+
+const (
+	// RoleViewer can look at everything but change nothing
+	RoleViewer Role = "viewer"
+	// RoleOperator can manage and sync the apps of their team
+	RoleOperator Role = "operator"
+	// RoleAdmin can do everything, including the config editor and
+	// managing users
+	RoleAdmin Role = "admin"
+)
+
+var Roles = []Role{RoleViewer, RoleOperator, RoleAdmin}
+
+func (r Role) level() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleOperator:
+		return 2
+	case RoleAdmin:
+		return 3
+	}
+	return 0
+}
+
+func (r Role) Valid() bool {
+	return r.level() > 0
+}
+
+// Includes is true if r has every permission of other
+func (r Role) Includes(other Role) bool {
+	return r.Valid() && r.level() >= other.level()
+}
+
+var (
+	ErrOtherTeam = errors.New("only admins can create apps for another team")
+	ErrNoTeam    = errors.New("operators need a team to create apps, ask an admin to set one")
+)
+
+// NewAppTeam is the team of an app the request creates, team or else the
+// user's team. Only admins can pick another team, an operator without a
+// team couldn't edit the app afterwards so they can't create one
+func NewAppTeam(ctx context.Context, team string) (string, error) {
+	user := UserFromContext(ctx)
+	if user == nil {
+		return "", ErrOtherTeam
+	}
+	team = strings.TrimSpace(team)
+	if len(team) == 0 {
+		team = user.Team.String
+	}
+	if Role(user.Role).Includes(RoleAdmin) {
+		return team, nil
+	}
+	if team != user.Team.String {
+		return "", ErrOtherTeam
+	}
+	// service tokens can edit any app they reach, team or not
+	token := TokenFromContext(ctx)
+	if len(team) == 0 && (token == nil || token.Kind != api_tokens.KindService) {
+		return "", ErrNoTeam
+	}
+	return team, nil
+}
+
+// CanEditApp is true for admins and for operators in the same team as
+// the app, apps without a team can only be edited by admins. Requests
+// made with a service token can edit any app the token is limited to
+func CanEditApp(r *http.Request, db *sql.DB, appId string) bool {
+	user := UserFromContext(r.Context())
+	if user == nil || !AppAllowed(r.Context(), appId) {
+		return false
+	}
+	role := Role(user.Role)
+	if role.Includes(RoleAdmin) {
+		return true
+	}
+	if !role.Includes(RoleOperator) {
+		return false
+	}
+	if token := TokenFromContext(r.Context()); token != nil && token.Kind == api_tokens.KindService {
+		return true
+	}
+	if !user.Team.Valid || len(user.Team.String) == 0 {
+		return false
+	}
+	app, err := apps.FindById(db, appId)
+	if err != nil || app.ID == 0 {
+		return false
+	}
+	return app.Team.Valid && app.Team.String == user.Team.String
+}
@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/barelyhuman/caddy-ui/data"
+	"github.com/barelyhuman/caddy-ui/data/models/api_tokens"
+	"github.com/barelyhuman/caddy-ui/data/models/users"
+)
+
+const tokenPrefix = "cui_"
+
+type Scope string
+
+const (
+	ScopeRead  Scope = "read"
+	ScopeWrite Scope = "write"
+	ScopeAdmin Scope = "admin"
+)
+
+var Scopes = []Scope{ScopeRead, ScopeWrite, ScopeAdmin}
+
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+type tokenContextKey struct{}
+
+// Role is the most a token with this scope can do
+func (s Scope) Role() Role {
+	switch s {
+	case ScopeRead:
+		return RoleViewer
+	case ScopeWrite:
+		return RoleOperator
+	case ScopeAdmin:
+		return RoleAdmin
+	}
+	return ""
+}
+
+func (s Scope) Valid() bool {
+	return s.Role().Valid()
+}
+
+// ScopeFor is the widest scope a role is allowed to hand out
+func ScopeFor(role Role) Scope {
+	for _, s := range []Scope{ScopeAdmin, ScopeWrite, ScopeRead} {
+		if role.Includes(s.Role()) {
+			return s
+		}
+	}
+	return ""
+}
+
+// NewToken generates a token, the plain value is only returned here and
+// has to be shown to the user right away
+func NewToken() (plain string, hash string, prefix string, err error) {
+	buf := make([]byte, 32)
+	if _, err = rand.Read(buf); err != nil {
+		return
+	}
+	plain = tokenPrefix + base64.RawURLEncoding.EncodeToString(buf)
+	hash = hashToken(plain)
+	prefix = plain[:len(tokenPrefix)+6]
+	return
+}
+
+// APIPrefix is the only place API tokens are accepted, the pages (and
+// what they post to, such as /users or /upload-config) need a session
+const APIPrefix = "/api/v1"
+
+func isAPIPath(path string) bool {
+	return path == APIPrefix || strings.HasPrefix(path, APIPrefix+"/")
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
+}
+
+// authenticateToken resolves the bearer token to the user it acts as,
+// service tokens get a user that only exists for the request. Unknown
+// tokens give ErrInvalidToken, any other error comes from the database
+func authenticateToken(db *sql.DB, plain string) (*users.UsersWithIdentifier, *api_tokens.ApiTokensWithIdentifier, error) {
+	token, err := api_tokens.FindByTokenHash(db, hashToken(plain))
+	if errors.Is(err, data.ErrNotFound) {
+		return nil, nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	if token.Expired(now) {
+		return nil, nil, ErrInvalidToken
+	}
+
+	scopeRole := Scope(token.Scope).Role()
+	if !scopeRole.Valid() {
+		return nil, nil, ErrInvalidToken
+	}
+
+	var user *users.UsersWithIdentifier
+	if token.Kind == api_tokens.KindPersonal {
+		if !token.UserID.Valid {
+			return nil, nil, ErrInvalidToken
+		}
+		user, err = users.FindById(db, token.UserID.Int64)
+		if errors.Is(err, data.ErrNotFound) {
+			return nil, nil, ErrInvalidToken
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		// a token never does more than its user
+		if !scopeRole.Includes(Role(user.Role)) {
+			user.Role = string(scopeRole)
+		}
+	} else {
+		user = &users.UsersWithIdentifier{}
+		user.Username = "token:" + token.Name
+		user.Role = string(scopeRole)
+	}
+
+	api_tokens.TouchLastUsed(db, token.ID, now)
+	return user, token, nil
+}
+
+// TokenFromContext returns the API token the request was authenticated
+// with, nil for session requests
+func TokenFromContext(ctx context.Context) *api_tokens.ApiTokensWithIdentifier {
+	token, _ := ctx.Value(tokenContextKey{}).(*api_tokens.ApiTokensWithIdentifier)
+	return token
+}
+
+// AppAllowed is false if the request was made with a token that's
+// limited to other apps
+func AppAllowed(ctx context.Context, appId string) bool {
+	token := TokenFromContext(ctx)
+	if token == nil {
+		return true
+	}
+	allowed := token.Apps()
+	return allowed == nil || slices.Contains(allowed, appId)
+}
@@ -0,0 +1,325 @@
+// Package backup writes everything caddy-ui needs to come back after a
+// loss in a single archive: a snapshot of the SQLite database, caddy's
+// live config and the files the apps and the config point to, and
+// restores such an archive on an empty instance
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/barelyhuman/caddy-ui/caddy"
+	"github.com/barelyhuman/caddy-ui/config"
+	"github.com/barelyhuman/caddy-ui/data"
+	"github.com/barelyhuman/caddy-ui/data/models/app_options"
+	"github.com/barelyhuman/caddy-ui/data/models/apps"
+)
+
+// Version is the layout of the archive, bumped whenever a restore of
+// an older version would need to be handled differently
+const Version = 1
+
+const (
+	manifestName = "manifest.json"
+	databaseName = "data.sqlite3"
+	caddyName    = "caddy.json"
+	filesDir     = "files"
+)
+
+const (
+	// FileKindSite is the root of a file-server app
+	FileKindSite = "site"
+	// FileKindCertificate is a certificate or key loaded by caddy's tls
+	// app
+	FileKindCertificate = "certificate"
+)
+
+// File is a file or a directory of the host saved in the archive
+type File struct {
+	// Path is where it lives on the host, always absolute
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+}
+
+// Manifest is the first entry of the archive, a restore reads it before
+// anything else
+type Manifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	// Schema is the last migration applied to the snapshot
+	Schema string `json:"schema"`
+	// CaddyConfig is false when caddy couldn't be reached during the
+	// backup, the archive has no caddy.json then
+	CaddyConfig bool   `json:"caddy_config"`
+	Files       []File `json:"files"`
+}
+
+// Filename is the name given to an archive taken at t, ex:
+// caddy-ui-20240102-150405.tar.gz
+func Filename(t time.Time) string {
+	return "caddy-ui-" + t.UTC().Format("20060102-150405") + ".tar.gz"
+}
+
+// filenameTime reads back the time Filename put in name, ok is false
+// for archives named some other way
+func filenameTime(name string) (time.Time, bool) {
+	stamp := strings.TrimSuffix(strings.TrimPrefix(name, "caddy-ui-"), ".tar.gz")
+	t, err := time.Parse("20060102-150405", stamp)
+	return t, err == nil
+}
+
+// DatabasePath is the file of the SQLite database in use, backups and
+// restores don't work with postgres or in-memory databases
+func DatabasePath() (string, error) {
+	database, err := config.ParseDatabaseURL(config.Get().DatabaseURL)
+	if err != nil {
+		return "", err
+	}
+	if database.Dialect != config.DialectSQLite {
+		return "", errors.New("backups only cover SQLite databases, use pg_dump for postgres")
+	}
+	file, query, _ := strings.Cut(strings.TrimPrefix(database.DSN, "file:"), "?")
+	if len(file) == 0 || file == ":memory:" || strings.Contains(query, "mode=memory") {
+		return "", errors.New("backups need a database file, not an in-memory database")
+	}
+	return filepath.Clean(file), nil
+}
+
+// Write takes the snapshot and streams the archive to w. The database is
+// copied with VACUUM INTO so the snapshot is consistent while the server
+// keeps writing. Missing files and an unreachable caddy are warnings,
+// the database alone is still worth keeping
+func Write(ctx context.Context, db *sql.DB, w io.Writer) (*Manifest, []string, error) {
+	if data.Dialect(db) != config.DialectSQLite {
+		return nil, nil, errors.New("backups only cover SQLite databases, use pg_dump for postgres")
+	}
+
+	dir, err := os.MkdirTemp("", "caddy-ui-backup-")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(dir)
+	snapshot := filepath.Join(dir, databaseName)
+	if _, err := db.ExecContext(ctx, "VACUUM INTO ?", snapshot); err != nil {
+		return nil, nil, fmt.Errorf("failed to snapshot the database: %w", err)
+	}
+
+	manifest := &Manifest{Version: Version, CreatedAt: time.Now().UTC(), Files: []File{}}
+	if err := db.QueryRowContext(ctx, "select name from migrations order by name desc limit 1").Scan(&manifest.Schema); err != nil {
+		return nil, nil, fmt.Errorf("failed to read the schema version: %w", err)
+	}
+
+	warnings := []string{}
+	var caddyConfig []byte
+	if raw, err := caddy.GetConfigAtPath(""); err != nil {
+		warnings = append(warnings, fmt.Sprintf("caddy's live config isn't in the backup: %v", err))
+	} else {
+		caddyConfig = raw
+		manifest.CaddyConfig = true
+	}
+
+	files, fileWarnings, err := collectFiles(db, caddyConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest.Files = files
+	warnings = append(warnings, fileWarnings...)
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writeEntry(tw, manifestName, manifestJSON); err != nil {
+		return nil, nil, err
+	}
+	if err := writeFile(tw, databaseName, snapshot); err != nil {
+		return nil, nil, err
+	}
+	if manifest.CaddyConfig {
+		if err := writeEntry(tw, caddyName, caddyConfig); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, file := range manifest.Files {
+		skipped, err := writeTree(tw, file.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		warnings = append(warnings, skipped...)
+	}
+	if err := tw.Close(); err != nil {
+		return nil, nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, nil, err
+	}
+	return manifest, warnings, nil
+}
+
+// collectFiles finds the roots of the file-server apps and the
+// certificates loaded from disk by caddy's tls app
+func collectFiles(db *sql.DB, caddyConfig []byte) ([]File, []string, error) {
+	candidates := []File{}
+
+	appList, err := apps.FindAll(db)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, app := range appList {
+		if app.Type.String != string(caddy.RouteKindFileServer) {
+			continue
+		}
+		options, err := app_options.FindByAppId(db, fmt.Sprint(app.ID))
+		if err != nil {
+			return nil, nil, err
+		}
+		if root := options[app_options.Root]; len(root) > 0 {
+			candidates = append(candidates, File{Path: root, Kind: FileKindSite})
+		}
+	}
+
+	if len(caddyConfig) > 0 {
+		var tlsConfig struct {
+			Apps struct {
+				TLS struct {
+					Certificates struct {
+						LoadFiles []struct {
+							Certificate string `json:"certificate"`
+							Key         string `json:"key"`
+						} `json:"load_files"`
+						LoadFolders []string `json:"load_folders"`
+					} `json:"certificates"`
+				} `json:"tls"`
+			} `json:"apps"`
+		}
+		// a config without a tls app (or with one we don't understand)
+		// just has no certificates to save
+		if err := json.Unmarshal(caddyConfig, &tlsConfig); err == nil {
+			certificates := tlsConfig.Apps.TLS.Certificates
+			for _, pair := range certificates.LoadFiles {
+				candidates = append(candidates,
+					File{Path: pair.Certificate, Kind: FileKindCertificate},
+					File{Path: pair.Key, Kind: FileKindCertificate},
+				)
+			}
+			for _, folder := range certificates.LoadFolders {
+				candidates = append(candidates, File{Path: folder, Kind: FileKindCertificate})
+			}
+		}
+	}
+
+	files := []File{}
+	warnings := []string{}
+	seen := map[string]bool{}
+	for _, file := range candidates {
+		if len(file.Path) == 0 || seen[file.Path] {
+			continue
+		}
+		seen[file.Path] = true
+		if !filepath.IsAbs(file.Path) {
+			warnings = append(warnings, fmt.Sprintf("%v %v isn't an absolute path, it isn't in the backup", file.Kind, file.Path))
+			continue
+		}
+		if _, err := os.Stat(file.Path); err != nil {
+			warnings = append(warnings, fmt.Sprintf("%v %v isn't in the backup: %v", file.Kind, file.Path, err))
+			continue
+		}
+		file.Path = filepath.Clean(file.Path)
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	// a path inside another one (ex: certificates in a site's root) is
+	// already saved with its parent
+	roots := []File{}
+	for _, file := range files {
+		if n := len(roots); n > 0 && strings.HasPrefix(file.Path, roots[n-1].Path+string(filepath.Separator)) {
+			continue
+		}
+		roots = append(roots, file)
+	}
+	return roots, warnings, nil
+}
+
+func writeEntry(tw *tar.Writer, name string, contents []byte) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    int64(len(contents)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(contents)
+	return err
+}
+
+func writeFile(tw *tar.Writer, name string, source string) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// writeTree adds a file or a whole directory under files/ with its
+// absolute path, anything that isn't a regular file or a directory (ex:
+// symlinks) is skipped and returned as a warning
+func writeTree(tw *tar.Writer, root string) ([]string, error) {
+	skipped := []string{}
+	err := filepath.WalkDir(root, func(current string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := path.Join(filesDir, filepath.ToSlash(current))
+		switch {
+		case entry.IsDir():
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			header, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			header.Name = name + "/"
+			return tw.WriteHeader(header)
+		case entry.Type().IsRegular():
+			return writeFile(tw, name, current)
+		default:
+			skipped = append(skipped, fmt.Sprintf("%v isn't a regular file, it isn't in the backup", current))
+			return nil
+		}
+	})
+	return skipped, err
+}
@@ -0,0 +1,292 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/barelyhuman/caddy-ui/config"
+	"github.com/barelyhuman/caddy-ui/migrate"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// fakeCaddy serves config on GET /config/ (asked for as /config) and
+// keeps what is posted to /load
+type fakeCaddy struct {
+	config []byte
+
+	mu     sync.Mutex
+	loaded []byte
+}
+
+func newFakeCaddy(t *testing.T, config []byte) *fakeCaddy {
+	t.Helper()
+	f := &fakeCaddy{config: config}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && strings.TrimSuffix(r.URL.Path, "/") == "/config":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(f.config)
+		case r.Method == http.MethodPost && r.URL.Path == "/load":
+			body, _ := io.ReadAll(r.Body)
+			f.mu.Lock()
+			f.loaded = body
+			f.mu.Unlock()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	useCaddy(t, server.URL)
+	return f
+}
+
+func useCaddy(t *testing.T, url string) {
+	previous := config.Get()
+	c := previous
+	c.CaddyURL = url
+	config.Set(c)
+	t.Cleanup(func() { config.Set(previous) })
+}
+
+func writeTestFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
+
+// sourceDatabase is a migrated database with a user and a file-server
+// app serving root
+func sourceDatabase(t *testing.T, root string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "source.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := migrate.MigrateUp(db, migrate.Source(db, "")); err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{
+		"insert into instances (id,is_primary,base_domain) values (1,true,'example.com')",
+		"insert into users (username,password,role) values ('admin','x','admin')",
+		"insert into apps (id,name,instance_id,type) values (1,'site',1,'file-server')",
+		"insert into app_options (app_id,name,value) values (1,'root','" + root + "')",
+		"insert into domains (app_id,domain) values (1,'site.example.com')",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatalf("%v: %v", query, err)
+		}
+	}
+	return db
+}
+
+func TestWriteRestore(t *testing.T) {
+	host := t.TempDir()
+	site := filepath.Join(host, "srv", "site")
+	certs := filepath.Join(host, "certs")
+	writeTestFile(t, filepath.Join(site, "index.html"), "<h1>hello</h1>")
+	writeTestFile(t, filepath.Join(site, "assets", "app.css"), "body{}")
+	writeTestFile(t, filepath.Join(certs, "site.crt"), "certificate")
+	writeTestFile(t, filepath.Join(certs, "site.key"), "key")
+	// inside the site's root, saved along with it
+	writeTestFile(t, filepath.Join(site, "tls", "inner.crt"), "inner")
+
+	caddyConfig, _ := json.Marshal(map[string]any{
+		"apps": map[string]any{"tls": map[string]any{"certificates": map[string]any{
+			"load_files": []map[string]string{
+				{"certificate": filepath.Join(certs, "site.crt"), "key": filepath.Join(certs, "site.key")},
+				{"certificate": filepath.Join(site, "tls", "inner.crt"), "key": "relative.key"},
+				{"certificate": filepath.Join(host, "missing.crt")},
+			},
+		}}},
+	})
+	caddy := newFakeCaddy(t, caddyConfig)
+	db := sourceDatabase(t, site)
+
+	archive := &bytes.Buffer{}
+	manifest, warnings, err := Write(context.Background(), db, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !manifest.CaddyConfig || !strings.HasSuffix(manifest.Schema, ".up.sql") {
+		t.Errorf("manifest = %+v, warnings = %q", manifest, warnings)
+	}
+	wantFiles := []File{
+		{Path: filepath.Join(certs, "site.crt"), Kind: FileKindCertificate},
+		{Path: filepath.Join(certs, "site.key"), Kind: FileKindCertificate},
+		{Path: site, Kind: FileKindSite},
+	}
+	if len(manifest.Files) != len(wantFiles) {
+		t.Fatalf("files = %+v, want %+v", manifest.Files, wantFiles)
+	}
+	for i := range wantFiles {
+		if manifest.Files[i] != wantFiles[i] {
+			t.Errorf("files[%v] = %+v, want %+v", i, manifest.Files[i], wantFiles[i])
+		}
+	}
+	if len(warnings) != 2 {
+		t.Errorf("warnings = %q, want the relative key and the missing certificate", warnings)
+	}
+
+	// restore on a new host, under another root so nothing collides
+	target := t.TempDir()
+	databasePath := filepath.Join(target, "data.sqlite3")
+	restoredRoot := filepath.Join(target, "root")
+	restored, warnings, err := Restore(bytes.NewReader(archive.Bytes()), databasePath, RestoreOptions{FilesRoot: restoredRoot})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) > 0 {
+		t.Errorf("unexpected warnings %q", warnings)
+	}
+	if restored.Schema != manifest.Schema || len(restored.Files) != len(manifest.Files) {
+		t.Errorf("restored manifest = %+v, want %+v", restored, manifest)
+	}
+	if !bytes.Equal(caddy.loaded, caddyConfig) {
+		t.Errorf("caddy was loaded with %s", caddy.loaded)
+	}
+	for path, want := range map[string]string{
+		filepath.Join(site, "index.html"):        "<h1>hello</h1>",
+		filepath.Join(site, "assets", "app.css"): "body{}",
+		filepath.Join(site, "tls", "inner.crt"):  "inner",
+		filepath.Join(certs, "site.crt"):         "certificate",
+		filepath.Join(certs, "site.key"):         "key",
+	} {
+		if got := readTestFile(t, filepath.Join(restoredRoot, path)); got != want {
+			t.Errorf("%v = %q, want %q", path, got, want)
+		}
+	}
+
+	restoredDB, err := sql.Open("sqlite3", databasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restoredDB.Close()
+	var domain, root string
+	err = restoredDB.QueryRow(`select d.domain, o.value from apps a
+		join domains d on d.app_id = a.id
+		join app_options o on o.app_id = a.id and o.name = 'root'
+		where a.name = 'site'`).Scan(&domain, &root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domain != "site.example.com" || root != site {
+		t.Errorf("restored app has %v and root %v", domain, root)
+	}
+
+	t.Run("refuses a database in use", func(t *testing.T) {
+		_, _, err := Restore(bytes.NewReader(archive.Bytes()), databasePath, RestoreOptions{FilesRoot: restoredRoot, SkipCaddy: true})
+		if err == nil || !strings.Contains(err.Error(), "already has 1 apps and 1 users") {
+			t.Fatalf("error = %v", err)
+		}
+	})
+
+	t.Run("keeps existing files", func(t *testing.T) {
+		writeTestFile(t, filepath.Join(restoredRoot, site, "index.html"), "changed")
+		_, warnings, err := Restore(bytes.NewReader(archive.Bytes()), filepath.Join(t.TempDir(), "data.sqlite3"), RestoreOptions{FilesRoot: restoredRoot, SkipCaddy: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(warnings) != 5 {
+			t.Errorf("warnings = %q, want one per existing file", warnings)
+		}
+		if got := readTestFile(t, filepath.Join(restoredRoot, site, "index.html")); got != "changed" {
+			t.Errorf("index.html was overwritten with %q", got)
+		}
+	})
+
+	t.Run("not a backup", func(t *testing.T) {
+		_, _, err := Restore(strings.NewReader("hello"), filepath.Join(t.TempDir(), "data.sqlite3"), RestoreOptions{SkipCaddy: true})
+		if err == nil || !strings.Contains(err.Error(), "not a caddy-ui backup") {
+			t.Fatalf("error = %v", err)
+		}
+	})
+}
+
+func TestWriteWithoutCaddy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	server.Close()
+	useCaddy(t, server.URL)
+	db := sourceDatabase(t, t.TempDir())
+
+	archive := &bytes.Buffer{}
+	manifest, warnings, err := Write(context.Background(), db, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.CaddyConfig || len(warnings) != 1 {
+		t.Errorf("caddy_config = %v, warnings = %q", manifest.CaddyConfig, warnings)
+	}
+
+	// nothing to load into caddy, the restore doesn't call it
+	restored, _, err := Restore(bytes.NewReader(archive.Bytes()), filepath.Join(t.TempDir(), "data.sqlite3"), RestoreOptions{FilesRoot: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.CaddyConfig {
+		t.Error("restored manifest lists caddy's config")
+	}
+}
+
+func TestPruneGoesByName(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	dir := t.TempDir()
+	target := NewTarget(config.BackupTarget{Dir: dir})
+
+	// the modification time is what a copy (or a restore of the
+	// directory) leaves, the name is when the backup was taken
+	files := []struct {
+		name     string
+		modified time.Time
+	}{
+		{Filename(now), now},
+		{Filename(now.Add(-10 * day)), now},
+		{Filename(now.Add(-day)), now.Add(-30 * day)},
+		{"caddy-ui-manual.tar.gz", now.Add(-30 * day)},
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+		if err := os.WriteFile(path, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, file.modified, file.modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pruned, err := Prune(context.Background(), target, Retention{MaxAge: 7 * day}, files[0].name, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "caddy-ui-manual.tar.gz," + files[1].name
+	if got := strings.Join(pruned, ","); got != want {
+		t.Errorf("pruned %v, want %v", got, want)
+	}
+}
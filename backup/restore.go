@@ -0,0 +1,268 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/barelyhuman/caddy-ui/caddy"
+	"github.com/barelyhuman/caddy-ui/migrate"
+)
+
+// limit for the manifest and caddy's config, both are read in memory
+const maxEntrySize = 64 << 20
+
+type RestoreOptions struct {
+	// FilesRoot is prepended to the paths of the saved files, empty puts
+	// them back where they were
+	FilesRoot string
+	// SkipCaddy doesn't load the saved config into caddy
+	SkipCaddy bool
+}
+
+// Restore checks the archive and re-applies it: the snapshot becomes
+// the database at databasePath, caddy's config is loaded and the files
+// are written back. The instance must be empty (no apps and no users)
+// and the server stopped. Nothing is changed until the whole archive has
+// been read and checked, files that already exist are kept and returned
+// as warnings
+func Restore(r io.Reader, databasePath string, opts RestoreOptions) (*Manifest, []string, error) {
+	if err := checkEmpty(databasePath); err != nil {
+		return nil, nil, err
+	}
+
+	staging, err := os.MkdirTemp(filepath.Dir(databasePath), ".caddy-ui-restore-")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	manifest, caddyConfig, err := extract(r, staging)
+	if err != nil {
+		return nil, nil, err
+	}
+	snapshot := filepath.Join(staging, databaseName)
+	if err := checkSnapshot(snapshot); err != nil {
+		return nil, nil, err
+	}
+
+	// caddy goes first, a config it refuses leaves the instance as it was
+	if manifest.CaddyConfig && !opts.SkipCaddy {
+		if err := caddy.SaveConfig(caddyConfig); err != nil {
+			return nil, nil, fmt.Errorf("caddy refused the saved config, nothing was restored: %w", err)
+		}
+	}
+
+	for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+		if err := os.Remove(databasePath + suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, err
+		}
+	}
+	if err := os.Rename(snapshot, databasePath); err != nil {
+		return nil, nil, fmt.Errorf("failed to move the database in place: %w", err)
+	}
+
+	warnings, err := restoreFiles(filepath.Join(staging, filesDir), opts.FilesRoot)
+	if err != nil {
+		return manifest, warnings, fmt.Errorf("the database was restored but not every file: %w", err)
+	}
+	return manifest, warnings, nil
+}
+
+// checkEmpty refuses to restore over a database that has apps or users,
+// a missing file or a freshly migrated one is fine
+func checkEmpty(databasePath string) error {
+	if _, err := os.Stat(databasePath); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	db, err := sql.Open("sqlite3", "file:"+databasePath+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	counts := []string{}
+	for _, table := range []string{"apps", "users"} {
+		var count int
+		err := db.QueryRow("select count(*) from " + table).Scan(&count)
+		if err != nil && strings.Contains(err.Error(), "no such table") {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to check %v: %w", databasePath, err)
+		}
+		if count > 0 {
+			counts = append(counts, fmt.Sprintf("%v %v", count, table))
+		}
+	}
+	if len(counts) > 0 {
+		return fmt.Errorf("%v already has %v, restores only go to an empty instance", databasePath, strings.Join(counts, " and "))
+	}
+	return nil
+}
+
+// extract reads the whole archive into staging, the manifest has to come
+// first and be of a version this build knows
+func extract(r io.Reader, staging string) (*Manifest, []byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("not a caddy-ui backup: %w", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	header, err := tr.Next()
+	if err != nil || header.Name != manifestName {
+		return nil, nil, errors.New("not a caddy-ui backup: the archive doesn't start with a manifest")
+	}
+	manifest := &Manifest{}
+	if err := json.NewDecoder(io.LimitReader(tr, maxEntrySize)).Decode(manifest); err != nil {
+		return nil, nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if manifest.Version != Version {
+		return nil, nil, fmt.Errorf("backup version %v isn't supported, this build restores version %v", manifest.Version, Version)
+	}
+
+	var caddyConfig []byte
+	hasDatabase := false
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read the archive: %w", err)
+		}
+
+		switch {
+		case header.Name == databaseName:
+			if err := extractFile(tr, filepath.Join(staging, databaseName), 0o600); err != nil {
+				return nil, nil, err
+			}
+			hasDatabase = true
+		case header.Name == caddyName:
+			caddyConfig, err = io.ReadAll(io.LimitReader(tr, maxEntrySize))
+			if err != nil {
+				return nil, nil, err
+			}
+		case strings.HasPrefix(header.Name, filesDir+"/"):
+			// cleaning from the root keeps `..` from leaving the staging
+			// directory
+			name := path.Clean("/" + strings.TrimPrefix(header.Name, filesDir+"/"))
+			target := filepath.Join(staging, filesDir, filepath.FromSlash(name))
+			switch header.Typeflag {
+			case tar.TypeDir:
+				if err := os.MkdirAll(target, 0o755); err != nil {
+					return nil, nil, err
+				}
+			case tar.TypeReg:
+				if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+					return nil, nil, err
+				}
+				if err := extractFile(tr, target, fs.FileMode(header.Mode).Perm()); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+
+	if !hasDatabase {
+		return nil, nil, errors.New("the backup has no database")
+	}
+	if manifest.CaddyConfig && caddyConfig == nil {
+		return nil, nil, errors.New("the manifest lists caddy's config but the backup doesn't have it")
+	}
+	return manifest, caddyConfig, nil
+}
+
+func extractFile(r io.Reader, target string, mode fs.FileMode) error {
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// checkSnapshot makes sure the database isn't corrupt and wasn't written
+// by a newer version, then brings an older schema up to date
+func checkSnapshot(snapshot string) error {
+	db, err := sql.Open("sqlite3", snapshot)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var integrity string
+	if err := db.QueryRow("pragma integrity_check").Scan(&integrity); err != nil {
+		return fmt.Errorf("the saved database can't be read: %w", err)
+	}
+	if integrity != "ok" {
+		return fmt.Errorf("the saved database is corrupt: %v", integrity)
+	}
+
+	source := migrate.Source(db, "")
+	unknown, err := migrate.Unknown(db, source)
+	if err != nil {
+		return err
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("the backup comes from a newer caddy-ui (migrations %v), upgrade first", strings.Join(unknown, ", "))
+	}
+	if err := migrate.MigrateUp(db, source); err != nil {
+		return fmt.Errorf("failed to migrate the saved database: %w", err)
+	}
+	return nil
+}
+
+// restoreFiles copies the staged files under root, existing files are
+// never overwritten
+func restoreFiles(staged string, root string) ([]string, error) {
+	warnings := []string{}
+	if _, err := os.Stat(staged); errors.Is(err, fs.ErrNotExist) {
+		return warnings, nil
+	}
+	if len(root) == 0 {
+		root = string(filepath.Separator)
+	}
+	err := filepath.WalkDir(staged, func(current string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(staged, current)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(root, rel)
+		if entry.IsDir() {
+			return os.MkdirAll(target, 0o755)
+		}
+		if _, err := os.Lstat(target); err == nil {
+			warnings = append(warnings, fmt.Sprintf("%v already exists, it was kept", target))
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		source, err := os.Open(current)
+		if err != nil {
+			return err
+		}
+		defer source.Close()
+		return extractFile(source, target, info.Mode().Perm())
+	})
+	return warnings, err
+}
@@ -0,0 +1,252 @@
+package backup
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/barelyhuman/caddy-ui/config"
+)
+
+// bucketTarget talks to an S3 compatible API (AWS, MinIO, R2...) with
+// signature v4, only the three calls backups need are implemented
+type bucketTarget struct {
+	bucket config.BackupBucket
+	// now is replaced to sign with a fixed date
+	now func() time.Time
+}
+
+func (b *bucketTarget) String() string {
+	return fmt.Sprintf("%v/%v/%v", b.bucket.Endpoint, b.bucket.Bucket, b.bucket.Prefix)
+}
+
+func (b *bucketTarget) key(name string) string {
+	if len(b.bucket.Prefix) == 0 {
+		return name
+	}
+	return path.Join(b.bucket.Prefix, name)
+}
+
+func (b *bucketTarget) Put(ctx context.Context, name string, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	resp, err := b.do(ctx, http.MethodPut, b.key(name), nil, f, size, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type listResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (b *bucketTarget) List(ctx context.Context) ([]Stored, error) {
+	prefix := ""
+	if len(b.bucket.Prefix) > 0 {
+		prefix = strings.TrimSuffix(b.bucket.Prefix, "/") + "/"
+	}
+	stored := []Stored{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if len(token) > 0 {
+			query.Set("continuation-token", token)
+		}
+		resp, err := b.do(ctx, http.MethodGet, "", query, nil, 0, emptyHash)
+		if err != nil {
+			return nil, err
+		}
+		var result listResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid list response from %v: %w", b, err)
+		}
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, prefix)
+			// objects in "sub directories" of the prefix aren't ours
+			if strings.Contains(name, "/") || !isArchive(name) {
+				continue
+			}
+			stored = append(stored, Stored{Name: name, CreatedAt: object.LastModified})
+		}
+		if !result.IsTruncated || len(result.NextContinuationToken) == 0 {
+			return stored, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (b *bucketTarget) Delete(ctx context.Context, name string) error {
+	resp, err := b.do(ctx, http.MethodDelete, b.key(name), nil, nil, 0, emptyHash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// sha256 of an empty body
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// do sends a signed request, key is empty for requests on the bucket
+// itself. Anything but a 2xx is an error with the body S3 sent back
+func (b *bucketTarget) do(ctx context.Context, method string, key string, query url.Values, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	endpoint, err := url.Parse(b.bucket.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	objectPath := "/" + b.bucket.Bucket
+	if len(key) > 0 {
+		objectPath += "/" + key
+	}
+	target := *endpoint
+	target.Path = objectPath
+	target.RawPath = encodePath(objectPath)
+	target.RawQuery = encodeQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	b.sign(req, payloadHash)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("%v %v failed with %v: %s", method, objectPath, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
+
+// sign adds the AWS signature v4 headers, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (b *bucketTarget) sign(req *http.Request, payloadHash string) {
+	now := time.Now
+	if b.now != nil {
+		now = b.now
+	}
+	timestamp := now().UTC()
+	amzDate := timestamp.Format("20060102T150405Z")
+	day := timestamp.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signed := []string{"host"}
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			signed = append(signed, lower)
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	sort.Strings(signed)
+	canonicalHeaders := ""
+	for _, name := range signed {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + b.bucket.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+b.bucket.SecretKey), day)
+	key = hmacSHA256(key, b.bucket.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		b.bucket.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, value string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// uriEncode escapes everything but the unreserved characters, the way
+// signature v4 wants it (url.QueryEscape turns spaces into +)
+func uriEncode(value string) string {
+	var sb strings.Builder
+	for _, c := range []byte(value) {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+func encodePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = uriEncode(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// encodeQuery sorts by key, which is both a valid query string and the
+// canonical one
+func encodeQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, uriEncode(key)+"="+uriEncode(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
@@ -0,0 +1,392 @@
+package backup
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/barelyhuman/caddy-ui/config"
+)
+
+type s3Object struct {
+	body     []byte
+	modified time.Time
+}
+
+// fakeS3 is a bucket behind a path style S3 API, it checks the
+// signature v4 of every request the way S3 does and lists two objects
+// per page so the pagination is used
+type fakeS3 struct {
+	t         *testing.T
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+
+	mu      sync.Mutex
+	objects map[string]s3Object
+	now     time.Time
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{
+		t:         t,
+		bucket:    "backups",
+		region:    "eu-west-1",
+		accessKey: "AKIDEXAMPLE",
+		secretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		objects:   map[string]s3Object{},
+		now:       time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC),
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		f.fail(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if err := f.verify(r, body); err != nil {
+		f.fail(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		f.fail(w, http.StatusNotFound, "NoSuchBucket", bucket)
+		return
+	}
+	switch {
+	case r.Method == http.MethodPut && len(key) > 0:
+		f.objects[key] = s3Object{body: body, modified: f.now}
+	case r.Method == http.MethodDelete && len(key) > 0:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && len(key) == 0 && r.URL.Query().Get("list-type") == "2":
+		f.list(w, r.URL.Query())
+	default:
+		f.fail(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method+" "+r.URL.Path)
+	}
+}
+
+type s3ListResult struct {
+	XMLName  xml.Name `xml:"ListBucketResult"`
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken,omitempty"`
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	keys := []string{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, query.Get("prefix")) && key > query.Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	result := s3ListResult{}
+	if len(keys) > 2 {
+		keys = keys[:2]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[1]
+	}
+	for _, key := range keys {
+		result.Contents = append(result.Contents, struct {
+			Key          string    `xml:"Key"`
+			LastModified time.Time `xml:"LastModified"`
+		}{key, f.objects[key].modified})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeS3) fail(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%v</Code><Message>%v</Message></Error>", code, message)
+}
+
+// verify recomputes the signature from the request as it was received
+func (f *fakeS3) verify(r *http.Request, body []byte) error {
+	credential, signedHeaders, signature, err := parseAuthorization(r.Header.Get("Authorization"))
+	if err != nil {
+		return err
+	}
+	amzDate := r.Header.Get("x-amz-date")
+	if len(amzDate) != len("20060102T150405Z") {
+		return fmt.Errorf("x-amz-date %q is invalid", amzDate)
+	}
+	day := amzDate[:8]
+	scope := day + "/" + f.region + "/s3/aws4_request"
+	if credential != f.accessKey+"/"+scope {
+		return fmt.Errorf("credential %q, want %v/%v", credential, f.accessKey, scope)
+	}
+	bodyHash := sha256.Sum256(body)
+	if r.Header.Get("x-amz-content-sha256") != hex.EncodeToString(bodyHash[:]) {
+		return errors.New("x-amz-content-sha256 doesn't match the body")
+	}
+	for _, required := range []string{"host", "x-amz-content-sha256", "x-amz-date"} {
+		if !strings.Contains(";"+signedHeaders+";", ";"+required+";") {
+			return fmt.Errorf("%v isn't signed", required)
+		}
+	}
+
+	canonicalHeaders := ""
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders += name + ":" + strings.TrimSpace(value) + "\n"
+	}
+	canonicalPath, _, _ := strings.Cut(r.RequestURI, "?")
+	query, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := []string{}
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, awsEscape(name)+"="+awsEscape(value))
+		}
+	}
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		canonicalPath,
+		strings.Join(pairs, "&"),
+		canonicalHeaders,
+		signedHeaders,
+		r.Header.Get("x-amz-content-sha256"),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := []byte("AWS4" + f.secretKey)
+	for _, part := range []string{day, f.region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	if hex.EncodeToString(key) != signature {
+		return fmt.Errorf("signature doesn't match for %q", canonicalRequest)
+	}
+	return nil
+}
+
+func parseAuthorization(header string) (credential, signedHeaders, signature string, err error) {
+	fields, found := strings.CutPrefix(header, "AWS4-HMAC-SHA256 ")
+	if !found {
+		return "", "", "", fmt.Errorf("authorization %q isn't signature v4", header)
+	}
+	for _, field := range strings.Split(fields, ", ") {
+		name, value, _ := strings.Cut(field, "=")
+		switch name {
+		case "Credential":
+			credential = value
+		case "SignedHeaders":
+			signedHeaders = value
+		case "Signature":
+			signature = value
+		}
+	}
+	if len(credential) == 0 || len(signedHeaders) == 0 || len(signature) == 0 {
+		return "", "", "", fmt.Errorf("authorization %q is incomplete", header)
+	}
+	return credential, signedHeaders, signature, nil
+}
+
+// awsEscape is url.QueryEscape with spaces as %20, which leaves only
+// the unreserved characters as they are
+func awsEscape(value string) string {
+	return strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+}
+
+func (f *fakeS3) put(key string, body string, modified time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = s3Object{body: []byte(body), modified: modified}
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := []string{}
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) target(server *httptest.Server, prefix string) Target {
+	parsed, err := config.ParseBackupTarget(fmt.Sprintf("s3+http://%v:%v@%v/%v/%v?region=%v",
+		f.accessKey, url.QueryEscape(f.secretKey), strings.TrimPrefix(server.URL, "http://"), f.bucket, prefix, f.region))
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return NewTarget(parsed)
+}
+
+func TestBucketTarget(t *testing.T) {
+	fake, server := newFakeS3(t)
+	// a space and a + in the prefix have to be escaped the same way when
+	// sending and signing
+	target := fake.target(server, "prod+eu/caddy ui")
+	ctx := context.Background()
+
+	archive := filepath.Join(t.TempDir(), "archive.tar.gz")
+	if err := os.WriteFile(archive, []byte("archive contents"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for i := 0; i < 3; i++ {
+		name := Filename(fake.now.Add(time.Duration(i) * time.Hour))
+		if err := target.Put(ctx, name, archive); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if got := string(fake.objects["prod+eu/caddy ui/"+names[0]].body); got != "archive contents" {
+		t.Errorf("stored %q", got)
+	}
+	// not backups of this target
+	fake.put("prod+eu/caddy ui/notes.txt", "", fake.now)
+	fake.put("prod+eu/caddy ui/old/"+names[0], "", fake.now)
+	fake.put("prod+eu/other/"+names[0], "", fake.now)
+
+	stored, err := target.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, s := range stored {
+		got = append(got, s.Name)
+		if !s.CreatedAt.Equal(fake.now) {
+			t.Errorf("%v was created at %v, want %v", s.Name, s.CreatedAt, fake.now)
+		}
+	}
+	if strings.Join(got, ",") != strings.Join(names, ",") {
+		t.Errorf("listed %v, want %v", got, names)
+	}
+
+	if err := target.Delete(ctx, names[1]); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"prod+eu/caddy ui/" + names[0],
+		"prod+eu/caddy ui/" + names[2],
+		"prod+eu/caddy ui/notes.txt",
+		"prod+eu/caddy ui/old/" + names[0],
+		"prod+eu/other/" + names[0],
+	}
+	if got := fake.keys(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("bucket has %q, want %q", got, want)
+	}
+
+	t.Run("without a prefix", func(t *testing.T) {
+		target := fake.target(server, "")
+		name := Filename(fake.now.Add(-time.Hour))
+		if err := target.Put(ctx, name, archive); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := target.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stored) != 1 || stored[0].Name != name {
+			t.Errorf("listed %+v, want only %v", stored, name)
+		}
+		if err := target.Delete(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("wrong secret", func(t *testing.T) {
+		parsed := *target.(*bucketTarget)
+		parsed.bucket.SecretKey = "not the secret"
+		err := parsed.Put(ctx, names[0], archive)
+		if err == nil || !strings.Contains(err.Error(), "403 Forbidden") || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+			t.Errorf("error = %v", err)
+		}
+		if _, err := parsed.List(ctx); err == nil {
+			t.Error("listed with the wrong secret")
+		}
+	})
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	tests := []struct {
+		name      string
+		retention Retention
+		// ages of the archives, the newest is the one just written
+		ages []time.Duration
+		want []int
+	}{
+		{"no limit", Retention{}, []time.Duration{0, day, 60 * day}, []int{}},
+		{"keep", Retention{Keep: 2}, []time.Duration{0, day, 2 * day, 3 * day}, []int{2, 3}},
+		{"max age", Retention{MaxAge: 7 * day}, []time.Duration{0, 6 * day, 8 * day}, []int{2}},
+		{"both", Retention{Keep: 3, MaxAge: 7 * day}, []time.Duration{0, day, 8 * day, 9 * day, 10 * day}, []int{2, 3, 4}},
+		{"keeps the new one", Retention{Keep: 1, MaxAge: time.Hour}, []time.Duration{2 * time.Hour, 3 * time.Hour}, []int{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, server := newFakeS3(t)
+			target := fake.target(server, "caddy")
+			names := []string{}
+			for _, age := range tt.ages {
+				name := Filename(now.Add(-age))
+				fake.put("caddy/"+name, "", now.Add(-age))
+				names = append(names, name)
+			}
+
+			pruned, err := Prune(context.Background(), target, tt.retention, names[0], now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{}
+			for _, i := range tt.want {
+				want = append(want, names[i])
+			}
+			if strings.Join(pruned, ",") != strings.Join(want, ",") {
+				t.Errorf("pruned %v, want %v", pruned, want)
+			}
+			stored, err := target.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stored) != len(names)-len(want) {
+				t.Errorf("%v archives left, want %v", len(stored), len(names)-len(want))
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/barelyhuman/caddy-ui/config"
+	"github.com/barelyhuman/caddy-ui/cron"
+)
+
+// Retention is how many automatic backups are kept, zero values don't
+// limit anything
+type Retention struct {
+	Keep   int
+	MaxAge time.Duration
+}
+
+// RetentionFromConfig reads backup_keep and backup_max_age, they were
+// checked when the config was loaded
+func RetentionFromConfig(c config.Config) Retention {
+	keep, _ := strconv.Atoi(c.BackupKeep)
+	maxAge, _ := config.ParseAge(c.BackupMaxAge)
+	return Retention{Keep: keep, MaxAge: maxAge}
+}
+
+// Result is one automatic backup
+type Result struct {
+	Name     string
+	Warnings []string
+	// Pruned are the older archives removed after this one was stored
+	Pruned []string
+}
+
+// Run writes a backup to target and prunes the old ones, the new archive
+// is never pruned. A failed prune is an error too, the backup itself is
+// stored by then
+func Run(ctx context.Context, db *sql.DB, target Target, retention Retention) (*Result, error) {
+	f, err := os.CreateTemp("", "caddy-ui-backup-*.tar.gz")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+
+	manifest, warnings, err := Write(ctx, db, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{Name: Filename(manifest.CreatedAt), Warnings: warnings}
+	if err := target.Put(ctx, result.Name, f.Name()); err != nil {
+		return nil, fmt.Errorf("failed to store %v in %v: %w", result.Name, target, err)
+	}
+
+	result.Pruned, err = Prune(ctx, target, retention, result.Name, time.Now())
+	if err != nil {
+		return result, fmt.Errorf("%v was stored but pruning %v failed: %w", result.Name, target, err)
+	}
+	return result, nil
+}
+
+// Prune removes the archives beyond retention.Keep (newest first) and
+// the ones older than retention.MaxAge, except keep which was just
+// written. The age comes from the name, the time the target reports is
+// only used for archives named some other way
+func Prune(ctx context.Context, target Target, retention Retention, keep string, now time.Time) ([]string, error) {
+	stored, err := target.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// the names sort by creation time, the modification time of a copied
+	// file can't be trusted as much
+	sort.Slice(stored, func(i, j int) bool { return stored[i].Name > stored[j].Name })
+
+	pruned := []string{}
+	for i, archive := range stored {
+		if archive.Name == keep {
+			continue
+		}
+		tooMany := retention.Keep > 0 && i >= retention.Keep
+		created, ok := filenameTime(archive.Name)
+		if !ok {
+			created = archive.CreatedAt
+		}
+		tooOld := retention.MaxAge > 0 && now.Sub(created) > retention.MaxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := target.Delete(ctx, archive.Name); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, archive.Name)
+	}
+	return pruned, nil
+}
+
+// Status is what the home page shows about automatic backups
+type Status struct {
+	Enabled  bool
+	Schedule string
+	Target   string
+	Next     time.Time
+	LastRun  time.Time
+	LastName string
+	// LastError is set when the last run failed, cleared by the next one
+	// that works
+	LastError string
+	// Failures counts the runs that failed in a row
+	Failures int
+}
+
+var (
+	statusLock sync.Mutex
+	status     Status
+)
+
+// CurrentStatus returns the state of the scheduler, Enabled is false
+// when no schedule is configured
+func CurrentStatus() Status {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	return status
+}
+
+func updateStatus(fn func(s *Status)) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	fn(&status)
+}
+
+// Schedule runs automatic backups from backup_schedule until ctx is
+// done, it returns right away when no schedule is configured. A failed
+// run is logged and kept in the status, the next one still happens on
+// time
+func Schedule(ctx context.Context, db *sql.DB) error {
+	c := config.Get()
+	if len(c.BackupSchedule) == 0 {
+		return nil
+	}
+	schedule, err := cron.Parse(c.BackupSchedule)
+	if err != nil {
+		return err
+	}
+	parsed, err := config.ParseBackupTarget(c.BackupTarget)
+	if err != nil {
+		return err
+	}
+	if len(parsed.Dir) == 0 && parsed.Bucket == nil {
+		return errors.New("backup_target is required with backup_schedule")
+	}
+	target := NewTarget(parsed)
+	retention := RetentionFromConfig(c)
+
+	next := schedule.Next(time.Now())
+	if next.IsZero() {
+		return fmt.Errorf("backup_schedule %q never fires", c.BackupSchedule)
+	}
+	updateStatus(func(s *Status) {
+		s.Enabled = true
+		s.Schedule = c.BackupSchedule
+		s.Target = target.String()
+		s.Next = next
+	})
+	log.Printf("automatic backups to %v, next at %v", target, next.Format(time.RFC3339))
+
+	go func() {
+		for {
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			result, err := Run(ctx, db, target, retention)
+			next = schedule.Next(time.Now())
+			updateStatus(func(s *Status) {
+				s.LastRun = time.Now()
+				s.Next = next
+				if result != nil {
+					s.LastName = result.Name
+				}
+				if err != nil {
+					s.LastError = err.Error()
+					s.Failures++
+				} else {
+					s.LastError = ""
+					s.Failures = 0
+				}
+			})
+			if err != nil {
+				log.Printf("automatic backup failed: %v", err)
+			} else {
+				for _, warning := range result.Warnings {
+					log.Printf("automatic backup %v: %v", result.Name, warning)
+				}
+				log.Printf("automatic backup %v stored, %v pruned", result.Name, len(result.Pruned))
+			}
+			if next.IsZero() {
+				return
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,99 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/barelyhuman/caddy-ui/config"
+)
+
+// Stored is an archive kept by a Target
+type Stored struct {
+	Name string
+	// CreatedAt is when the target got the archive (the modification
+	// time of a file, which a copy resets), Prune prefers the time in
+	// the name
+	CreatedAt time.Time
+}
+
+// Target keeps the archives of automatic backups
+type Target interface {
+	// Put uploads the archive at path under name
+	Put(ctx context.Context, name string, path string) error
+	// List returns the archives, only the ones named like Filename
+	List(ctx context.Context) ([]Stored, error)
+	Delete(ctx context.Context, name string) error
+	// String describes the target without its secrets, for messages
+	String() string
+}
+
+// NewTarget opens the directory or the bucket of the config
+func NewTarget(target config.BackupTarget) Target {
+	if target.Bucket != nil {
+		return &bucketTarget{bucket: *target.Bucket}
+	}
+	return dirTarget(target.Dir)
+}
+
+// isArchive keeps other files sharing the target out of the retention
+func isArchive(name string) bool {
+	return strings.HasPrefix(name, "caddy-ui-") && strings.HasSuffix(name, ".tar.gz")
+}
+
+// dirTarget is a local directory, ex: a mounted network share
+type dirTarget string
+
+func (d dirTarget) String() string {
+	return string(d)
+}
+
+func (d dirTarget) Put(ctx context.Context, name string, path string) error {
+	if err := os.MkdirAll(string(d), 0o700); err != nil {
+		return err
+	}
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	// written under a temporary name first so a partial archive never
+	// looks like a backup
+	partial := filepath.Join(string(d), "."+name+".partial")
+	if err := extractFile(source, partial, 0o600); err != nil {
+		os.Remove(partial)
+		return err
+	}
+	return os.Rename(partial, filepath.Join(string(d), name))
+}
+
+func (d dirTarget) List(ctx context.Context) ([]Stored, error) {
+	entries, err := os.ReadDir(string(d))
+	if errors.Is(err, fs.ErrNotExist) {
+		return []Stored{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	stored := []Stored{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !isArchive(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		stored = append(stored, Stored{Name: entry.Name(), CreatedAt: info.ModTime()})
+	}
+	return stored, nil
+}
+
+func (d dirTarget) Delete(ctx context.Context, name string) error {
+	return os.Remove(filepath.Join(string(d), name))
+}
@@ -5,16 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 
-	"github.com/barelyhuman/go/env"
+	"github.com/barelyhuman/caddy-ui/config"
 )
 
 func getCaddyURL(path string) (string, error) {
-	baseURL := env.Get("CADDY_URL", "http://localhost:2019")
-	return url.JoinPath(baseURL, path)
+	return url.JoinPath(config.Get().CaddyURL, path)
 }
 
 type AdminConfig struct {
@@ -22,45 +20,64 @@ type AdminConfig struct {
 	Listen        string   `json:"listen,omitempty"`
 	EnforceOrigin bool     `json:"enforce_origin,omitempty"`
 	Origins       []string `json:"origins,omitempty"`
+	Extra         Extra    `json:"-"`
 }
 
 // tiny subset of the caddy config to avoid bundling the entire
-// caddy package as a dep
+// caddy package as a dep, what isn't modelled is kept in Extra
 type Config struct {
 	Admin *AdminConfig `json:"admin,omitempty"`
 	Apps  *AppConfig   `json:"apps,omitempty"`
+	Extra Extra        `json:"-"`
 }
 
 type ListenAddresses []string
 
 type Upstream struct {
-	Dial string `json:"dial"`
+	Dial  string `json:"dial"`
+	Extra Extra  `json:"-"`
 }
 
 type HandleDef struct {
-	Handler   string     `json:"handler,omitempty"`
-	Upstreams []Upstream `json:"upstreams,omitempty"`
-	Routes    []Route    `json:"routes,omitempty"`
+	Handler    string              `json:"handler,omitempty"`
+	Upstreams  []Upstream          `json:"upstreams,omitempty"`
+	Routes     []Route             `json:"routes,omitempty"`
+	Root       string              `json:"root,omitempty"`
+	StatusCode StatusCode          `json:"status_code,omitempty"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	Body       string              `json:"body,omitempty"`
+	Extra      Extra               `json:"-"`
 }
+
 type Match struct {
-	Host []string `json:"host,omitempty"`
+	Host  []string `json:"host,omitempty"`
+	Path  []string `json:"path,omitempty"`
+	Extra Extra    `json:"-"`
 }
 
 type Route struct {
 	Handle   []HandleDef `json:"handle,omitempty"`
 	Match    []Match     `json:"match,omitempty"`
 	Terminal bool        `json:"terminal,omitempty"`
+	Extra    Extra       `json:"-"`
+	// raw is the route as caddy sent it
+	raw json.RawMessage
 }
 
 type Server struct {
 	Listen ListenAddresses `json:"listen,omitempty"`
 	Routes []Route         `json:"routes,omitempty"`
+	Extra  Extra           `json:"-"`
+}
+
+type HTTPApp struct {
+	Servers ServersConfig `json:"servers,omitempty"`
+	Extra   Extra         `json:"-"`
 }
 
 type AppConfig struct {
-	HTTP struct {
-		Servers ServersConfig `json:"servers,omitempty"`
-	} `json:"http,omitempty"`
+	HTTP  HTTPApp `json:"http,omitempty"`
+	Extra Extra   `json:"-"`
 }
 
 type ServersConfig map[string]Server
@@ -72,18 +89,8 @@ func SaveConfig(fullConfig []byte) error {
 		return err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusBadRequest {
-		var errorMessage struct {
-			Error string `json:"error"`
-		}
-		err := json.NewDecoder(resp.Body).Decode(&errorMessage)
-		if err != nil {
-			log.Println("error decoding", err)
-		}
-		fmt.Printf("errorMessage: %v\n", errorMessage)
-		if len(errorMessage.Error) > 0 {
-			return fmt.Errorf("%v", errorMessage.Error)
-		}
+	if !succeeded(resp) {
+		return apiError(resp)
 	}
 	return nil
 }
@@ -106,9 +113,9 @@ func SaveServersConfig(config ServersConfig) error {
 	}
 
 	defer resp.Body.Close()
-	v, _ := io.ReadAll(resp.Body)
-	fmt.Printf("v: %v\n", string(v))
-
+	if !succeeded(resp) {
+		return apiError(resp)
+	}
 	return nil
 }
 
@@ -129,7 +136,13 @@ func GetServersConfig() (ServersConfig, error) {
 	}
 	defer resp.Body.Close()
 
-	json.NewDecoder(resp.Body).Decode(&config)
+	if !succeeded(resp) {
+		return nil, apiError(resp)
+	}
+	// a config that can't be read must not be saved back as empty
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid servers config from caddy: %w", err)
+	}
 	return config, nil
 }
 
@@ -150,10 +163,73 @@ func GetConfigAtPath(path string) (json.RawMessage, error) {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return config, apiError(resp)
+	}
+
 	json.NewDecoder(resp.Body).Decode(&config)
 	return config, nil
 }
 
+// UpdateConfigAtPath changes a single subtree of the config, method
+// follows the admin API semantics: PUT creates (or inserts into an
+// array), PATCH replaces, DELETE removes and value is ignored
+func UpdateConfigAtPath(method, path string, value []byte) error {
+	switch method {
+	case http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		return fmt.Errorf("unsupported method %v", method)
+	}
+
+	result, err := url.JoinPath("/config/", path)
+	if err != nil {
+		return err
+	}
+	url, err := getCaddyURL(result)
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader
+	if method != http.MethodDelete {
+		body = bytes.NewReader(value)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return apiError(resp)
+	}
+	return nil
+}
+
+func succeeded(resp *http.Response) bool {
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+// apiError reads the `{"error": ""}` body the admin API responds with
+func apiError(resp *http.Response) error {
+	var errorMessage struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&errorMessage)
+	if len(errorMessage.Error) > 0 {
+		return fmt.Errorf("%v", errorMessage.Error)
+	}
+	return fmt.Errorf("caddy responded with status %v", resp.StatusCode)
+}
+
 func GetFullConfig() (Config, error) {
 	var fullConfig Config
 	url, err := getCaddyURL("/config/")
@@ -175,3 +251,37 @@ func GetFullConfig() (Config, error) {
 
 	return fullConfig, nil
 }
+
+type AdaptWarning struct {
+	File      string `json:"file,omitempty"`
+	Line      int    `json:"line,omitempty"`
+	Directive string `json:"directive,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+type AdaptResult struct {
+	Result   json.RawMessage `json:"result"`
+	Warnings []AdaptWarning  `json:"warnings,omitempty"`
+}
+
+// Adapt converts a Caddyfile to JSON using the admin API, the result is
+// not loaded, that's left to SaveConfig
+func Adapt(caddyfile []byte) (AdaptResult, error) {
+	var result AdaptResult
+	url, err := getCaddyURL("/adapt")
+	if err != nil {
+		return result, err
+	}
+	resp, err := http.Post(url, "text/caddyfile", bytes.NewReader(caddyfile))
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return result, apiError(resp)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	return result, err
+}
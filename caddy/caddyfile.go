@@ -0,0 +1,75 @@
+package caddy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Site is a set of hosts and the handlers that serve them, it maps to a
+// single site block in a Caddyfile
+type Site struct {
+	Hosts  []string
+	Handle []HandleDef
+}
+
+// FormatCaddyfile renders the sites as Caddyfile site blocks, only the
+// handlers that caddy-ui generates have an equivalent directive, others
+// are written out as comments so nothing is silently dropped
+func FormatCaddyfile(sites []Site) string {
+	var out strings.Builder
+	for i, site := range sites {
+		if i > 0 {
+			out.WriteString("\n")
+		}
+		out.WriteString(strings.Join(site.Hosts, ", "))
+		out.WriteString(" {\n")
+		for _, directive := range directives(site.Handle) {
+			out.WriteString("\t" + directive + "\n")
+		}
+		out.WriteString("}\n")
+	}
+	return out.String()
+}
+
+func directives(handles []HandleDef) []string {
+	lines := []string{}
+	for _, h := range handles {
+		switch h.Handler {
+		case "subroute":
+			for _, route := range h.Routes {
+				lines = append(lines, directives(route.Handle)...)
+			}
+		case "reverse_proxy":
+			dials := []string{}
+			for _, u := range h.Upstreams {
+				dials = append(dials, u.Dial)
+			}
+			lines = append(lines, "reverse_proxy "+strings.Join(dials, " "))
+		case "file_server":
+			if len(h.Root) > 0 {
+				lines = append(lines, "root * "+quoteArg(h.Root))
+			}
+			lines = append(lines, "file_server")
+		case "vars":
+			if len(h.Root) > 0 {
+				lines = append(lines, "root * "+quoteArg(h.Root))
+			}
+		case "static_response":
+			if location := h.Headers["Location"]; h.StatusCode.IsRedirect() && len(location) > 0 {
+				lines = append(lines, fmt.Sprintf("redir %v %v", quoteArg(location[0]), h.StatusCode))
+				continue
+			}
+			lines = append(lines, strings.TrimSpace(fmt.Sprintf("respond %v %v", quoteArg(h.Body), h.StatusCode)))
+		default:
+			lines = append(lines, fmt.Sprintf("# unsupported handler: %v", h.Handler))
+		}
+	}
+	return lines
+}
+
+func quoteArg(arg string) string {
+	if len(arg) == 0 || strings.ContainsAny(arg, " \t\"{}") {
+		return fmt.Sprintf("%q", arg)
+	}
+	return arg
+}
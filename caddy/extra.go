@@ -0,0 +1,209 @@
+package caddy
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// Extra keeps the fields of a caddy object that the structs here don't
+// model (matchers such as remote_ip, a reverse_proxy's transport, a
+// server's automatic_https...) so posting a config back doesn't drop
+// them
+type Extra map[string]json.RawMessage
+
+// knownKeys lists the json names of the fields of t
+func knownKeys(t reflect.Type) map[string]bool {
+	keys := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		if field := t.Field(i); field.Anonymous && len(field.Tag.Get("json")) == 0 {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			for key := range knownKeys(embedded) {
+				keys[key] = true
+			}
+			continue
+		}
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "-" || !t.Field(i).IsExported() {
+			continue
+		}
+		if len(name) == 0 {
+			name = t.Field(i).Name
+		}
+		keys[name] = true
+	}
+	return keys
+}
+
+// unmarshalExtra decodes b into v (a pointer to a struct without its
+// own UnmarshalJSON) and returns the fields v has no room for
+func unmarshalExtra(b []byte, v any) (Extra, error) {
+	if err := json.Unmarshal(b, v); err != nil {
+		return nil, err
+	}
+	fields := Extra{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	known := knownKeys(reflect.TypeOf(v).Elem())
+	for key := range fields {
+		if known[key] {
+			delete(fields, key)
+		}
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return fields, nil
+}
+
+// marshalExtra encodes v (a struct without its own MarshalJSON) along
+// with extra, the modelled fields win over extra ones of the same name
+func marshalExtra(v any, extra Extra) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return b, err
+	}
+	fields := Extra{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	for key, value := range extra {
+		if _, ok := fields[key]; !ok {
+			fields[key] = value
+		}
+	}
+	return json.Marshal(fields)
+}
+
+func (c *Config) UnmarshalJSON(b []byte) (err error) {
+	type plain Config
+	c.Extra, err = unmarshalExtra(b, (*plain)(c))
+	return err
+}
+
+func (c Config) MarshalJSON() ([]byte, error) {
+	type plain Config
+	return marshalExtra(plain(c), c.Extra)
+}
+
+func (a *AdminConfig) UnmarshalJSON(b []byte) (err error) {
+	type plain AdminConfig
+	a.Extra, err = unmarshalExtra(b, (*plain)(a))
+	return err
+}
+
+func (a AdminConfig) MarshalJSON() ([]byte, error) {
+	type plain AdminConfig
+	return marshalExtra(plain(a), a.Extra)
+}
+
+func (a *AppConfig) UnmarshalJSON(b []byte) (err error) {
+	type plain AppConfig
+	a.Extra, err = unmarshalExtra(b, (*plain)(a))
+	return err
+}
+
+func (a AppConfig) MarshalJSON() ([]byte, error) {
+	type plain AppConfig
+	return marshalExtra(plain(a), a.Extra)
+}
+
+func (h *HTTPApp) UnmarshalJSON(b []byte) (err error) {
+	type plain HTTPApp
+	h.Extra, err = unmarshalExtra(b, (*plain)(h))
+	return err
+}
+
+func (h HTTPApp) MarshalJSON() ([]byte, error) {
+	type plain HTTPApp
+	return marshalExtra(plain(h), h.Extra)
+}
+
+func (s *Server) UnmarshalJSON(b []byte) (err error) {
+	type plain Server
+	s.Extra, err = unmarshalExtra(b, (*plain)(s))
+	return err
+}
+
+func (s Server) MarshalJSON() ([]byte, error) {
+	type plain Server
+	return marshalExtra(plain(s), s.Extra)
+}
+
+// UnmarshalJSON keeps the route as it was read too, a route nothing
+// changed is written back exactly the same
+func (r *Route) UnmarshalJSON(b []byte) (err error) {
+	type plain Route
+	*r = Route{}
+	r.Extra, err = unmarshalExtra(b, (*plain)(r))
+	if err != nil {
+		return err
+	}
+	r.raw = append(json.RawMessage{}, b...)
+	return nil
+}
+
+func (r Route) MarshalJSON() ([]byte, error) {
+	type plain Route
+	if len(r.raw) > 0 {
+		var read Route
+		if err := json.Unmarshal(r.raw, &read); err == nil && reflect.DeepEqual(read, r) {
+			return r.raw, nil
+		}
+	}
+	return marshalExtra(plain(r), r.Extra)
+}
+
+func (m *Match) UnmarshalJSON(b []byte) (err error) {
+	type plain Match
+	m.Extra, err = unmarshalExtra(b, (*plain)(m))
+	return err
+}
+
+func (m Match) MarshalJSON() ([]byte, error) {
+	type plain Match
+	return marshalExtra(plain(m), m.Extra)
+}
+
+// UnmarshalJSON reads headers as the static_response ones, the
+// headers of other handlers (ex: reverse_proxy's request and response
+// operations) are kept in Extra
+func (h *HandleDef) UnmarshalJSON(b []byte) (err error) {
+	type plain HandleDef
+	fields := struct {
+		*plain
+		Headers json.RawMessage `json:"headers,omitempty"`
+	}{plain: (*plain)(h)}
+	h.Extra, err = unmarshalExtra(b, &fields)
+	if err != nil || len(fields.Headers) == 0 {
+		return err
+	}
+	if json.Unmarshal(fields.Headers, &h.Headers) != nil {
+		h.Headers = nil
+		if h.Extra == nil {
+			h.Extra = Extra{}
+		}
+		h.Extra["headers"] = fields.Headers
+	}
+	return nil
+}
+
+func (h HandleDef) MarshalJSON() ([]byte, error) {
+	type plain HandleDef
+	return marshalExtra(plain(h), h.Extra)
+}
+
+func (u *Upstream) UnmarshalJSON(b []byte) (err error) {
+	type plain Upstream
+	u.Extra, err = unmarshalExtra(b, (*plain)(u))
+	return err
+}
+
+func (u Upstream) MarshalJSON() ([]byte, error) {
+	type plain Upstream
+	return marshalExtra(plain(u), u.Extra)
+}
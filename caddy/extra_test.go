@@ -0,0 +1,110 @@
+package caddy
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// a config with fields the structs don't model at every level
+const foreignConfig = `{
+	"admin": {"listen": "localhost:2019", "config": {"persist": false}},
+	"logging": {"logs": {"default": {"level": "DEBUG"}}},
+	"apps": {
+		"tls": {"certificates": {"load_files": [{"certificate": "/c.crt", "key": "/c.key"}]}},
+		"http": {
+			"grace_period": "10s",
+			"servers": {
+				"srv0": {
+					"listen": [":443"],
+					"automatic_https": {"disable_redirects": true},
+					"tls_connection_policies": [{"match": {"sni": ["admin.example.com"]}}],
+					"logs": {"default_logger_name": "log0"},
+					"routes": [
+						{
+							"match": [{"host": ["admin.example.com"], "remote_ip": {"ranges": ["10.0.0.0/8"]}}],
+							"handle": [{
+								"handler": "reverse_proxy",
+								"upstreams": [{"dial": "10.0.0.5:443", "max_requests": 10}],
+								"transport": {"protocol": "http", "tls": {}},
+								"load_balancing": {"selection_policy": {"policy": "first"}}
+							}],
+							"terminal": true,
+							"group": "admin"
+						}
+					]
+				}
+			}
+		}
+	}
+}`
+
+func decodeAny(t *testing.T, b []byte) any {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	var config Config
+	if err := json.Unmarshal([]byte(foreignConfig), &config); err != nil {
+		t.Fatal(err)
+	}
+	route := config.Apps.HTTP.Servers["srv0"].Routes[0]
+	if RouteHosts(route)[0] != "admin.example.com" || route.Handle[0].Upstreams[0].Dial != "10.0.0.5:443" {
+		t.Errorf("modelled fields weren't read: %+v", route)
+	}
+
+	written, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := decodeAny(t, written), decodeAny(t, []byte(foreignConfig)); !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip gave\n%s", written)
+	}
+
+	// a changed route keeps what it doesn't model too
+	server := config.Apps.HTTP.Servers["srv0"]
+	server.Routes[0].Match[0].Host = []string{"admin.example.org"}
+	written, err = json.Marshal(server.Routes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := decodeAny(t, []byte(`{
+		"match": [{"host": ["admin.example.org"], "remote_ip": {"ranges": ["10.0.0.0/8"]}}],
+		"handle": [{
+			"handler": "reverse_proxy",
+			"upstreams": [{"dial": "10.0.0.5:443", "max_requests": 10}],
+			"transport": {"protocol": "http", "tls": {}},
+			"load_balancing": {"selection_policy": {"policy": "first"}}
+		}],
+		"terminal": true,
+		"group": "admin"
+	}`))
+	if got := decodeAny(t, written); !reflect.DeepEqual(got, want) {
+		t.Errorf("changed route is\n%s", written)
+	}
+}
+
+func TestRouteWrittenAsRead(t *testing.T) {
+	// keys out of the order the structs would write them in
+	raw := `{"terminal":true,"match":[{"remote_ip":{"ranges":["10.0.0.0/8"]},"host":["a.com"]}],"handle":[{"handler":"subroute","routes":[{"handle":[{"handler":"file_server","root":"/srv","hide":["/srv/.git"]}]}]}]}`
+	var routes []Route
+	if err := json.Unmarshal([]byte("["+raw+"]"), &routes); err != nil {
+		t.Fatal(err)
+	}
+	written, err := json.Marshal(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(written) != "["+raw+"]" {
+		t.Errorf("unchanged route written as\n%s\nwant\n[%s]", written, raw)
+	}
+
+	if summary := ClassifyRoute(routes[0]); summary.Managed() {
+		t.Errorf("a route limited to some IPs was classified as %v", summary.Kind)
+	}
+}
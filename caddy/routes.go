@@ -0,0 +1,252 @@
+package caddy
+
+import (
+	"encoding/json"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StatusCode mirrors caddy's WeakString handling for status codes, the
+// admin API accepts both `302` and `"302"` (or a placeholder) so we keep
+// the raw value and write numbers back as numbers
+type StatusCode string
+
+func (s *StatusCode) UnmarshalJSON(b []byte) error {
+	var asString string
+	if err := json.Unmarshal(b, &asString); err == nil {
+		*s = StatusCode(asString)
+		return nil
+	}
+	var asNumber json.Number
+	if err := json.Unmarshal(b, &asNumber); err != nil {
+		return err
+	}
+	*s = StatusCode(asNumber.String())
+	return nil
+}
+
+func (s StatusCode) MarshalJSON() ([]byte, error) {
+	if n, err := strconv.Atoi(string(s)); err == nil {
+		return json.Marshal(n)
+	}
+	return json.Marshal(string(s))
+}
+
+func (s StatusCode) IsRedirect() bool {
+	n, err := strconv.Atoi(string(s))
+	if err != nil {
+		return false
+	}
+	return n >= 300 && n < 400
+}
+
+type RouteKind string
+
+const (
+	RouteKindUnmanaged    RouteKind = "unmanaged"
+	RouteKindReverseProxy RouteKind = "reverse-proxy"
+	RouteKindFileServer   RouteKind = "file-server"
+	RouteKindRedirect     RouteKind = "redirect"
+)
+
+// RouteSummary is the flattened view of a single top level route in a
+// server, only routes that match on hosts and end in one of the handlers
+// caddy-ui knows how to manage are classified, everything else is left
+// as RouteKindUnmanaged
+type RouteSummary struct {
+	Server     string
+	Index      int
+	Hosts      []string
+	Kind       RouteKind
+	Upstreams  []string
+	Root       string
+	RedirectTo string
+	StatusCode string
+}
+
+// ID is a stable identifier for the route inside the current config,
+// it changes if routes are re-ordered
+func (r RouteSummary) ID() string {
+	return r.Server + "/" + strconv.Itoa(r.Index)
+}
+
+func (r RouteSummary) Managed() bool {
+	return r.Kind != RouteKindUnmanaged
+}
+
+// WalkRoutes classifies every top level route of every server, ordered
+// by server key and then by the route's position in the server
+func WalkRoutes(servers ServersConfig) []RouteSummary {
+	keys := make([]string, 0, len(servers))
+	for key := range servers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	summaries := []RouteSummary{}
+	for _, key := range keys {
+		for i, route := range servers[key].Routes {
+			summary := ClassifyRoute(route)
+			summary.Server = key
+			summary.Index = i
+			summaries = append(summaries, summary)
+		}
+	}
+	return summaries
+}
+
+// ClassifyRoute figures out if the route is one of the shapes that
+// caddy-ui (or a Caddyfile site block) produces for a reverse proxy,
+// file server or redirect
+func ClassifyRoute(route Route) RouteSummary {
+	summary := RouteSummary{
+		Kind:  RouteKindUnmanaged,
+		Hosts: RouteHosts(route),
+	}
+
+	if len(summary.Hosts) == 0 {
+		return summary
+	}
+
+	// any other matcher (path, remote_ip, etc) means the route only
+	// handles part of the site which isn't something an app can represent
+	for _, m := range route.Match {
+		if len(m.Path) > 0 || len(m.Extra) > 0 {
+			return summary
+		}
+	}
+
+	handles := flattenHandles(route.Handle)
+	if handles == nil {
+		return summary
+	}
+
+	var root string
+	for _, h := range handles {
+		switch h.Handler {
+		case "vars":
+			// Caddyfile's `root` directive sets the root through vars
+			if len(h.Root) > 0 {
+				root = h.Root
+			}
+		case "reverse_proxy":
+			if len(h.Upstreams) == 0 {
+				return summary
+			}
+			summary.Kind = RouteKindReverseProxy
+			for _, u := range h.Upstreams {
+				summary.Upstreams = append(summary.Upstreams, u.Dial)
+			}
+			return summary
+		case "file_server":
+			if len(h.Root) > 0 {
+				root = h.Root
+			}
+			summary.Kind = RouteKindFileServer
+			summary.Root = root
+			return summary
+		case "static_response":
+			location := h.Headers["Location"]
+			if !h.StatusCode.IsRedirect() || len(location) == 0 {
+				return summary
+			}
+			summary.Kind = RouteKindRedirect
+			summary.RedirectTo = location[0]
+			summary.StatusCode = string(h.StatusCode)
+			return summary
+		default:
+			return summary
+		}
+	}
+
+	return summary
+}
+
+// RouteHosts collects every host from the route's matcher sets
+func RouteHosts(route Route) []string {
+	hosts := []string{}
+	for _, m := range route.Match {
+		hosts = append(hosts, m.Host...)
+	}
+	return hosts
+}
+
+// RemoveHostRoutes takes the hosts out of the top level routes, other
+// hosts of a route keep being served. A matcher set left without hosts
+// is dropped since it would match every host, and so is a route left
+// without matcher sets. The other matchers of a set (ex: remote_ip) and
+// the handlers stay as they are. It returns how many routes were changed
+func RemoveHostRoutes(servers ServersConfig, hosts []string) int {
+	remove := map[string]bool{}
+	for _, host := range hosts {
+		remove[NormalizeHost(host)] = true
+	}
+	released := func(host string) bool {
+		return remove[NormalizeHost(host)]
+	}
+
+	changed := 0
+	for key, server := range servers {
+		kept := []Route{}
+		for _, route := range server.Routes {
+			matchers := []Match{}
+			touched := false
+			for _, m := range route.Match {
+				if !slices.ContainsFunc(m.Host, released) {
+					matchers = append(matchers, m)
+					continue
+				}
+				touched = true
+				m.Host = slices.DeleteFunc(slices.Clone(m.Host), released)
+				if len(m.Host) > 0 {
+					matchers = append(matchers, m)
+				}
+			}
+			if !touched {
+				kept = append(kept, route)
+				continue
+			}
+			changed++
+			if len(matchers) == 0 {
+				continue
+			}
+			route.Match = matchers
+			kept = append(kept, route)
+		}
+		server.Routes = kept
+		servers[key] = server
+	}
+	return changed
+}
+
+// flattenHandles unwraps the `subroute` nesting that the Caddyfile
+// adapter (and SyncConfigForApp) wrap handlers in, returns nil if the
+// chain branches into multiple routes or has nested matchers
+func flattenHandles(handles []HandleDef) []HandleDef {
+	flat := []HandleDef{}
+	for _, h := range handles {
+		if h.Handler != "subroute" {
+			flat = append(flat, h)
+			continue
+		}
+		for _, sub := range h.Routes {
+			if len(sub.Match) > 0 {
+				return nil
+			}
+			inner := flattenHandles(sub.Handle)
+			if inner == nil {
+				return nil
+			}
+			flat = append(flat, inner...)
+		}
+	}
+	return flat
+}
+
+// NormalizeHost lowercases and trims the host so comparisons between
+// the config and the database are consistent
+func NormalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSpace(host))
+}
@@ -0,0 +1,39 @@
+package caddy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRemoveHostRoutes(t *testing.T) {
+	handle := []HandleDef{{Handler: "static_response"}}
+	servers := ServersConfig{
+		"srv0": {
+			Listen: ListenAddresses{":443"},
+			Routes: []Route{
+				{Match: []Match{{Host: []string{"a.com"}}}, Handle: handle},
+				{Match: []Match{{Host: []string{"B.com", "c.com"}}}, Handle: handle},
+				{Match: []Match{{Host: []string{"d.com"}, Path: []string{"/api/*"}}, {Host: []string{"e.com"}}}, Handle: handle},
+				// no host matcher at all, a catch all the release must not touch
+				{Handle: handle},
+			},
+		},
+	}
+
+	changed := RemoveHostRoutes(servers, []string{"a.com", "b.com", " D.com "})
+	if changed != 3 {
+		t.Errorf("changed %v routes, want 3", changed)
+	}
+	want := []Route{
+		{Match: []Match{{Host: []string{"c.com"}}}, Handle: handle},
+		{Match: []Match{{Host: []string{"e.com"}}}, Handle: handle},
+		{Handle: handle},
+	}
+	if got := servers["srv0"].Routes; !reflect.DeepEqual(got, want) {
+		t.Errorf("routes = %+v, want %+v", got, want)
+	}
+
+	if changed := RemoveHostRoutes(servers, []string{"unknown.com"}); changed != 0 {
+		t.Errorf("changed %v routes for an unknown host", changed)
+	}
+}
@@ -0,0 +1,151 @@
+package caddy
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The typed config structs only carry what caddy-ui writes, the tree
+// below is built from the raw JSON instead so that matchers and handler
+// fields we don't model are still visible
+
+type ServerNode struct {
+	Name   string
+	Listen []string
+	Routes []RouteNode
+}
+
+type RouteNode struct {
+	ID       string
+	Hosts    []string
+	Matchers []string
+	Handlers []HandlerNode
+	Terminal bool
+}
+
+type HandlerNode struct {
+	Name    string
+	Details []string
+	Routes  []RouteNode
+}
+
+type rawRoute struct {
+	Match    []map[string]json.RawMessage `json:"match"`
+	Handle   []map[string]json.RawMessage `json:"handle"`
+	Terminal bool                         `json:"terminal"`
+}
+
+type rawServer struct {
+	Listen []string   `json:"listen"`
+	Routes []rawRoute `json:"routes"`
+}
+
+// GetServerTree fetches the live http servers and builds the tree
+func GetServerTree() ([]ServerNode, error) {
+	raw, err := GetConfigAtPath("apps/http/servers")
+	if err != nil {
+		return nil, err
+	}
+	return BuildServerTree(raw)
+}
+
+func BuildServerTree(raw json.RawMessage) ([]ServerNode, error) {
+	servers := map[string]rawServer{}
+	if len(raw) > 0 && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &servers); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := make([]string, 0, len(servers))
+	for key := range servers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	nodes := []ServerNode{}
+	for _, key := range keys {
+		server := servers[key]
+		node := ServerNode{
+			Name:   key,
+			Listen: server.Listen,
+			Routes: buildRouteNodes(key, server.Routes),
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+func buildRouteNodes(prefix string, routes []rawRoute) []RouteNode {
+	nodes := []RouteNode{}
+	for i, route := range routes {
+		id := prefix + "/" + strconv.Itoa(i)
+		node := RouteNode{
+			ID:       id,
+			Hosts:    []string{},
+			Terminal: route.Terminal,
+		}
+
+		for _, set := range route.Match {
+			if hosts, ok := set["host"]; ok {
+				var h []string
+				json.Unmarshal(hosts, &h)
+				node.Hosts = append(node.Hosts, h...)
+			}
+			node.Matchers = append(node.Matchers, strings.Join(describeFields(set), ", "))
+		}
+
+		for j, handle := range route.Handle {
+			handler := HandlerNode{}
+			json.Unmarshal(handle["handler"], &handler.Name)
+
+			fields := map[string]json.RawMessage{}
+			for k, v := range handle {
+				if k == "handler" || k == "routes" {
+					continue
+				}
+				fields[k] = v
+			}
+			if len(fields) > 0 {
+				handler.Details = describeFields(fields)
+			}
+
+			if nested, ok := handle["routes"]; ok {
+				var subRoutes []rawRoute
+				json.Unmarshal(nested, &subRoutes)
+				handler.Routes = buildRouteNodes(id+"/handle/"+strconv.Itoa(j)+"/routes", subRoutes)
+			}
+			node.Handlers = append(node.Handlers, handler)
+		}
+
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// describeFields renders a JSON object as `key: value` pairs with the
+// values compacted, long values are cut short to keep the tree readable
+func describeFields(fields map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := []string{}
+	for _, k := range keys {
+		value := string(fields[k])
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, fields[k]); err == nil {
+			value = compact.String()
+		}
+		if len(value) > 120 {
+			value = value[:117] + "..."
+		}
+		parts = append(parts, k+": "+value)
+	}
+	return parts
+}
@@ -0,0 +1,412 @@
+package caddy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Problem is a single finding from Validate, Path is the slash
+// separated location in the config (same format as the admin API's
+// /config/ paths) and Line/Column point at it in the submitted document
+type Problem struct {
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Path     string `json:"path,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+}
+
+// handlers shipped with the standard caddy build, plugins add more so
+// an unknown handler is only a warning
+var knownHandlers = map[string]bool{
+	"acme_server":           true,
+	"authentication":        true,
+	"copy_response":         true,
+	"copy_response_headers": true,
+	"encode":                true,
+	"error":                 true,
+	"file_server":           true,
+	"headers":               true,
+	"intercept":             true,
+	"invoke":                true,
+	"log_append":            true,
+	"map":                   true,
+	"metrics":               true,
+	"push":                  true,
+	"request_body":          true,
+	"reverse_proxy":         true,
+	"rewrite":               true,
+	"static_response":       true,
+	"subroute":              true,
+	"templates":             true,
+	"tracing":               true,
+	"vars":                  true,
+}
+
+// handlers that always write a response, a route made of these without
+// matchers swallows every request that reaches it
+var respondingHandlers = map[string]bool{
+	"error":           true,
+	"file_server":     true,
+	"reverse_proxy":   true,
+	"static_response": true,
+}
+
+func HasErrors(problems []Problem) bool {
+	for _, p := range problems {
+		if p.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the config before it's sent to /load, caddy would
+// reject some of these anyway but with a single message and no position
+func Validate(config []byte) []Problem {
+	problems := []Problem{}
+
+	var doc struct {
+		Apps struct {
+			HTTP struct {
+				Servers map[string]rawServer `json:"servers"`
+			} `json:"http"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal(config, &doc); err != nil {
+		problem := Problem{
+			Severity: SeverityError,
+			Message:  err.Error(),
+		}
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			problem.Line, problem.Column = lineColumn(config, syntaxErr.Offset)
+		case errors.As(err, &typeErr):
+			problem.Line, problem.Column = lineColumn(config, typeErr.Offset)
+			problem.Path = strings.ReplaceAll(typeErr.Field, ".", "/")
+		}
+		return append(problems, problem)
+	}
+
+	servers := doc.Apps.HTTP.Servers
+	keys := make([]string, 0, len(servers))
+	for key := range servers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	type listener struct {
+		socket listenSocket
+		addr   string
+		server string
+	}
+	listeners := []listener{}
+	for _, key := range keys {
+		server := servers[key]
+		serverPath := "apps/http/servers/" + key
+
+	listen:
+		for i, addr := range server.Listen {
+			socket := parseListen(addr)
+			for _, other := range listeners {
+				if !socket.overlaps(other.socket) {
+					continue
+				}
+				message := fmt.Sprintf("listen address %v is already used by server %v", addr, other.server)
+				if other.addr != addr {
+					message = fmt.Sprintf("listen address %v binds the same socket as %v of server %v", addr, other.addr, other.server)
+				}
+				problems = append(problems, Problem{
+					Severity: SeverityError,
+					Message:  message,
+					Path:     serverPath + "/listen/" + strconv.Itoa(i),
+				})
+				continue listen
+			}
+			listeners = append(listeners, listener{socket: socket, addr: addr, server: key})
+		}
+
+		problems = append(problems, checkOverlappingHosts(serverPath, server.Routes)...)
+		problems = append(problems, checkRoutes(serverPath+"/routes", server.Routes)...)
+	}
+
+	for i := range problems {
+		if len(problems[i].Path) == 0 || problems[i].Line > 0 {
+			continue
+		}
+		if offset, ok := locate(config, problems[i].Path); ok {
+			problems[i].Line, problems[i].Column = lineColumn(config, offset)
+		}
+	}
+
+	return problems
+}
+
+// listenSocket is a listen address reduced to what gets bound, so :443,
+// 0.0.0.0:443 and [::]:443 are the same socket. Addresses that can't be
+// parsed (ex: unix sockets) keep the raw address as host and no ports
+type listenSocket struct {
+	network string
+	// host is empty for every interface
+	host     string
+	from, to int
+}
+
+// parseListen reads caddy's [network/]host:port[-port] listen format
+func parseListen(addr string) listenSocket {
+	network, address := "tcp", addr
+	if before, after, found := strings.Cut(addr, "/"); found {
+		network, address = strings.ToLower(before), after
+	}
+	// tcp4 and tcp6 sockets share ports with tcp ones
+	network = strings.TrimRight(network, "46")
+	raw := listenSocket{network: network, host: address}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return raw
+	}
+	fromPort, toPort, isRange := strings.Cut(port, "-")
+	from, err := strconv.Atoi(fromPort)
+	if err != nil {
+		return raw
+	}
+	to := from
+	if isRange {
+		if to, err = strconv.Atoi(toPort); err != nil {
+			return raw
+		}
+	}
+
+	host = strings.ToLower(host)
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsUnspecified() {
+			host = ""
+		} else {
+			host = ip.String()
+		}
+	}
+	return listenSocket{network: network, host: host, from: from, to: to}
+}
+
+// overlaps is true when both addresses would bind the same socket
+func (s listenSocket) overlaps(other listenSocket) bool {
+	if s.network != other.network || s.host != other.host {
+		return false
+	}
+	if s.from == 0 && other.from == 0 {
+		return true
+	}
+	return s.from <= other.to && other.from <= s.to
+}
+
+func checkRoutes(path string, routes []rawRoute) []Problem {
+	problems := []Problem{}
+	catchAll := -1
+	for i, route := range routes {
+		routePath := path + "/" + strconv.Itoa(i)
+
+		if catchAll >= 0 {
+			problems = append(problems, Problem{
+				Severity: SeverityWarning,
+				Message:  fmt.Sprintf("route is unreachable, route %v matches every request before it", catchAll),
+				Path:     routePath,
+			})
+		}
+
+		responds := false
+		for j, handle := range route.Handle {
+			var name string
+			json.Unmarshal(handle["handler"], &name)
+			handlePath := routePath + "/handle/" + strconv.Itoa(j)
+			if len(name) == 0 {
+				problems = append(problems, Problem{
+					Severity: SeverityError,
+					Message:  "handler name is missing",
+					Path:     handlePath,
+				})
+				continue
+			}
+			if !knownHandlers[name] {
+				problems = append(problems, Problem{
+					Severity: SeverityWarning,
+					Message:  fmt.Sprintf("unknown handler %q, it must be provided by a plugin", name),
+					Path:     handlePath + "/handler",
+				})
+			}
+			if respondingHandlers[name] {
+				responds = true
+			}
+			if nested, ok := handle["routes"]; ok {
+				var subRoutes []rawRoute
+				json.Unmarshal(nested, &subRoutes)
+				problems = append(problems, checkRoutes(handlePath+"/routes", subRoutes)...)
+			}
+		}
+
+		if catchAll < 0 && len(route.Match) == 0 && (route.Terminal || responds) {
+			catchAll = i
+		}
+	}
+	return problems
+}
+
+// checkOverlappingHosts warns when the same host is matched by more
+// than one route of a server, only the first one would ever handle it
+// unless the matcher sets narrow it down further
+func checkOverlappingHosts(serverPath string, routes []rawRoute) []Problem {
+	problems := []Problem{}
+	seen := map[string]int{}
+	for i, route := range routes {
+		for _, set := range route.Match {
+			if len(set) != 1 {
+				continue
+			}
+			var hosts []string
+			if err := json.Unmarshal(set["host"], &hosts); err != nil {
+				continue
+			}
+			for _, host := range hosts {
+				host = NormalizeHost(host)
+				if first, ok := seen[host]; ok && first != i {
+					problems = append(problems, Problem{
+						Severity: SeverityWarning,
+						Message:  fmt.Sprintf("host %v is also matched by route %v", host, first),
+						Path:     serverPath + "/routes/" + strconv.Itoa(i),
+					})
+					continue
+				}
+				seen[host] = i
+			}
+		}
+	}
+	return problems
+}
+
+func lineColumn(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := int(offset) - (bytes.LastIndexByte(before, '\n') + 1) + 1
+	return line, column
+}
+
+// locate walks the JSON tokens to find the byte offset of the value at
+// path, the offset points just before the value
+func locate(data []byte, path string) (int64, bool) {
+	target := strings.Split(path, "/")
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	type frame struct {
+		isArray bool
+		index   int
+		key     string
+	}
+	stack := []frame{}
+
+	current := func() []string {
+		parts := []string{}
+		for _, f := range stack {
+			if f.isArray {
+				parts = append(parts, strconv.Itoa(f.index))
+			} else {
+				parts = append(parts, f.key)
+			}
+		}
+		return parts
+	}
+	matches := func() bool {
+		parts := current()
+		if len(parts) != len(target) {
+			return false
+		}
+		for i := range parts {
+			if parts[i] != target[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	expectKey := false
+	for {
+		offset := dec.InputOffset()
+		tok, err := dec.Token()
+		if err != nil {
+			return 0, false
+		}
+
+		if delim, ok := tok.(json.Delim); ok && (delim == '}' || delim == ']') {
+			stack = stack[:len(stack)-1]
+			expectKey = false
+			if len(stack) > 0 {
+				top := &stack[len(stack)-1]
+				if top.isArray {
+					top.index++
+				} else {
+					expectKey = true
+				}
+			}
+			continue
+		}
+
+		if expectKey {
+			stack[len(stack)-1].key = tok.(string)
+			expectKey = false
+			continue
+		}
+
+		// tok is a value, it sits at the current path
+		if len(stack) > 0 && matches() {
+			return skipSeparator(data, offset), true
+		}
+
+		if delim, ok := tok.(json.Delim); ok {
+			if delim == '{' {
+				stack = append(stack, frame{})
+				expectKey = true
+			} else {
+				stack = append(stack, frame{isArray: true})
+			}
+			continue
+		}
+
+		if len(stack) > 0 {
+			top := &stack[len(stack)-1]
+			if top.isArray {
+				top.index++
+			} else {
+				expectKey = true
+			}
+		}
+	}
+}
+
+// skipSeparator moves past the `:`/`,` and whitespace that the decoder
+// reports as part of the next token's offset
+func skipSeparator(data []byte, offset int64) int64 {
+	for offset < int64(len(data)) {
+		switch data[offset] {
+		case ' ', '\t', '\n', '\r', ':', ',':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}
@@ -0,0 +1,1149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/barelyhuman/caddy-ui/api"
+	"github.com/barelyhuman/caddy-ui/appsfile"
+	"github.com/barelyhuman/caddy-ui/audit"
+	"github.com/barelyhuman/caddy-ui/auth"
+	"github.com/barelyhuman/caddy-ui/backup"
+	"github.com/barelyhuman/caddy-ui/caddy"
+	"github.com/barelyhuman/caddy-ui/config"
+	"github.com/barelyhuman/caddy-ui/data"
+	"github.com/barelyhuman/caddy-ui/data/models/apps"
+	"github.com/barelyhuman/caddy-ui/data/models/instances"
+	"github.com/barelyhuman/caddy-ui/data/models/users"
+	"github.com/barelyhuman/caddy-ui/data/store"
+	"github.com/barelyhuman/caddy-ui/gitops"
+	"github.com/barelyhuman/caddy-ui/importer"
+	"github.com/barelyhuman/caddy-ui/migrate"
+	"github.com/barelyhuman/caddy-ui/ports"
+)
+
+const usage = `Usage: caddy-ui [global flags] <command> [flags] [args]
+
+Commands:
+  serve                          start the web UI, the default
+  migrate up                     apply pending migrations
+  migrate down [-n N]            revert the last N migrations, 1 by default
+  migrate status                 list applied, pending and modified migrations
+  apps list [-json]              list apps with their domains and upstreams
+  apps create -name NAME ...     create an app, see apps create -h
+  apps delete [-no-sync] APP     delete an app with its domains, upstreams, options
+                                 and caddy routes
+  apps apply [-dry-run] [-no-sync] [-json] [PATH]
+                                 make the apps match an apps file or directory, the
+                                 configured apps file (or repository) by default
+  apps export [-format yaml|json] [-o FILE]
+                                 print every app as an apps file, apps apply reads it back
+  apps import [-all | -key KEY...] [-no-sync] [FILE]
+                                 list the routes of a caddy config that can become apps, the
+                                 live one by default, and import the selected ones
+  domains set [-no-sync] APP DOMAIN...
+                                 replace the domains of an app, the ones it no longer has
+                                 are taken out of caddy's routes
+  ports [-json]                  list the upstreams of every app and the next free port
+  sync -all | -app APP           push apps to caddy
+  config export [-o FILE]        print the live caddy config
+  config import FILE             validate and load a caddy config, - reads stdin
+  config print                   print the server settings in use
+  user create -username NAME ... create a user, see user create -h
+  backup [-o FILE | -upload]     write the database, caddy's config and the app files to an archive,
+                                 -upload stores it in the backup target
+  restore [-files-root DIR] [-skip-caddy] FILE
+                                 restore a backup on an empty instance, with the server stopped
+
+Global flags, each one can also be set with its env variable or in the
+config file:
+  -config FILE                   JSON config file (CONFIG_FILE)
+  -listen ADDR                   address of the web UI (LISTEN_ADDR, default :8081)
+  -database-url URL              SQLite path or postgres:// URL (DATABASE_URL, default ./data.sqlite3)
+  -migrations-dir DIR            use the migrations in DIR instead of the embedded ones (MIGRATIONS_DIR)
+  -caddy-url URL                 caddy's admin API (CADDY_URL, default http://localhost:2019)
+  -port-range FROM-TO            ports allocated to new apps (PORT_RANGE, default 10000-10999)
+  -backup-schedule CRON          automatic backups, ex: "0 3 * * *" (BACKUP_SCHEDULE, off by default)
+  -backup-target DIR|URL         directory or s3:// URL of automatic backups (BACKUP_TARGET)
+  -backup-keep N                 automatic backups kept, 0 for all (BACKUP_KEEP, default 7)
+  -backup-max-age AGE            remove automatic backups older than AGE, ex: 30d (BACKUP_MAX_AGE)
+  -apps-file PATH                apps file or directory kept applied by the server (APPS_FILE)
+  -apps-repo REPO                git repository apps-file is pulled from (APPS_REPO)
+  -apps-branch BRANCH            branch of apps-repo, its default one when empty (APPS_BRANCH)
+  -apps-interval DURATION        how often the apps file is checked, 0 for on start only
+                                 (APPS_INTERVAL, default 30s)
+  -cookie-secure true|false      mark cookies as Secure on every request (COOKIE_SECURE, default false)
+  -trust-proxy true|false        read the client IP from X-Forwarded-For (TRUST_PROXY, default false)
+  -oidc-issuer URL               single sign-on provider, with -oidc-client-id (OIDC_ISSUER)
+  -oidc-client-id ID             (OIDC_CLIENT_ID)
+  -oidc-client-secret SECRET     for confidential clients (OIDC_CLIENT_SECRET)
+  -oidc-redirect-url URL         (OIDC_REDIRECT_URL, default http://localhost:8081/login/oidc/callback)
+  -oidc-scopes SCOPES            (OIDC_SCOPES, default "openid profile email groups")
+  -oidc-groups-claim CLAIM       (OIDC_GROUPS_CLAIM, default groups)
+  -oidc-role-map MAP             groups to roles, ex: caddy-admins=admin,ops=operator (OIDC_ROLE_MAP)
+  -oidc-default-role ROLE        role of users without a mapped group, empty rejects them
+                                 (OIDC_DEFAULT_ROLE)
+  -oidc-auto-provision true|false
+                                 create users on their first login (OIDC_AUTO_PROVISION, default true)
+
+APP is the id or the name of an app. Flags go before the arguments.
+`
+
+var errUsage = errors.New("invalid usage, run caddy-ui help")
+
+// run dispatches the command line, no command starts the server like
+// the binary always did
+func run(args []string) error {
+	cfg, args, err := config.Load(args)
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Print(usage)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	config.Set(cfg)
+
+	if len(args) == 0 {
+		return serve(nil)
+	}
+
+	command, rest := args[0], args[1:]
+	switch command {
+	case "serve":
+		return serve(rest)
+	case "migrate":
+		return subcommand(rest, map[string]func([]string) error{
+			"up":     migrateUpCommand,
+			"down":   migrateDownCommand,
+			"status": migrateStatusCommand,
+		})
+	case "apps":
+		return subcommand(rest, map[string]func([]string) error{
+			"list":   appsListCommand,
+			"create": appsCreateCommand,
+			"delete": appsDeleteCommand,
+			"apply":  appsApplyCommand,
+			"export": appsExportCommand,
+			"import": appsImportCommand,
+		})
+	case "domains":
+		return subcommand(rest, map[string]func([]string) error{
+			"set": domainsSetCommand,
+		})
+	case "ports":
+		return portsCommand(rest)
+	case "sync":
+		return syncCommand(rest)
+	case "config":
+		return subcommand(rest, map[string]func([]string) error{
+			"export": configExportCommand,
+			"import": configImportCommand,
+			"print":  configPrintCommand,
+		})
+	case "user":
+		return subcommand(rest, map[string]func([]string) error{
+			"create": userCreateCommand,
+		})
+	case "backup":
+		return backupCommand(rest)
+	case "restore":
+		return restoreCommand(rest)
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return nil
+	}
+
+	fmt.Fprint(os.Stderr, usage)
+	return fmt.Errorf("unknown command %q", command)
+}
+
+func subcommand(args []string, commands map[string]func([]string) error) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return errUsage
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	return command(args[1:])
+}
+
+// connectDatabase opens the database without looking at its schema,
+// for the migrate commands
+func connectDatabase() (*sql.DB, error) {
+	db, err := data.GetDatabaseHandle()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	return db, nil
+}
+
+// openDatabase connects and checks the schema is up to date. Only serve
+// and migrate up apply migrations, any command doing it would undo a
+// migrate down
+func openDatabase() (*sql.DB, error) {
+	db, err := connectDatabase()
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := migrate.Status(db, migrations(db))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+	pending := 0
+	for _, status := range statuses {
+		switch status.State {
+		case migrate.StateModified:
+			return nil, fmt.Errorf("migration %v was modified after it was applied", status.Name)
+		case migrate.StatePending:
+			pending++
+		}
+	}
+	if pending > 0 {
+		return nil, fmt.Errorf("the database has %v pending migrations, run caddy-ui migrate up first", pending)
+	}
+	return db, nil
+}
+
+// migrateDatabase connects and applies the pending migrations, for serve
+// and restore
+func migrateDatabase() (*sql.DB, error) {
+	db, err := connectDatabase()
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate.MigrateUp(db, migrations(db)); err != nil {
+		return nil, fmt.Errorf("failed to migrate: %w", err)
+	}
+	return db, nil
+}
+
+func migrations(db *sql.DB) fs.FS {
+	return migrate.Source(db, config.Get().MigrationsDir)
+}
+
+// stringList collects a flag that can be repeated
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// fieldsError turns API validation results into a single error, nil when
+// there is nothing to report
+func fieldsError(fields map[string]string, conflicts map[string]string) error {
+	problems := []string{}
+	for key, msg := range fields {
+		problems = append(problems, key+" "+msg)
+	}
+	for key, msg := range conflicts {
+		problems = append(problems, key+" "+msg)
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("%v", strings.Join(problems, ", "))
+}
+
+// printWarnings shows the problems that didn't stop the command, on
+// stderr so the output stays parseable
+func printWarnings(warnings []string) {
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", warning)
+	}
+}
+
+// findAppArg loads an app by id or by name
+func findAppArg(db *sql.DB, arg string) (*apps.AppsWithIdentifier, error) {
+	if _, err := strconv.ParseInt(arg, 10, 64); err == nil {
+		app, err := apps.FindById(db, arg)
+		if err != nil {
+			return nil, err
+		}
+		if app.ID != 0 {
+			return app, nil
+		}
+	}
+	app, found, err := apps.FindByName(db, arg)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("app %q not found", arg)
+	}
+	return app, nil
+}
+
+func migrateUpCommand(args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
+	db, err := connectDatabase()
+	if err != nil {
+		return err
+	}
+	statuses, err := migrate.Status(db, migrations(db))
+	if err != nil {
+		return err
+	}
+	pending := 0
+	for _, status := range statuses {
+		if status.State == migrate.StatePending {
+			pending++
+		}
+	}
+	if err := migrate.MigrateUp(db, migrations(db)); err != nil {
+		return fmt.Errorf("failed to migrate database: %w", err)
+	}
+	if pending == 0 {
+		fmt.Println("migrations are up to date")
+	} else {
+		fmt.Printf("applied %v migrations\n", pending)
+	}
+	return nil
+}
+
+func migrateDownCommand(args []string) error {
+	flags := flag.NewFlagSet("migrate down", flag.ExitOnError)
+	n := flags.Int("n", 1, "number of migrations to revert")
+	flags.Parse(args)
+	if flags.NArg() > 0 || *n < 1 {
+		return errUsage
+	}
+	db, err := connectDatabase()
+	if err != nil {
+		return err
+	}
+	return migrate.MigrateDown(db, migrations(db), *n)
+}
+
+func migrateStatusCommand(args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
+	db, err := connectDatabase()
+	if err != nil {
+		return err
+	}
+	statuses, err := migrate.Status(db, migrations(db))
+	if err != nil {
+		return err
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "MIGRATION\tSTATE")
+	for _, status := range statuses {
+		fmt.Fprintf(out, "%v\t%v\n", status.Name, status.State)
+	}
+	return out.Flush()
+}
+
+func appsListCommand(args []string) error {
+	flags := flag.NewFlagSet("apps list", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the apps as JSON")
+	flags.Parse(args)
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	all, err := apps.FindAll(db)
+	if err != nil {
+		return err
+	}
+
+	states := []*audit.AppState{}
+	for _, app := range all {
+		if state := audit.App(db, strconv.FormatInt(app.ID, 10)); state != nil {
+			states = append(states, state)
+		}
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(states)
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "ID\tNAME\tTYPE\tTEAM\tDOMAINS\tUPSTREAMS")
+	for _, state := range states {
+		appType := state.Type
+		if len(appType) == 0 {
+			appType = string(caddy.RouteKindReverseProxy)
+		}
+		fmt.Fprintf(out, "%v\t%v\t%v\t%v\t%v\t%v\n",
+			state.ID,
+			state.Name,
+			appType,
+			orDash(state.Team),
+			orDash(strings.Join(state.Domains, ",")),
+			orDash(strings.Join(state.Upstreams, ",")),
+		)
+	}
+	return out.Flush()
+}
+
+func orDash(value string) string {
+	if len(value) == 0 {
+		return "-"
+	}
+	return value
+}
+
+func appsCreateCommand(args []string) error {
+	flags := flag.NewFlagSet("apps create", flag.ExitOnError)
+	name := flags.String("name", "", "name of the app (required)")
+	appType := flags.String("type", string(caddy.RouteKindReverseProxy), "reverse-proxy, file-server or redirect")
+	team := flags.String("team", "", "team owning the app")
+	var domainList, upstreams, options stringList
+	flags.Var(&domainList, "domain", "domain of the app, can be repeated")
+	flags.Var(&upstreams, "upstream", "port or host:port to proxy to, can be repeated")
+	flags.Var(&options, "option", "option as name=value (ex: root=/srv/site), can be repeated")
+	allocatePort := flags.Bool("allocate-port", false, "add an upstream on the next free port of the port range")
+	sync := flags.Bool("sync", false, "push the app to caddy once created")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return errUsage
+	}
+
+	body := api.CreateAppRequest{
+		Name:         *name,
+		Type:         *appType,
+		Team:         strings.TrimSpace(*team),
+		Options:      map[string]string{},
+		Domains:      domainList,
+		Upstreams:    upstreams,
+		AllocatePort: *allocatePort,
+	}
+	for _, option := range options {
+		key, value, ok := strings.Cut(option, "=")
+		if !ok {
+			return fmt.Errorf("option %q must be name=value", option)
+		}
+		body.Options[key] = value
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	fields, conflicts, warnings, err := body.Check(db)
+	if err != nil {
+		return err
+	}
+	if err := fieldsError(fields, conflicts); err != nil {
+		return err
+	}
+	printWarnings(warnings)
+
+	appID, err := api.CreateApp(context.Background(), db, &body)
+	if err != nil {
+		return err
+	}
+	id := strconv.FormatInt(appID, 10)
+	audit.Log(audit.Entry{
+		Action:     "app.create",
+		TargetType: "app",
+		TargetID:   appID,
+		After:      audit.App(db, id),
+	})
+	fmt.Printf("created app %v (%v)\n", body.Name, appID)
+	if body.AllocatedPort > 0 {
+		fmt.Printf("allocated port %v\n", body.AllocatedPort)
+	}
+
+	if *sync {
+		return syncApps(db, []string{id})
+	}
+	return nil
+}
+
+func appsDeleteCommand(args []string) error {
+	flags := flag.NewFlagSet("apps delete", flag.ExitOnError)
+	noSync := flags.Bool("no-sync", false, "only delete the app, keep its routes in caddy")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errUsage
+	}
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	app, err := findAppArg(db, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if app.ManagedBy.Valid {
+		return fmt.Errorf("app %v is managed by %v, change it there", app.Name, app.ManagedBy.String)
+	}
+
+	before := audit.App(db, strconv.FormatInt(app.ID, 10))
+	hosts, err := api.AppHosts(db, app.ID)
+	if err != nil {
+		return err
+	}
+	if err := store.New(db).DeleteApp(context.Background(), app.ID); err != nil {
+		return err
+	}
+	audit.Log(audit.Entry{
+		Action:     "app.delete",
+		TargetType: "app",
+		TargetID:   app.ID,
+		Before:     before,
+	})
+	fmt.Printf("deleted app %v (%v)\n", app.Name, app.ID)
+	if *noSync {
+		return nil
+	}
+	if err := RemoveConfigForHosts(hosts); err != nil {
+		return fmt.Errorf("caddy refused to remove the routes of the app: %w", err)
+	}
+	return nil
+}
+
+func appsApplyCommand(args []string) error {
+	flags := flag.NewFlagSet("apps apply", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only print the changes")
+	noSync := flags.Bool("no-sync", false, "only save the apps, don't update caddy")
+	asJSON := flags.Bool("json", false, "print the changes as JSON")
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		return errUsage
+	}
+
+	source := gitops.SourceFromConfig(config.Get())
+	if flags.NArg() == 1 {
+		source = gitops.Source{Path: flags.Arg(0)}
+	}
+	if !source.Enabled() {
+		return errors.New("pass an apps file or set apps_file or apps_repo")
+	}
+	ctx := context.Background()
+	snapshot, err := source.Read(ctx)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	opts := gitops.Options{Source: source.String(), DryRun: *dryRun}
+	if !*noSync {
+		opts.Sync = SyncConfigForApp
+		opts.RemoveRoutes = RemoveConfigForHosts
+	}
+	result, applyErr := gitops.Apply(ctx, db, snapshot.File, opts)
+	if result == nil {
+		return applyErr
+	}
+	printWarnings(result.Warnings)
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			return err
+		}
+		return applyErr
+	}
+
+	counts := map[string]int{}
+	for _, change := range result.Changes {
+		counts[change.Action]++
+		if change.Action == gitops.ActionUnchanged {
+			continue
+		}
+		action := change.Action
+		if *dryRun {
+			action = "would " + action
+		}
+		fmt.Printf("%v %v\n", action, change.App)
+		for _, line := range change.Diff {
+			fmt.Printf("  %v\n", line)
+		}
+	}
+	fmt.Printf("%v created, %v updated, %v deleted, %v unchanged\n",
+		counts[gitops.ActionCreate], counts[gitops.ActionUpdate], counts[gitops.ActionDelete], counts[gitops.ActionUnchanged])
+	return applyErr
+}
+
+func appsExportCommand(args []string) error {
+	flags := flag.NewFlagSet("apps export", flag.ExitOnError)
+	format := flags.String("format", "", "yaml or json, picked from the -o extension by default, else yaml")
+	output := flags.String("o", "", "write to the file instead of stdout")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return errUsage
+	}
+	if len(*format) == 0 {
+		*format = appsfile.FormatYAML
+		if strings.EqualFold(filepath.Ext(*output), ".json") {
+			*format = appsfile.FormatJSON
+		}
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	file, err := appsfile.Export(context.Background(), store.New(db), nil)
+	if err != nil {
+		return err
+	}
+	contents, err := appsfile.Marshal(file, *format)
+	if err != nil {
+		return err
+	}
+
+	if len(*output) == 0 {
+		_, err := os.Stdout.Write(contents)
+		return err
+	}
+	return os.WriteFile(*output, contents, 0o644)
+}
+
+// readServers reads the http servers of a caddy config file, - reads
+// stdin, or of the live config when path is empty
+func readServers(path string) (caddy.ServersConfig, error) {
+	if len(path) == 0 {
+		return caddy.GetServersConfig()
+	}
+	var contents []byte
+	var err error
+	if path == "-" {
+		contents, err = io.ReadAll(os.Stdin)
+	} else {
+		contents, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cfg caddy.Config
+	if err := json.Unmarshal(contents, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid caddy config %v: %w", path, err)
+	}
+	return cfg.Apps.HTTP.Servers, nil
+}
+
+func appsImportCommand(args []string) error {
+	flags := flag.NewFlagSet("apps import", flag.ExitOnError)
+	all := flags.Bool("all", false, "import every proposed app")
+	var keys stringList
+	flags.Var(&keys, "key", "key of a proposed app to import, can be repeated")
+	noSync := flags.Bool("no-sync", false, "only create the apps, don't push them to caddy")
+	flags.Parse(args)
+	if flags.NArg() > 1 || (*all && len(keys) > 0) {
+		return errUsage
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	servers, err := readServers(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	plan, err := importer.BuildPlan(db, servers)
+	if err != nil {
+		return err
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "KEY\tNAME\tTYPE\tTARGET")
+	for _, proposal := range plan.Proposals {
+		target := append([]string{}, proposal.Upstreams...)
+		for name, value := range proposal.Options {
+			target = append(target, name+"="+value)
+		}
+		sort.Strings(target)
+		fmt.Fprintf(out, "%v\t%v\t%v\t%v\n", proposal.Key, proposal.Name, proposal.Type, strings.Join(target, ","))
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	for _, route := range plan.Unmanaged {
+		fmt.Printf("unmanaged %v: %v\n", route.ID(), route.Reason)
+	}
+
+	if *all {
+		for _, proposal := range plan.Proposals {
+			keys = append(keys, proposal.Key)
+		}
+	}
+	if len(keys) == 0 {
+		fmt.Println("\nnothing imported, pass -all or -key KEY")
+		return nil
+	}
+
+	created, err := importer.Apply(db, plan, keys)
+	var invalid *importer.InvalidError
+	if errors.As(err, &invalid) {
+		return fieldsError(invalid.Fields, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	ids := []string{}
+	for _, appID := range created {
+		id := strconv.FormatInt(appID, 10)
+		audit.Log(audit.Entry{
+			Action:     "app.import",
+			TargetType: "app",
+			TargetID:   appID,
+			After:      audit.App(db, id),
+		})
+		ids = append(ids, id)
+	}
+	fmt.Printf("\nimported %v apps\n", len(created))
+
+	if *noSync {
+		return nil
+	}
+	return syncApps(db, ids)
+}
+
+func portsCommand(args []string) error {
+	flags := flag.NewFlagSet("ports", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return errUsage
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	registry := store.New(db)
+	entries, err := ports.List(ctx, registry)
+	if err != nil {
+		return err
+	}
+	next, err := ports.Allocate(ctx, registry)
+	if err != nil && !errors.Is(err, ports.ErrExhausted) {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "PORT\tDIAL\tAPP\tLISTENING")
+	for _, entry := range entries {
+		listening := "-"
+		if entry.Local {
+			listening = strconv.FormatBool(entry.Bound)
+		}
+		fmt.Fprintf(out, "%v\t%v\t%v\t%v\n", entry.Port, entry.Dial, orDash(entry.AppName), listening)
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	if next == 0 {
+		fmt.Printf("\nrange %v, %v\n", config.Get().PortRange, ports.ErrExhausted)
+	} else {
+		fmt.Printf("\nrange %v, next free port %v\n", config.Get().PortRange, next)
+	}
+	return nil
+}
+
+func domainsSetCommand(args []string) error {
+	flags := flag.NewFlagSet("domains set", flag.ExitOnError)
+	noSync := flags.Bool("no-sync", false, "only save the domains, don't update caddy")
+	flags.Parse(args)
+	if flags.NArg() < 2 {
+		return errUsage
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	app, err := findAppArg(db, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if app.ManagedBy.Valid {
+		return fmt.Errorf("app %v is managed by %v, change it there", app.Name, app.ManagedBy.String)
+	}
+
+	check, err := api.CheckDomains(db, app.ID, flags.Args()[1:])
+	if err != nil {
+		return err
+	}
+	if err := fieldsError(check.Fields, check.Conflicts); err != nil {
+		return err
+	}
+	printWarnings(check.Warnings)
+	list := check.Domains
+
+	id := strconv.FormatInt(app.ID, 10)
+	before := audit.App(db, id)
+	released, err := api.SetDomains(context.Background(), db, app.ID, list)
+	if err != nil {
+		return err
+	}
+	audit.Log(audit.Entry{
+		Action:     "app.domain",
+		TargetType: "app",
+		TargetID:   app.ID,
+		Before:     before,
+		After:      audit.App(db, id),
+	})
+	fmt.Printf("set domains of %v to %v\n", app.Name, strings.Join(list, ", "))
+
+	if *noSync {
+		return nil
+	}
+	if err := RemoveConfigForHosts(released); err != nil {
+		return fmt.Errorf("failed to remove the routes of %v: %w", strings.Join(released, ", "), err)
+	}
+	return syncApps(db, []string{id})
+}
+
+func syncCommand(args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	all := flags.Bool("all", false, "sync every app")
+	appArg := flags.String("app", "", "id or name of the app to sync")
+	flags.Parse(args)
+	if flags.NArg() > 0 || *all == (len(*appArg) > 0) {
+		return fmt.Errorf("pass either -all or -app")
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+
+	if !*all {
+		app, err := findAppArg(db, *appArg)
+		if err != nil {
+			return err
+		}
+		return syncApps(db, []string{strconv.FormatInt(app.ID, 10)})
+	}
+
+	list, err := apps.FindAll(db)
+	if err != nil {
+		return err
+	}
+	ids := []string{}
+	for _, app := range list {
+		ids = append(ids, strconv.FormatInt(app.ID, 10))
+	}
+	return syncApps(db, ids)
+}
+
+// syncApps pushes every app to caddy and reports each one, it only fails
+// once all of them were tried
+func syncApps(db *sql.DB, ids []string) error {
+	failed := 0
+	for _, id := range ids {
+		err := SyncConfigForApp(id)
+		entry := audit.Entry{
+			Action:     "app.sync",
+			TargetType: "app",
+			TargetID:   id,
+		}
+		if err != nil {
+			failed++
+			entry.After = map[string]string{"error": err.Error()}
+			fmt.Printf("app %v: failed, %v\n", id, err)
+		} else {
+			fmt.Printf("app %v: synced\n", id)
+		}
+		audit.Log(entry)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%v of %v apps failed to sync", failed, len(ids))
+	}
+	return nil
+}
+
+func configExportCommand(args []string) error {
+	flags := flag.NewFlagSet("config export", flag.ExitOnError)
+	output := flags.String("o", "", "write to the file instead of stdout")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return errUsage
+	}
+
+	config, err := caddy.GetConfigAtPath("")
+	if err != nil {
+		return err
+	}
+	var formatted bytes.Buffer
+	if err := json.Indent(&formatted, config, "", "  "); err != nil {
+		return err
+	}
+	formatted.WriteString("\n")
+
+	if len(*output) == 0 {
+		_, err := formatted.WriteTo(os.Stdout)
+		return err
+	}
+	return os.WriteFile(*output, formatted.Bytes(), 0o644)
+}
+
+func configImportCommand(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	var config []byte
+	var err error
+	if args[0] == "-" {
+		config, err = io.ReadAll(os.Stdin)
+	} else {
+		config, err = os.ReadFile(args[0])
+	}
+	if err != nil {
+		return err
+	}
+
+	problems := caddy.Validate(config)
+	for _, problem := range problems {
+		location := problem.Path
+		if problem.Line > 0 {
+			location = fmt.Sprintf("%v:%v %v", problem.Line, problem.Column, problem.Path)
+		}
+		fmt.Fprintf(os.Stderr, "%v: %v (%v)\n", problem.Severity, problem.Message, location)
+	}
+	if caddy.HasErrors(problems) {
+		return fmt.Errorf("config has errors, fix them before loading")
+	}
+
+	// the audit log lives in the database, open it before changing caddy
+	if _, err := openDatabase(); err != nil {
+		return err
+	}
+	before, _ := caddy.GetConfigAtPath("")
+	if err := caddy.SaveConfig(config); err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	audit.Log(audit.Entry{
+		Action:     "config.upload",
+		TargetType: "config",
+		Before:     before,
+		After:      config,
+	})
+	fmt.Println("config loaded")
+	return nil
+}
+
+func userCreateCommand(args []string) error {
+	flags := flag.NewFlagSet("user create", flag.ExitOnError)
+	username := flags.String("username", "", "username (required)")
+	password := flags.String("password", "", "password, read from stdin when empty")
+	role := flags.String("role", string(auth.RoleViewer), "viewer, operator or admin")
+	team := flags.String("team", "", "team of the user")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return errUsage
+	}
+
+	name := strings.TrimSpace(*username)
+	if len(name) == 0 {
+		return fmt.Errorf("-username is required")
+	}
+	if !auth.Role(*role).Valid() {
+		return fmt.Errorf("role must be viewer, operator or admin")
+	}
+	if len(*password) == 0 {
+		fmt.Fprint(os.Stderr, "Password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		*password = strings.TrimRight(line, "\r\n")
+	}
+	if len(*password) < 8 {
+		return fmt.Errorf("password must be at least 8 characters")
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	if _, err := users.FindByUsername(db, name); err == nil {
+		return fmt.Errorf("username %q is already taken", name)
+	} else if !errors.Is(err, data.ErrNotFound) {
+		return err
+	}
+
+	// the primary instance apps are attached to
+	if _, err := instances.FindOrCreatePrimary(db); err != nil {
+		return err
+	}
+
+	hash, err := auth.HashPassword(*password)
+	if err != nil {
+		return err
+	}
+	user := users.New()
+	user.Username = name
+	user.Password = hash
+	user.Role = *role
+	user.Team = sql.NullString{String: strings.TrimSpace(*team), Valid: len(strings.TrimSpace(*team)) > 0}
+	created, err := user.Save(db)
+	if err != nil {
+		return err
+	}
+	audit.Log(audit.Entry{
+		Action:     "user.create",
+		TargetType: "user",
+		TargetID:   created.ID,
+		After:      audit.User(created),
+	})
+	fmt.Printf("created %v %v (%v)\n", created.Role, created.Username, created.ID)
+	return nil
+}
+
+func configPrintCommand(args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(config.Get().Redacted())
+}
+
+func backupCommand(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	output := flags.String("o", "", "archive to write, defaults to caddy-ui-<time>.tar.gz in the current directory")
+	upload := flags.Bool("upload", false, "store the archive in backup_target and prune the old ones like automatic backups")
+	flags.Parse(args)
+	if flags.NArg() > 0 || (*upload && len(*output) > 0) {
+		return errUsage
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+
+	if *upload {
+		target, err := config.ParseBackupTarget(config.Get().BackupTarget)
+		if err != nil {
+			return err
+		}
+		if len(target.Dir) == 0 && target.Bucket == nil {
+			return fmt.Errorf("-upload needs backup_target")
+		}
+		result, err := backup.Run(context.Background(), db, backup.NewTarget(target), backup.RetentionFromConfig(config.Get()))
+		if result != nil {
+			printWarnings(result.Warnings)
+			fmt.Printf("stored %v\n", result.Name)
+			for _, name := range result.Pruned {
+				fmt.Printf("pruned %v\n", name)
+			}
+		}
+		return err
+	}
+
+	if len(*output) == 0 {
+		*output = backup.Filename(time.Now())
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	manifest, warnings, err := backup.Write(context.Background(), db, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*output)
+		return err
+	}
+	printWarnings(warnings)
+	audit.Log(audit.Entry{
+		Action:     "backup.create",
+		TargetType: "backup",
+		TargetID:   filepath.Base(*output),
+		After:      manifest,
+	})
+	fmt.Printf("wrote %v (%v files)\n", *output, len(manifest.Files))
+	return nil
+}
+
+func restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	filesRoot := flags.String("files-root", "", "directory the saved files are restored under, they go back to their own paths by default")
+	skipCaddy := flags.Bool("skip-caddy", false, "don't load the saved config into caddy")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errUsage
+	}
+
+	databasePath, err := backup.DatabasePath()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	manifest, warnings, err := backup.Restore(f, databasePath, backup.RestoreOptions{
+		FilesRoot: *filesRoot,
+		SkipCaddy: *skipCaddy,
+	})
+	printWarnings(warnings)
+	if err != nil {
+		return err
+	}
+
+	// the restored database is the one that gets the audit entry, a
+	// backup of an older version is brought up to date first like serve
+	// would on start
+	if _, err := migrateDatabase(); err != nil {
+		return fmt.Errorf("restored the database but %w", err)
+	}
+	audit.Log(audit.Entry{
+		Action:     "backup.restore",
+		TargetType: "backup",
+		TargetID:   filepath.Base(flags.Arg(0)),
+		After:      manifest,
+	})
+	fmt.Printf("restored the backup of %v into %v\n", manifest.CreatedAt.Format(time.RFC3339), databasePath)
+	if manifest.CaddyConfig && *skipCaddy {
+		fmt.Println("caddy's config wasn't loaded, sync the apps with: caddy-ui sync -all")
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadSettings(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	contents := `{"trust_proxy": "true", "oidc_issuer": "https://idp.example.com", "oidc_client_secret": "from-file"}`
+	if err := os.WriteFile(file, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("COOKIE_SECURE", "true")
+	t.Setenv("OIDC_CLIENT_SECRET", "from-env")
+
+	c, args, err := Load([]string{"-config", file, "-oidc-client-id", "caddy-ui", "serve"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 1 || args[0] != "serve" {
+		t.Errorf("args = %v", args)
+	}
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"cookie_secure", c.CookieSecure, "true"},
+		{"trust_proxy", c.TrustProxy, "true"},
+		{"oidc_issuer", c.OIDCIssuer, "https://idp.example.com"},
+		{"oidc_client_id", c.OIDCClientID, "caddy-ui"},
+		{"oidc_client_secret", c.OIDCClientSecret, "from-env"},
+		{"oidc_groups_claim", c.OIDCGroupsClaim, "groups"},
+		{"oidc_auto_provision", c.OIDCAutoProvision, "true"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+	if secret := c.Redacted().OIDCClientSecret; secret == "from-env" {
+		t.Error("Redacted() kept the oidc client secret")
+	}
+
+	invalid := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"-trust-proxy", "yes"}, `trust_proxy "yes" must be true or false`},
+		{[]string{"-oidc-auto-provision", "0"}, `oidc_auto_provision "0" must be true or false`},
+		{[]string{"-oidc-issuer", "idp.example.com"}, "oidc_issuer"},
+	}
+	for _, tt := range invalid {
+		if _, _, err := Load(tt.args); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Load(%v) error = %v, want %q", tt.args, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Package cron parses the usual five field cron expressions (minute,
+// hour, day of month, month, day of week) and works out when they fire
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed expression, each field is a set of the values it
+// matches
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	// day of month and day of week are matched like cron does: when both
+	// are restricted (don't start with `*`) either one is enough
+	domAny, dowAny bool
+}
+
+type field struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var fields = []field{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{name: "day of week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse reads an expression such as `0 3 * * *` or `*/15 * * * mon-fri`,
+// the @daily style macros work too
+func Parse(expression string) (Schedule, error) {
+	expression = strings.TrimSpace(expression)
+	if macro, ok := macros[strings.ToLower(expression)]; ok {
+		expression = macro
+	}
+	parts := strings.Fields(expression)
+	if len(parts) != len(fields) {
+		return Schedule{}, fmt.Errorf("cron expression %q must have 5 fields: minute hour day-of-month month day-of-week", expression)
+	}
+
+	sets := make([]uint64, len(fields))
+	for i, part := range parts {
+		set, err := parseField(part, fields[i])
+		if err != nil {
+			return Schedule{}, fmt.Errorf("cron expression %q: %w", expression, err)
+		}
+		sets[i] = set
+	}
+	// 7 is sunday too
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return Schedule{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		domAny: strings.HasPrefix(parts[2], "*"),
+		dowAny: strings.HasPrefix(parts[4], "*"),
+	}, nil
+}
+
+func parseField(part string, f field) (uint64, error) {
+	var set uint64
+	for _, item := range strings.Split(part, ",") {
+		valueRange, stepText, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q in the %v field", stepText, f.name)
+			}
+			step = n
+		}
+
+		from, to := f.min, f.max
+		if valueRange != "*" {
+			fromText, toText, isRange := strings.Cut(valueRange, "-")
+			var err error
+			if from, err = parseValue(fromText, f); err != nil {
+				return 0, err
+			}
+			to = from
+			if isRange {
+				if to, err = parseValue(toText, f); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				// `5/10` means from 5 to the end every 10
+				to = f.max
+			}
+			if from > to {
+				return 0, fmt.Errorf("invalid range %q in the %v field", valueRange, f.name)
+			}
+		}
+		for value := from; value <= to; value += step {
+			set |= 1 << value
+		}
+	}
+	return set, nil
+}
+
+func parseValue(text string, f field) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(text, name) {
+			return f.min + i, nil
+		}
+	}
+	value, err := strconv.Atoi(text)
+	if err != nil || value < f.min || value > f.max {
+		return 0, fmt.Errorf("%q is not a valid %v, it must be between %v and %v", text, f.name, f.min, f.max)
+	}
+	return value, nil
+}
+
+func (s Schedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<t.Day()) != 0
+	dowMatch := s.dow&(1<<int(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// Next returns the first time after t the schedule fires, in t's
+// location. The zero time is returned for expressions that never fire
+// (ex: the 31st of february)
+func (s Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// a matching day comes within a few years, unless there is none
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<int(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<t.Hour()) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<t.Minute()) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
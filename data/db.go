@@ -2,9 +2,9 @@ package data
 
 import (
 	"database/sql"
-	"fmt"
+	"strings"
 
-	"github.com/barelyhuman/go/env"
+	"github.com/barelyhuman/caddy-ui/config"
 )
 
 var connection *sql.DB
@@ -13,11 +13,61 @@ func GetDatabaseHandle() (*sql.DB, error) {
 	if connection != nil {
 		return connection, nil
 	}
-	dsn := env.Get("DATABASE_URL", "")
-	if len(dsn) == 0 {
-		return &sql.DB{}, fmt.Errorf("failed to get DSN for database, DATABASE_URL is a required env variable")
+	database, err := config.ParseDatabaseURL(config.Get().DatabaseURL)
+	if err != nil {
+		return &sql.DB{}, err
 	}
-	db, err := sql.Open("sqlite3", "./data.sqlite3")
+	driverName := "sqlite3"
+	dsn := sqliteDSN(database.DSN)
+	if database.Dialect == config.DialectPostgres {
+		driverName = postgresDriverName
+		dsn = database.DSN
+	}
+	db, err := sql.Open(driverName, dsn)
 	connection = db
 	return connection, err
 }
+
+// Dialect tells which engine the handle talks to, for the few places
+// where the SQL differs (ex: migrations)
+func Dialect(db *sql.DB) string {
+	if _, ok := db.Driver().(rebindDriver); ok {
+		return config.DialectPostgres
+	}
+	return config.DialectSQLite
+}
+
+// sqliteDefaults are set on every sqlite connection unless the database
+// URL already sets them: foreign keys are off by default in sqlite, WAL
+// lets the UI read while a sync writes and the busy timeout waits for a
+// lock instead of failing with "database is locked"
+var sqliteDefaults = []struct {
+	names []string
+	param string
+}{
+	{[]string{"_foreign_keys", "_fk"}, "_foreign_keys=on"},
+	{[]string{"_journal_mode", "_journal"}, "_journal_mode=WAL"},
+	{[]string{"_busy_timeout", "_timeout"}, "_busy_timeout=5000"},
+}
+
+func sqliteDSN(dsn string) string {
+	path, query, _ := strings.Cut(dsn, "?")
+	params := []string{}
+	if len(query) > 0 {
+		params = append(params, query)
+	}
+	for _, d := range sqliteDefaults {
+		set := false
+		for _, name := range d.names {
+			for _, pair := range strings.Split(query, "&") {
+				if key, _, _ := strings.Cut(pair, "="); key == name {
+					set = true
+				}
+			}
+		}
+		if !set {
+			params = append(params, d.param)
+		}
+	}
+	return path + "?" + strings.Join(params, "&")
+}
@@ -0,0 +1,202 @@
+package api_tokens
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/barelyhuman/caddy-ui/data"
+)
+
+const (
+	KindPersonal = "personal"
+	KindService  = "service"
+)
+
+type ApiTokens struct {
+	Name       string         `db:"api_tokens.name"`
+	TokenHash  string         `db:"api_tokens.token_hash"`
+	Prefix     string         `db:"api_tokens.prefix"`
+	Kind       string         `db:"api_tokens.kind"`
+	UserID     sql.NullInt64  `db:"api_tokens.user_id"`
+	Scope      string         `db:"api_tokens.scope"`
+	AppIDs     sql.NullString `db:"api_tokens.app_ids"`
+	ExpiresAt  sql.NullTime   `db:"api_tokens.expires_at"`
+	LastUsedAt sql.NullTime   `db:"api_tokens.last_used_at"`
+	CreatedAt  time.Time      `db:"api_tokens.created_at"`
+	UpdatedAt  time.Time      `db:"api_tokens.updated_at"`
+}
+
+type ApiTokensWithIdentifier struct {
+	ID int64 `db:"api_tokens.id"`
+	ApiTokens
+}
+
+func New() *ApiTokens {
+	return &ApiTokens{}
+}
+
+// Apps returns the app ids the token is limited to, nil if it can
+// access every app
+func (a ApiTokens) Apps() []string {
+	if !a.AppIDs.Valid || len(strings.TrimSpace(a.AppIDs.String)) == 0 {
+		return nil
+	}
+	ids := []string{}
+	for _, id := range strings.Split(a.AppIDs.String, ",") {
+		id = strings.TrimSpace(id)
+		if _, err := strconv.ParseInt(id, 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (a ApiTokens) Expired(now time.Time) bool {
+	return a.ExpiresAt.Valid && now.After(a.ExpiresAt.Time)
+}
+
+const columns = `id,name,token_hash,prefix,kind,user_id,scope,app_ids,expires_at,last_used_at,created_at,updated_at`
+
+func scanToken(row interface{ Scan(...any) error }) (*ApiTokensWithIdentifier, error) {
+	var x ApiTokensWithIdentifier
+	err := row.Scan(
+		&x.ID,
+		&x.Name,
+		&x.TokenHash,
+		&x.Prefix,
+		&x.Kind,
+		&x.UserID,
+		&x.Scope,
+		&x.AppIDs,
+		&x.ExpiresAt,
+		&x.LastUsedAt,
+		&x.CreatedAt,
+		&x.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &x, nil
+}
+
+// Store reads and writes API tokens through a database handle or a
+// transaction
+type Store struct {
+	db data.Querier
+}
+
+func NewStore(db data.Querier) *Store {
+	return &Store{db: db}
+}
+
+func (s *Store) findOne(ctx context.Context, key any, query string, args ...any) (*ApiTokensWithIdentifier, error) {
+	x, err := scanToken(s.db.QueryRowContext(ctx, query, args...))
+	if err == sql.ErrNoRows {
+		return nil, &data.NotFoundError{Table: "api_tokens", Key: key}
+	}
+	return x, err
+}
+
+func (s *Store) findMany(ctx context.Context, query string, args ...any) ([]ApiTokensWithIdentifier, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	collection := []ApiTokensWithIdentifier{}
+	for rows.Next() {
+		x, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		collection = append(collection, *x)
+	}
+	return collection, rows.Err()
+}
+
+// FindByUserId lists the personal tokens of the user
+func (s *Store) FindByUserId(ctx context.Context, userID int64) ([]ApiTokensWithIdentifier, error) {
+	return s.findMany(ctx, `select `+columns+` from api_tokens where kind = ? and user_id = ? order by id`, KindPersonal, userID)
+}
+
+func (s *Store) FindServiceTokens(ctx context.Context) ([]ApiTokensWithIdentifier, error) {
+	return s.findMany(ctx, `select `+columns+` from api_tokens where kind = ? order by id`, KindService)
+}
+
+func (s *Store) FindByTokenHash(ctx context.Context, tokenHash string) (*ApiTokensWithIdentifier, error) {
+	return s.findOne(ctx, tokenHash, `select `+columns+` from api_tokens where token_hash = ?`, tokenHash)
+}
+
+func (s *Store) FindById(ctx context.Context, id int64) (*ApiTokensWithIdentifier, error) {
+	return s.findOne(ctx, id, `select `+columns+` from api_tokens where id = ?`, id)
+}
+
+func (s *Store) Create(ctx context.Context, a *ApiTokens) (*ApiTokensWithIdentifier, error) {
+	result := &ApiTokensWithIdentifier{
+		ApiTokens: *a,
+	}
+	err := s.db.QueryRowContext(ctx,
+		`insert into api_tokens (name,token_hash,prefix,kind,user_id,scope,app_ids,expires_at) values (?,?,?,?,?,?,?,?) returning id`,
+		a.Name,
+		a.TokenHash,
+		a.Prefix,
+		a.Kind,
+		a.UserID,
+		a.Scope,
+		a.AppIDs,
+		a.ExpiresAt,
+	).Scan(&result.ID)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *Store) TouchLastUsed(ctx context.Context, id int64, now time.Time) error {
+	result, err := s.db.ExecContext(ctx, "update api_tokens set last_used_at = ? where id = ?", now.UTC(), id)
+	if err != nil {
+		return err
+	}
+	return data.ExpectAffected(result, "api_tokens", id)
+}
+
+func (s *Store) Delete(ctx context.Context, id int64) error {
+	result, err := s.db.ExecContext(ctx, "delete from api_tokens where id = ?", id)
+	if err != nil {
+		return err
+	}
+	return data.ExpectAffected(result, "api_tokens", id)
+}
+
+func FindByUserId(db *sql.DB, userID int64) ([]ApiTokensWithIdentifier, error) {
+	return NewStore(db).FindByUserId(context.Background(), userID)
+}
+
+func FindServiceTokens(db *sql.DB) ([]ApiTokensWithIdentifier, error) {
+	return NewStore(db).FindServiceTokens(context.Background())
+}
+
+// FindByTokenHash returns data.ErrNotFound if there's no such token
+func FindByTokenHash(db *sql.DB, tokenHash string) (*ApiTokensWithIdentifier, error) {
+	return NewStore(db).FindByTokenHash(context.Background(), tokenHash)
+}
+
+func FindById(db *sql.DB, id int64) (*ApiTokensWithIdentifier, error) {
+	return NewStore(db).FindById(context.Background(), id)
+}
+
+func DeleteById(db *sql.DB, id int64) error {
+	return NewStore(db).Delete(context.Background(), id)
+}
+
+func TouchLastUsed(db *sql.DB, id int64, now time.Time) error {
+	return NewStore(db).TouchLastUsed(context.Background(), id, now)
+}
+
+func (a *ApiTokens) Save(db *sql.DB) (*ApiTokensWithIdentifier, error) {
+	return NewStore(db).Create(context.Background(), a)
+}
@@ -0,0 +1,120 @@
+package app_options
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/barelyhuman/caddy-ui/data"
+)
+
+const (
+	Root               = "root"
+	RedirectTo         = "redirect_to"
+	RedirectStatusCode = "redirect_status_code"
+)
+
+type AppOptions struct {
+	AppId     int64          `db:"app_options.app_id"`
+	Name      string         `db:"app_options.name"`
+	Value     sql.NullString `db:"app_options.value"`
+	CreatedAt time.Time      `db:"app_options.created_at"`
+	UpdatedAt time.Time      `db:"app_options.updated_at"`
+}
+
+type AppOptionsWithIdentifier struct {
+	ID int64 `db:"app_options.id"`
+	AppOptions
+}
+
+func New() *AppOptions {
+	return &AppOptions{}
+}
+
+// Store reads and writes app options through a database handle or a
+// transaction
+type Store struct {
+	db data.Querier
+}
+
+func NewStore(db data.Querier) *Store {
+	return &Store{db: db}
+}
+
+// FindByAppId returns the options of the app as a name => value map
+func (s *Store) FindByAppId(ctx context.Context, appID int64) (map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx, `select name,value from app_options where app_id = ?`, appID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	options := map[string]string{}
+	for rows.Next() {
+		var name string
+		var value sql.NullString
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		options[name] = value.String
+	}
+	return options, rows.Err()
+}
+
+// Save inserts the option or replaces the value of an existing option
+// with the same name for the app
+func (s *Store) Save(ctx context.Context, a *AppOptions) (*AppOptionsWithIdentifier, error) {
+	result := &AppOptionsWithIdentifier{
+		AppOptions: *a,
+	}
+	err := s.db.QueryRowContext(ctx,
+		`insert into app_options (app_id,name,value) values(?,?,?)
+		on conflict(app_id,name) do update set value = excluded.value returning id`,
+		a.AppId,
+		a.Name,
+		a.Value,
+	).Scan(&result.ID)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *Store) Delete(ctx context.Context, appID int64, name string) error {
+	result, err := s.db.ExecContext(ctx, `delete from app_options where app_id = ? and name = ?`, appID, name)
+	if err != nil {
+		return err
+	}
+	return data.ExpectAffected(result, "app_options", name)
+}
+
+// DeleteByAppId removes every option of the app, having none isn't an
+// error
+func (s *Store) DeleteByAppId(ctx context.Context, appID int64) error {
+	_, err := s.db.ExecContext(ctx, "delete from app_options where app_id = ?", appID)
+	return err
+}
+
+func DeleteByAppId(db *sql.DB, appId string) error {
+	appID, err := strconv.ParseInt(appId, 10, 64)
+	if err != nil {
+		return nil
+	}
+	return NewStore(db).DeleteByAppId(context.Background(), appID)
+}
+
+// FindByAppId returns the options of the app as a name => value map
+func FindByAppId(db *sql.DB, appId string) (map[string]string, error) {
+	appID, err := strconv.ParseInt(appId, 10, 64)
+	if err != nil {
+		return map[string]string{}, nil
+	}
+	return NewStore(db).FindByAppId(context.Background(), appID)
+}
+
+// Save inserts the option or replaces the value of an existing option
+// with the same name for the app
+func (a *AppOptions) Save(db *sql.DB) (*AppOptionsWithIdentifier, error) {
+	return NewStore(db).Save(context.Background(), a)
+}
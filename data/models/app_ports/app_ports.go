@@ -1,11 +1,13 @@
 package app_ports
 
 import (
+	"context"
 	"database/sql"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/barelyhuman/caddy-ui/utils"
-	"github.com/blockloop/scan/v2"
+	"github.com/barelyhuman/caddy-ui/data"
 )
 
 type AppPorts struct {
@@ -25,60 +27,198 @@ func New() *AppPorts {
 	return &AppPorts{}
 }
 
-func DeleteByAppId(db *sql.DB, appId string) error {
-	_, err := db.Exec("delete from app_ports where app_id = ?", appId)
-	return err
+// Dial treats a bare port as a local upstream, anything with a host
+// (ex: imported remote upstreams) is dialed as is
+func (a AppPorts) Dial() string {
+	if strings.Contains(a.Port, ":") {
+		return a.Port
+	}
+	return "127.0.0.1:" + a.Port
 }
 
-func FindByAppId(db *sql.DB, appId string) (*AppPortsWithIdentifier, error) {
-	var record AppPortsWithIdentifier
+// DialKey is what makes two upstreams the same, matches the
+// idx_app_ports_dial index
+func DialKey(port string) string {
+	return strings.ToLower(AppPorts{Port: strings.TrimSpace(port)}.Dial())
+}
 
-	cols, _ := scan.Columns(&record)
+const columns = `id,port,app_id,domain_id,created_at,updated_at`
+
+// Store reads and writes app ports through a database handle or a
+// transaction
+type Store struct {
+	db data.Querier
+}
+
+func NewStore(db data.Querier) *Store {
+	return &Store{db: db}
+}
 
-	res, err := db.Query(`select `+utils.Join(cols, ",")+` from app_ports where app_id = ? limit 1`, appId)
+func scanPorts(rows *sql.Rows) ([]AppPortsWithIdentifier, error) {
+	collection := []AppPortsWithIdentifier{}
+	for rows.Next() {
+		x := AppPortsWithIdentifier{}
+		var port sql.NullString
+		if err := rows.Scan(&x.ID, &port, &x.AppId, &x.DomainId, &x.CreatedAt, &x.UpdatedAt); err != nil {
+			return nil, err
+		}
+		x.Port = port.String
+		collection = append(collection, x)
+	}
+	return collection, rows.Err()
+}
+
+// FindAll returns the ports of every app, oldest first
+func (s *Store) FindAll(ctx context.Context) ([]AppPortsWithIdentifier, error) {
+	rows, err := s.db.QueryContext(ctx, `select `+columns+` from app_ports order by id`)
 	if err != nil {
 		return nil, err
 	}
-	defer res.Close()
-
-	err = scan.Row(&record, res)
+	defer rows.Close()
+	return scanPorts(rows)
+}
 
+// FindAllByAppId returns every port of the app, oldest first
+func (s *Store) FindAllByAppId(ctx context.Context, appID int64) ([]AppPortsWithIdentifier, error) {
+	rows, err := s.db.QueryContext(ctx, `select `+columns+` from app_ports where app_id = ? order by id`, appID)
 	if err != nil {
 		return nil, err
 	}
-
-	return &record, nil
+	defer rows.Close()
+	return scanPorts(rows)
 }
 
-func (a *AppPorts) Save(db *sql.DB) (*AppPortsWithIdentifier, error) {
-	tx, err := db.Begin()
+func (s *Store) FindById(ctx context.Context, id int64) (*AppPortsWithIdentifier, error) {
+	rows, err := s.db.QueryContext(ctx, `select `+columns+` from app_ports where id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	collection, err := scanPorts(rows)
 	if err != nil {
 		return nil, err
 	}
+	if len(collection) == 0 {
+		return nil, &data.NotFoundError{Table: "app_ports", Key: id}
+	}
+	return &collection[0], nil
+}
 
-	query := `insert into app_ports (port,app_id,domain_id) values(?,?,?)`
+// AppIdsByDial maps every upstream (as dialed, lowercased) to the app
+// using it, an upstream can only be used by one app
+func (s *Store) AppIdsByDial(ctx context.Context) (map[string]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `select port, app_id from app_ports`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mapping := map[string]int64{}
+	for rows.Next() {
+		var port sql.NullString
+		var appID int64
+		if err := rows.Scan(&port, &appID); err != nil {
+			return nil, err
+		}
+		if port.Valid {
+			mapping[DialKey(port.String)] = appID
+		}
+	}
+	return mapping, rows.Err()
+}
 
-	res, err := tx.Exec(query,
+func (s *Store) Create(ctx context.Context, a *AppPorts) (*AppPortsWithIdentifier, error) {
+	result := &AppPortsWithIdentifier{
+		AppPorts: *a,
+	}
+	err := s.db.QueryRowContext(ctx,
+		`insert into app_ports (port,app_id,domain_id) values (?,?,?) returning id`,
 		a.Port,
 		a.AppId,
 		a.DomainId,
-	)
-
+	).Scan(&result.ID)
 	if err != nil {
 		return nil, err
 	}
+	return result, nil
+}
 
-	result := &AppPortsWithIdentifier{
-		AppPorts: *a,
+func (s *Store) Update(ctx context.Context, a *AppPortsWithIdentifier) error {
+	result, err := s.db.ExecContext(ctx, `update app_ports set port = ?, domain_id = ? where id = ?`, a.Port, a.DomainId, a.ID)
+	if err != nil {
+		return err
 	}
-	result.ID, err = res.LastInsertId()
+	return data.ExpectAffected(result, "app_ports", a.ID)
+}
+
+func (s *Store) Delete(ctx context.Context, id int64) error {
+	result, err := s.db.ExecContext(ctx, "delete from app_ports where id = ?", id)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return data.ExpectAffected(result, "app_ports", id)
+}
 
-	if err = tx.Commit(); err != nil {
+// DeleteByAppId removes every port of the app, having none isn't an
+// error
+func (s *Store) DeleteByAppId(ctx context.Context, appID int64) error {
+	_, err := s.db.ExecContext(ctx, "delete from app_ports where app_id = ?", appID)
+	return err
+}
+
+func DeleteById(db *sql.DB, id int64) error {
+	return NewStore(db).Delete(context.Background(), id)
+}
+
+func DeleteByAppId(db *sql.DB, appId string) error {
+	appID, err := strconv.ParseInt(appId, 10, 64)
+	if err != nil {
+		return nil
+	}
+	return NewStore(db).DeleteByAppId(context.Background(), appID)
+}
+
+// FindByAppId returns the oldest port of the app, data.ErrNotFound when
+// the app has none (ex: file servers and redirects)
+func FindByAppId(db *sql.DB, appId string) (*AppPortsWithIdentifier, error) {
+	collection, err := FindAllByAppId(db, appId)
+	if err != nil {
 		return nil, err
 	}
+	if len(collection) == 0 {
+		return nil, &data.NotFoundError{Table: "app_ports", Key: appId}
+	}
+	return &collection[0], nil
+}
 
-	return result, nil
+// FindAllByAppId returns every port of the app, oldest first
+func FindAllByAppId(db *sql.DB, appId string) ([]AppPortsWithIdentifier, error) {
+	appID, err := strconv.ParseInt(appId, 10, 64)
+	if err != nil {
+		return []AppPortsWithIdentifier{}, nil
+	}
+	return NewStore(db).FindAllByAppId(context.Background(), appID)
+}
+
+// FindById returns data.ErrNotFound when the port doesn't exist
+func FindById(db *sql.DB, id string) (*AppPortsWithIdentifier, error) {
+	portID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, &data.NotFoundError{Table: "app_ports", Key: id}
+	}
+	return NewStore(db).FindById(context.Background(), portID)
+}
+
+// AppIdsByDial maps every upstream (as dialed, lowercased) to the app
+// using it
+func AppIdsByDial(db *sql.DB) (map[string]int64, error) {
+	return NewStore(db).AppIdsByDial(context.Background())
+}
+
+func (a *AppPortsWithIdentifier) Update(db *sql.DB) error {
+	return NewStore(db).Update(context.Background(), a)
+}
+
+func (a *AppPorts) Save(db *sql.DB) (*AppPortsWithIdentifier, error) {
+	return NewStore(db).Create(context.Background(), a)
 }
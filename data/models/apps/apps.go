@@ -1,16 +1,24 @@
 package apps
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"strconv"
 	"time"
+
+	"github.com/barelyhuman/caddy-ui/data"
 )
 
 type Apps struct {
 	Name       string         `db:"apps.name"`
 	InstanceID int64          `db:"apps.instance_id"`
 	Type       sql.NullString `db:"apps.type"`
-	CreatedAt  time.Time      `db:"apps.created_at"`
-	UpdatedAt  time.Time      `db:"apps.updated_at"`
+	Team       sql.NullString `db:"apps.team"`
+	// ManagedBy is the apps file the app comes from, see gitops
+	ManagedBy sql.NullString `db:"apps.managed_by"`
+	CreatedAt time.Time      `db:"apps.created_at"`
+	UpdatedAt time.Time      `db:"apps.updated_at"`
 }
 
 type AppsWithIdentifier struct {
@@ -22,97 +30,172 @@ func New() *Apps {
 	return &Apps{}
 }
 
-func DeleteById(db *sql.DB, id int64) error {
-	_, err := db.Exec("delete from apps where id = ?", id)
-	return err
-}
+const columns = `id,name,instance_id,type,team,managed_by,created_at,updated_at`
 
-func FindAll(db *sql.DB) ([]AppsWithIdentifier, error) {
-	res, err := db.Query(`
-		select id,name,instance_id,type,created_at,updated_at from apps
-	`)
-	if err != nil {
-		return []AppsWithIdentifier{}, err
-	}
+// Store reads and writes apps through a database handle or a transaction
+type Store struct {
+	db data.Querier
+}
 
-	if res == nil {
-		return []AppsWithIdentifier{}, nil
-	}
+func NewStore(db data.Querier) *Store {
+	return &Store{db: db}
+}
 
+func scanApps(rows *sql.Rows) ([]AppsWithIdentifier, error) {
 	collection := []AppsWithIdentifier{}
-	for res.Next() {
+	for rows.Next() {
 		x := AppsWithIdentifier{}
-		res.Scan(
+		if err := rows.Scan(
 			&x.ID,
 			&x.Name,
 			&x.InstanceID,
 			&x.Type,
+			&x.Team,
+			&x.ManagedBy,
 			&x.CreatedAt,
 			&x.UpdatedAt,
-		)
+		); err != nil {
+			return nil, err
+		}
 		collection = append(collection, x)
 	}
-	return collection, nil
+	return collection, rows.Err()
 }
 
-func FindById(db *sql.DB, id string) (*AppsWithIdentifier, error) {
-	var x AppsWithIdentifier
-	res, err := db.Query(`
-		select id,name,instance_id,type,created_at,updated_at from apps where id = ?
-	`, id)
+func (s *Store) findOne(ctx context.Context, key any, query string, args ...any) (*AppsWithIdentifier, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return &x, err
+		return nil, err
 	}
-	defer res.Close()
-
-	if res == nil {
-		return &x, nil
+	defer rows.Close()
+	collection, err := scanApps(rows)
+	if err != nil {
+		return nil, err
 	}
-
-	for res.Next() {
-		res.Scan(
-			&x.ID,
-			&x.Name,
-			&x.InstanceID,
-			&x.Type,
-			&x.CreatedAt,
-			&x.UpdatedAt,
-		)
-		return &x, nil
+	if len(collection) == 0 {
+		return nil, &data.NotFoundError{Table: "apps", Key: key}
 	}
-
-	return &x, nil
+	return &collection[0], nil
 }
 
-func (a *Apps) Save(db *sql.DB) (*AppsWithIdentifier, error) {
-	tx, err := db.Begin()
+func (s *Store) FindAll(ctx context.Context) ([]AppsWithIdentifier, error) {
+	rows, err := s.db.QueryContext(ctx, `select `+columns+` from apps order by id`)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+	return scanApps(rows)
+}
+
+func (s *Store) FindById(ctx context.Context, id int64) (*AppsWithIdentifier, error) {
+	return s.findOne(ctx, id, `select `+columns+` from apps where id = ?`, id)
+}
 
-	stmt, _ := tx.Prepare(`insert into apps (name,instance_id,type) values (?,?,?)`)
+func (s *Store) FindByName(ctx context.Context, name string) (*AppsWithIdentifier, error) {
+	return s.findOne(ctx, name, `select `+columns+` from apps where name = ?`, name)
+}
 
-	res, err := stmt.Exec(
+func (s *Store) Create(ctx context.Context, a *Apps) (*AppsWithIdentifier, error) {
+	result := &AppsWithIdentifier{
+		Apps: *a,
+	}
+	err := s.db.QueryRowContext(ctx,
+		`insert into apps (name,instance_id,type,team,managed_by) values (?,?,?,?,?) returning id`,
 		a.Name,
 		a.InstanceID,
 		a.Type,
+		a.Team,
+		a.ManagedBy,
+	).Scan(&result.ID)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *Store) Update(ctx context.Context, a *AppsWithIdentifier) error {
+	result, err := s.db.ExecContext(ctx,
+		`update apps set name = ?, type = ?, team = ?, managed_by = ? where id = ?`,
+		a.Name,
+		a.Type,
+		a.Team,
+		a.ManagedBy,
+		a.ID,
 	)
+	if err != nil {
+		return err
+	}
+	return data.ExpectAffected(result, "apps", a.ID)
+}
 
+func (s *Store) SetTeam(ctx context.Context, id int64, team sql.NullString) error {
+	result, err := s.db.ExecContext(ctx, "update apps set team = ? where id = ?", team, id)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return data.ExpectAffected(result, "apps", id)
+}
 
-	result := &AppsWithIdentifier{
-		Apps: *a,
+// Delete only removes the app row, use store.Atomic to remove the
+// domains, ports and options along with it
+func (s *Store) Delete(ctx context.Context, id int64) error {
+	result, err := s.db.ExecContext(ctx, "delete from apps where id = ?", id)
+	if err != nil {
+		return err
 	}
-	result.ID, err = res.LastInsertId()
+	return data.ExpectAffected(result, "apps", id)
+}
+
+func DeleteById(db *sql.DB, id int64) error {
+	return NewStore(db).Delete(context.Background(), id)
+}
+
+func SetTeam(db *sql.DB, id string, team sql.NullString) error {
+	appID, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
-		return nil, err
+		return &data.NotFoundError{Table: "apps", Key: id}
 	}
+	return NewStore(db).SetTeam(context.Background(), appID, team)
+}
 
-	if err = tx.Commit(); err != nil {
-		return nil, err
+// FindByName is used to keep app names unique, ok is false when there is
+// no app with the name
+func FindByName(db *sql.DB, name string) (*AppsWithIdentifier, bool, error) {
+	x, err := NewStore(db).FindByName(context.Background(), name)
+	if errors.Is(err, data.ErrNotFound) {
+		return nil, false, nil
 	}
+	if err != nil {
+		return nil, false, err
+	}
+	return x, true, nil
+}
 
-	return result, nil
+func FindAll(db *sql.DB) ([]AppsWithIdentifier, error) {
+	return NewStore(db).FindAll(context.Background())
+}
+
+// FindById returns an empty app (ID 0) when it doesn't exist, the Store
+// version returns data.ErrNotFound instead
+func FindById(db *sql.DB, id string) (*AppsWithIdentifier, error) {
+	appID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return &AppsWithIdentifier{}, nil
+	}
+	x, err := NewStore(db).FindById(context.Background(), appID)
+	if errors.Is(err, data.ErrNotFound) {
+		return &AppsWithIdentifier{}, nil
+	}
+	if err != nil {
+		return &AppsWithIdentifier{}, err
+	}
+	return x, nil
+}
+
+func (a *Apps) Save(db *sql.DB) (*AppsWithIdentifier, error) {
+	return NewStore(db).Create(context.Background(), a)
+}
+
+func (a *AppsWithIdentifier) Update(db *sql.DB) error {
+	return NewStore(db).Update(context.Background(), a)
 }
@@ -0,0 +1,161 @@
+package audit_log
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+type AuditLog struct {
+	Actor      string         `db:"audit_log.actor"`
+	Action     string         `db:"audit_log.action"`
+	TargetType string         `db:"audit_log.target_type"`
+	TargetID   sql.NullString `db:"audit_log.target_id"`
+	Before     sql.NullString `db:"audit_log.before"`
+	After      sql.NullString `db:"audit_log.after"`
+	ClientIP   sql.NullString `db:"audit_log.client_ip"`
+	CreatedAt  time.Time      `db:"audit_log.created_at"`
+}
+
+type AuditLogWithIdentifier struct {
+	ID int64 `db:"audit_log.id"`
+	AuditLog
+}
+
+// Filter narrows down Find and Count, zero values are ignored
+type Filter struct {
+	Actor      string
+	Action     string
+	TargetType string
+	TargetID   string
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+	Offset     int
+}
+
+func New() *AuditLog {
+	return &AuditLog{}
+}
+
+func (f Filter) where() (string, []any) {
+	clauses := []string{}
+	args := []any{}
+	if len(f.Actor) > 0 {
+		clauses = append(clauses, "actor = ?")
+		args = append(args, f.Actor)
+	}
+	if len(f.Action) > 0 {
+		clauses = append(clauses, "action = ?")
+		args = append(args, f.Action)
+	}
+	if len(f.TargetType) > 0 {
+		clauses = append(clauses, "target_type = ?")
+		args = append(args, f.TargetType)
+	}
+	if len(f.TargetID) > 0 {
+		clauses = append(clauses, "target_id = ?")
+		args = append(args, f.TargetID)
+	}
+	if !f.Since.IsZero() {
+		clauses = append(clauses, "created_at >= ?")
+		args = append(args, f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		clauses = append(clauses, "created_at < ?")
+		args = append(args, f.Until.UTC())
+	}
+	if len(clauses) == 0 {
+		return "", args
+	}
+	return " where " + strings.Join(clauses, " and "), args
+}
+
+// Find returns the matching entries, newest first
+func Find(db *sql.DB, filter Filter) ([]AuditLogWithIdentifier, error) {
+	where, args := filter.where()
+	query := `select id,actor,action,target_type,target_id,before,after,client_ip,created_at from audit_log` + where + ` order by id desc`
+	if filter.Limit > 0 {
+		query += ` limit ? offset ?`
+		args = append(args, filter.Limit, filter.Offset)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	collection := []AuditLogWithIdentifier{}
+	for rows.Next() {
+		x := AuditLogWithIdentifier{}
+		if err := rows.Scan(
+			&x.ID,
+			&x.Actor,
+			&x.Action,
+			&x.TargetType,
+			&x.TargetID,
+			&x.Before,
+			&x.After,
+			&x.ClientIP,
+			&x.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		collection = append(collection, x)
+	}
+	return collection, rows.Err()
+}
+
+func Count(db *sql.DB, filter Filter) (int, error) {
+	where, args := filter.where()
+	var count int
+	err := db.QueryRow(`select count(*) from audit_log`+where, args...).Scan(&count)
+	return count, err
+}
+
+// Distinct returns the values of a column for the filter dropdowns
+func Distinct(db *sql.DB, column string) ([]string, error) {
+	switch column {
+	case "actor", "action", "target_type":
+	default:
+		return nil, sql.ErrNoRows
+	}
+	rows, err := db.Query(`select distinct ` + column + ` from audit_log order by ` + column)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []string{}
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// Save appends the entry, there is no update or delete
+func (a *AuditLog) Save(db *sql.DB) (*AuditLogWithIdentifier, error) {
+	result := &AuditLogWithIdentifier{
+		AuditLog: *a,
+	}
+	err := db.QueryRow(
+		`insert into audit_log (actor,action,target_type,target_id,before,after,client_ip,created_at) values (?,?,?,?,?,?,?,?) returning id`,
+		a.Actor,
+		a.Action,
+		a.TargetType,
+		a.TargetID,
+		a.Before,
+		a.After,
+		a.ClientIP,
+		a.CreatedAt.UTC(),
+	).Scan(&result.ID)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
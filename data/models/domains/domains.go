@@ -1,11 +1,13 @@
 package domains
 
 import (
+	"context"
 	"database/sql"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/blockloop/scan/v2"
+	"github.com/barelyhuman/caddy-ui/data"
 )
 
 type Domains struct {
@@ -24,49 +26,166 @@ func New() *Domains {
 	return &Domains{}
 }
 
-func FindByAppId(db *sql.DB, id string) (*DomainsWithIdentifier, error) {
-	var record DomainsWithIdentifier
-	res, err := db.Query(`select * from domains where app_id = ? limit 1`, id)
+const columns = `id,domain,app_id,created_at,updated_at`
+
+// Store reads and writes domains through a database handle or a
+// transaction
+type Store struct {
+	db data.Querier
+}
+
+func NewStore(db data.Querier) *Store {
+	return &Store{db: db}
+}
 
+func scanDomains(rows *sql.Rows) ([]DomainsWithIdentifier, error) {
+	collection := []DomainsWithIdentifier{}
+	for rows.Next() {
+		x := DomainsWithIdentifier{}
+		var domain sql.NullString
+		if err := rows.Scan(&x.ID, &domain, &x.AppID, &x.CreatedAt, &x.UpdatedAt); err != nil {
+			return nil, err
+		}
+		x.Domain = domain.String
+		collection = append(collection, x)
+	}
+	return collection, rows.Err()
+}
+
+// FindAllByAppId returns every domain of the app, oldest first
+func (s *Store) FindAllByAppId(ctx context.Context, appID int64) ([]DomainsWithIdentifier, error) {
+	rows, err := s.db.QueryContext(ctx, `select `+columns+` from domains where app_id = ? order by id`, appID)
 	if err != nil {
 		return nil, err
 	}
-	defer res.Close()
+	defer rows.Close()
+	return scanDomains(rows)
+}
 
-	err = scan.Row(&record, res)
+func (s *Store) FindById(ctx context.Context, id int64) (*DomainsWithIdentifier, error) {
+	rows, err := s.db.QueryContext(ctx, `select `+columns+` from domains where id = ?`, id)
 	if err != nil {
-		if strings.Contains(err.Error(), "no rows in result set") {
-			return &record, nil
-		}
 		return nil, err
 	}
-	return &record, nil
+	defer rows.Close()
+	collection, err := scanDomains(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(collection) == 0 {
+		return nil, &data.NotFoundError{Table: "domains", Key: id}
+	}
+	return &collection[0], nil
 }
 
-func (a *Domains) Save(db *sql.DB) (*DomainsWithIdentifier, error) {
-	tx, err := db.Begin()
+// AppIdsByDomain maps every domain (lowercased) to the app it belongs to
+func (s *Store) AppIdsByDomain(ctx context.Context) (map[string]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `select domain, app_id from domains`)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	query := `insert into domains(domain,app_id) values(?,?)`
+	mapping := map[string]int64{}
+	for rows.Next() {
+		var domain sql.NullString
+		var appID int64
+		if err := rows.Scan(&domain, &appID); err != nil {
+			return nil, err
+		}
+		if domain.Valid {
+			mapping[strings.ToLower(strings.TrimSpace(domain.String))] = appID
+		}
+	}
+	return mapping, rows.Err()
+}
 
-	res, err := tx.Exec(query,
+func (s *Store) Create(ctx context.Context, a *Domains) (*DomainsWithIdentifier, error) {
+	result := &DomainsWithIdentifier{
+		Domains: *a,
+	}
+	err := s.db.QueryRowContext(ctx,
+		`insert into domains (domain,app_id) values (?,?) returning id`,
 		a.Domain,
 		a.AppID,
-	)
-
+	).Scan(&result.ID)
 	if err != nil {
 		return nil, err
 	}
+	return result, nil
+}
 
-	result := &DomainsWithIdentifier{
-		Domains: *a,
+func (s *Store) Update(ctx context.Context, a *DomainsWithIdentifier) error {
+	result, err := s.db.ExecContext(ctx, `update domains set domain = ? where id = ?`, a.Domain, a.ID)
+	if err != nil {
+		return err
 	}
-	result.ID, err = res.LastInsertId()
+	return data.ExpectAffected(result, "domains", a.ID)
+}
+
+func (s *Store) Delete(ctx context.Context, id int64) error {
+	result, err := s.db.ExecContext(ctx, "delete from domains where id = ?", id)
+	if err != nil {
+		return err
+	}
+	return data.ExpectAffected(result, "domains", id)
+}
+
+// DeleteByAppId removes every domain of the app, having none isn't an
+// error
+func (s *Store) DeleteByAppId(ctx context.Context, appID int64) error {
+	_, err := s.db.ExecContext(ctx, "delete from domains where app_id = ?", appID)
+	return err
+}
+
+// FindByAppId returns the oldest domain of the app, or an empty one (ID
+// 0) when the app has no domain
+func FindByAppId(db *sql.DB, id string) (*DomainsWithIdentifier, error) {
+	appID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return &DomainsWithIdentifier{}, nil
+	}
+	collection, err := NewStore(db).FindAllByAppId(context.Background(), appID)
 	if err != nil {
 		return nil, err
 	}
+	if len(collection) == 0 {
+		return &DomainsWithIdentifier{}, nil
+	}
+	return &collection[0], nil
+}
 
-	return result, nil
+// FindAllByAppId returns every domain of the app, oldest first
+func FindAllByAppId(db *sql.DB, appId string) ([]DomainsWithIdentifier, error) {
+	appID, err := strconv.ParseInt(appId, 10, 64)
+	if err != nil {
+		return []DomainsWithIdentifier{}, nil
+	}
+	return NewStore(db).FindAllByAppId(context.Background(), appID)
+}
+
+// FindById returns data.ErrNotFound when the domain doesn't exist
+func FindById(db *sql.DB, id string) (*DomainsWithIdentifier, error) {
+	domainID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, &data.NotFoundError{Table: "domains", Key: id}
+	}
+	return NewStore(db).FindById(context.Background(), domainID)
+}
+
+func DeleteById(db *sql.DB, id int64) error {
+	return NewStore(db).Delete(context.Background(), id)
+}
+
+func (a *DomainsWithIdentifier) Update(db *sql.DB) error {
+	return NewStore(db).Update(context.Background(), a)
+}
+
+// AppIdsByDomain maps every domain (lowercased) to the app it belongs to
+func AppIdsByDomain(db *sql.DB) (map[string]int64, error) {
+	return NewStore(db).AppIdsByDomain(context.Background())
+}
+
+func (a *Domains) Save(db *sql.DB) (*DomainsWithIdentifier, error) {
+	return NewStore(db).Create(context.Background(), a)
 }
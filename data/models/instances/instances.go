@@ -1,8 +1,12 @@
 package instances
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"time"
+
+	"github.com/barelyhuman/caddy-ui/data"
 )
 
 type Instances struct {
@@ -22,36 +26,119 @@ func New() *Instances {
 	return &Instances{}
 }
 
-func FindById(db *sql.DB) *InstancesWithIdentifier {
-	return &InstancesWithIdentifier{}
+const columns = `id,password,base_domain,is_primary,created_at,updated_at`
+
+// Store reads and writes instances through a database handle or a
+// transaction
+type Store struct {
+	db data.Querier
 }
 
-func (a *Instances) Save(db *sql.DB) (*InstancesWithIdentifier, error) {
-	tx, err := db.Begin()
+func NewStore(db data.Querier) *Store {
+	return &Store{db: db}
+}
+
+func (s *Store) findOne(ctx context.Context, key any, query string, args ...any) (*InstancesWithIdentifier, error) {
+	var x InstancesWithIdentifier
+	var password sql.NullString
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(
+		&x.ID,
+		&password,
+		&x.BaseDomain,
+		&x.IsPrimary,
+		&x.CreatedAt,
+		&x.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, &data.NotFoundError{Table: "instances", Key: key}
+	}
 	if err != nil {
 		return nil, err
 	}
+	x.Password = password.String
+	return &x, nil
+}
 
-	query := `insert into (password,is_primary,base_domain) values(?,?,?)`
+func (s *Store) FindById(ctx context.Context, id int64) (*InstancesWithIdentifier, error) {
+	return s.findOne(ctx, id, `select `+columns+` from instances where id = ?`, id)
+}
+
+// FindPrimary returns data.ErrNotFound until the primary instance is
+// created, see FindOrCreatePrimary
+func (s *Store) FindPrimary(ctx context.Context) (*InstancesWithIdentifier, error) {
+	return s.findOne(ctx, "primary", `select `+columns+` from instances where is_primary = true order by id limit 1`)
+}
 
-	res, err := tx.Exec(query,
+// FindOrCreatePrimary creates the primary instance the first time it is
+// needed, whichever way the first user came in (setup, SSO or the
+// command line)
+func (s *Store) FindOrCreatePrimary(ctx context.Context) (*InstancesWithIdentifier, error) {
+	instance, err := s.FindPrimary(ctx)
+	if !errors.Is(err, data.ErrNotFound) {
+		return instance, err
+	}
+	primary := New()
+	primary.IsPrimary = true
+	return s.Create(ctx, primary)
+}
+
+func (s *Store) Create(ctx context.Context, a *Instances) (*InstancesWithIdentifier, error) {
+	result := &InstancesWithIdentifier{
+		Instances: *a,
+	}
+	err := s.db.QueryRowContext(ctx,
+		`insert into instances (password,is_primary,base_domain) values(?,?,?) returning id`,
 		a.Password,
 		a.IsPrimary,
 		a.BaseDomain,
-	)
-
+	).Scan(&result.ID)
 	if err != nil {
 		return nil, err
 	}
+	return result, nil
+}
 
-	result := &InstancesWithIdentifier{
-		Instances: *a,
+func (s *Store) Update(ctx context.Context, a *InstancesWithIdentifier) error {
+	result, err := s.db.ExecContext(ctx,
+		`update instances set password = ?, base_domain = ?, is_primary = ? where id = ?`,
+		a.Password,
+		a.BaseDomain,
+		a.IsPrimary,
+		a.ID,
+	)
+	if err != nil {
+		return err
 	}
+	return data.ExpectAffected(result, "instances", a.ID)
+}
 
-	result.ID, err = res.LastInsertId()
+func (s *Store) Delete(ctx context.Context, id int64) error {
+	result, err := s.db.ExecContext(ctx, "delete from instances where id = ?", id)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return data.ExpectAffected(result, "instances", id)
+}
 
-	return result, nil
+func FindById(db *sql.DB, id int64) (*InstancesWithIdentifier, error) {
+	return NewStore(db).FindById(context.Background(), id)
+}
+
+// FindPrimary returns data.ErrNotFound until the primary instance is
+// created, see FindOrCreatePrimary
+func FindPrimary(db *sql.DB) (*InstancesWithIdentifier, error) {
+	return NewStore(db).FindPrimary(context.Background())
+}
+
+func FindOrCreatePrimary(db *sql.DB) (*InstancesWithIdentifier, error) {
+	return NewStore(db).FindOrCreatePrimary(context.Background())
+}
+
+func SetPassword(db *sql.DB, id int64, password string) error {
+	_, err := db.Exec(`update instances set password = ? where id = ?`, password, id)
+	return err
+}
+
+func (a *Instances) Save(db *sql.DB) (*InstancesWithIdentifier, error) {
+	return NewStore(db).Create(context.Background(), a)
 }
@@ -0,0 +1,114 @@
+package sessions
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/barelyhuman/caddy-ui/data"
+)
+
+type Sessions struct {
+	TokenHash string    `db:"sessions.token_hash"`
+	UserID    int64     `db:"sessions.user_id"`
+	ExpiresAt time.Time `db:"sessions.expires_at"`
+	CreatedAt time.Time `db:"sessions.created_at"`
+	UpdatedAt time.Time `db:"sessions.updated_at"`
+}
+
+type SessionsWithIdentifier struct {
+	ID int64 `db:"sessions.id"`
+	Sessions
+}
+
+func New() *Sessions {
+	return &Sessions{}
+}
+
+// Store reads and writes sessions through a database handle or a
+// transaction
+type Store struct {
+	db data.Querier
+}
+
+func NewStore(db data.Querier) *Store {
+	return &Store{db: db}
+}
+
+func (s *Store) FindByTokenHash(ctx context.Context, tokenHash string) (*SessionsWithIdentifier, error) {
+	var x SessionsWithIdentifier
+	err := s.db.QueryRowContext(ctx, `
+		select id,token_hash,user_id,expires_at,created_at,updated_at from sessions where token_hash = ?
+	`, tokenHash).Scan(
+		&x.ID,
+		&x.TokenHash,
+		&x.UserID,
+		&x.ExpiresAt,
+		&x.CreatedAt,
+		&x.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		// the key is the hash, the token itself never gets in an error
+		return nil, &data.NotFoundError{Table: "sessions", Key: tokenHash}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &x, nil
+}
+
+func (s *Store) Create(ctx context.Context, a *Sessions) (*SessionsWithIdentifier, error) {
+	result := &SessionsWithIdentifier{
+		Sessions: *a,
+	}
+	err := s.db.QueryRowContext(ctx,
+		`insert into sessions (token_hash,user_id,expires_at) values (?,?,?) returning id`,
+		a.TokenHash,
+		a.UserID,
+		a.ExpiresAt.UTC(),
+	).Scan(&result.ID)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DeleteByTokenHash doesn't fail when the session is already gone, ex:
+// logging out twice
+func (s *Store) DeleteByTokenHash(ctx context.Context, tokenHash string) error {
+	_, err := s.db.ExecContext(ctx, "delete from sessions where token_hash = ?", tokenHash)
+	return err
+}
+
+// DeleteByUserId logs the user out everywhere but the session with the
+// except hash, ex: the one changing the password
+func (s *Store) DeleteByUserId(ctx context.Context, userID int64, except string) error {
+	_, err := s.db.ExecContext(ctx, "delete from sessions where user_id = ? and token_hash <> ?", userID, except)
+	return err
+}
+
+func (s *Store) DeleteExpired(ctx context.Context, now time.Time) error {
+	_, err := s.db.ExecContext(ctx, "delete from sessions where expires_at < ?", now.UTC())
+	return err
+}
+
+// FindByTokenHash returns data.ErrNotFound if there's no such session
+func FindByTokenHash(db *sql.DB, tokenHash string) (*SessionsWithIdentifier, error) {
+	return NewStore(db).FindByTokenHash(context.Background(), tokenHash)
+}
+
+func DeleteByTokenHash(db *sql.DB, tokenHash string) error {
+	return NewStore(db).DeleteByTokenHash(context.Background(), tokenHash)
+}
+
+func DeleteByUserId(db *sql.DB, userID int64, except string) error {
+	return NewStore(db).DeleteByUserId(context.Background(), userID, except)
+}
+
+func DeleteExpired(db *sql.DB, now time.Time) error {
+	return NewStore(db).DeleteExpired(context.Background(), now)
+}
+
+func (a *Sessions) Save(db *sql.DB) (*SessionsWithIdentifier, error) {
+	return NewStore(db).Create(context.Background(), a)
+}
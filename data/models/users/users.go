@@ -0,0 +1,212 @@
+package users
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/barelyhuman/caddy-ui/data"
+)
+
+type Users struct {
+	Username string         `db:"users.username"`
+	Password string         `db:"users.password"`
+	Role     string         `db:"users.role"`
+	Team     sql.NullString `db:"users.team"`
+	// OIDCSubject links the user to the identity provider's `sub` claim
+	OIDCSubject sql.NullString `db:"users.oidc_subject"`
+	CreatedAt   time.Time      `db:"users.created_at"`
+	UpdatedAt   time.Time      `db:"users.updated_at"`
+}
+
+type UsersWithIdentifier struct {
+	ID int64 `db:"users.id"`
+	Users
+}
+
+func New() *Users {
+	return &Users{}
+}
+
+const columns = `id,username,password,role,team,oidc_subject,created_at,updated_at`
+
+// Store reads and writes users through a database handle or a
+// transaction
+type Store struct {
+	db data.Querier
+}
+
+func NewStore(db data.Querier) *Store {
+	return &Store{db: db}
+}
+
+func scanUser(row interface{ Scan(...any) error }) (*UsersWithIdentifier, error) {
+	var x UsersWithIdentifier
+	err := row.Scan(
+		&x.ID,
+		&x.Username,
+		&x.Password,
+		&x.Role,
+		&x.Team,
+		&x.OIDCSubject,
+		&x.CreatedAt,
+		&x.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &x, nil
+}
+
+func (s *Store) findOne(ctx context.Context, key any, query string, args ...any) (*UsersWithIdentifier, error) {
+	x, err := scanUser(s.db.QueryRowContext(ctx, query, args...))
+	if err == sql.ErrNoRows {
+		return nil, &data.NotFoundError{Table: "users", Key: key}
+	}
+	return x, err
+}
+
+func (s *Store) FindAll(ctx context.Context) ([]UsersWithIdentifier, error) {
+	rows, err := s.db.QueryContext(ctx, `select `+columns+` from users order by username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	collection := []UsersWithIdentifier{}
+	for rows.Next() {
+		x, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		collection = append(collection, *x)
+	}
+	return collection, rows.Err()
+}
+
+func (s *Store) FindById(ctx context.Context, id int64) (*UsersWithIdentifier, error) {
+	return s.findOne(ctx, id, `select `+columns+` from users where id = ?`, id)
+}
+
+// FindByOIDCSubject returns data.ErrNotFound if no user is linked to the
+// subject
+func (s *Store) FindByOIDCSubject(ctx context.Context, subject string) (*UsersWithIdentifier, error) {
+	return s.findOne(ctx, subject, `select `+columns+` from users where oidc_subject = ?`, subject)
+}
+
+func (s *Store) FindByUsername(ctx context.Context, username string) (*UsersWithIdentifier, error) {
+	return s.findOne(ctx, username, `select `+columns+` from users where username = ?`, username)
+}
+
+func (s *Store) Count(ctx context.Context) (int64, error) {
+	var count int64
+	err := s.db.QueryRowContext(ctx, `select count(id) from users`).Scan(&count)
+	return count, err
+}
+
+func (s *Store) CountByRole(ctx context.Context, role string) (int64, error) {
+	var count int64
+	err := s.db.QueryRowContext(ctx, `select count(id) from users where role = ?`, role).Scan(&count)
+	return count, err
+}
+
+func (s *Store) Create(ctx context.Context, a *Users) (*UsersWithIdentifier, error) {
+	result := &UsersWithIdentifier{
+		Users: *a,
+	}
+	err := s.db.QueryRowContext(ctx,
+		`insert into users (username,password,role,team,oidc_subject) values (?,?,?,?,?) returning id`,
+		a.Username,
+		a.Password,
+		a.Role,
+		a.Team,
+		a.OIDCSubject,
+	).Scan(&result.ID)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *Store) Update(ctx context.Context, a *UsersWithIdentifier) error {
+	result, err := s.db.ExecContext(ctx,
+		`update users set username = ?, password = ?, role = ?, team = ?, oidc_subject = ? where id = ?`,
+		a.Username,
+		a.Password,
+		a.Role,
+		a.Team,
+		a.OIDCSubject,
+		a.ID,
+	)
+	if err != nil {
+		return err
+	}
+	return data.ExpectAffected(result, "users", a.ID)
+}
+
+// Delete removes the user with their sessions and personal API tokens,
+// run it in a transaction so they go together
+func (s *Store) Delete(ctx context.Context, id int64) error {
+	if _, err := s.db.ExecContext(ctx, `delete from sessions where user_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := s.db.ExecContext(ctx, `delete from api_tokens where user_id = ?`, id); err != nil {
+		return err
+	}
+	result, err := s.db.ExecContext(ctx, `delete from users where id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return data.ExpectAffected(result, "users", id)
+}
+
+func FindAll(db *sql.DB) ([]UsersWithIdentifier, error) {
+	return NewStore(db).FindAll(context.Background())
+}
+
+// FindById returns data.ErrNotFound if the user doesn't exist
+func FindById(db *sql.DB, id int64) (*UsersWithIdentifier, error) {
+	return NewStore(db).FindById(context.Background(), id)
+}
+
+// FindByOIDCSubject returns data.ErrNotFound if no user is linked to the
+// subject
+func FindByOIDCSubject(db *sql.DB, subject string) (*UsersWithIdentifier, error) {
+	return NewStore(db).FindByOIDCSubject(context.Background(), subject)
+}
+
+// FindByUsername returns data.ErrNotFound if the user doesn't exist
+func FindByUsername(db *sql.DB, username string) (*UsersWithIdentifier, error) {
+	return NewStore(db).FindByUsername(context.Background(), username)
+}
+
+func Count(db *sql.DB) (int64, error) {
+	return NewStore(db).Count(context.Background())
+}
+
+func CountByRole(db *sql.DB, role string) (int64, error) {
+	return NewStore(db).CountByRole(context.Background(), role)
+}
+
+// DeleteById removes the user with their sessions and personal API
+// tokens
+func DeleteById(db *sql.DB, id int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := NewStore(tx).Delete(context.Background(), id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (a *UsersWithIdentifier) Update(db *sql.DB) error {
+	return NewStore(db).Update(context.Background(), a)
+}
+
+func (a *Users) Save(db *sql.DB) (*UsersWithIdentifier, error) {
+	return NewStore(db).Create(context.Background(), a)
+}
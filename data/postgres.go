@@ -0,0 +1,154 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const postgresDriverName = "caddy-ui-postgres"
+
+func init() {
+	sql.Register(postgresDriverName, rebindDriver{})
+}
+
+// rebindDriver wraps lib/pq so the `?` placeholders used by every query
+// become the `$1` style postgres expects, the queries themselves stay
+// the same for both engines
+type rebindDriver struct{}
+
+func (rebindDriver) Open(name string) (driver.Conn, error) {
+	conn, err := pq.Driver{}.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &rebindConn{conn}, nil
+}
+
+type rebindConn struct {
+	driver.Conn
+}
+
+func (c *rebindConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(Rebind(query))
+}
+
+func (c *rebindConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, Rebind(query))
+	}
+	return c.Prepare(query)
+}
+
+func (c *rebindConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	return execer.ExecContext(ctx, Rebind(query), args)
+}
+
+func (c *rebindConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	return queryer.QueryContext(ctx, Rebind(query), args)
+}
+
+func (c *rebindConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *rebindConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *rebindConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *rebindConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+// Rebind numbers the `?` placeholders of the query, question marks in
+// quoted strings, quoted identifiers, dollar quoted bodies and comments
+// are left alone
+func Rebind(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+
+	var out strings.Builder
+	out.Grow(len(query) + 8)
+	n := 0
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		opening, closing := "", ""
+		switch {
+		case ch == '\'' || ch == '"':
+			opening, closing = query[i:i+1], query[i:i+1]
+		case strings.HasPrefix(query[i:], "--"):
+			opening, closing = "--", "\n"
+		case strings.HasPrefix(query[i:], "/*"):
+			opening, closing = "/*", "*/"
+		case ch == '$':
+			opening = dollarTag(query[i:])
+			closing = opening
+		}
+		if len(opening) > 0 {
+			end := strings.Index(query[i+len(opening):], closing)
+			if end < 0 {
+				out.WriteString(query[i:])
+				return out.String()
+			}
+			next := i + len(opening) + end + len(closing)
+			out.WriteString(query[i:next])
+			i = next - 1
+			continue
+		}
+		if ch == '?' {
+			n++
+			out.WriteByte('$')
+			out.WriteString(strconv.Itoa(n))
+			continue
+		}
+		out.WriteByte(ch)
+	}
+	return out.String()
+}
+
+// dollarTag returns the `$tag$` that opens a dollar quoted string at the
+// start of s, `$1` style parameters aren't tags since a tag can't start
+// with a digit
+func dollarTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ch == '$':
+			return s[:i+1]
+		case ch == '_' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= 0x80:
+		case ch >= '0' && ch <= '9' && i > 1:
+		default:
+			return ""
+		}
+	}
+	return ""
+}
@@ -0,0 +1,31 @@
+package data
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"no placeholders", "select 1", "select 1"},
+		{"placeholders", "select * from apps where id = ? and name = ?", "select * from apps where id = $1 and name = $2"},
+		{"single quotes", "select '?' from apps where id = ?", "select '?' from apps where id = $1"},
+		{"escaped single quote", "select 'it''s ?' where id = ?", "select 'it''s ?' where id = $1"},
+		{"quoted identifier", `select "a?b" from t where id = ?`, `select "a?b" from t where id = $1`},
+		{"line comment", "select ? -- why?\nfrom t where id = ?", "select $1 -- why?\nfrom t where id = $2"},
+		{"line comment at the end", "select ? -- why?", "select $1 -- why?"},
+		{"block comment", "select /* a ? b */ ?", "select /* a ? b */ $1"},
+		{"dollar quoted body", "create function f() returns text as $$ select '?' || ? $$ language sql; select ?", "create function f() returns text as $$ select '?' || ? $$ language sql; select $1"},
+		{"tagged dollar quote", "select $body$ $$ ? $$ $body$, ?", "select $body$ $$ ? $$ $body$, $1"},
+		{"positional parameter", "select $1, ?", "select $1, $1"},
+		{"unterminated quote", "select ?, 'a?", "select $1, 'a?"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Rebind(tt.query); got != tt.want {
+				t.Errorf("Rebind(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrNotFound is matched (with errors.Is) by every NotFoundError
+var ErrNotFound = errors.New("not found")
+
+// NotFoundError is returned by the model stores when the record being
+// read, updated or deleted doesn't exist
+type NotFoundError struct {
+	// Table is the table that was looked up, ex: apps
+	Table string
+	// Key is the value that was looked up, usually the id
+	Key any
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%v %v not found", e.Table, e.Key)
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// Querier is implemented by both *sql.DB and *sql.Tx so the model stores
+// work the same inside and outside of a transaction
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// ExpectAffected turns an update or delete that matched no rows into a
+// NotFoundError
+func ExpectAffected(result sql.Result, table string, key any) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return &NotFoundError{Table: table, Key: key}
+	}
+	return nil
+}
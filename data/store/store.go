@@ -0,0 +1,191 @@
+// Package store groups the model stores behind interfaces so handlers
+// can run several changes (ex: an app with its ports and domains) in one
+// transaction
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/barelyhuman/caddy-ui/data"
+	"github.com/barelyhuman/caddy-ui/data/models/api_tokens"
+	"github.com/barelyhuman/caddy-ui/data/models/app_options"
+	"github.com/barelyhuman/caddy-ui/data/models/app_ports"
+	"github.com/barelyhuman/caddy-ui/data/models/apps"
+	"github.com/barelyhuman/caddy-ui/data/models/domains"
+	"github.com/barelyhuman/caddy-ui/data/models/instances"
+	"github.com/barelyhuman/caddy-ui/data/models/sessions"
+	"github.com/barelyhuman/caddy-ui/data/models/users"
+)
+
+// Reads of a single record, updates and deletes return a
+// *data.NotFoundError (matched by data.ErrNotFound) when the record
+// doesn't exist
+
+type AppStore interface {
+	FindAll(ctx context.Context) ([]apps.AppsWithIdentifier, error)
+	FindById(ctx context.Context, id int64) (*apps.AppsWithIdentifier, error)
+	FindByName(ctx context.Context, name string) (*apps.AppsWithIdentifier, error)
+	Create(ctx context.Context, app *apps.Apps) (*apps.AppsWithIdentifier, error)
+	Update(ctx context.Context, app *apps.AppsWithIdentifier) error
+	SetTeam(ctx context.Context, id int64, team sql.NullString) error
+	Delete(ctx context.Context, id int64) error
+}
+
+type DomainStore interface {
+	FindAllByAppId(ctx context.Context, appID int64) ([]domains.DomainsWithIdentifier, error)
+	FindById(ctx context.Context, id int64) (*domains.DomainsWithIdentifier, error)
+	AppIdsByDomain(ctx context.Context) (map[string]int64, error)
+	Create(ctx context.Context, domain *domains.Domains) (*domains.DomainsWithIdentifier, error)
+	Update(ctx context.Context, domain *domains.DomainsWithIdentifier) error
+	Delete(ctx context.Context, id int64) error
+	DeleteByAppId(ctx context.Context, appID int64) error
+}
+
+type PortStore interface {
+	FindAll(ctx context.Context) ([]app_ports.AppPortsWithIdentifier, error)
+	FindAllByAppId(ctx context.Context, appID int64) ([]app_ports.AppPortsWithIdentifier, error)
+	FindById(ctx context.Context, id int64) (*app_ports.AppPortsWithIdentifier, error)
+	AppIdsByDial(ctx context.Context) (map[string]int64, error)
+	Create(ctx context.Context, port *app_ports.AppPorts) (*app_ports.AppPortsWithIdentifier, error)
+	Update(ctx context.Context, port *app_ports.AppPortsWithIdentifier) error
+	Delete(ctx context.Context, id int64) error
+	DeleteByAppId(ctx context.Context, appID int64) error
+}
+
+type OptionStore interface {
+	FindByAppId(ctx context.Context, appID int64) (map[string]string, error)
+	Save(ctx context.Context, option *app_options.AppOptions) (*app_options.AppOptionsWithIdentifier, error)
+	Delete(ctx context.Context, appID int64, name string) error
+	DeleteByAppId(ctx context.Context, appID int64) error
+}
+
+type InstanceStore interface {
+	FindById(ctx context.Context, id int64) (*instances.InstancesWithIdentifier, error)
+	FindPrimary(ctx context.Context) (*instances.InstancesWithIdentifier, error)
+	FindOrCreatePrimary(ctx context.Context) (*instances.InstancesWithIdentifier, error)
+	Create(ctx context.Context, instance *instances.Instances) (*instances.InstancesWithIdentifier, error)
+	Update(ctx context.Context, instance *instances.InstancesWithIdentifier) error
+	Delete(ctx context.Context, id int64) error
+}
+
+type UserStore interface {
+	FindAll(ctx context.Context) ([]users.UsersWithIdentifier, error)
+	FindById(ctx context.Context, id int64) (*users.UsersWithIdentifier, error)
+	FindByUsername(ctx context.Context, username string) (*users.UsersWithIdentifier, error)
+	FindByOIDCSubject(ctx context.Context, subject string) (*users.UsersWithIdentifier, error)
+	Count(ctx context.Context) (int64, error)
+	CountByRole(ctx context.Context, role string) (int64, error)
+	Create(ctx context.Context, user *users.Users) (*users.UsersWithIdentifier, error)
+	Update(ctx context.Context, user *users.UsersWithIdentifier) error
+	Delete(ctx context.Context, id int64) error
+}
+
+type SessionStore interface {
+	FindByTokenHash(ctx context.Context, tokenHash string) (*sessions.SessionsWithIdentifier, error)
+	Create(ctx context.Context, session *sessions.Sessions) (*sessions.SessionsWithIdentifier, error)
+	DeleteByTokenHash(ctx context.Context, tokenHash string) error
+	DeleteExpired(ctx context.Context, now time.Time) error
+}
+
+type TokenStore interface {
+	FindByUserId(ctx context.Context, userID int64) ([]api_tokens.ApiTokensWithIdentifier, error)
+	FindServiceTokens(ctx context.Context) ([]api_tokens.ApiTokensWithIdentifier, error)
+	FindByTokenHash(ctx context.Context, tokenHash string) (*api_tokens.ApiTokensWithIdentifier, error)
+	FindById(ctx context.Context, id int64) (*api_tokens.ApiTokensWithIdentifier, error)
+	Create(ctx context.Context, token *api_tokens.ApiTokens) (*api_tokens.ApiTokensWithIdentifier, error)
+	TouchLastUsed(ctx context.Context, id int64, now time.Time) error
+	Delete(ctx context.Context, id int64) error
+}
+
+var (
+	_ AppStore      = (*apps.Store)(nil)
+	_ DomainStore   = (*domains.Store)(nil)
+	_ PortStore     = (*app_ports.Store)(nil)
+	_ OptionStore   = (*app_options.Store)(nil)
+	_ InstanceStore = (*instances.Store)(nil)
+	_ UserStore     = (*users.Store)(nil)
+	_ SessionStore  = (*sessions.Store)(nil)
+	_ TokenStore    = (*api_tokens.Store)(nil)
+)
+
+// Store is the unit of work, every store in it goes through the same
+// database handle or, inside Atomic, the same transaction
+type Store struct {
+	Apps      AppStore
+	Domains   DomainStore
+	Ports     PortStore
+	Options   OptionStore
+	Instances InstanceStore
+	Users     UserStore
+	Sessions  SessionStore
+	Tokens    TokenStore
+
+	db *sql.DB
+}
+
+func bind(q data.Querier) *Store {
+	return &Store{
+		Apps:      apps.NewStore(q),
+		Domains:   domains.NewStore(q),
+		Ports:     app_ports.NewStore(q),
+		Options:   app_options.NewStore(q),
+		Instances: instances.NewStore(q),
+		Users:     users.NewStore(q),
+		Sessions:  sessions.NewStore(q),
+		Tokens:    api_tokens.NewStore(q),
+	}
+}
+
+func New(db *sql.DB) *Store {
+	s := bind(db)
+	s.db = db
+	return s
+}
+
+// Atomic runs fn with a Store bound to a new transaction, which is
+// committed when fn returns nil and rolled back otherwise. Calling it on
+// the Store passed to fn just runs fn in the same transaction
+func (s *Store) Atomic(ctx context.Context, fn func(tx *Store) error) error {
+	if s.db == nil {
+		return fn(s)
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(bind(tx)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PrimaryInstanceID is the instance new apps are attached to, it is
+// created along with the first app when nothing created it before. Its
+// id is only 1 on a fresh SQLite database
+func (s *Store) PrimaryInstanceID(ctx context.Context) (int64, error) {
+	instance, err := s.Instances.FindOrCreatePrimary(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return instance.ID, nil
+}
+
+// DeleteApp removes the app along with its domains, ports and options
+func (s *Store) DeleteApp(ctx context.Context, id int64) error {
+	return s.Atomic(ctx, func(tx *Store) error {
+		if err := tx.Domains.DeleteByAppId(ctx, id); err != nil {
+			return err
+		}
+		if err := tx.Ports.DeleteByAppId(ctx, id); err != nil {
+			return err
+		}
+		if err := tx.Options.DeleteByAppId(ctx, id); err != nil {
+			return err
+		}
+		return tx.Apps.Delete(ctx, id)
+	})
+}
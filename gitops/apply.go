@@ -0,0 +1,495 @@
+// Package gitops applies an apps file. Applying it creates, updates and
+// deletes apps until the database matches the file, the apps it manages
+// are read-only everywhere else
+package gitops
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/barelyhuman/caddy-ui/api"
+	"github.com/barelyhuman/caddy-ui/appsfile"
+	"github.com/barelyhuman/caddy-ui/audit"
+	"github.com/barelyhuman/caddy-ui/data/models/app_options"
+	"github.com/barelyhuman/caddy-ui/data/models/app_ports"
+	"github.com/barelyhuman/caddy-ui/data/models/apps"
+	"github.com/barelyhuman/caddy-ui/data/models/domains"
+	"github.com/barelyhuman/caddy-ui/data/store"
+)
+
+const (
+	ActionCreate    = "create"
+	ActionUpdate    = "update"
+	ActionDelete    = "delete"
+	ActionUnchanged = "unchanged"
+)
+
+// Change is what applying the file does to one app
+type Change struct {
+	Action string `json:"action"`
+	App    string `json:"app"`
+	// ID is 0 for the apps a dry run would create
+	ID int64 `json:"id,omitempty"`
+	// Diff lists the fields that change, ex: domains: a.com -> b.com
+	Diff []string `json:"diff,omitempty"`
+}
+
+type Result struct {
+	Changes  []Change `json:"changes"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Changed counts the apps that were created, updated or deleted
+func (r *Result) Changed() int {
+	changed := 0
+	for _, change := range r.Changes {
+		if change.Action != ActionUnchanged {
+			changed++
+		}
+	}
+	return changed
+}
+
+type Options struct {
+	// Source names the file in apps.managed_by, ex: its path
+	Source string
+	// DryRun only works out the changes
+	DryRun bool
+	// Sync pushes an app to caddy and RemoveRoutes drops the routes of
+	// hosts no app has anymore, caddy isn't touched when they are nil
+	Sync         func(appID string) error
+	RemoveRoutes func(hosts []string) error
+}
+
+// InvalidError lists every problem of the file, keyed by the file and
+// the path of the value, ex: apps.yaml: apps.2.domains.0
+type InvalidError struct {
+	Fields map[string]string
+}
+
+func (e *InvalidError) Error() string {
+	problems := []string{}
+	for key, msg := range e.Fields {
+		problems = append(problems, key+" "+msg)
+	}
+	sort.Strings(problems)
+	return "invalid apps file: " + strings.Join(problems, "; ")
+}
+
+// planned is a change along with the states it goes between
+type planned struct {
+	Change
+	existing *apps.AppsWithIdentifier
+	before   *appsfile.App
+	after    *appsfile.App
+}
+
+// Apply makes the database match the file: apps of the file are
+// created or updated (an app created in the UI with the same name is
+// taken over), apps managed by opts.Source that aren't in it anymore are
+// deleted and the others are left alone. An app of the file that
+// another source manages makes the file invalid. Every change is made
+// in one transaction, caddy is updated once it is committed
+func Apply(ctx context.Context, db *sql.DB, file *appsfile.File, opts Options) (*Result, error) {
+	s := store.New(db)
+	existing, err := s.Apps.FindAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]*apps.AppsWithIdentifier{}
+	for i := range existing {
+		byName[existing[i].Name] = &existing[i]
+	}
+
+	desired, warnings, err := check(db, file, existing, opts.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := []*planned{}
+	listed := map[string]bool{}
+	for i := range desired {
+		after := &desired[i]
+		listed[after.Name] = true
+		current := byName[after.Name]
+		if current == nil {
+			plan = append(plan, &planned{Change: Change{Action: ActionCreate, App: after.Name}, after: after})
+			continue
+		}
+		before, err := appsfile.Current(ctx, s, current)
+		if err != nil {
+			return nil, err
+		}
+		change := Change{Action: ActionUnchanged, App: after.Name, ID: current.ID, Diff: diff(before, after)}
+		// check refused the apps of other sources, this one is adopted
+		if !current.ManagedBy.Valid {
+			change.Diff = append(change.Diff, "managed by "+opts.Source)
+		}
+		if len(change.Diff) > 0 {
+			change.Action = ActionUpdate
+		}
+		plan = append(plan, &planned{Change: change, existing: current, before: before, after: after})
+	}
+	for i := range existing {
+		current := &existing[i]
+		if !managedBy(current, opts.Source) || listed[current.Name] {
+			continue
+		}
+		before, err := appsfile.Current(ctx, s, current)
+		if err != nil {
+			return nil, err
+		}
+		plan = append(plan, &planned{Change: Change{Action: ActionDelete, App: current.Name, ID: current.ID}, existing: current, before: before})
+	}
+
+	result := &Result{Changes: []Change{}, Warnings: warnings}
+	if opts.DryRun {
+		for _, p := range plan {
+			result.Changes = append(result.Changes, p.Change)
+		}
+		return result, nil
+	}
+
+	audits := make([]*audit.AppState, len(plan))
+	for i, p := range plan {
+		if p.existing != nil && p.Action != ActionUnchanged {
+			audits[i] = audit.App(db, strconv.FormatInt(p.existing.ID, 10))
+		}
+	}
+
+	err = s.Atomic(ctx, func(tx *store.Store) error {
+		// what is released goes first, a domain or an upstream can move
+		// between two apps of the file
+		for _, p := range plan {
+			switch {
+			case p.Action == ActionDelete:
+				if err := tx.DeleteApp(ctx, p.ID); err != nil {
+					return err
+				}
+			case p.Action == ActionUpdate:
+				if !slices.Equal(p.before.Domains, p.after.Domains) {
+					if err := tx.Domains.DeleteByAppId(ctx, p.ID); err != nil {
+						return err
+					}
+				}
+				if !slices.Equal(p.before.Upstreams, p.after.Upstreams) {
+					if err := tx.Ports.DeleteByAppId(ctx, p.ID); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		// looked up once, and only when an app is created
+		instanceID := int64(0)
+		for _, p := range plan {
+			switch p.Action {
+			case ActionCreate:
+				if instanceID == 0 {
+					var err error
+					if instanceID, err = tx.PrimaryInstanceID(ctx); err != nil {
+						return err
+					}
+				}
+				app := apps.New()
+				app.Name = p.after.Name
+				app.InstanceID = instanceID
+				app.Type = sql.NullString{String: p.after.Type, Valid: true}
+				app.Team = sql.NullString{String: p.after.Team, Valid: len(p.after.Team) > 0}
+				app.ManagedBy = sql.NullString{String: opts.Source, Valid: true}
+				created, err := tx.Apps.Create(ctx, app)
+				if err != nil {
+					return err
+				}
+				p.ID = created.ID
+				if err := save(ctx, tx, p.ID, &appsfile.App{}, p.after); err != nil {
+					return err
+				}
+			case ActionUpdate:
+				p.existing.Type = sql.NullString{String: p.after.Type, Valid: true}
+				p.existing.Team = sql.NullString{String: p.after.Team, Valid: len(p.after.Team) > 0}
+				p.existing.ManagedBy = sql.NullString{String: opts.Source, Valid: true}
+				if err := tx.Apps.Update(ctx, p.existing); err != nil {
+					return err
+				}
+				if err := save(ctx, tx, p.ID, p.before, p.after); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, p := range plan {
+		result.Changes = append(result.Changes, p.Change)
+		if p.Action == ActionUnchanged {
+			continue
+		}
+		entry := audit.Entry{
+			Action:     "app." + p.Action,
+			Actor:      "gitops",
+			TargetType: "app",
+			TargetID:   p.ID,
+			Before:     audits[i],
+		}
+		if p.Action != ActionDelete {
+			entry.After = audit.App(db, strconv.FormatInt(p.ID, 10))
+		}
+		audit.Log(entry)
+	}
+
+	if err := push(plan, opts); err != nil {
+		return result, fmt.Errorf("the apps were saved but caddy wasn't fully updated: %w", err)
+	}
+	return result, nil
+}
+
+// managedBy tells if app was applied from source
+func managedBy(app *apps.AppsWithIdentifier, source string) bool {
+	return app.ManagedBy.Valid && app.ManagedBy.String == source
+}
+
+// check validates the file like the API validates a new app, except
+// the domains and upstreams of the apps the file replaces are free to
+// take. Listing an app another source manages is a conflict. The apps
+// are returned normalized
+func check(db *sql.DB, file *appsfile.File, existing []apps.AppsWithIdentifier, source string) ([]appsfile.App, []string, error) {
+	listed := map[string]bool{}
+	for _, app := range file.Apps {
+		listed[strings.TrimSpace(app.Name)] = true
+	}
+	// apps of the file are updated or deleted, the ones of other sources
+	// keep what they have
+	released := map[int64]bool{}
+	managers := map[string]string{}
+	for i := range existing {
+		app := &existing[i]
+		if app.ManagedBy.Valid && !managedBy(app, source) {
+			managers[app.Name] = app.ManagedBy.String
+			continue
+		}
+		if listed[app.Name] || app.ManagedBy.Valid {
+			released[app.ID] = true
+		}
+	}
+
+	index, err := api.LoadHostIndex(db)
+	if err != nil {
+		return nil, nil, err
+	}
+	index.Release(released)
+	dials, err := app_ports.AppIdsByDial(db)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	warnings := index.Warnings
+	fields := map[string]string{}
+	names := map[string]bool{}
+	hosts := map[string]string{}
+	upstreams := map[string]string{}
+	desired := []appsfile.App{}
+	for _, app := range file.Apps {
+		body := api.CreateAppRequest{
+			Name:      app.Name,
+			Type:      app.Type,
+			Team:      strings.TrimSpace(app.Team),
+			Options:   app.Options,
+			Domains:   slices.Clone(app.Domains),
+			Upstreams: slices.Clone(app.Upstreams),
+		}
+		for key, msg := range body.Validate() {
+			fields[app.Key(key)] = msg
+		}
+		if _, invalid := fields[app.Key("name")]; !invalid && names[body.Name] {
+			fields[app.Key("name")] = "is listed twice"
+		} else if other, managed := managers[body.Name]; !invalid && managed {
+			fields[app.Key("name")] = "is managed by " + other
+		}
+		names[body.Name] = true
+
+		for i, domain := range body.Domains {
+			key := app.Key(fmt.Sprintf("domains.%v", i))
+			if _, invalid := fields[key]; invalid {
+				continue
+			}
+			if other, ok := hosts[domain]; ok {
+				fields[key] = "is also listed by " + other
+				continue
+			}
+			hosts[domain] = app.Key("")
+			conflict, overlaps := index.Check(domain, 0)
+			if len(conflict) > 0 {
+				fields[key] = conflict
+			}
+			for _, overlap := range overlaps {
+				warnings = append(warnings, body.Name+": "+overlap)
+			}
+		}
+		for i, upstream := range body.Upstreams {
+			key := app.Key(fmt.Sprintf("upstreams.%v", i))
+			if _, invalid := fields[key]; invalid {
+				continue
+			}
+			dial := app_ports.DialKey(upstream)
+			if other, ok := upstreams[dial]; ok {
+				fields[key] = "is also listed by " + other
+				continue
+			}
+			upstreams[dial] = app.Key("")
+			if owner, taken := dials[dial]; taken && !released[owner] {
+				fields[key] = "is already in use"
+			}
+		}
+
+		normalized := app
+		normalized.Name = body.Name
+		normalized.Type = body.Type
+		normalized.Team = body.Team
+		normalized.Options = body.Options
+		normalized.Domains = append([]string{}, body.Domains...)
+		normalized.Upstreams = append([]string{}, body.Upstreams...)
+		desired = append(desired, normalized)
+	}
+	if len(fields) > 0 {
+		return nil, nil, &InvalidError{Fields: fields}
+	}
+	return desired, warnings, nil
+}
+
+// save writes the domains, upstreams and options that differ between
+// before and after, the old domains and upstreams were already removed
+func save(ctx context.Context, tx *store.Store, appID int64, before *appsfile.App, after *appsfile.App) error {
+	if !slices.Equal(before.Domains, after.Domains) {
+		for _, value := range after.Domains {
+			domain := domains.New()
+			domain.Domain = value
+			domain.AppID = appID
+			if _, err := tx.Domains.Create(ctx, domain); err != nil {
+				return err
+			}
+		}
+	}
+	if !slices.Equal(before.Upstreams, after.Upstreams) {
+		for _, upstream := range after.Upstreams {
+			port := app_ports.New()
+			port.Port = upstream
+			port.AppId = appID
+			if _, err := tx.Ports.Create(ctx, port); err != nil {
+				return err
+			}
+		}
+	}
+	for name := range before.Options {
+		if _, kept := after.Options[name]; !kept {
+			if err := tx.Options.Delete(ctx, appID, name); err != nil {
+				return err
+			}
+		}
+	}
+	for name, value := range after.Options {
+		if current, ok := before.Options[name]; ok && current == value {
+			continue
+		}
+		option := app_options.New()
+		option.AppId = appID
+		option.Name = name
+		option.Value = sql.NullString{String: value, Valid: true}
+		if _, err := tx.Options.Save(ctx, option); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func diff(before *appsfile.App, after *appsfile.App) []string {
+	changes := []string{}
+	if before.Type != after.Type {
+		changes = append(changes, fmt.Sprintf("type: %v -> %v", before.Type, after.Type))
+	}
+	if before.Team != after.Team {
+		changes = append(changes, fmt.Sprintf("team: %v -> %v", orNone(before.Team), orNone(after.Team)))
+	}
+	if !slices.Equal(before.Domains, after.Domains) {
+		changes = append(changes, fmt.Sprintf("domains: %v -> %v",
+			orNone(strings.Join(before.Domains, ", ")), orNone(strings.Join(after.Domains, ", "))))
+	}
+	if !slices.Equal(before.Upstreams, after.Upstreams) {
+		changes = append(changes, fmt.Sprintf("upstreams: %v -> %v",
+			orNone(strings.Join(before.Upstreams, ", ")), orNone(strings.Join(after.Upstreams, ", "))))
+	}
+	names := []string{}
+	for name := range before.Options {
+		names = append(names, name)
+	}
+	for name := range after.Options {
+		if _, ok := before.Options[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if before.Options[name] != after.Options[name] {
+			changes = append(changes, fmt.Sprintf("options.%v: %v -> %v", name, orNone(before.Options[name]), orNone(after.Options[name])))
+		}
+	}
+	return changes
+}
+
+func orNone(value string) string {
+	if len(value) == 0 {
+		return "none"
+	}
+	return value
+}
+
+// push removes the routes of the hosts that went away, then syncs every
+// app of the file so caddy matches it even if it drifted. Apps without
+// a domain have no route to sync
+func push(plan []*planned, opts Options) error {
+	kept := map[string]bool{}
+	for _, p := range plan {
+		if p.after != nil {
+			for _, host := range p.after.Domains {
+				kept[host] = true
+			}
+		}
+	}
+	removed := []string{}
+	for _, p := range plan {
+		if p.before == nil || p.Action == ActionUnchanged {
+			continue
+		}
+		for _, host := range p.before.Domains {
+			if !kept[host] {
+				removed = append(removed, host)
+			}
+		}
+	}
+
+	problems := []error{}
+	if opts.RemoveRoutes != nil && len(removed) > 0 {
+		if err := opts.RemoveRoutes(removed); err != nil {
+			problems = append(problems, fmt.Errorf("failed to remove the routes of %v: %w", strings.Join(removed, ", "), err))
+		}
+	}
+	if opts.Sync != nil {
+		for _, p := range plan {
+			if p.after == nil || len(p.after.Domains) == 0 {
+				continue
+			}
+			if err := opts.Sync(strconv.FormatInt(p.ID, 10)); err != nil {
+				problems = append(problems, fmt.Errorf("app %v: %w", p.App, err))
+			}
+		}
+	}
+	return errors.Join(problems...)
+}
@@ -0,0 +1,217 @@
+package gitops
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/barelyhuman/caddy-ui/appsfile"
+	"github.com/barelyhuman/caddy-ui/config"
+	"github.com/barelyhuman/caddy-ui/migrate"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// openTestDatabase is also the database of the audit log, which only
+// opens the one of the config. Caddy is a stand-in without routes
+func openTestDatabase(t *testing.T) *sql.DB {
+	t.Helper()
+	caddy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(caddy.Close)
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	previous := config.Get()
+	c := previous
+	c.DatabaseURL = path
+	c.CaddyURL = caddy.URL
+	config.Set(c)
+	t.Cleanup(func() { config.Set(previous) })
+
+	db, err := sql.Open("sqlite3", path+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := migrate.MigrateUp(db, migrate.Source(db, "")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("insert into instances (id,is_primary,base_domain) values (1,true,'example.com')"); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func parseFile(t *testing.T, name string, contents string) *appsfile.File {
+	t.Helper()
+	file, err := appsfile.Parse(name, []byte("version: 1\napps:\n"+contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// actions is the plan as "app:action", in order
+func actions(result *Result) string {
+	list := []string{}
+	for _, change := range result.Changes {
+		list = append(list, change.App+":"+change.Action)
+	}
+	return strings.Join(list, ",")
+}
+
+func managers(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	rows, err := db.Query("select name, coalesce(managed_by, 'ui') from apps order by name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	list := []string{}
+	for rows.Next() {
+		var name, managedBy string
+		if err := rows.Scan(&name, &managedBy); err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, name+":"+managedBy)
+	}
+	return strings.Join(list, ",")
+}
+
+func TestApplySources(t *testing.T) {
+	db := openTestDatabase(t)
+	ctx := context.Background()
+	for _, query := range []string{
+		"insert into apps (id,name,instance_id,type) values (100,'legacy',1,'reverse-proxy')",
+		"insert into domains (app_id,domain) values (100,'legacy.example.com')",
+		"insert into app_ports (app_id,port) values (100,'3001')",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatalf("%v: %v", query, err)
+		}
+	}
+
+	a := parseFile(t, "a.yaml", `
+  - name: web
+    domains: [web.example.com]
+    upstreams: ["3000"]
+  - name: legacy
+    domains: [legacy.example.com]
+    upstreams: ["3001"]
+`)
+	result, err := Apply(ctx, db, a, Options{Source: "a.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := actions(result); got != "web:create,legacy:update" {
+		t.Errorf("a.yaml: %v", got)
+	}
+	if diff := result.Changes[1].Diff; len(diff) != 1 || diff[0] != "managed by a.yaml" {
+		t.Errorf("legacy was adopted with %q", diff)
+	}
+
+	// another source leaves the apps of a.yaml alone
+	b := parseFile(t, "b.yaml", `
+  - name: api
+    domains: [api.example.com]
+    upstreams: ["4000"]
+`)
+	removed := []string{}
+	opts := Options{Source: "b.yaml", RemoveRoutes: func(hosts []string) error {
+		removed = append(removed, hosts...)
+		return nil
+	}}
+	result, err = Apply(ctx, db, b, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := actions(result); got != "api:create" {
+		t.Errorf("b.yaml: %v", got)
+	}
+	if len(removed) > 0 {
+		t.Errorf("b.yaml removed the routes of %v", removed)
+	}
+	if got := managers(t, db); got != "api:b.yaml,legacy:a.yaml,web:a.yaml" {
+		t.Errorf("apps are %v", got)
+	}
+
+	tests := []struct {
+		name   string
+		apps   string
+		fields map[string]string
+	}{
+		{
+			"app of another source",
+			`
+  - name: web
+    domains: [web.example.com]
+    upstreams: ["3000"]
+`,
+			map[string]string{
+				"b.yaml: apps.0.name":        "is managed by a.yaml",
+				"b.yaml: apps.0.domains.0":   "",
+				"b.yaml: apps.0.upstreams.0": "is already in use",
+			},
+		},
+		{
+			"domain and upstream of another source",
+			`
+  - name: api
+    domains: [web.example.com]
+    upstreams: ["3000"]
+`,
+			map[string]string{
+				"b.yaml: apps.0.domains.0":   "",
+				"b.yaml: apps.0.upstreams.0": "is already in use",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Apply(ctx, db, parseFile(t, "b.yaml", tt.apps), opts)
+			var invalid *InvalidError
+			if !errors.As(err, &invalid) {
+				t.Fatalf("error = %v", err)
+			}
+			if len(invalid.Fields) != len(tt.fields) {
+				t.Errorf("fields = %v, want %v", invalid.Fields, tt.fields)
+			}
+			for key, msg := range tt.fields {
+				got, ok := invalid.Fields[key]
+				if !ok || (len(msg) > 0 && got != msg) {
+					t.Errorf("%v = %q, want %q", key, got, msg)
+				}
+			}
+			if got := managers(t, db); got != "api:b.yaml,legacy:a.yaml,web:a.yaml" {
+				t.Errorf("apps are %v", got)
+			}
+		})
+	}
+
+	// only the apps a.yaml manages are pruned
+	a = parseFile(t, "a.yaml", `
+  - name: web
+    domains: [web.example.com]
+    upstreams: ["3000"]
+`)
+	opts.Source = "a.yaml"
+	result, err = Apply(ctx, db, a, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := actions(result); got != "web:unchanged,legacy:delete" {
+		t.Errorf("a.yaml: %v", got)
+	}
+	if strings.Join(removed, ",") != "legacy.example.com" {
+		t.Errorf("removed the routes of %v", removed)
+	}
+	if got := managers(t, db); got != "api:b.yaml,web:a.yaml" {
+		t.Errorf("apps are %v", got)
+	}
+}
@@ -0,0 +1,272 @@
+package gitops
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/barelyhuman/caddy-ui/appsfile"
+	"github.com/barelyhuman/caddy-ui/config"
+)
+
+// DefaultRepoFile is read from apps_repo when apps_file isn't set
+const DefaultRepoFile = "caddy-ui.yaml"
+
+// Source is where the apps file is read from: a local path, or a path
+// inside a git repository that is pulled before every read
+type Source struct {
+	Path   string
+	Repo   string
+	Branch string
+}
+
+// SourceFromConfig reads apps_file, apps_repo and apps_branch
+func SourceFromConfig(c config.Config) Source {
+	source := Source{Path: c.AppsFile, Repo: c.AppsRepo, Branch: c.AppsBranch}
+	if len(source.Repo) > 0 && len(source.Path) == 0 {
+		source.Path = DefaultRepoFile
+	}
+	return source
+}
+
+func (s Source) Enabled() bool {
+	return len(s.Path) > 0
+}
+
+// String names the source in apps.managed_by, without the credentials a
+// repository URL may have
+func (s Source) String() string {
+	if len(s.Repo) == 0 {
+		if abs, err := filepath.Abs(s.Path); err == nil {
+			return abs
+		}
+		return s.Path
+	}
+	repo := s.Repo
+	if parsed, err := url.Parse(repo); err == nil && parsed.User != nil {
+		parsed.User = nil
+		repo = parsed.String()
+	}
+	if len(s.Branch) > 0 {
+		repo += "@" + s.Branch
+	}
+	return fmt.Sprintf("%v (%v)", repo, s.Path)
+}
+
+// Snapshot is the apps file as it was read
+type Snapshot struct {
+	File *appsfile.File
+	// Digest changes whenever the file does
+	Digest string
+	// Revision is the commit the repository was at, empty without one
+	Revision string
+}
+
+// Read pulls the repository, when there is one, and loads the file
+func (s Source) Read(ctx context.Context) (*Snapshot, error) {
+	path := s.Path
+	revision := ""
+	if len(s.Repo) > 0 {
+		checkout := checkoutDir(s.Repo, s.Branch)
+		var err error
+		if revision, err = pull(ctx, s.Repo, s.Branch, checkout); err != nil {
+			return nil, err
+		}
+		path = filepath.Join(checkout, s.Path)
+	}
+	file, digest, err := appsfile.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{File: file, Digest: digest, Revision: revision}, nil
+}
+
+// checkoutDir is where the repository is checked out, one directory per
+// repository and branch in the user's cache
+func checkoutDir(repo string, branch string) string {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	sum := sha256.Sum256([]byte(repo + "\n" + branch))
+	return filepath.Join(base, "caddy-ui", "apps-"+hex.EncodeToString(sum[:])[:16])
+}
+
+// pull fetches the branch (or the default branch) of repo and checks it
+// out in dir, the commit is returned. The repository is fetched by URL
+// every time so the checkout never needs its own remote
+func pull(ctx context.Context, repo string, branch string, dir string) (string, error) {
+	// a relative path would be resolved from the checkout
+	if _, err := os.Stat(repo); err == nil {
+		if abs, err := filepath.Abs(repo); err == nil {
+			repo = abs
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); errors.Is(err, fs.ErrNotExist) {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return "", err
+		}
+		if _, err := git(ctx, dir, "init", "--quiet"); err != nil {
+			return "", err
+		}
+	}
+	ref := branch
+	if len(ref) == 0 {
+		ref = "HEAD"
+	}
+	if _, err := git(ctx, dir, "fetch", "--quiet", "--depth", "1", repo, ref); err != nil {
+		return "", err
+	}
+	if _, err := git(ctx, dir, "checkout", "--quiet", "--force", "--detach", "FETCH_HEAD"); err != nil {
+		return "", err
+	}
+	revision, err := git(ctx, dir, "rev-parse", "--short", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	return revision, nil
+}
+
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	// never wait on a credentials prompt
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %v failed: %w: %v", args[0], err, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// Status is what the home page shows about the apps file
+type Status struct {
+	Enabled  bool
+	Source   string
+	Interval time.Duration
+	// Revision is the commit of the repository that was last read
+	Revision    string
+	LastCheck   time.Time
+	LastApplied time.Time
+	// LastChanges counts the apps the last apply created, updated or
+	// deleted
+	LastChanges int
+	// LastError is set when the file couldn't be read or applied,
+	// cleared once it applies
+	LastError string
+}
+
+var (
+	statusLock sync.Mutex
+	status     Status
+)
+
+// CurrentStatus returns the state of the watcher, Enabled is false when
+// no apps file is configured
+func CurrentStatus() Status {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	return status
+}
+
+func updateStatus(fn func(s *Status)) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	fn(&status)
+}
+
+// Watch applies the configured apps file, then checks it every
+// apps_interval (pulling the repository) and applies it again when it
+// changed or when the last apply failed. It returns right away when no
+// apps file is configured. A file that doesn't apply is logged and kept
+// in the status, the apps stay as they were
+func Watch(ctx context.Context, db *sql.DB, opts Options) error {
+	c := config.Get()
+	source := SourceFromConfig(c)
+	if !source.Enabled() {
+		return nil
+	}
+	interval, err := time.ParseDuration(c.AppsInterval)
+	if err != nil {
+		return err
+	}
+	opts.Source = source.String()
+	opts.DryRun = false
+	updateStatus(func(s *Status) {
+		s.Enabled = true
+		s.Source = opts.Source
+		s.Interval = interval
+	})
+
+	applied := ""
+	check := func() {
+		snapshot, err := source.Read(ctx)
+		if err == nil && snapshot.Digest == applied {
+			updateStatus(func(s *Status) {
+				s.LastCheck = time.Now()
+				s.Revision = snapshot.Revision
+			})
+			return
+		}
+		var result *Result
+		if err == nil {
+			result, err = Apply(ctx, db, snapshot.File, opts)
+		}
+		updateStatus(func(s *Status) {
+			s.LastCheck = time.Now()
+			if snapshot != nil {
+				s.Revision = snapshot.Revision
+			}
+			if result != nil {
+				s.LastApplied = s.LastCheck
+				s.LastChanges = result.Changed()
+			}
+			if err != nil {
+				s.LastError = err.Error()
+			} else {
+				s.LastError = ""
+			}
+		})
+		if result != nil {
+			for _, warning := range result.Warnings {
+				log.Printf("apps file %v: %v", opts.Source, warning)
+			}
+			log.Printf("apps file %v applied, %v of %v apps changed", opts.Source, result.Changed(), len(result.Changes))
+		}
+		if err != nil {
+			log.Printf("apps file %v: %v", opts.Source, err)
+			return
+		}
+		applied = snapshot.Digest
+	}
+
+	check()
+	if interval == 0 {
+		return nil
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				check()
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,374 @@
+package importer
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/barelyhuman/caddy-ui/caddy"
+	"github.com/barelyhuman/caddy-ui/data"
+	"github.com/barelyhuman/caddy-ui/data/models/app_options"
+	"github.com/barelyhuman/caddy-ui/data/models/app_ports"
+	"github.com/barelyhuman/caddy-ui/data/models/domains"
+	"github.com/barelyhuman/caddy-ui/data/store"
+)
+
+// Proposal is an app that would be created from one or more routes of
+// the live config, routes for the same hosts on different servers (ex:
+// :80 and :443) are folded into a single proposal
+type Proposal struct {
+	Key       string
+	Name      string
+	Type      caddy.RouteKind
+	Domains   []string
+	Upstreams []string
+	Options   map[string]string
+	Routes    []string
+}
+
+type UnmanagedRoute struct {
+	caddy.RouteSummary
+	Reason string
+}
+
+type ExistingRoute struct {
+	caddy.RouteSummary
+	AppID int64
+}
+
+type Plan struct {
+	Proposals []Proposal
+	Existing  []ExistingRoute
+	Unmanaged []UnmanagedRoute
+}
+
+// BuildPlan walks the servers config and proposes apps for every route
+// that caddy-ui can manage and isn't already mapped to an app
+func BuildPlan(db *sql.DB, servers caddy.ServersConfig) (Plan, error) {
+	plan := Plan{}
+
+	knownHosts, err := domains.AppIdsByDomain(db)
+	if err != nil {
+		return plan, err
+	}
+	usedNames, err := appNames(context.Background(), db)
+	if err != nil {
+		return plan, err
+	}
+	// upstreams can only be used by one app, routes sharing one with an
+	// app (or an earlier proposal) are left for the user to sort out
+	usedUpstreams, err := app_ports.AppIdsByDial(db)
+	if err != nil {
+		return plan, err
+	}
+	proposedUpstreams := map[string]string{}
+
+	byKey := map[string]int{}
+	for _, route := range caddy.WalkRoutes(servers) {
+		if !route.Managed() {
+			plan.Unmanaged = append(plan.Unmanaged, UnmanagedRoute{
+				RouteSummary: route,
+				Reason:       unmanagedReason(route),
+			})
+			continue
+		}
+
+		if appID, ok := existingApp(knownHosts, route.Hosts); ok {
+			plan.Existing = append(plan.Existing, ExistingRoute{
+				RouteSummary: route,
+				AppID:        appID,
+			})
+			continue
+		}
+
+		proposal := proposalFromRoute(route)
+		if idx, ok := byKey[proposal.Key]; ok {
+			existing := &plan.Proposals[idx]
+			if !sameTarget(*existing, proposal) {
+				plan.Unmanaged = append(plan.Unmanaged, UnmanagedRoute{
+					RouteSummary: route,
+					Reason:       fmt.Sprintf("conflicts with route %v for the same hosts", existing.Routes[0]),
+				})
+				continue
+			}
+			existing.Routes = append(existing.Routes, route.ID())
+			continue
+		}
+
+		if reason := upstreamConflict(proposal, usedUpstreams, proposedUpstreams); len(reason) > 0 {
+			plan.Unmanaged = append(plan.Unmanaged, UnmanagedRoute{
+				RouteSummary: route,
+				Reason:       reason,
+			})
+			continue
+		}
+		for _, upstream := range proposal.Upstreams {
+			proposedUpstreams[app_ports.DialKey(upstream)] = route.ID()
+		}
+
+		proposal.Name = uniqueName(usedNames, proposal.Domains[0])
+		byKey[proposal.Key] = len(plan.Proposals)
+		plan.Proposals = append(plan.Proposals, proposal)
+	}
+
+	return plan, nil
+}
+
+func upstreamConflict(proposal Proposal, used map[string]int64, proposed map[string]string) string {
+	for _, upstream := range proposal.Upstreams {
+		dial := app_ports.DialKey(upstream)
+		if appID, ok := used[dial]; ok {
+			return fmt.Sprintf("upstream %v is already used by app %v", upstream, appID)
+		}
+		if routeID, ok := proposed[dial]; ok {
+			return fmt.Sprintf("upstream %v is already used by route %v", upstream, routeID)
+		}
+	}
+	return ""
+}
+
+// InvalidError lists the selected proposals that can't be imported,
+// keyed by the proposal key, or by "key" when none was selected
+type InvalidError struct {
+	Fields map[string]string
+}
+
+func (e *InvalidError) Error() string {
+	problems := []string{}
+	for key, msg := range e.Fields {
+		problems = append(problems, key+" "+msg)
+	}
+	sort.Strings(problems)
+	return "invalid import: " + strings.Join(problems, "; ")
+}
+
+// check looks for the selected keys that aren't proposals of the plan
+// and for names, domains and upstreams taken since the plan was built
+func check(ctx context.Context, q data.Querier, plan Plan, selected map[string]bool) (map[string]string, error) {
+	fields := map[string]string{}
+	if len(selected) == 0 {
+		fields["key"] = "select at least one route to import"
+		return fields, nil
+	}
+
+	names, err := appNames(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	knownHosts, err := domains.NewStore(q).AppIdsByDomain(ctx)
+	if err != nil {
+		return nil, err
+	}
+	usedUpstreams, err := app_ports.NewStore(q).AppIdsByDial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	proposed := map[string]bool{}
+	for _, proposal := range plan.Proposals {
+		proposed[proposal.Key] = true
+		if !selected[proposal.Key] {
+			continue
+		}
+		if names[proposal.Name] {
+			fields[proposal.Key] = fmt.Sprintf("app name %v is already taken", proposal.Name)
+			continue
+		}
+		if appID, ok := existingApp(knownHosts, proposal.Domains); ok {
+			fields[proposal.Key] = fmt.Sprintf("a domain is already used by app %v", appID)
+			continue
+		}
+		if reason := upstreamConflict(proposal, usedUpstreams, nil); len(reason) > 0 {
+			fields[proposal.Key] = reason
+		}
+	}
+	for key := range selected {
+		if !proposed[key] {
+			fields[key] = "isn't a route that can be imported"
+		}
+	}
+	return fields, nil
+}
+
+// Apply creates the apps, domains, ports and options for the proposals
+// with the given keys in a single transaction. Keys that aren't in the
+// plan and proposals that clash with apps created since the plan was
+// built are reported in an InvalidError, nothing is created then
+func Apply(db *sql.DB, plan Plan, keys []string) ([]int64, error) {
+	ctx := context.Background()
+	selected := map[string]bool{}
+	for _, k := range keys {
+		selected[k] = true
+	}
+
+	instanceID, err := store.New(db).PrimaryInstanceID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	fields, err := check(ctx, tx, plan, selected)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) > 0 {
+		return nil, &InvalidError{Fields: fields}
+	}
+
+	created := []int64{}
+	for _, proposal := range plan.Proposals {
+		if !selected[proposal.Key] {
+			continue
+		}
+
+		var appID int64
+		err := tx.QueryRow(`insert into apps (name,instance_id,type) values (?,?,?) returning id`, proposal.Name, instanceID, string(proposal.Type)).Scan(&appID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create app %v: %w", proposal.Name, err)
+		}
+
+		for _, domain := range proposal.Domains {
+			if _, err := tx.Exec(`insert into domains (domain,app_id) values (?,?)`, domain, appID); err != nil {
+				return nil, fmt.Errorf("failed to add domain %v: %w", domain, err)
+			}
+		}
+
+		for _, upstream := range proposal.Upstreams {
+			if _, err := tx.Exec(`insert into app_ports (port,app_id) values (?,?)`, upstream, appID); err != nil {
+				return nil, fmt.Errorf("failed to add upstream %v: %w", upstream, err)
+			}
+		}
+
+		for name, value := range proposal.Options {
+			if _, err := tx.Exec(`insert into app_options (app_id,name,value) values (?,?,?)`, appID, name, value); err != nil {
+				return nil, fmt.Errorf("failed to add option %v: %w", name, err)
+			}
+		}
+
+		created = append(created, appID)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func proposalFromRoute(route caddy.RouteSummary) Proposal {
+	domains := []string{}
+	seen := map[string]bool{}
+	for _, h := range route.Hosts {
+		h = caddy.NormalizeHost(h)
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		domains = append(domains, h)
+	}
+
+	sortedHosts := append([]string{}, domains...)
+	sort.Strings(sortedHosts)
+
+	proposal := Proposal{
+		Key:     strings.Join(sortedHosts, ","),
+		Type:    route.Kind,
+		Domains: domains,
+		Options: map[string]string{},
+		Routes:  []string{route.ID()},
+	}
+
+	switch route.Kind {
+	case caddy.RouteKindReverseProxy:
+		for _, dial := range route.Upstreams {
+			proposal.Upstreams = append(proposal.Upstreams, upstreamFromDial(dial))
+		}
+	case caddy.RouteKindFileServer:
+		proposal.Options[app_options.Root] = route.Root
+	case caddy.RouteKindRedirect:
+		proposal.Options[app_options.RedirectTo] = route.RedirectTo
+		proposal.Options[app_options.RedirectStatusCode] = route.StatusCode
+	}
+
+	return proposal
+}
+
+// upstreamFromDial reduces local upstreams to just the port, which is
+// what app_ports stores for apps created from the UI, remote upstreams
+// are kept as the full dial address
+func upstreamFromDial(dial string) string {
+	host, port, err := net.SplitHostPort(dial)
+	if err != nil {
+		return dial
+	}
+	switch host {
+	case "localhost", "127.0.0.1", "::1", "":
+		return port
+	}
+	return dial
+}
+
+func sameTarget(a, b Proposal) bool {
+	if a.Type != b.Type {
+		return false
+	}
+	if strings.Join(a.Upstreams, ",") != strings.Join(b.Upstreams, ",") {
+		return false
+	}
+	for k, v := range a.Options {
+		if b.Options[k] != v {
+			return false
+		}
+	}
+	return len(a.Options) == len(b.Options)
+}
+
+func unmanagedReason(route caddy.RouteSummary) string {
+	if len(route.Hosts) == 0 {
+		return "route does not match on a host"
+	}
+	return "route handlers are not a reverse proxy, file server or redirect"
+}
+
+func existingApp(knownHosts map[string]int64, hosts []string) (int64, bool) {
+	for _, h := range hosts {
+		if id, ok := knownHosts[caddy.NormalizeHost(h)]; ok {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+func uniqueName(used map[string]bool, base string) string {
+	name := base
+	for i := 2; used[name]; i++ {
+		name = fmt.Sprintf("%v-%v", base, i)
+	}
+	used[name] = true
+	return name
+}
+
+func appNames(ctx context.Context, q data.Querier) (map[string]bool, error) {
+	rows, err := q.QueryContext(ctx, `select name from apps`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names[name] = true
+	}
+	return names, rows.Err()
+}
@@ -0,0 +1,107 @@
+package importer
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/barelyhuman/caddy-ui/caddy"
+	"github.com/barelyhuman/caddy-ui/migrate"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openTestDatabase(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db")+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := migrate.MigrateUp(db, migrate.Source(db, "")); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestApply(t *testing.T) {
+	var servers caddy.ServersConfig
+	err := json.Unmarshal([]byte(`{"srv0":{"listen":[":443"],"routes":[
+		{"match":[{"host":["web.example.com"]}],"handle":[{"handler":"reverse_proxy","upstreams":[{"dial":"localhost:3000"}]}]},
+		{"match":[{"host":["docs.example.com"]}],"handle":[{"handler":"file_server","root":"/srv/docs"}]},
+		{"match":[{"host":["api.example.com"]}],"handle":[{"handler":"reverse_proxy","upstreams":[{"dial":"localhost:4000"}]}]}
+	]}}`), &servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := openTestDatabase(t)
+	plan, err := BuildPlan(db, servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Proposals) != 3 {
+		t.Fatalf("proposals = %+v", plan.Proposals)
+	}
+
+	// apps created after the plan was built
+	for _, query := range []string{
+		"insert into instances (id,is_primary) values (1,true)",
+		"insert into apps (id,name,instance_id,type) values (1,'docs.example.com',1,'file-server')",
+		"insert into apps (id,name,instance_id,type) values (2,'other',1,'reverse-proxy')",
+		"insert into app_ports (app_id,port) values (2,'127.0.0.1:4000')",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatalf("%v: %v", query, err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		keys   []string
+		fields map[string]string
+	}{
+		{"nothing selected", nil, map[string]string{"key": "select at least one route to import"}},
+		{
+			"taken since",
+			[]string{"web.example.com", "docs.example.com", "api.example.com", "gone.example.com"},
+			map[string]string{
+				"docs.example.com": "app name docs.example.com is already taken",
+				"api.example.com":  "upstream 4000 is already used by app 2",
+				"gone.example.com": "isn't a route that can be imported",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Apply(db, plan, tt.keys)
+			var invalid *InvalidError
+			if !errors.As(err, &invalid) {
+				t.Fatalf("error = %v", err)
+			}
+			if len(invalid.Fields) != len(tt.fields) {
+				t.Errorf("fields = %v, want %v", invalid.Fields, tt.fields)
+			}
+			for key, msg := range tt.fields {
+				if got := invalid.Fields[key]; got != msg {
+					t.Errorf("%v = %q, want %q", key, got, msg)
+				}
+			}
+			var count int
+			if err := db.QueryRow("select count(*) from apps").Scan(&count); err != nil || count != 2 {
+				t.Errorf("%v apps after a failed import (%v)", count, err)
+			}
+		})
+	}
+
+	created, err := Apply(db, plan, []string{"web.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var name, port string
+	err = db.QueryRow("select a.name, p.port from apps a join app_ports p on p.app_id = a.id where a.id = ?", created[0]).Scan(&name, &port)
+	if err != nil || name != "web.example.com" || port != "3000" {
+		t.Errorf("imported %v with %v (%v)", name, port, err)
+	}
+}
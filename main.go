@@ -1,25 +1,815 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/barelyhuman/caddy-ui/api"
+	"github.com/barelyhuman/caddy-ui/audit"
+	"github.com/barelyhuman/caddy-ui/auth"
+	"github.com/barelyhuman/caddy-ui/backup"
 	"github.com/barelyhuman/caddy-ui/caddy"
+	"github.com/barelyhuman/caddy-ui/config"
 	"github.com/barelyhuman/caddy-ui/data"
+	"github.com/barelyhuman/caddy-ui/data/models/api_tokens"
+	"github.com/barelyhuman/caddy-ui/data/models/app_options"
 	"github.com/barelyhuman/caddy-ui/data/models/app_ports"
 	"github.com/barelyhuman/caddy-ui/data/models/apps"
+	"github.com/barelyhuman/caddy-ui/data/models/audit_log"
 	"github.com/barelyhuman/caddy-ui/data/models/domains"
-	"github.com/barelyhuman/caddy-ui/migrate"
+	"github.com/barelyhuman/caddy-ui/data/models/instances"
+	"github.com/barelyhuman/caddy-ui/data/models/users"
+	"github.com/barelyhuman/caddy-ui/data/store"
+	"github.com/barelyhuman/caddy-ui/gitops"
+	"github.com/barelyhuman/caddy-ui/importer"
+	"github.com/barelyhuman/caddy-ui/ports"
 	"github.com/barelyhuman/caddy-ui/views"
 	"github.com/joho/godotenv"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := data.GetDatabaseHandle()
+	if err != nil {
+		log.Printf("failed with error: %v", err)
+	}
+
+	if needsSetup, _ := auth.NeedsSetup(db); needsSetup {
+		http.Redirect(w, r, "/setup", http.StatusSeeOther)
+		return
+	}
+
+	renderLogin := func(message string) {
+		w.Header().Set("Content-Type", "text/html")
+		views.Render(w, "Login", struct {
+			Error       string
+			OIDCEnabled bool
+		}{
+			Error:       message,
+			OIDCEnabled: auth.OIDCEnabled(),
+		})
+	}
+
+	if r.Method == http.MethodGet {
+		renderLogin("")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	r.ParseForm()
+	user, err := auth.Login(db, r.Form.Get("username"), r.Form.Get("password"))
+	if errors.Is(err, auth.ErrInvalidCredentials) {
+		audit.Record(r, audit.Entry{
+			Actor:      r.Form.Get("username"),
+			Action:     "user.login_failed",
+			TargetType: "user",
+		})
+		w.WriteHeader(http.StatusUnauthorized)
+		renderLogin("Invalid username or password")
+		return
+	}
+	if err != nil {
+		log.Printf("failed with error: %v", err)
+		renderLogin("Failed to login, please try again later")
+		return
+	}
+
+	if err := auth.StartSession(w, r, db, user.ID); err != nil {
+		log.Printf("failed to start session: %v", err)
+		renderLogin("Failed to login, please try again later")
+		return
+	}
+	audit.Record(r, audit.Entry{
+		Actor:      user.Username,
+		Action:     "user.login",
+		TargetType: "user",
+		TargetID:   user.ID,
+	})
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if err := auth.StartOIDCLogin(w, r); err != nil {
+		log.Printf("failed to start oidc login: %v", err)
+		http.Error(w, "Single sign-on is not available right now", http.StatusServiceUnavailable)
+	}
+}
+
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := data.GetDatabaseHandle()
+	if err != nil {
+		log.Printf("failed with error: %v", err)
+	}
+
+	user, err := auth.FinishOIDCLogin(w, r, db)
+	if err != nil {
+		log.Printf("oidc login failed: %v", err)
+		audit.Record(r, audit.Entry{
+			Actor:      "sso",
+			Action:     "user.login_failed",
+			TargetType: "user",
+			After:      map[string]string{"error": err.Error()},
+		})
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusUnauthorized)
+		views.Render(w, "Login", struct {
+			Error       string
+			OIDCEnabled bool
+		}{
+			Error:       "Single sign-on failed: " + err.Error(),
+			OIDCEnabled: auth.OIDCEnabled(),
+		})
+		return
+	}
+
+	if err := auth.StartSession(w, r, db, user.ID); err != nil {
+		log.Printf("failed to start session: %v", err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	audit.Record(r, audit.Entry{
+		Actor:      user.Username,
+		Action:     "user.login",
+		TargetType: "user",
+		TargetID:   user.ID,
+		After:      audit.User(user),
+	})
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	db, _ := data.GetDatabaseHandle()
+	if session, err := auth.SessionFromRequest(db, r); err == nil {
+		if user, err := users.FindById(db, session.UserID); err == nil {
+			audit.Record(r, audit.Entry{
+				Actor:      user.Username,
+				Action:     "user.logout",
+				TargetType: "user",
+				TargetID:   user.ID,
+			})
+		}
+	}
+	if err := auth.EndSession(w, r, db); err != nil {
+		log.Printf("failed to end session: %v", err)
+	}
+
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// setupHandler creates the admin credentials on the first run, it's
+// unreachable once a password is set
+func setupHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := data.GetDatabaseHandle()
+	if err != nil {
+		log.Printf("failed with error: %v", err)
+	}
+
+	if needsSetup, _ := auth.NeedsSetup(db); !needsSetup {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	renderSetup := func(message string) {
+		w.Header().Set("Content-Type", "text/html")
+		views.Render(w, "Setup", struct {
+			Error       string
+			OIDCEnabled bool
+		}{
+			Error:       message,
+			OIDCEnabled: auth.OIDCEnabled(),
+		})
+	}
+
+	if r.Method == http.MethodGet {
+		renderSetup("")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	r.ParseForm()
+	username := strings.TrimSpace(r.Form.Get("username"))
+	password := r.Form.Get("password")
+	if len(username) == 0 {
+		renderSetup("Username is required")
+		return
+	}
+	if len(password) < 8 {
+		renderSetup("Password must be at least 8 characters")
+		return
+	}
+	if password != r.Form.Get("confirm_password") {
+		renderSetup("Passwords do not match")
+		return
+	}
+
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		log.Printf("failed to hash password: %v", err)
+		renderSetup("Failed to save password, please try again")
+		return
+	}
+
+	// apps are created against the primary instance
+	if _, err := instances.FindOrCreatePrimary(db); err != nil {
+		log.Printf("failed to create primary instance: %v", err)
+	}
+
+	admin := users.New()
+	admin.Username = username
+	admin.Password = hash
+	admin.Role = string(auth.RoleAdmin)
+	created, err := admin.Save(db)
+	if err != nil {
+		log.Printf("failed to save admin user: %v", err)
+		renderSetup("Failed to save user, please try again")
+		return
+	}
+	audit.Record(r, audit.Entry{
+		Actor:      created.Username,
+		Action:     "user.setup",
+		TargetType: "user",
+		TargetID:   created.ID,
+		After:      audit.User(created),
+	})
+
+	if err := auth.StartSession(w, r, db, created.ID); err != nil {
+		log.Printf("failed to start session: %v", err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func renderUsers(w http.ResponseWriter, r *http.Request, message string) {
+	db, _ := data.GetDatabaseHandle()
+	allUsers, err := users.FindAll(db)
+	if err != nil {
+		log.Printf("failed with error: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := views.Render(w, "Users", struct {
+		Users   []users.UsersWithIdentifier
+		Roles   []auth.Role
+		Current *users.UsersWithIdentifier
+		Error   string
+	}{
+		Users:   allUsers,
+		Roles:   auth.Roles,
+		Current: auth.UserFromContext(r.Context()),
+		Error:   message,
+	}); err != nil {
+		fmt.Fprintf(w, "failed to render page, please try again later")
+		log.Printf("failed with error: %v", err)
+	}
+}
+
+func usersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		renderUsers(w, r, "")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	db, _ := data.GetDatabaseHandle()
+	r.ParseForm()
+
+	username := strings.TrimSpace(r.Form.Get("username"))
+	password := r.Form.Get("password")
+	role := auth.Role(r.Form.Get("role"))
+	team := strings.TrimSpace(r.Form.Get("team"))
+
+	if len(username) == 0 || len(password) < 8 || !role.Valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		renderUsers(w, r, "A username, a valid role and a password of at least 8 characters are required")
+		return
+	}
+
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		log.Printf("failed to hash password: %v", err)
+		renderUsers(w, r, "Failed to create user, please try again")
+		return
+	}
+
+	user := users.New()
+	user.Username = username
+	user.Password = hash
+	user.Role = string(role)
+	user.Team = sql.NullString{String: team, Valid: len(team) > 0}
+	created, err := user.Save(db)
+	if err != nil {
+		log.Printf("failed to create user: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		renderUsers(w, r, "Failed to create user, the username might already be taken")
+		return
+	}
+	audit.Record(r, audit.Entry{
+		Action:     "user.create",
+		TargetType: "user",
+		TargetID:   created.ID,
+		After:      audit.User(created),
+	})
+
+	http.Redirect(w, r, "/users", http.StatusSeeOther)
+}
+
+// isLastAdmin guards against locking everyone out of user management
+func isLastAdmin(db *sql.DB, user *users.UsersWithIdentifier) bool {
+	if auth.Role(user.Role) != auth.RoleAdmin {
+		return false
+	}
+	count, err := users.CountByRole(db, string(auth.RoleAdmin))
+	return err != nil || count <= 1
+}
+
+func userUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	db, _ := data.GetDatabaseHandle()
+	id, _ := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	user, err := users.FindById(db, id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	before := audit.User(user)
+
+	r.ParseForm()
+	role := auth.Role(r.Form.Get("role"))
+	team := strings.TrimSpace(r.Form.Get("team"))
+	password := r.Form.Get("password")
+
+	if !role.Valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		renderUsers(w, r, "Invalid role")
+		return
+	}
+	if role != auth.RoleAdmin && isLastAdmin(db, user) {
+		w.WriteHeader(http.StatusBadRequest)
+		renderUsers(w, r, "Can't change the role of the last admin")
+		return
+	}
+
+	user.Role = string(role)
+	user.Team = sql.NullString{String: team, Valid: len(team) > 0}
+	if len(password) > 0 {
+		if len(password) < 8 {
+			w.WriteHeader(http.StatusBadRequest)
+			renderUsers(w, r, "Password must be at least 8 characters")
+			return
+		}
+		user.Password, err = auth.HashPassword(password)
+		if err != nil {
+			log.Printf("failed to hash password: %v", err)
+			renderUsers(w, r, "Failed to update user, please try again")
+			return
+		}
+	}
+
+	if err := user.Update(db); err != nil {
+		log.Printf("failed to update user: %v", err)
+		renderUsers(w, r, "Failed to update user, please try again")
+		return
+	}
+	action := "user.update"
+	if len(password) > 0 {
+		action = "user.update_password"
+		// whoever knew the old password is logged out
+		if err := auth.EndOtherSessions(r, db, user.ID); err != nil {
+			log.Printf("failed to end the sessions of user %v: %v", user.ID, err)
+		}
+	}
+	audit.Record(r, audit.Entry{
+		Action:     action,
+		TargetType: "user",
+		TargetID:   user.ID,
+		Before:     before,
+		After:      audit.User(user),
+	})
+
+	http.Redirect(w, r, "/users", http.StatusSeeOther)
+}
+
+func userDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	db, _ := data.GetDatabaseHandle()
+	id, _ := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	user, err := users.FindById(db, id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if isLastAdmin(db, user) {
+		w.WriteHeader(http.StatusBadRequest)
+		renderUsers(w, r, "Can't delete the last admin")
+		return
+	}
+
+	if err := users.DeleteById(db, id); err != nil {
+		log.Printf("failed to delete user: %v", err)
+	} else {
+		audit.Record(r, audit.Entry{
+			Action:     "user.delete",
+			TargetType: "user",
+			TargetID:   user.ID,
+			Before:     audit.User(user),
+		})
+	}
+
+	http.Redirect(w, r, "/users", http.StatusSeeOther)
+}
+
+type tokenForm struct {
+	Personal []api_tokens.ApiTokensWithIdentifier
+	Service  []api_tokens.ApiTokensWithIdentifier
+	Apps     []apps.AppsWithIdentifier
+	Scopes   []auth.Scope
+	IsAdmin  bool
+	Created  string
+	Error    string
+}
+
+func renderTokens(w http.ResponseWriter, r *http.Request, created string, message string) {
+	db, _ := data.GetDatabaseHandle()
+	user := auth.UserFromContext(r.Context())
+	isAdmin := auth.Role(user.Role).Includes(auth.RoleAdmin)
+
+	form := tokenForm{
+		IsAdmin: isAdmin,
+		Created: created,
+		Error:   message,
+	}
+
+	var err error
+	if form.Personal, err = api_tokens.FindByUserId(db, user.ID); err != nil {
+		log.Printf("failed with error: %v", err)
+	}
+	if isAdmin {
+		if form.Service, err = api_tokens.FindServiceTokens(db); err != nil {
+			log.Printf("failed with error: %v", err)
+		}
+	}
+	if form.Apps, err = apps.FindAll(db); err != nil {
+		log.Printf("failed with error: %v", err)
+	}
+	maxScope := auth.ScopeFor(auth.Role(user.Role))
+	for _, scope := range auth.Scopes {
+		if maxScope.Role().Includes(scope.Role()) {
+			form.Scopes = append(form.Scopes, scope)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := views.Render(w, "Tokens", form); err != nil {
+		fmt.Fprintf(w, "failed to render page, please try again later")
+		log.Printf("failed with error: %v", err)
+	}
+}
+
+// tokensHandler lists and creates API tokens, tokens can only be managed
+// from a logged in session and never with another token
+func tokensHandler(w http.ResponseWriter, r *http.Request) {
+	if auth.TokenFromContext(r.Context()) != nil {
+		auth.Forbidden(w, r)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		renderTokens(w, r, "", "")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	db, _ := data.GetDatabaseHandle()
+	user := auth.UserFromContext(r.Context())
+	r.ParseForm()
+
+	name := strings.TrimSpace(r.Form.Get("name"))
+	scope := auth.Scope(r.Form.Get("scope"))
+	kind := r.Form.Get("kind")
+	if len(kind) == 0 {
+		kind = api_tokens.KindPersonal
+	}
+
+	if len(name) == 0 || !scope.Valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		renderTokens(w, r, "", "A name and a valid scope are required")
+		return
+	}
+	if !auth.Role(user.Role).Includes(scope.Role()) {
+		w.WriteHeader(http.StatusForbidden)
+		renderTokens(w, r, "", "You can't create a token with more access than your role")
+		return
+	}
+	if kind != api_tokens.KindPersonal && (kind != api_tokens.KindService || !auth.Role(user.Role).Includes(auth.RoleAdmin)) {
+		w.WriteHeader(http.StatusForbidden)
+		renderTokens(w, r, "", "Only admins can create service tokens")
+		return
+	}
+
+	plain, hash, prefix, err := auth.NewToken()
+	if err != nil {
+		log.Printf("failed to generate token: %v", err)
+		renderTokens(w, r, "", "Failed to create token, please try again")
+		return
+	}
+
+	token := api_tokens.New()
+	token.Name = name
+	token.TokenHash = hash
+	token.Prefix = prefix
+	token.Kind = kind
+	token.Scope = string(scope)
+	if kind == api_tokens.KindPersonal {
+		token.UserID = sql.NullInt64{Int64: user.ID, Valid: true}
+	}
+
+	appIds := []string{}
+	for _, id := range r.Form["app_id"] {
+		if _, err := strconv.ParseInt(id, 10, 64); err == nil {
+			appIds = append(appIds, id)
+		}
+	}
+	if len(appIds) > 0 {
+		token.AppIDs = sql.NullString{String: strings.Join(appIds, ","), Valid: true}
+	}
+
+	if days, err := strconv.Atoi(r.Form.Get("expires_in_days")); err == nil && days > 0 {
+		token.ExpiresAt = sql.NullTime{Time: time.Now().UTC().AddDate(0, 0, days), Valid: true}
+	}
+
+	created, err := token.Save(db)
+	if err != nil {
+		log.Printf("failed to save token: %v", err)
+		renderTokens(w, r, "", "Failed to create token, please try again")
+		return
+	}
+	audit.Record(r, audit.Entry{
+		Action:     "token.create",
+		TargetType: "token",
+		TargetID:   created.ID,
+		After:      audit.Token(created.ID, &created.ApiTokens),
+	})
+
+	renderTokens(w, r, plain, "")
+}
+
+func tokenDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || auth.TokenFromContext(r.Context()) != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	db, _ := data.GetDatabaseHandle()
+	user := auth.UserFromContext(r.Context())
+	id, _ := strconv.ParseInt(r.PathValue("id"), 10, 64)
+
+	token, err := api_tokens.FindById(db, id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	isOwner := token.UserID.Valid && token.UserID.Int64 == user.ID
+	if !isOwner && !auth.Role(user.Role).Includes(auth.RoleAdmin) {
+		auth.Forbidden(w, r)
+		return
+	}
+
+	if err := api_tokens.DeleteById(db, id); err != nil {
+		log.Printf("failed to delete token: %v", err)
+	} else {
+		audit.Record(r, audit.Entry{
+			Action:     "token.delete",
+			TargetType: "token",
+			TargetID:   token.ID,
+			Before:     audit.Token(token.ID, &token.ApiTokens),
+		})
+	}
+
+	http.Redirect(w, r, "/tokens", http.StatusSeeOther)
+}
+
+const auditPageSize = 50
+
+// auditFilter reads the audit filters from the query, dates are whole
+// days so until includes the day picked
+func auditFilter(r *http.Request) audit_log.Filter {
+	query := r.URL.Query()
+	filter := audit_log.Filter{
+		Actor:      query.Get("actor"),
+		Action:     query.Get("action"),
+		TargetType: query.Get("target_type"),
+		TargetID:   query.Get("target_id"),
+	}
+	if since, err := time.Parse("2006-01-02", query.Get("since")); err == nil {
+		filter.Since = since
+	}
+	if until, err := time.Parse("2006-01-02", query.Get("until")); err == nil {
+		filter.Until = until.AddDate(0, 0, 1)
+	}
+	return filter
+}
+
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := data.GetDatabaseHandle()
+
+	filter := auditFilter(r)
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	filter.Limit = auditPageSize
+	filter.Offset = (page - 1) * auditPageSize
+
+	entries, err := audit_log.Find(db, filter)
+	if err != nil {
+		log.Printf("failed with error: %v", err)
+	}
+	total, err := audit_log.Count(db, filter)
+	if err != nil {
+		log.Printf("failed with error: %v", err)
+	}
+	actors, _ := audit_log.Distinct(db, "actor")
+	actions, _ := audit_log.Distinct(db, "action")
+	targetTypes, _ := audit_log.Distinct(db, "target_type")
+
+	nextPage := 0
+	if page*auditPageSize < total {
+		nextPage = page + 1
+	}
+
+	// keeps the filters on the pagination and export links
+	query := r.URL.Query()
+	query.Del("page")
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := views.Render(w, "Audit", struct {
+		Entries     []audit_log.AuditLogWithIdentifier
+		Query       url.Values
+		Filters     string
+		Actors      []string
+		Actions     []string
+		TargetTypes []string
+		Page        int
+		PrevPage    int
+		NextPage    int
+		Total       int
+	}{
+		Entries:     entries,
+		Query:       r.URL.Query(),
+		Filters:     query.Encode(),
+		Actors:      actors,
+		Actions:     actions,
+		TargetTypes: targetTypes,
+		Page:        page,
+		PrevPage:    page - 1,
+		NextPage:    nextPage,
+		Total:       total,
+	}); err != nil {
+		fmt.Fprintf(w, "failed to render page, please try again later")
+		log.Printf("failed with error: %v", err)
+	}
+}
+
+// auditExportHandler downloads the filtered entries as JSON or CSV
+func auditExportHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := data.GetDatabaseHandle()
+
+	entries, err := audit_log.Find(db, auditFilter(r))
+	if err != nil {
+		log.Printf("failed with error: %v", err)
+		http.Error(w, "failed to read the audit log", http.StatusInternalServerError)
+		return
+	}
+
+	type exportEntry struct {
+		ID         int64           `json:"id"`
+		Actor      string          `json:"actor"`
+		Action     string          `json:"action"`
+		TargetType string          `json:"target_type"`
+		TargetID   string          `json:"target_id"`
+		Before     json.RawMessage `json:"before"`
+		After      json.RawMessage `json:"after"`
+		ClientIP   string          `json:"client_ip"`
+		CreatedAt  time.Time       `json:"created_at"`
+	}
+	rawOrNull := func(value sql.NullString) json.RawMessage {
+		if !value.Valid {
+			return json.RawMessage("null")
+		}
+		return json.RawMessage(value.String)
+	}
+
+	filename := "audit-" + time.Now().UTC().Format("20060102-150405")
+
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.csv"`)
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"id", "created_at", "actor", "action", "target_type", "target_id", "client_ip", "before", "after"})
+		for _, entry := range entries {
+			writer.Write([]string{
+				strconv.FormatInt(entry.ID, 10),
+				entry.CreatedAt.UTC().Format(time.RFC3339),
+				entry.Actor,
+				entry.Action,
+				entry.TargetType,
+				entry.TargetID.String,
+				entry.ClientIP.String,
+				entry.Before.String,
+				entry.After.String,
+			})
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			log.Printf("failed to write csv: %v", err)
+		}
+		return
+	}
+
+	export := []exportEntry{}
+	for _, entry := range entries {
+		export = append(export, exportEntry{
+			ID:         entry.ID,
+			Actor:      entry.Actor,
+			Action:     entry.Action,
+			TargetType: entry.TargetType,
+			TargetID:   entry.TargetID.String,
+			Before:     rawOrNull(entry.Before),
+			After:      rawOrNull(entry.After),
+			ClientIP:   entry.ClientIP.String,
+			CreatedAt:  entry.CreatedAt.UTC(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+	if err := json.NewEncoder(w).Encode(export); err != nil {
+		log.Printf("failed with error: %v", err)
+	}
+}
+
+func apiExplorerHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	if err := views.Render(w, "ApiExplorer", struct {
+		SpecURL string
+	}{
+		SpecURL: api.Prefix + "/openapi.json",
+	}); err != nil {
+		fmt.Fprintf(w, "failed to render page, please try again later")
+		log.Printf("failed with error: %v", err)
+	}
+}
+
 func configEditorHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
 	views.Render(w, "ConfigEditor", nil)
@@ -30,6 +820,10 @@ func SyncConfigForApp(appId string) error {
 	if err != nil {
 		return err
 	}
+	if servers == nil {
+		// caddy without any http servers responds with null
+		servers = caddy.ServersConfig{}
+	}
 
 	// Collect server keys that listen on :80 or :443.
 	mappings := []string{}
@@ -39,15 +833,17 @@ func SyncConfigForApp(appId string) error {
 				// Remove default file_server handler for :80.
 				if port == ":80" {
 					for i, route := range server.Routes {
-						newHandles := []caddy.HandleDef{}
-						for _, h := range route.Handle {
-							// Skip the default file_server if no match criteria.
-							if h.Handler == "file_server" && len(route.Match) == 0 {
-								continue
-							}
-							newHandles = append(newHandles, h)
+						// Skip the default file_server if no match criteria.
+						if len(route.Match) > 0 {
+							continue
+						}
+						newHandles := slices.DeleteFunc(slices.Clone(route.Handle), func(h caddy.HandleDef) bool {
+							return h.Handler == "file_server"
+						})
+						// untouched routes are written back as they were read
+						if len(newHandles) != len(route.Handle) {
+							server.Routes[i].Handle = newHandles
 						}
-						server.Routes[i].Handle = newHandles
 					}
 				}
 				mappings = append(mappings, key)
@@ -83,69 +879,54 @@ func SyncConfigForApp(appId string) error {
 	if err != nil {
 		return err
 	}
-	domainData, err := domains.FindByAppId(db, appId)
+	app, err := apps.FindById(db, appId)
 	if err != nil {
 		return err
 	}
-	appPort, err := app_ports.FindByAppId(db, appId)
+	domainList, err := domains.FindAllByAppId(db, appId)
+	if err != nil {
+		return err
+	}
+	hosts := []string{}
+	for _, d := range domainList {
+		if len(d.Domain) > 0 {
+			hosts = append(hosts, d.Domain)
+		}
+	}
+	if len(hosts) == 0 {
+		return fmt.Errorf("app %v has no domain mapped", appId)
+	}
+	handlers, err := appHandlers(db, app)
 	if err != nil {
 		return err
 	}
-	dialAddr := "127.0.0.1:" + appPort.Port
 
-	// For each mapping, update an existing reverse_proxy route or add a new one.
+	// For each mapping, replace the route for the app's domains or add a
+	// new one.
 	for _, key := range mappings {
 		server := servers[key]
 		updated := false
 
 		for i, route := range server.Routes {
-			for j, handle := range route.Handle {
-				if handle.Handler != "subroute" || len(handle.Routes) == 0 {
-					continue
-				}
-				for k, subRoute := range handle.Routes {
-					for l, subHandle := range subRoute.Handle {
-						if subHandle.Handler == "reverse_proxy" && len(subHandle.Upstreams) > 0 {
-							if subHandle.Upstreams[0].Dial != dialAddr {
-								server.Routes[i].Handle[j].Routes[k].Handle[l].Upstreams[0].Dial = dialAddr
-							}
-							updated = true
-							break
-						}
-					}
-					if updated {
-						break
-					}
-				}
-				if updated {
-					break
-				}
-			}
-			if updated {
-				break
+			routeHosts := caddy.RouteHosts(route)
+			if !slices.ContainsFunc(hosts, func(host string) bool {
+				return slices.Contains(routeHosts, host)
+			}) {
+				continue
 			}
+			server.Routes[i].Match = []caddy.Match{{Host: hosts}}
+			server.Routes[i].Handle = handlers
+			updated = true
+			break
 		}
 
 		if !updated {
 			newRoute := caddy.Route{
 				Match: []caddy.Match{
-					{Host: []string{domainData.Domain}},
-				},
-				Handle: []caddy.HandleDef{
-					{
-						Handler: "subroute",
-						Routes: []caddy.Route{
-							{
-								Handle: []caddy.HandleDef{
-									{
-										Handler:   "reverse_proxy",
-										Upstreams: []caddy.Upstream{{Dial: dialAddr}},
-									},
-								},
-							},
-						},
-					},
+					{Host: hosts},
 				},
+				Handle:   handlers,
+				Terminal: true,
 			}
 			server.Routes = append(server.Routes, newRoute)
 		}
@@ -155,27 +936,117 @@ func SyncConfigForApp(appId string) error {
 	return caddy.SaveServersConfig(servers)
 }
 
+// RemoveConfigForHosts takes the hosts no app uses anymore out of the
+// routes, caddy keeps serving the domains of a deleted app or the old
+// domain of a renamed one otherwise
+func RemoveConfigForHosts(hosts []string) error {
+	if len(hosts) == 0 {
+		return nil
+	}
+	servers, err := caddy.GetServersConfig()
+	if err != nil {
+		return err
+	}
+	if caddy.RemoveHostRoutes(servers, hosts) == 0 {
+		return nil
+	}
+	return caddy.SaveServersConfig(servers)
+}
+
+// appHandlers builds the handler chain for the app based on its type,
+// wrapped in a subroute the same way the Caddyfile adapter does
+func appHandlers(db *sql.DB, app *apps.AppsWithIdentifier) ([]caddy.HandleDef, error) {
+	appId := strconv.FormatInt(app.ID, 10)
+	options, err := app_options.FindByAppId(db, appId)
+	if err != nil {
+		return nil, err
+	}
+
+	var handle caddy.HandleDef
+	switch caddy.RouteKind(app.Type.String) {
+	case caddy.RouteKindFileServer:
+		if len(options[app_options.Root]) == 0 {
+			return nil, fmt.Errorf("file server app %v has no root", appId)
+		}
+		handle = caddy.HandleDef{
+			Handler: "file_server",
+			Root:    options[app_options.Root],
+		}
+	case caddy.RouteKindRedirect:
+		if len(options[app_options.RedirectTo]) == 0 {
+			return nil, fmt.Errorf("redirect app %v has no target", appId)
+		}
+		statusCode := options[app_options.RedirectStatusCode]
+		if len(statusCode) == 0 {
+			statusCode = "302"
+		}
+		handle = caddy.HandleDef{
+			Handler:    "static_response",
+			StatusCode: caddy.StatusCode(statusCode),
+			Headers: map[string][]string{
+				"Location": {options[app_options.RedirectTo]},
+			},
+		}
+	default:
+		ports, err := app_ports.FindAllByAppId(db, appId)
+		if err != nil {
+			return nil, err
+		}
+		upstreams := []caddy.Upstream{}
+		for _, port := range ports {
+			if len(port.Port) > 0 {
+				upstreams = append(upstreams, caddy.Upstream{Dial: port.Dial()})
+			}
+		}
+		if len(upstreams) == 0 {
+			return nil, fmt.Errorf("app %v has no upstream", appId)
+		}
+		handle = caddy.HandleDef{
+			Handler:   "reverse_proxy",
+			Upstreams: upstreams,
+		}
+	}
+
+	return []caddy.HandleDef{
+		{
+			Handler: "subroute",
+			Routes: []caddy.Route{
+				{Handle: []caddy.HandleDef{handle}},
+			},
+		},
+	}, nil
+}
+
 func homeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
 	db, _ := data.GetDatabaseHandle()
 
-	portRows, _ := db.Query(`select app_id, port from app_ports`)
-
-	usedPortMap := map[int64]string{}
-
-	for portRows.Next() {
-		var appId int64
-		var port string
-		portRows.Scan(&appId, &port)
-		if len(port) > 0 {
-			usedPortMap[appId] = port
-		}
+	ctx := r.Context()
+	registry := store.New(db)
+	entries, err := ports.List(ctx, registry)
+	if err != nil {
+		log.Printf("failed with error: %v", err)
+	}
+	nextPort, err := ports.Allocate(ctx, registry)
+	if err != nil {
+		log.Printf("failed to find a free port: %v", err)
 	}
 
+	user := auth.UserFromContext(r.Context())
 	if err := views.Render(w, "Home", struct {
-		UsedPorts map[int64]string
+		Ports     []ports.Entry
+		PortRange string
+		NextPort  int
+		IsAdmin   bool
+		Backups   backup.Status
+		AppsFile  gitops.Status
 	}{
-		UsedPorts: usedPortMap,
+		Ports:     entries,
+		PortRange: config.Get().PortRange,
+		NextPort:  nextPort,
+		IsAdmin:   auth.Role(user.Role).Includes(auth.RoleAdmin),
+		Backups:   backup.CurrentStatus(),
+		AppsFile:  gitops.CurrentStatus(),
 	}); err != nil {
 		fmt.Fprintf(w, "failed to render page, please try again later")
 		log.Printf("failed with error: %v", err)
@@ -183,6 +1054,48 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// backupHandler sends a backup archive, it's written to a temporary file
+// first so a failure is still an error page and not half an archive
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := data.GetDatabaseHandle()
+
+	f, err := os.CreateTemp("", "caddy-ui-backup-*.tar.gz")
+	if err != nil {
+		log.Printf("failed with error: %v", err)
+		http.Error(w, "failed to create the backup", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	manifest, warnings, err := backup.Write(r.Context(), db, f)
+	if err != nil {
+		log.Printf("failed to create backup: %v", err)
+		http.Error(w, "failed to create the backup: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, warning := range warnings {
+		log.Printf("backup: %v", warning)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		log.Printf("failed with error: %v", err)
+		http.Error(w, "failed to create the backup", http.StatusInternalServerError)
+		return
+	}
+
+	filename := backup.Filename(manifest.CreatedAt)
+	audit.Record(r, audit.Entry{
+		Action:     "backup.create",
+		TargetType: "backup",
+		TargetID:   filename,
+		After:      manifest,
+	})
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	io.Copy(w, f)
+}
+
 func appsHandler(w http.ResponseWriter, r *http.Request) {
 	db, err := data.GetDatabaseHandle()
 	if err != nil {
@@ -204,175 +1117,592 @@ func appsHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("failed with error: %v", err)
 		return
 	}
-}
+}
+
+func appDetailsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+
+	id := r.PathValue("id")
+
+	if !auth.AppAllowed(r.Context(), id) {
+		auth.Forbidden(w, r)
+		return
+	}
+
+	db, _ := data.GetDatabaseHandle()
+
+	app, err := apps.FindById(db, id)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	ports, err := app_ports.FindByAppId(db, id)
+	if errors.Is(err, data.ErrNotFound) {
+		// file servers and redirects don't have a port
+		ports, err = &app_ports.AppPortsWithIdentifier{}, nil
+	}
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	domainData, err := domains.FindByAppId(db, id)
+	if err != nil {
+		return
+	}
+
+	options, err := app_options.FindByAppId(db, id)
+	if err != nil {
+		log.Println(err)
+	}
+
+	user := auth.UserFromContext(r.Context())
+
+	views.Render(w, "AppsDetails", struct {
+		App           apps.AppsWithIdentifier
+		Ports         app_ports.AppPortsWithIdentifier
+		PrimaryDomain domains.DomainsWithIdentifier
+		Options       map[string]string
+		CanEdit       bool
+		CanSync       bool
+		IsAdmin       bool
+		// DomainError and DomainWarning come back from the domain form
+		DomainError   string
+		DomainWarning string
+	}{
+		App:           *app,
+		Ports:         *ports,
+		PrimaryDomain: *domainData,
+		Options:       options,
+		CanEdit:       auth.CanEditApp(r, db, id) && !app.ManagedBy.Valid,
+		CanSync:       auth.CanEditApp(r, db, id),
+		IsAdmin:       auth.Role(user.Role).Includes(auth.RoleAdmin),
+		DomainError:   r.URL.Query().Get("error"),
+		DomainWarning: r.URL.Query().Get("warning"),
+	})
+}
+
+// appTeamHandler assigns the app to a team, operators in that team can
+// then edit it
+func appTeamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	r.ParseForm()
+	id := r.PathValue("id")
+	team := strings.TrimSpace(r.Form.Get("team"))
+
+	db, _ := data.GetDatabaseHandle()
+	if managedApp(w, db, id) {
+		return
+	}
+	before := audit.App(db, id)
+	if err := apps.SetTeam(db, id, sql.NullString{String: team, Valid: len(team) > 0}); err != nil {
+		log.Println("failed to update team", err)
+	} else {
+		audit.Record(r, audit.Entry{
+			Action:     "app.team",
+			TargetType: "app",
+			TargetID:   id,
+			Before:     before,
+			After:      audit.App(db, id),
+		})
+	}
+
+	http.Redirect(w, r, "/apps/"+id, http.StatusSeeOther)
+}
+
+func syncConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	id := r.PathValue("id")
+
+	db, _ := data.GetDatabaseHandle()
+	if !auth.CanEditApp(r, db, id) {
+		auth.Forbidden(w, r)
+		return
+	}
+
+	syncErr := SyncConfigForApp(id)
+	entry := audit.Entry{
+		Action:     "app.sync",
+		TargetType: "app",
+		TargetID:   id,
+	}
+	if syncErr != nil {
+		entry.After = map[string]string{"error": syncErr.Error()}
+	}
+	audit.Record(r, entry)
+	if syncErr != nil {
+		log.Printf("failed to sync app %v: %v", id, syncErr)
+		http.Error(w, fmt.Sprintf("failed to sync with caddy: %v", syncErr), http.StatusBadGateway)
+		return
+	}
+
+	jsonResponse, _ := ResponseJson{
+		"message": "Done",
+	}.toJSONString()
+
+	io.WriteString(w, jsonResponse)
+}
+
+func appDomainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	r.ParseForm()
+
+	domain := caddy.NormalizeHost(r.Form.Get("domain"))
+
+	id := r.PathValue("id")
+	db, _ := data.GetDatabaseHandle()
+
+	if !auth.CanEditApp(r, db, id) {
+		auth.Forbidden(w, r)
+		return
+	}
+	if managedApp(w, db, id) {
+		return
+	}
+
+	appID, _ := strconv.ParseInt(id, 10, 64)
+	query := url.Values{}
+	if len(domain) > 0 {
+		check, err := api.CheckDomains(db, appID, []string{domain})
+		if err != nil {
+			log.Printf("failed with error: %v", err)
+			http.Redirect(w, r, "/apps/"+id, http.StatusSeeOther)
+			return
+		}
+		for _, msg := range check.Fields {
+			query.Set("error", domain+" "+msg)
+		}
+		for _, msg := range check.Conflicts {
+			query.Set("error", domain+" "+msg)
+		}
+		if query.Has("error") {
+			http.Redirect(w, r, "/apps/"+id+"?"+query.Encode(), http.StatusSeeOther)
+			return
+		}
+		if len(check.Warnings) > 0 {
+			query.Set("warning", strings.Join(check.Warnings, "; "))
+		}
+	}
+
+	before := audit.App(db, id)
+
+	// the form edits the primary (oldest) domain, the others are kept
+	ctx := r.Context()
+	released := []string{}
+	err := store.New(db).Atomic(ctx, func(tx *store.Store) error {
+		existing, err := tx.Domains.FindAllByAppId(ctx, appID)
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			released = api.ReleasedHosts([]string{existing[0].Domain}, []string{domain})
+		}
+		// an empty domain clears it, hostnames are unique so it can't
+		// be stored
+		if len(domain) == 0 {
+			if len(existing) == 0 {
+				return nil
+			}
+			return tx.Domains.Delete(ctx, existing[0].ID)
+		}
+		if len(existing) > 0 {
+			existing[0].Domain = domain
+			return tx.Domains.Update(ctx, &existing[0])
+		}
+		record := domains.New()
+		record.Domain = domain
+		record.AppID = appID
+		_, err = tx.Domains.Create(ctx, record)
+		return err
+	})
+	if err != nil {
+		log.Printf("failed to save domain: %v", err)
+		query.Set("error", fmt.Sprintf("failed to save the domain: %v", err))
+		http.Redirect(w, r, "/apps/"+id+"?"+query.Encode(), http.StatusSeeOther)
+		return
+	}
+
+	audit.Record(r, audit.Entry{
+		Action:     "app.domain",
+		TargetType: "app",
+		TargetID:   id,
+		Before:     before,
+		After:      audit.App(db, id),
+	})
+
+	// a sync only replaces the route of the hosts the app still has, the
+	// released ones are taken out first
+	syncErr := RemoveConfigForHosts(released)
+	if syncErr == nil {
+		var hosts []string
+		hosts, syncErr = api.AppHosts(db, appID)
+		if syncErr == nil && len(hosts) > 0 {
+			syncErr = SyncConfigForApp(id)
+		}
+	}
+	if syncErr != nil {
+		log.Printf("failed to sync app %v: %v", id, syncErr)
+		query.Set("error", fmt.Sprintf("domain saved but failed to sync with caddy: %v", syncErr))
+	}
+
+	target := "/apps/" + id
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// managedApp refuses changes to an app applied from an apps file, the
+// file is where it changes. The error is written when it returns true
+func managedApp(w http.ResponseWriter, db *sql.DB, id string) bool {
+	app, err := apps.FindById(db, id)
+	if err != nil || !app.ManagedBy.Valid {
+		return false
+	}
+	http.Error(w, fmt.Sprintf("app %v is managed by %v, change it there", app.Name, app.ManagedBy.String), http.StatusConflict)
+	return true
+}
+
+func appDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		db, _ := data.GetDatabaseHandle()
+		id := r.PathValue("id")
+		idInt, _ := strconv.Atoi(id)
+
+		if !auth.CanEditApp(r, db, id) {
+			auth.Forbidden(w, r)
+			return
+		}
+		if managedApp(w, db, id) {
+			return
+		}
+
+		before := audit.App(db, id)
+		hosts, err := api.AppHosts(db, int64(idInt))
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "failed to delete the app, please try again later", http.StatusInternalServerError)
+			return
+		}
+
+		if err := store.New(db).DeleteApp(r.Context(), int64(idInt)); err != nil {
+			log.Println(err)
+			http.Error(w, "failed to delete the app, please try again later", http.StatusInternalServerError)
+			return
+		}
+		audit.Record(r, audit.Entry{
+			Action:     "app.delete",
+			TargetType: "app",
+			TargetID:   id,
+			Before:     before,
+		})
+
+		// caddy would keep serving the app's domains otherwise
+		if err := RemoveConfigForHosts(hosts); err != nil {
+			log.Printf("failed to remove the routes of app %v: %v", id, err)
+			http.Error(w, fmt.Sprintf("app deleted but caddy refused to remove its routes: %v", err), http.StatusBadGateway)
+			return
+		}
+
+		http.Redirect(w, r, "/apps", http.StatusSeeOther)
+		return
+	}
+}
+
+// appForm is the create form with the values to show again and the
+// errors keyed by input
+type appForm struct {
+	Name   string
+	Type   string
+	Port   string
+	Root   string
+	Error  string
+	Fields map[string]string
+}
+
+// formField maps the keys of a CreateAppRequest error to the input of
+// the create form, empty for the ones the form doesn't have
+func formField(key string) string {
+	switch {
+	case key == "name" || key == "type":
+		return key
+	case key == "options."+app_options.Root:
+		return "root"
+	case key == "allocate_port" || key == "upstreams" || strings.HasPrefix(key, "upstreams."):
+		return "port"
+	}
+	return ""
+}
+
+func appsNewHandler(w http.ResponseWriter, r *http.Request) {
+	form := appForm{Fields: map[string]string{}}
+	render := func(status int) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(status)
+		views.Render(w, "AppsCreate", form)
+	}
+
+	if r.Method == http.MethodGet {
+		render(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	db, err := data.GetDatabaseHandle()
+	if err != nil {
+		log.Printf("failed with error: %v", err)
+		http.Error(w, "failed to connect to database", http.StatusInternalServerError)
+		return
+	}
+	r.ParseForm()
+	form.Name = r.Form.Get("name")
+	form.Type = r.Form.Get("type")
+	form.Port = strings.TrimSpace(r.Form.Get("port"))
+	form.Root = strings.TrimSpace(r.Form.Get("root"))
+
+	// the same checks and creation as the API, an empty port on a
+	// reverse proxy gets the next free one of the port range
+	body := api.CreateAppRequest{Name: form.Name, Type: form.Type, Options: map[string]string{}}
+	if len(form.Root) > 0 {
+		body.Options[app_options.Root] = form.Root
+	}
+	if len(form.Port) > 0 {
+		body.Upstreams = []string{form.Port}
+	} else if len(form.Type) == 0 || form.Type == string(caddy.RouteKindReverseProxy) {
+		body.AllocatePort = true
+	}
+	// operators can only manage apps of their own team
+	body.Team, err = auth.NewAppTeam(r.Context(), "")
+	if err != nil {
+		form.Error = err.Error()
+		render(http.StatusForbidden)
+		return
+	}
+
+	fields, conflicts, _, err := body.Check(db)
+	if err != nil {
+		log.Printf("failed to check app: %v", err)
+		form.Error = "failed to check the app, please try again later"
+		render(http.StatusInternalServerError)
+		return
+	}
+	if len(fields) > 0 || len(conflicts) > 0 {
+		status := http.StatusConflict
+		if len(fields) > 0 {
+			status = http.StatusUnprocessableEntity
+		}
+		for _, problems := range []map[string]string{conflicts, fields} {
+			for key, msg := range problems {
+				if input := formField(key); len(input) > 0 {
+					form.Fields[input] = msg
+				} else {
+					form.Error = key + " " + msg
+				}
+			}
+		}
+		render(status)
+		return
+	}
 
-func appDetailsHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.NotFound(w, r)
+	appID, err := api.CreateApp(r.Context(), db, &body)
+	if errors.Is(err, ports.ErrExhausted) {
+		form.Fields["port"] = err.Error()
+		render(http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to create app: %v", err)
+		form.Error = "failed to create the app, please try again later"
+		render(http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/html")
+	appId := strconv.FormatInt(appID, 10)
+	audit.Record(r, audit.Entry{
+		Action:     "app.create",
+		TargetType: "app",
+		TargetID:   appId,
+		After:      audit.App(db, appId),
+	})
 
-	id := r.PathValue("id")
+	http.Redirect(w, r, "/apps", http.StatusSeeOther)
+}
 
-	db, _ := data.GetDatabaseHandle()
+// importForm is the import page, the proposals of the plan are checked
+// when Selected has their key
+type importForm struct {
+	importer.Plan
+	Selected map[string]bool
+	Error    string
+	Fields   map[string]string
+}
 
-	data, err := apps.FindById(db, id)
+func appsImportHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := data.GetDatabaseHandle()
 	if err != nil {
-		log.Println(err)
-		return
+		log.Printf("failed with error: %v", err)
 	}
-	ports, err := app_ports.FindByAppId(db, id)
+
+	servers, err := caddy.GetServersConfig()
 	if err != nil {
-		log.Println(err)
+		log.Printf("failed to fetch caddy config: %v", err)
+		http.Error(w, "failed to fetch config from caddy", http.StatusBadGateway)
 		return
 	}
 
-	domainData, err := domains.FindByAppId(db, id)
+	plan, err := importer.BuildPlan(db, servers)
 	if err != nil {
+		log.Printf("failed with error: %v", err)
+		http.Error(w, "failed to read existing apps", http.StatusInternalServerError)
 		return
 	}
 
-	views.Render(w, "AppsDetails", struct {
-		App           apps.AppsWithIdentifier
-		Ports         app_ports.AppPortsWithIdentifier
-		PrimaryDomain domains.DomainsWithIdentifier
-	}{
-		App:           *data,
-		Ports:         *ports,
-		PrimaryDomain: *domainData,
-	})
-}
+	form := importForm{Plan: plan, Selected: map[string]bool{}, Fields: map[string]string{}}
+	render := func(status int) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(status)
+		if err := views.Render(w, "AppsImport", form); err != nil {
+			log.Printf("failed with error: %v", err)
+		}
+	}
 
-func syncConfigHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.NotFound(w, r)
+	if r.Method == http.MethodGet {
+		for _, proposal := range plan.Proposals {
+			form.Selected[proposal.Key] = true
+		}
+		render(http.StatusOK)
 		return
 	}
-	id := r.PathValue("id")
-
-	SyncConfigForApp(id)
-
-	jsonResponse, _ := ResponseJson{
-		"message": "Done",
-	}.toJSONString()
-
-	io.WriteString(w, jsonResponse)
-}
 
-func appDomainHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.NotFound(w, r)
 		return
 	}
 
 	r.ParseForm()
-
-	domain := r.Form.Get("domain")
-
-	id := r.PathValue("id")
-	db, _ := data.GetDatabaseHandle()
-
-	var existingDomainId int64
-	rows, _ := db.Query(`select id from domains where app_id = ? limit 1`, id)
-	for rows.Next() {
-		rows.Scan(&existingDomainId)
+	for _, key := range r.Form["key"] {
+		form.Selected[key] = true
 	}
-	rows.Close()
-
-	if existingDomainId > 0 {
-		_, err := db.Exec(`update domains set domain = ? where app_id = ?`, domain, id)
-		if err != nil {
-			log.Println("failed to update domain", err)
-		}
-	} else {
-		_, err := db.Exec(`insert into domains (domain,app_id) values (?,?)`, domain, id)
-		if err != nil {
-			log.Println("failed to insert domain", err)
+	created, err := importer.Apply(db, plan, r.Form["key"])
+	var invalid *importer.InvalidError
+	if errors.As(err, &invalid) {
+		// the keys without a row in the table are shown above it
+		problems := []string{}
+		for key, msg := range invalid.Fields {
+			if form.Selected[key] && slices.ContainsFunc(plan.Proposals, func(p importer.Proposal) bool { return p.Key == key }) {
+				form.Fields[key] = msg
+				continue
+			}
+			problems = append(problems, msg)
 		}
+		slices.Sort(problems)
+		form.Error = strings.Join(problems, ", ")
+		render(http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to import apps: %v", err)
+		form.Error = "failed to import the apps, please try again later"
+		render(http.StatusInternalServerError)
+		return
 	}
 
-	SyncConfigForApp(id)
+	for _, id := range created {
+		appId := strconv.FormatInt(id, 10)
+		audit.Record(r, audit.Entry{
+			Action:     "app.import",
+			TargetType: "app",
+			TargetID:   appId,
+			After:      audit.App(db, appId),
+		})
+		if err := SyncConfigForApp(appId); err != nil {
+			log.Printf("failed to sync imported app %v: %v", id, err)
+		}
+	}
 
-	http.Redirect(w, r, "/apps/"+id, http.StatusSeeOther)
+	http.Redirect(w, r, "/apps", http.StatusSeeOther)
 }
 
-func appDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodPost {
-		db, _ := data.GetDatabaseHandle()
-		id := r.PathValue("id")
-		idInt, _ := strconv.Atoi(id)
-
-		rolledBack := false
-		tx, _ := db.Begin()
-		_, err := tx.Exec(`delete from apps where id = ?`, idInt)
-		if err != nil {
-			log.Println(err)
-			tx.Rollback()
-			rolledBack = true
-		}
-		_, err = tx.Exec(`delete from app_ports where app_id = ?`, idInt)
-		if err != nil {
-			log.Println(err)
-			if !rolledBack {
-				tx.Rollback()
-				rolledBack = true
-			}
-		}
+type routeView struct {
+	caddy.RouteNode
+	AppID int64
+}
 
-		if !rolledBack {
-			tx.Commit()
-		}
+type serverView struct {
+	Name   string
+	Listen []string
+	Routes []routeView
+}
 
-		http.Redirect(w, r, "/apps", http.StatusSeeOther)
+func routesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
 		return
 	}
-}
 
-func appsNewHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := data.GetDatabaseHandle()
+	if err != nil {
+		log.Printf("failed with error: %v", err)
+	}
 
-	if r.Method == http.MethodGet {
-		w.Header().Set("Content-Type", "text/html")
-		views.Render(w, "AppsCreate", nil)
+	tree, err := caddy.GetServerTree()
+	if err != nil {
+		log.Printf("failed to fetch caddy config: %v", err)
+		http.Error(w, "failed to fetch config from caddy", http.StatusBadGateway)
 		return
 	}
 
-	if r.Method == http.MethodPost {
-		db, _ := data.GetDatabaseHandle()
-		r.ParseForm()
-		appName := r.Form.Get("name")
-		appType := r.Form.Get("type")
-		appPort := r.Form.Get("port")
-
-		appInstance := apps.New()
-		appInstance.Name = appName
-		appInstance.InstanceID = 1
-		appInstance.Type.Scan(appType)
-
-		appRecord, err := appInstance.Save(db)
+	owners, err := domains.AppIdsByDomain(db)
+	if err != nil {
+		log.Printf("failed with error: %v", err)
+	}
 
-		if err != nil {
-			log.Println(err)
-			http.Redirect(w, r, "/apps/new", http.StatusSeeOther)
-			return
+	servers := []serverView{}
+	for _, server := range tree {
+		view := serverView{
+			Name:   server.Name,
+			Listen: server.Listen,
 		}
-
-		if len(appPort) > 0 {
-			port := app_ports.New()
-			port.AppId = appRecord.ID
-			port.Port = appPort
-			_, err := port.Save(db)
-			if err != nil {
-				log.Println(err)
-				http.Redirect(w, r, "/apps/new", http.StatusSeeOther)
-				return
+		for _, route := range server.Routes {
+			rv := routeView{RouteNode: route}
+			for _, host := range route.Hosts {
+				if id, ok := owners[caddy.NormalizeHost(host)]; ok {
+					rv.AppID = id
+					break
+				}
 			}
+			view.Routes = append(view.Routes, rv)
 		}
+		servers = append(servers, view)
+	}
 
-		http.Redirect(w, r, "/apps", http.StatusSeeOther)
-
-		return
+	w.Header().Set("Content-Type", "text/html")
+	if err := views.Render(w, "ConfigRoutes", struct {
+		Servers []serverView
+	}{
+		Servers: servers,
+	}); err != nil {
+		fmt.Fprintf(w, "failed to render page, please try again later")
+		log.Printf("failed with error: %v", err)
 	}
 }
 
@@ -422,6 +1752,21 @@ func uploadConfigHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
+
+	problems := caddy.Validate(configBytes)
+	if caddy.HasErrors(problems) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		jsonReponse, _ := ResponseJson{
+			"error":    "Config has errors, fix them before saving",
+			"problems": problems,
+		}.toJSONString()
+		io.WriteString(w, jsonReponse)
+		return
+	}
+
+	before, _ := caddy.GetConfigAtPath("")
+
 	err = caddy.SaveConfig(configBytes)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
@@ -433,13 +1778,208 @@ func uploadConfigHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	audit.Record(r, audit.Entry{
+		Action:     "config.upload",
+		TargetType: "config",
+		Before:     before,
+		After:      configBytes,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	jsonResponse, _ := ResponseJson{
+		"message":  "Config saved successfully",
+		"problems": problems,
+	}.toJSONString()
+	io.WriteString(w, jsonResponse)
+}
+
+// configPathHandler reads or edits a single subtree of the live config,
+// the subtree is picked with the `path` query param, ex:
+// apps/http/servers/srv0/routes/3
+func configPathHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	path := strings.Trim(r.URL.Query().Get("path"), "/")
+	if slices.Contains(strings.Split(path, "/"), "..") {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error": "Invalid config path"}`)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		value, err := caddy.GetConfigAtPath(path)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			jsonReponse, _ := ResponseError{
+				err: err,
+			}.toJSONString()
+			io.WriteString(w, jsonReponse)
+			return
+		}
+		if len(value) == 0 {
+			value = json.RawMessage("null")
+		}
+		w.Write(value)
+		return
+	case http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, `{"error": "Method not allowed. Expected GET, PUT, PATCH or DELETE"}`)
+		return
+	}
+
+	if len(path) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error": "A path is required, use /upload-config to replace the entire config"}`)
+		return
+	}
+
+	value, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, `{"error": "Failed to read config from request, make sure a valid config was sent"}`)
+		return
+	}
+	defer r.Body.Close()
+
+	if r.Method != http.MethodDelete && !json.Valid(value) {
+		w.WriteHeader(http.StatusBadRequest)
+		jsonReponse, _ := ResponseJson{
+			"error":    "Config is not valid JSON",
+			"problems": caddy.Validate(value),
+		}.toJSONString()
+		io.WriteString(w, jsonReponse)
+		return
+	}
+
+	before, _ := caddy.GetConfigAtPath(path)
+
+	if err := caddy.UpdateConfigAtPath(r.Method, path, value); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		jsonReponse, _ := ResponseError{
+			err: fmt.Errorf("failed to update %v due to error: %v", path, err.Error()),
+		}.toJSONString()
+		io.WriteString(w, jsonReponse)
+		return
+	}
+
+	audit.Record(r, audit.Entry{
+		Action:     "config." + strings.ToLower(r.Method),
+		TargetType: "config",
+		TargetID:   path,
+		Before:     before,
+		After:      value,
+	})
+
+	jsonResponse, _ := ResponseJson{
+		"message": "Config updated at " + path,
+	}.toJSONString()
+	io.WriteString(w, jsonResponse)
+}
+
+func validateConfigHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, `{"error": "Method not allowed. Expected POST"}`)
+		return
+	}
+
+	configBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, `{"error": "Failed to read config from request, make sure a valid config was sent"}`)
+		return
+	}
+	defer r.Body.Close()
+
 	jsonResponse, _ := ResponseJson{
-		"message": "Config saved successfully",
+		"problems": caddy.Validate(configBytes),
 	}.toJSONString()
 	io.WriteString(w, jsonResponse)
 }
 
+func adaptConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, `{"error": "Method not allowed. Expected POST"}`)
+		return
+	}
+
+	caddyfile, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, `{"error": "Failed to read Caddyfile from request"}`)
+		return
+	}
+	defer r.Body.Close()
+
+	result, err := caddy.Adapt(caddyfile)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		jsonReponse, _ := ResponseError{
+			err: fmt.Errorf("failed to adapt Caddyfile: %v", err.Error()),
+		}.toJSONString()
+		io.WriteString(w, jsonReponse)
+		return
+	}
+
+	json.NewEncoder(w).Encode(result)
+}
+
+// exportCaddyfileHandler renders every app the same way SyncConfigForApp
+// would, as Caddyfile site blocks
+func exportCaddyfileHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := data.GetDatabaseHandle()
+	if err != nil {
+		log.Printf("failed with error: %v", err)
+	}
+
+	allApps, err := apps.FindAll(db)
+	if err != nil {
+		log.Printf("failed with error: %v", err)
+		http.Error(w, "failed to read apps", http.StatusInternalServerError)
+		return
+	}
+
+	sites := []caddy.Site{}
+	for i := range allApps {
+		app := allApps[i]
+		domainList, err := domains.FindAllByAppId(db, strconv.FormatInt(app.ID, 10))
+		if err != nil {
+			log.Printf("skipping app %v in export: %v", app.ID, err)
+			continue
+		}
+		// every host of the app goes in one site block, like the route
+		// SyncConfigForApp writes
+		hosts := []string{}
+		for _, d := range domainList {
+			if len(d.Domain) > 0 {
+				hosts = append(hosts, d.Domain)
+			}
+		}
+		if len(hosts) == 0 {
+			continue
+		}
+		handlers, err := appHandlers(db, &app)
+		if err != nil {
+			log.Printf("skipping app %v in export: %v", app.ID, err)
+			continue
+		}
+		sites = append(sites, caddy.Site{
+			Hosts:  hosts,
+			Handle: handlers,
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/caddyfile; charset=utf-8")
+	io.WriteString(w, caddy.FormatCaddyfile(sites))
+}
+
 type ResponseJson map[string]interface{}
 
 func (e ResponseJson) toJSONString() (string, error) {
@@ -450,40 +1990,94 @@ func (e ResponseJson) toJSONString() (string, error) {
 func main() {
 	godotenv.Load()
 
-	db, err := data.GetDatabaseHandle()
-	if err != nil {
-		log.Fatalf("Failed to open database with error: %v", err)
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
 	}
-	defer db.Close()
+}
 
-	if err := db.Ping(); err != nil {
-		log.Fatal("Failed to connect to database")
-	}
+// routes is every page and the API behind the session, token and CSRF
+// checks
+func routes() http.Handler {
+	mux := http.NewServeMux()
 
-	migrate.MigrateUp(db, "./migrate")
+	mux.HandleFunc("/", auth.Allow(auth.RoleViewer, homeHandler))
+
+	mux.HandleFunc("/login", loginHandler)
+	mux.HandleFunc("/logout", logoutHandler)
+	mux.HandleFunc("/login/oidc", oidcLoginHandler)
+	mux.HandleFunc("/login/oidc/callback", oidcCallbackHandler)
+	mux.HandleFunc("/setup", setupHandler)
+
+	mux.HandleFunc("/apps", auth.Allow(auth.RoleViewer, appsHandler))
+	mux.HandleFunc("/apps/new", auth.Allow(auth.RoleOperator, appsNewHandler))
+	mux.HandleFunc("/apps/import", auth.Allow(auth.RoleAdmin, appsImportHandler))
+	mux.HandleFunc("/apps/{id}", auth.Allow(auth.RoleViewer, appDetailsHandler))
+	mux.HandleFunc("/apps/{id}/delete", auth.Allow(auth.RoleOperator, appDeleteHandler))
+	mux.HandleFunc("/apps/{id}/domain", auth.Allow(auth.RoleOperator, appDomainHandler))
+	mux.HandleFunc("/apps/{id}/sync", auth.Allow(auth.RoleOperator, syncConfigHandler))
+	mux.HandleFunc("/apps/{id}/team", auth.Allow(auth.RoleAdmin, appTeamHandler))
+
+	mux.HandleFunc("/config/editor", auth.Allow(auth.RoleAdmin, configEditorHandler))
+	mux.HandleFunc("/config/routes", auth.Allow(auth.RoleViewer, routesHandler))
+	mux.HandleFunc("/fetch-config", auth.Allow(auth.RoleAdmin, fetchConfigHandler))
+	mux.HandleFunc("/upload-config", auth.Allow(auth.RoleAdmin, uploadConfigHandler))
+	mux.HandleFunc("/validate-config", auth.Allow(auth.RoleAdmin, validateConfigHandler))
+	mux.HandleFunc("/config-path", auth.Allow(auth.RoleAdmin, configPathHandler))
+	mux.HandleFunc("/adapt-config", auth.Allow(auth.RoleAdmin, adaptConfigHandler))
+	mux.HandleFunc("/export-caddyfile", auth.Allow(auth.RoleAdmin, exportCaddyfileHandler))
+
+	mux.HandleFunc("/tokens", auth.Allow(auth.RoleViewer, tokensHandler))
+	mux.HandleFunc("/tokens/{id}/delete", auth.Allow(auth.RoleViewer, tokenDeleteHandler))
+
+	mux.HandleFunc("/users", auth.Allow(auth.RoleAdmin, usersHandler))
+	mux.HandleFunc("/users/{id}", auth.Allow(auth.RoleAdmin, userUpdateHandler))
+	mux.HandleFunc("/users/{id}/delete", auth.Allow(auth.RoleAdmin, userDeleteHandler))
+
+	apiServer := &api.Server{Sync: SyncConfigForApp, RemoveRoutes: RemoveConfigForHosts}
+	apiServer.Register(mux)
+	mux.HandleFunc("/api/explorer", auth.Allow(auth.RoleViewer, apiExplorerHandler))
+
+	mux.HandleFunc("/audit", auth.Allow(auth.RoleAdmin, auditHandler))
+	mux.HandleFunc("/audit/export", auth.Allow(auth.RoleAdmin, auditExportHandler))
+
+	mux.HandleFunc("/backup", auth.Allow(auth.RoleAdmin, backupHandler))
+
+	return auth.CSRF(auth.Require(mux))
+}
 
-	mux := http.NewServeMux()
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.Parse(args)
 
-	mux.HandleFunc("/", homeHandler)
+	db, err := migrateDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
 
-	mux.HandleFunc("/apps", appsHandler)
-	mux.HandleFunc("/apps/new", appsNewHandler)
-	mux.HandleFunc("/apps/{id}", appDetailsHandler)
-	mux.HandleFunc("/apps/{id}/delete", appDeleteHandler)
-	mux.HandleFunc("/apps/{id}/domain", appDomainHandler)
-	mux.HandleFunc("/apps/{id}/sync", syncConfigHandler)
+	if err := backup.Schedule(context.Background(), db); err != nil {
+		return fmt.Errorf("failed to schedule backups: %w", err)
+	}
+	err = gitops.Watch(context.Background(), db, gitops.Options{
+		Sync:         SyncConfigForApp,
+		RemoveRoutes: RemoveConfigForHosts,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to watch the apps file: %w", err)
+	}
 
-	mux.HandleFunc("/config/editor", configEditorHandler)
-	mux.HandleFunc("/fetch-config", fetchConfigHandler)
-	mux.HandleFunc("/upload-config", uploadConfigHandler)
+	handler := routes()
 
 	allApps, _ := apps.FindAll(db)
 	for _, v := range allApps {
 		SyncConfigForApp(fmt.Sprintf("%v", v.ID))
 	}
 
-	log.Println("Listening on :8081")
-	if err := http.ListenAndServe(":8081", mux); err != nil {
-		log.Fatal("Failed to start server:", err)
+	listen := config.Get().Listen
+	log.Printf("Listening on %v", listen)
+	if err := http.ListenAndServe(listen, handler); err != nil {
+		return fmt.Errorf("failed to start server: %w", err)
 	}
+	return nil
 }
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/barelyhuman/caddy-ui/api"
+	"github.com/barelyhuman/caddy-ui/auth"
+	"github.com/barelyhuman/caddy-ui/config"
+	"github.com/barelyhuman/caddy-ui/data"
+	"github.com/barelyhuman/caddy-ui/data/models/api_tokens"
+	"github.com/barelyhuman/caddy-ui/data/models/users"
+	"github.com/barelyhuman/caddy-ui/migrate"
+)
+
+// TestMain points the database handle every handler opens at a
+// migrated database with a primary instance, the handle is opened once
+// per process
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "caddy-ui-test-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := config.Default()
+	c.DatabaseURL = filepath.Join(dir, "test.db")
+	config.Set(c)
+
+	code := func() int {
+		defer os.RemoveAll(dir)
+		db, err := data.GetDatabaseHandle()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+		if err := migrate.MigrateUp(db, migrate.Source(db, "")); err != nil {
+			log.Fatal(err)
+		}
+		if _, err := db.Exec("insert into instances (id,is_primary,base_domain) values (1,true,'example.com')"); err != nil {
+			log.Fatal(err)
+		}
+		return m.Run()
+	}()
+	os.Exit(code)
+}
+
+func execAll(t *testing.T, queries ...string) {
+	t.Helper()
+	db, err := data.GetDatabaseHandle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatalf("%v: %v", query, err)
+		}
+	}
+}
+
+// fakeServers is caddy's http servers, GET returns them and POST
+// replaces them like the admin API does
+type fakeServers struct {
+	mu      sync.Mutex
+	servers []byte
+}
+
+func newFakeServers(t *testing.T, servers string) *fakeServers {
+	t.Helper()
+	f := &fakeServers{servers: []byte(servers)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/config/apps/http/servers" {
+			http.NotFound(w, r)
+			return
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(f.servers)
+		case http.MethodPost:
+			f.servers, _ = io.ReadAll(r.Body)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	previous := config.Get()
+	c := previous
+	c.CaddyURL = server.URL
+	config.Set(c)
+	t.Cleanup(func() { config.Set(previous) })
+	return f
+}
+
+// server reads a server of the saved config with its routes left raw
+func (f *fakeServers) server(t *testing.T, key string) (map[string]json.RawMessage, []json.RawMessage) {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	servers := map[string]map[string]json.RawMessage{}
+	if err := json.Unmarshal(f.servers, &servers); err != nil {
+		t.Fatal(err)
+	}
+	routes := []json.RawMessage{}
+	if raw, ok := servers[key]["routes"]; ok {
+		if err := json.Unmarshal(raw, &routes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return servers[key], routes
+}
+
+// routes caddy-ui doesn't manage, with matchers and handler settings it
+// doesn't model
+const (
+	adminRoute   = `{"match":[{"host":["admin.example.com"],"remote_ip":{"ranges":["10.0.0.0/8"]}}],"handle":[{"handler":"reverse_proxy","upstreams":[{"dial":"10.0.0.5:443"}],"transport":{"protocol":"http","tls":{}},"headers":{"request":{"set":{"X-Admin":["1"]}}},"load_balancing":{"selection_policy":{"policy":"first"}}}],"terminal":true}`
+	metricsRoute = `{"match":[{"path":["/metrics"],"header":{"X-Token":["secret"]}}],"handle":[{"handler":"static_response","body":"ok"}]}`
+	foreignSrv0  = `{"srv0":{"listen":[":443"],"automatic_https":{"disable_redirects":true},"tls_connection_policies":[{"match":{"sni":["admin.example.com"]}}],"logs":{"default_logger_name":"log0"},"routes":[` + adminRoute + `,` + metricsRoute + `]}}`
+)
+
+func TestSyncConfigForAppKeepsForeignRoutes(t *testing.T) {
+	fake := newFakeServers(t, foreignSrv0)
+	execAll(t,
+		"insert into apps (id,name,instance_id,type) values (10,'web',1,'reverse-proxy')",
+		"insert into domains (app_id,domain) values (10,'web.example.com')",
+		"insert into app_ports (app_id,port) values (10,'3000')",
+	)
+	t.Cleanup(func() { execAll(t, "delete from app_ports", "delete from domains", "delete from apps") })
+
+	for _, upstream := range []string{"3000", "3001"} {
+		execAll(t, "update app_ports set port = '"+upstream+"' where app_id = 10")
+		if err := SyncConfigForApp("10"); err != nil {
+			t.Fatal(err)
+		}
+
+		server, routes := fake.server(t, "srv0")
+		for key, want := range map[string]string{
+			"automatic_https":         `{"disable_redirects":true}`,
+			"tls_connection_policies": `[{"match":{"sni":["admin.example.com"]}}]`,
+			"logs":                    `{"default_logger_name":"log0"}`,
+		} {
+			if string(server[key]) != want {
+				t.Errorf("%v = %s, want %s", key, server[key], want)
+			}
+		}
+		if len(routes) != 3 {
+			t.Fatalf("routes = %s", routes)
+		}
+		if string(routes[0]) != adminRoute || string(routes[1]) != metricsRoute {
+			t.Errorf("foreign routes changed to\n%s\n%s", routes[0], routes[1])
+		}
+		var app struct {
+			Match []struct {
+				Host []string `json:"host"`
+			} `json:"match"`
+		}
+		if err := json.Unmarshal(routes[2], &app); err != nil || len(app.Match) != 1 || app.Match[0].Host[0] != "web.example.com" {
+			t.Errorf("app route = %s", routes[2])
+		}
+		if !containsDial(routes[2], "127.0.0.1:"+upstream) {
+			t.Errorf("app route doesn't proxy to %v: %s", upstream, routes[2])
+		}
+	}
+}
+
+// containsDial looks for the dial address anywhere in the route
+func containsDial(route json.RawMessage, dial string) bool {
+	var found bool
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			if v["dial"] == dial {
+				found = true
+			}
+			for _, child := range v {
+				walk(child)
+			}
+		case []any:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	var v any
+	json.Unmarshal(route, &v)
+	walk(v)
+	return found
+}
+
+func TestRemoveConfigForHostsKeepsForeignRoutes(t *testing.T) {
+	shared := `{"match":[{"host":["old.example.com","kept.example.com"],"remote_ip":{"ranges":["192.168.0.0/16"]}}],"handle":[{"handler":"reverse_proxy","upstreams":[{"dial":"127.0.0.1:4000"}],"transport":{"protocol":"http","read_timeout":"5s"}}],"terminal":true}`
+	gone := `{"match":[{"host":["gone.example.com"]}],"handle":[{"handler":"static_response","body":"gone"}],"terminal":true}`
+	fake := newFakeServers(t, `{"srv0":{"listen":[":443"],"automatic_https":{"skip":["admin.example.com"]},"routes":[`+adminRoute+`,`+shared+`,`+gone+`,`+metricsRoute+`]}}`)
+
+	if err := RemoveConfigForHosts([]string{"old.example.com", "gone.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	server, routes := fake.server(t, "srv0")
+	if string(server["automatic_https"]) != `{"skip":["admin.example.com"]}` {
+		t.Errorf("automatic_https = %s", server["automatic_https"])
+	}
+	if len(routes) != 3 {
+		t.Fatalf("routes = %s", routes)
+	}
+	if string(routes[0]) != adminRoute || string(routes[2]) != metricsRoute {
+		t.Errorf("foreign routes changed to\n%s\n%s", routes[0], routes[2])
+	}
+	// the route keeps serving its other host, from the same addresses
+	var got, want any
+	json.Unmarshal(routes[1], &got)
+	json.Unmarshal([]byte(`{"match":[{"host":["kept.example.com"],"remote_ip":{"ranges":["192.168.0.0/16"]}}],"handle":[{"handler":"reverse_proxy","upstreams":[{"dial":"127.0.0.1:4000"}],"transport":{"protocol":"http","read_timeout":"5s"}}],"terminal":true}`), &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("shared route = %s", routes[1])
+	}
+
+	// nothing to remove, nothing is saved
+	before := string(fake.servers)
+	if err := RemoveConfigForHosts([]string{"unknown.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if string(fake.servers) != before {
+		t.Errorf("config was saved again as %s", fake.servers)
+	}
+}
+
+// tokenFor stores an API token acting as the user, appIDs limits it to
+// some apps when set
+func tokenFor(t *testing.T, userID int64, scope auth.Scope, appIDs string) string {
+	t.Helper()
+	plain, hash, prefix, err := auth.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := api_tokens.New()
+	token.Name = "test " + prefix
+	token.TokenHash = hash
+	token.Prefix = prefix
+	token.Kind = api_tokens.KindPersonal
+	token.UserID = sql.NullInt64{Int64: userID, Valid: true}
+	token.Scope = string(scope)
+	token.AppIDs = sql.NullString{String: appIDs, Valid: len(appIDs) > 0}
+	db, _ := data.GetDatabaseHandle()
+	if _, err := api_tokens.NewStore(db).Create(context.Background(), token); err != nil {
+		t.Fatal(err)
+	}
+	return plain
+}
+
+func TestTokensOnlyWorkOnTheAPI(t *testing.T) {
+	loaded := false
+	caddy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/load" {
+			loaded = true
+		}
+	}))
+	defer caddy.Close()
+	previous := config.Get()
+	c := previous
+	c.CaddyURL = caddy.URL
+	config.Set(c)
+	defer config.Set(previous)
+
+	db, _ := data.GetDatabaseHandle()
+	admin := users.New()
+	admin.Username = "token-admin"
+	admin.Password = "x"
+	admin.Role = string(auth.RoleAdmin)
+	created, err := users.NewStore(db).Create(context.Background(), admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { execAll(t, "delete from api_tokens", "delete from users") })
+
+	handler := routes()
+	tokens := map[string]string{
+		"admin token":   tokenFor(t, created.ID, auth.ScopeAdmin, ""),
+		"limited token": tokenFor(t, created.ID, auth.ScopeAdmin, "1"),
+	}
+	for name, token := range tokens {
+		t.Run(name, func(t *testing.T) {
+			send := func(method, path, contentType, body string) *httptest.ResponseRecorder {
+				r := httptest.NewRequest(method, path, strings.NewReader(body))
+				r.Header.Set("Authorization", "Bearer "+token)
+				if len(contentType) > 0 {
+					r.Header.Set("Content-Type", contentType)
+				}
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, r)
+				return rec
+			}
+
+			form := url.Values{"username": {"sneaky"}, "password": {"password123"}, "role": {"admin"}}
+			if rec := send(http.MethodPost, "/users", "application/x-www-form-urlencoded", form.Encode()); rec.Code < 400 {
+				t.Errorf("POST /users = %v", rec.Code)
+			}
+			if _, err := users.FindByUsername(db, "sneaky"); !errors.Is(err, data.ErrNotFound) {
+				t.Errorf("a user was created with an API token: %v", err)
+			}
+
+			if rec := send(http.MethodPost, "/upload-config", "application/json", `{"apps":{}}`); rec.Code < 400 {
+				t.Errorf("POST /upload-config = %v", rec.Code)
+			}
+			if rec := send(http.MethodPost, "/config-path", "application/json", `{}`); rec.Code < 400 {
+				t.Errorf("POST /config-path = %v", rec.Code)
+			}
+			if loaded {
+				t.Error("caddy's config was replaced with an API token")
+			}
+			if rec := send(http.MethodGet, "/fetch-config", "", ""); rec.Code != http.StatusUnauthorized {
+				t.Errorf("GET /fetch-config = %v", rec.Code)
+			}
+
+			// the API itself still takes the token
+			if rec := send(http.MethodGet, api.Prefix+"/apps", "", ""); rec.Code != http.StatusOK {
+				t.Errorf("GET %v/apps = %v: %s", api.Prefix, rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestAppsImportShowsFieldErrors(t *testing.T) {
+	fake := newFakeServers(t, `{"srv0":{"listen":[":443"],"routes":[{"match":[{"host":["imported.example.com"]}],"handle":[{"handler":"reverse_proxy","upstreams":[{"dial":"localhost:5000"}]}]}]}}`)
+	t.Cleanup(func() { execAll(t, "delete from app_ports", "delete from domains", "delete from apps") })
+
+	post := func(keys ...string) *httptest.ResponseRecorder {
+		form := url.Values{"key": keys}
+		req := httptest.NewRequest(http.MethodPost, "/apps/import", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		appsImportHandler(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name string
+		keys []string
+		want string
+	}{
+		{"nothing selected", nil, "select at least one route to import"},
+		{"route gone", []string{"imported.example.com", "gone.example.com"}, "isn&#39;t a route that can be imported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := post(tt.keys...)
+			if rec.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("status = %v, want %v", rec.Code, http.StatusUnprocessableEntity)
+			}
+			body := rec.Body.String()
+			if !strings.Contains(body, tt.want) || !strings.Contains(body, `value="imported.example.com"`) {
+				t.Errorf("form doesn't show %q:\n%s", tt.want, body)
+			}
+		})
+	}
+
+	rec := post("imported.example.com")
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("status = %v: %s", rec.Code, rec.Body)
+	}
+	if _, routes := fake.server(t, "srv0"); len(routes) != 1 || !containsDial(routes[0], "127.0.0.1:5000") {
+		t.Errorf("routes after the import = %s", routes)
+	}
+}
+
+func TestPasswordChangeEndsOtherSessions(t *testing.T) {
+	db, _ := data.GetDatabaseHandle()
+	hash, err := auth.HashPassword("password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := users.New()
+	user.Username = "changing"
+	user.Password = hash
+	user.Role = string(auth.RoleAdmin)
+	created, err := users.NewStore(db).Create(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { execAll(t, "delete from sessions", "delete from users") })
+
+	login := func() *http.Cookie {
+		rec := httptest.NewRecorder()
+		if err := auth.StartSession(rec, httptest.NewRequest(http.MethodPost, "/login", nil), db, created.ID); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Result().Cookies()[0]
+	}
+	current, other := login(), login()
+
+	handler := routes()
+	send := func(method, path string, session *http.Cookie, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(session)
+		r.AddCookie(&http.Cookie{Name: auth.CSRFCookieName, Value: "csrf"})
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec
+	}
+
+	form := url.Values{"role": {"admin"}, "password": {"new-password"}, auth.CSRFFormField: {"csrf"}}
+	if rec := send(http.MethodPost, "/users/"+strconv.FormatInt(created.ID, 10), current, form); rec.Code != http.StatusSeeOther {
+		t.Fatalf("POST /users/%v = %v: %s", created.ID, rec.Code, rec.Body)
+	}
+
+	if rec := send(http.MethodGet, "/users", other, nil); rec.Code == http.StatusOK {
+		t.Error("the session from before the password change still works")
+	}
+	if rec := send(http.MethodGet, "/users", current, nil); rec.Code != http.StatusOK {
+		t.Errorf("the session that changed the password was ended: %v", rec.Code)
+	}
+}
@@ -1,132 +1,329 @@
 package migrate
 
 import (
-	"context"
 	"crypto/md5"
 	"database/sql"
+	"embed"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
 	"log"
 	"os"
-	"path/filepath"
+	"sort"
 	"strings"
+
+	"github.com/barelyhuman/caddy-ui/config"
+	"github.com/barelyhuman/caddy-ui/data"
+)
+
+// Files are the migrations shipped with the binary, one directory per
+// dialect
+//
+//go:embed sqlite/*.sql postgres/*.sql
+var Files embed.FS
+
+const (
+	StateApplied  = "applied"
+	StatePending  = "pending"
+	StateModified = "modified"
 )
 
-type Migration struct {
-	Name string
-	Hash string
+type MigrationStatus struct {
+	Name  string
+	State string
 }
 
-type MigrationCollection struct {
-	migrations []Migration
-	db         *sql.DB
+// Source returns the migrations in dir, or the embedded ones for the
+// dialect of db when dir is empty
+func Source(db *sql.DB, dir string) fs.FS {
+	if len(dir) > 0 {
+		return os.DirFS(dir)
+	}
+	sub, err := fs.Sub(Files, data.Dialect(db))
+	if err != nil {
+		// only fails on an invalid path, the dialects are constants
+		panic(err)
+	}
+	return sub
 }
 
-func md5String(data []byte) string {
-	hash := md5.Sum(data)
+func md5String(contents []byte) string {
+	hash := md5.Sum(contents)
 	return hex.EncodeToString(hash[:])
 }
 
-func (mc *MigrationCollection) loadExistingMigrations(direction *string) {
-	var dir string
-	if direction == nil {
-		dir = "asc"
-	} else {
-		dir = *direction
+func ensureMigrationTable(db *sql.DB) error {
+	query := "CREATE TABLE if not exists migrations(id INTEGER PRIMARY KEY AUTOINCREMENT,name TEXT NOT NULL UNIQUE,hash TEXT,created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP);"
+	if data.Dialect(db) == config.DialectPostgres {
+		query = "CREATE TABLE if not exists migrations(id BIGSERIAL PRIMARY KEY,name TEXT NOT NULL UNIQUE,hash TEXT,created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP);"
+	}
+	_, err := db.Exec(query)
+	return err
+}
+
+// applied maps the name of every applied migration to the hash of the
+// file when it ran
+func applied(db *sql.DB) (map[string]string, error) {
+	if err := ensureMigrationTable(db); err != nil {
+		return nil, err
 	}
-	result, err := mc.db.Query("select name,hash from migrations order by ?;", dir)
+	rows, err := db.Query("select name,hash from migrations")
 	if err != nil {
-		if strings.Contains(err.Error(), "no such table: migrations") {
-			ensureMigrationTable(mc.db)
-		} else {
-			log.Fatalf("Failed to get existing migrations with error: %v", err)
-		}
+		return nil, err
 	}
+	defer rows.Close()
 
-	existing := []Migration{}
-
-	if result != nil {
-		for result.Next() {
-			x := Migration{}
-			if err := result.Scan(&x.Name, &x.Hash); err != nil {
-				log.Fatalf("failed to read row with err: %v", err)
-			}
-			existing = append(existing, x)
+	existing := map[string]string{}
+	for rows.Next() {
+		var name string
+		var hash sql.NullString
+		if err := rows.Scan(&name, &hash); err != nil {
+			return nil, err
 		}
+		existing[name] = hash.String
 	}
-
-	mc.migrations = existing
+	return existing, rows.Err()
 }
 
-func (mc *MigrationCollection) hasMigration(name, hash string) bool {
-	for _, mig := range mc.migrations {
-		if mig.Name != name {
-			continue
-		}
-		if mig.Hash == hash {
-			return true
-		} else {
-			log.Fatalf("similar named migration with different hashes received, %v:%v, (savedHash:%v)", name, hash, mig.Hash)
-		}
+// upFiles lists the .up.sql files in lexical order, which is the order
+// they are applied in
+func upFiles(fsys fs.FS) ([]string, error) {
+	names, err := fs.Glob(fsys, "*.up.sql")
+	if err != nil {
+		return nil, err
 	}
-	return false
+	sort.Strings(names)
+	return names, nil
 }
 
-func ensureMigrationTable(db *sql.DB) {
-	db.Exec("CREATE TABLE if not exists migrations(id INTEGER PRIMARY KEY AUTOINCREMENT,name TEXT NOT NULL UNIQUE,hash TEXT,created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP);")
+// conflictTables lists the *_conflicts tables, where a migration moves
+// the rows it can't carry over instead of dropping them
+func conflictTables(db *sql.DB) (map[string]bool, error) {
+	query := `select name from sqlite_master where type = 'table' and name like '%\_conflicts' escape '\'`
+	if data.Dialect(db) == config.DialectPostgres {
+		query = `select table_name from information_schema.tables where table_schema = current_schema() and table_name like '%\_conflicts' escape '\'`
+	}
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tables := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables[name] = true
+	}
+	return tables, rows.Err()
 }
 
-func UpdateUpAudit(db *sql.DB, executed map[string]string) {
-	ensureMigrationTable(db)
-	tx, _ := db.Begin()
-	for name, hash := range executed {
-		tx.Exec("insert into migrations (name, hash) values (?,?)", name, hash)
+// logConflicts logs the rows migration name moved to the conflicts
+// tables it created, they have to be fixed by hand
+func logConflicts(db *sql.DB, name string, before map[string]bool) error {
+	after, err := conflictTables(db)
+	if err != nil {
+		return err
 	}
-	if err := tx.Commit(); err != nil {
-		panic(err)
+	tables := []string{}
+	for table := range after {
+		if !before[table] {
+			tables = append(tables, table)
+		}
 	}
-}
+	sort.Strings(tables)
 
-func MigrateUp(db *sql.DB, dir string) {
-	mc := &MigrationCollection{
-		db: db,
+	for _, table := range tables {
+		// table comes from the schema, not from input
+		rows, err := db.Query("select id, reason from " + table + " order by id")
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int64
+			var reason string
+			if err := rows.Scan(&id, &reason); err != nil {
+				rows.Close()
+				return err
+			}
+			log.Printf("%v moved %v %v to %v: %v", name, strings.TrimSuffix(table, "_conflicts"), id, table, reason)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
 	}
-	mc.loadExistingMigrations(nil)
+	return nil
+}
 
-	entries, err := os.ReadDir(dir)
+// MigrateUp applies the pending migrations, each one runs in its own
+// transaction along with its row in the migrations table. A migration
+// that changed after being applied stops everything since the schema
+// can't be trusted anymore. Rows a migration moves to a *_conflicts
+// table are logged
+func MigrateUp(db *sql.DB, fsys fs.FS) error {
+	existing, err := applied(db)
+	if err != nil {
+		return fmt.Errorf("failed to get existing migrations: %w", err)
+	}
+	conflicts, err := conflictTables(db)
+	if err != nil {
+		return fmt.Errorf("failed to list conflicts tables: %w", err)
+	}
+	names, err := upFiles(fsys)
 	if err != nil {
-		log.Fatalf("error reading migrations, %v", err)
+		return fmt.Errorf("failed to list migrations: %w", err)
 	}
 
-	executedFiles := map[string]string{}
-	for _, file := range entries {
-		if !strings.HasSuffix(file.Name(), ".up.sql") {
+	for _, name := range names {
+		contents, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		hash := md5String(contents)
+		if savedHash, ok := existing[name]; ok {
+			if savedHash != hash {
+				return fmt.Errorf("migration %v was modified after it was applied, (savedHash:%v, hash:%v)", name, savedHash, hash)
+			}
 			continue
 		}
-		tx, err := db.BeginTx(context.Background(), &sql.TxOptions{})
+
+		tx, err := db.Begin()
 		if err != nil {
-			panic(err)
+			return err
 		}
-		data, err := os.ReadFile(filepath.Join(dir, file.Name()))
-		if err != nil {
-			panic(err)
+		if _, err := tx.Exec(string(contents)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to run %v: %w", name, err)
+		}
+		if _, err := tx.Exec("insert into migrations (name, hash) values (?,?)", name, hash); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("Ran %v", name)
+		if err := logConflicts(db, name, conflicts); err != nil {
+			return err
 		}
+		if conflicts, err = conflictTables(db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		fileHash := md5String(data)
-		if mc.hasMigration(file.Name(), fileHash) {
-			continue
+// MigrateDown reverts the last n applied migrations with their
+// .down.sql files, newest first
+func MigrateDown(db *sql.DB, fsys fs.FS, n int) error {
+	if err := ensureMigrationTable(db); err != nil {
+		return err
+	}
+	rows, err := db.Query("select name from migrations order by name desc limit ?", n)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
 		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
 
-		_, err = tx.Exec(string(data))
+	for _, name := range names {
+		downName := strings.TrimSuffix(name, ".up.sql") + ".down.sql"
+		contents, err := fs.ReadFile(fsys, downName)
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("migration %v has no %v", name, downName)
+		}
 		if err != nil {
-			panic(err)
+			return err
 		}
 
-		if err = tx.Commit(); err != nil {
-			panic(err)
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(string(contents)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to run %v: %w", downName, err)
+		}
+		if _, err := tx.Exec("delete from migrations where name = ?", name); err != nil {
+			tx.Rollback()
+			return err
 		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("Reverted %v", name)
+	}
+	return nil
+}
+
+// Status compares the migration files with the ones recorded in the
+// database, a recorded migration whose file changed since is reported
+// as modified
+func Status(db *sql.DB, fsys fs.FS) ([]MigrationStatus, error) {
+	existing, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+	names, err := upFiles(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []MigrationStatus{}
+	for _, name := range names {
+		contents, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		status := MigrationStatus{Name: name, State: StatePending}
+		if hash, ok := existing[name]; ok {
+			status.State = StateApplied
+			if hash != md5String(contents) {
+				status.State = StateModified
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Unknown lists the migrations recorded in the database that have no
+// file, ex: a database written by a newer version of caddy-ui
+func Unknown(db *sql.DB, fsys fs.FS) ([]string, error) {
+	existing, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+	names, err := upFiles(fsys)
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	for _, name := range names {
+		known[name] = true
+	}
 
-		executedFiles[file.Name()] = fileHash
-		log.Printf("Ran %v\n", file)
+	unknown := []string{}
+	for name := range existing {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
 	}
-	UpdateUpAudit(db, executedFiles)
+	sort.Strings(unknown)
+	return unknown, nil
 }
@@ -0,0 +1,287 @@
+package migrate
+
+import (
+	"bytes"
+	"database/sql"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/barelyhuman/caddy-ui/config"
+	"github.com/barelyhuman/caddy-ui/data"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// openTestDatabase returns an empty sqlite database, or the postgres one
+// in CADDY_UI_TEST_POSTGRES_URL for the postgres dialect. That database
+// must be empty, the test drops everything it creates
+func openTestDatabase(t *testing.T, dialect string) *sql.DB {
+	t.Helper()
+	var db *sql.DB
+	var err error
+	switch dialect {
+	case config.DialectSQLite:
+		db, err = sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db")+"?_foreign_keys=on")
+	case config.DialectPostgres:
+		url := os.Getenv("CADDY_UI_TEST_POSTGRES_URL")
+		if len(url) == 0 {
+			t.Skip("CADDY_UI_TEST_POSTGRES_URL isn't set")
+		}
+		db, err = sql.Open("caddy-ui-postgres", url)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if got := data.Dialect(db); got != dialect {
+		t.Fatalf("Dialect() = %v, want %v", got, dialect)
+	}
+	return db
+}
+
+func countStates(t *testing.T, db *sql.DB, fsys fs.FS) map[string]int {
+	t.Helper()
+	statuses, err := Status(db, fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for _, status := range statuses {
+		counts[status.State]++
+	}
+	return counts
+}
+
+func TestMigrateUpDown(t *testing.T) {
+	for _, dialect := range []string{config.DialectSQLite, config.DialectPostgres} {
+		t.Run(dialect, func(t *testing.T) {
+			db := openTestDatabase(t, dialect)
+			fsys := Source(db, "")
+			names, err := upFiles(fsys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(names) == 0 {
+				t.Fatal("no migrations embedded")
+			}
+
+			if err := MigrateUp(db, fsys); err != nil {
+				t.Fatalf("MigrateUp: %v", err)
+			}
+			if counts := countStates(t, db, fsys); counts[StateApplied] != len(names) {
+				t.Fatalf("after up: %v, want %v applied", counts, len(names))
+			}
+			// running it again has nothing left to do
+			if err := MigrateUp(db, fsys); err != nil {
+				t.Fatalf("second MigrateUp: %v", err)
+			}
+			if _, err := db.Exec("insert into domains (domain,app_id) values (?,?)", "example.com", 999); err == nil {
+				t.Error("inserting a domain for a missing app should fail")
+			}
+
+			if err := MigrateDown(db, fsys, 1); err != nil {
+				t.Fatalf("MigrateDown 1: %v", err)
+			}
+			if counts := countStates(t, db, fsys); counts[StatePending] != 1 {
+				t.Fatalf("after one down: %v, want 1 pending", counts)
+			}
+
+			if err := MigrateDown(db, fsys, len(names)); err != nil {
+				t.Fatalf("MigrateDown all: %v", err)
+			}
+			if counts := countStates(t, db, fsys); counts[StatePending] != len(names) {
+				t.Fatalf("after down: %v, want %v pending", counts, len(names))
+			}
+			var tables int
+			query := "select count(*) from sqlite_master where type = 'table' and name not in ('migrations','sqlite_sequence')"
+			if dialect == config.DialectPostgres {
+				query = "select count(*) from information_schema.tables where table_schema = current_schema() and table_name <> 'migrations'"
+			}
+			if err := db.QueryRow(query).Scan(&tables); err != nil {
+				t.Fatal(err)
+			}
+			if tables != 0 {
+				t.Errorf("%v tables left after reverting every migration", tables)
+			}
+
+			// the down files must leave nothing behind that breaks a new up
+			if err := MigrateUp(db, fsys); err != nil {
+				t.Fatalf("MigrateUp after down: %v", err)
+			}
+			if err := MigrateDown(db, fsys, len(names)); err != nil {
+				t.Fatalf("cleanup: %v", err)
+			}
+			if _, err := db.Exec("drop table migrations"); err != nil {
+				t.Fatalf("cleanup: %v", err)
+			}
+		})
+	}
+}
+
+func TestModifiedMigration(t *testing.T) {
+	db := openTestDatabase(t, config.DialectSQLite)
+	dir := t.TempDir()
+	write := func(name, contents string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("001_a.up.sql", "create table a (id integer);")
+	write("001_a.down.sql", "drop table a;")
+	fsys := Source(db, dir)
+
+	if err := MigrateUp(db, fsys); err != nil {
+		t.Fatal(err)
+	}
+	write("001_a.up.sql", "create table a (id integer, name text);")
+	if counts := countStates(t, db, fsys); counts[StateModified] != 1 {
+		t.Fatalf("got %v, want 1 modified", counts)
+	}
+	if err := MigrateUp(db, fsys); err == nil {
+		t.Fatal("MigrateUp should refuse a modified migration")
+	}
+
+	write("002_b.up.sql", "create table b (id integer);")
+	os.Remove(filepath.Join(dir, "001_a.up.sql"))
+	unknown, err := Unknown(db, fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unknown) != 1 || unknown[0] != "001_a.up.sql" {
+		t.Errorf("Unknown() = %v, want [001_a.up.sql]", unknown)
+	}
+}
+
+// before returns the migrations of fsys that sort before name
+func before(t *testing.T, fsys fs.FS, name string) fs.FS {
+	t.Helper()
+	files, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := fstest.MapFS{}
+	for _, file := range files {
+		if file >= name {
+			continue
+		}
+		contents, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub[file] = &fstest.MapFile{Data: contents}
+	}
+	return sub
+}
+
+// rows joins the values of the single column query selects
+func rows(t *testing.T, db *sql.DB, query string) string {
+	t.Helper()
+	result, err := db.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.Close()
+	list := []string{}
+	for result.Next() {
+		var row string
+		if err := result.Scan(&row); err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, row)
+	}
+	return strings.Join(list, ",")
+}
+
+func TestReferentialIntegrityConflicts(t *testing.T) {
+	for _, dialect := range []string{config.DialectSQLite, config.DialectPostgres} {
+		t.Run(dialect, func(t *testing.T) {
+			db := openTestDatabase(t, dialect)
+			fsys := Source(db, "")
+			if err := MigrateUp(db, before(t, fsys, "008")); err != nil {
+				t.Fatal(err)
+			}
+			for _, query := range []string{
+				"insert into apps (id,name,instance_id) values (1,'web',1),(2,'api',1)",
+				"insert into domains (id,domain,app_id) values (1,'web.example.com',1),(2,' Web.Example.com',2),(3,'gone.example.com',99),(4,'',1),(5,'api.example.com',2)",
+				"insert into app_ports (id,port,app_id,domain_id) values (1,'3000',1,1),(2,'127.0.0.1:3000 ',2,5),(3,'4000',99,3),(4,'4001',2,2),(5,'  ',2,null)",
+				"insert into app_options (id,app_id,name,value) values (1,1,'root','/srv'),(2,99,'root','/gone')",
+			} {
+				if _, err := db.Exec(query); err != nil {
+					t.Fatalf("%v: %v", query, err)
+				}
+			}
+
+			var logged bytes.Buffer
+			log.SetOutput(&logged)
+			err := MigrateUp(db, fsys)
+			log.SetOutput(os.Stderr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				query string
+				want  string
+			}{
+				{"select id || ':' || domain from domains order by id", "1:web.example.com,5:api.example.com"},
+				{"select id || ':' || coalesce(domain_id, 0) from app_ports order by id", "1:1,4:0"},
+				{"select id from app_options order by id", "1"},
+				{
+					"select id || ':' || reason from domains_conflicts order by id",
+					"2:duplicate of domain 1,3:app was deleted,4:empty hostname",
+				},
+				{
+					"select id || ':' || reason from app_ports_conflicts order by id",
+					"2:duplicate of upstream 1,3:app was deleted,5:empty upstream",
+				},
+				{"select id || ':' || reason from app_options_conflicts order by id", "2:app was deleted"},
+			}
+			for _, tt := range tests {
+				if got := rows(t, db, tt.query); got != tt.want {
+					t.Errorf("%v = %v, want %v", tt.query, got, tt.want)
+				}
+			}
+			for _, line := range []string{
+				"008_referential_integrity.up.sql moved domains 2 to domains_conflicts: duplicate of domain 1",
+				"008_referential_integrity.up.sql moved app_ports 3 to app_ports_conflicts: app was deleted",
+				"008_referential_integrity.up.sql moved app_options 2 to app_options_conflicts: app was deleted",
+			} {
+				if !strings.Contains(logged.String(), line) {
+					t.Errorf("log doesn't have %q:\n%s", line, logged.String())
+				}
+			}
+
+			// reverting puts every row back
+			if err := MigrateDown(db, fsys, 2); err != nil {
+				t.Fatal(err)
+			}
+			if got := rows(t, db, "select id from domains order by id"); got != "1,2,3,4,5" {
+				t.Errorf("domains after down = %v", got)
+			}
+			if got := rows(t, db, "select id from app_ports order by id"); got != "1,2,3,4,5" {
+				t.Errorf("app_ports after down = %v", got)
+			}
+			if got := rows(t, db, "select id from app_options order by id"); got != "1,2" {
+				t.Errorf("app_options after down = %v", got)
+			}
+
+			names, err := upFiles(fsys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := MigrateDown(db, fsys, len(names)); err != nil {
+				t.Fatalf("cleanup: %v", err)
+			}
+			if _, err := db.Exec("drop table migrations"); err != nil {
+				t.Fatalf("cleanup: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS domains;
+DROP TABLE IF EXISTS app_ports;
+DROP TABLE IF EXISTS apps;
+DROP TABLE IF EXISTS instances;
+DROP FUNCTION IF EXISTS set_updated_at();
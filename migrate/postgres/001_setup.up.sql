@@ -0,0 +1,73 @@
+-- Postgres version of the sqlite migrations, keep both in sync.
+-- Timestamps are stored in UTC like sqlite's CURRENT_TIMESTAMP
+
+CREATE OR REPLACE FUNCTION set_updated_at() RETURNS trigger AS $$
+BEGIN
+    IF NEW.updated_at = OLD.updated_at THEN
+        NEW.updated_at = timezone('utc', now());
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TABLE instances (
+    id BIGSERIAL PRIMARY KEY,
+    password TEXT,
+    base_domain TEXT,
+    is_primary BOOLEAN,
+
+    created_at TIMESTAMP NOT NULL DEFAULT timezone('utc', now()),
+    updated_at TIMESTAMP NOT NULL DEFAULT timezone('utc', now())
+);
+
+CREATE TRIGGER instances_updated_at
+BEFORE UPDATE ON instances
+FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+
+-- Apps handled by the UI
+
+CREATE TABLE apps (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    instance_id BIGINT,
+    type TEXT,
+    caddy_server_map TEXT,
+
+    created_at TIMESTAMP NOT NULL DEFAULT timezone('utc', now()),
+    updated_at TIMESTAMP NOT NULL DEFAULT timezone('utc', now())
+);
+
+create index if not EXISTS idx_apps_name on apps(name);
+
+CREATE TRIGGER apps_updated_at
+BEFORE UPDATE ON apps
+FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+
+CREATE TABLE app_ports (
+    id BIGSERIAL PRIMARY KEY,
+    port TEXT,
+    app_id BIGINT NOT NULL,
+    domain_id BIGINT,
+
+    created_at TIMESTAMP NOT NULL DEFAULT timezone('utc', now()),
+    updated_at TIMESTAMP NOT NULL DEFAULT timezone('utc', now())
+);
+
+CREATE TRIGGER app_ports_updated_at
+BEFORE UPDATE ON app_ports
+FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+
+-- App Level Domains
+
+CREATE TABLE domains (
+    id BIGSERIAL PRIMARY KEY,
+    domain TEXT,
+    app_id BIGINT NOT NULL,
+
+    created_at TIMESTAMP NOT NULL DEFAULT timezone('utc', now()),
+    updated_at TIMESTAMP NOT NULL DEFAULT timezone('utc', now())
+);
+
+CREATE TRIGGER domains_updated_at
+BEFORE UPDATE ON domains
+FOR EACH ROW EXECUTE FUNCTION set_updated_at();
@@ -0,0 +1,18 @@
+-- Per app settings that don't fit the apps table,
+-- ex: the root of a file server or the target of a redirect
+
+CREATE TABLE app_options (
+    id BIGSERIAL PRIMARY KEY,
+    app_id BIGINT NOT NULL,
+    name TEXT NOT NULL,
+    value TEXT,
+
+    created_at TIMESTAMP NOT NULL DEFAULT timezone('utc', now()),
+    updated_at TIMESTAMP NOT NULL DEFAULT timezone('utc', now())
+);
+
+create unique index if not EXISTS idx_app_options_app_id_name on app_options(app_id, name);
+
+CREATE TRIGGER app_options_updated_at
+BEFORE UPDATE ON app_options
+FOR EACH ROW EXECUTE FUNCTION set_updated_at();
@@ -0,0 +1,16 @@
+-- Dashboard sessions, the cookie holds the token and only
+-- its sha256 is stored here
+
+CREATE TABLE sessions (
+    id BIGSERIAL PRIMARY KEY,
+    token_hash TEXT NOT NULL UNIQUE,
+    instance_id BIGINT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+
+    created_at TIMESTAMP NOT NULL DEFAULT timezone('utc', now()),
+    updated_at TIMESTAMP NOT NULL DEFAULT timezone('utc', now())
+);
+
+CREATE TRIGGER sessions_updated_at
+BEFORE UPDATE ON sessions
+FOR EACH ROW EXECUTE FUNCTION set_updated_at();
@@ -0,0 +1,21 @@
+-- sessions go back to the instance, everyone logs in again
+
+DROP TABLE IF EXISTS sessions;
+
+CREATE TABLE sessions (
+    id BIGSERIAL PRIMARY KEY,
+    token_hash TEXT NOT NULL UNIQUE,
+    instance_id BIGINT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+
+    created_at TIMESTAMP NOT NULL DEFAULT timezone('utc', now()),
+    updated_at TIMESTAMP NOT NULL DEFAULT timezone('utc', now())
+);
+
+CREATE TRIGGER sessions_updated_at
+BEFORE UPDATE ON sessions
+FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+
+ALTER TABLE apps DROP COLUMN team;
+
+DROP TABLE IF EXISTS users;
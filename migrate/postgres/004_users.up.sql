@@ -0,0 +1,45 @@
+-- Named users with a role, `team` is a free form name and users can
+-- edit the apps that belong to the same team
+
+CREATE TABLE users (
+    id BIGSERIAL PRIMARY KEY,
+    username TEXT NOT NULL UNIQUE,
+    password TEXT NOT NULL,
+    role TEXT NOT NULL DEFAULT 'viewer',
+    team TEXT,
+
+    created_at TIMESTAMP NOT NULL DEFAULT timezone('utc', now()),
+    updated_at TIMESTAMP NOT NULL DEFAULT timezone('utc', now())
+);
+
+CREATE TRIGGER users_updated_at
+BEFORE UPDATE ON users
+FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+
+-- the single instance password becomes the `admin` user
+
+INSERT INTO users (username, password, role)
+    SELECT 'admin', password, 'admin' FROM instances
+    WHERE is_primary = true AND password IS NOT NULL AND password != ''
+    ORDER BY id LIMIT 1;
+
+ALTER TABLE apps ADD COLUMN team TEXT;
+
+-- sessions now belong to users, existing ones are dropped and
+-- everyone logs in again
+
+DROP TABLE sessions;
+
+CREATE TABLE sessions (
+    id BIGSERIAL PRIMARY KEY,
+    token_hash TEXT NOT NULL UNIQUE,
+    user_id BIGINT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+
+    created_at TIMESTAMP NOT NULL DEFAULT timezone('utc', now()),
+    updated_at TIMESTAMP NOT NULL DEFAULT timezone('utc', now())
+);
+
+CREATE TRIGGER sessions_updated_at
+BEFORE UPDATE ON sessions
+FOR EACH ROW EXECUTE FUNCTION set_updated_at();
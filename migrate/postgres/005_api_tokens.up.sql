@@ -0,0 +1,24 @@
+-- Tokens for automation, personal tokens act as their user (capped by
+-- the scope) while service tokens have no user and act with the scope
+-- alone, only the sha256 of the token is stored
+
+CREATE TABLE api_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    prefix TEXT NOT NULL,
+    kind TEXT NOT NULL DEFAULT 'personal',
+    user_id BIGINT,
+    scope TEXT NOT NULL DEFAULT 'read',
+    -- comma separated app ids, empty for every app
+    app_ids TEXT,
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+
+    created_at TIMESTAMP NOT NULL DEFAULT timezone('utc', now()),
+    updated_at TIMESTAMP NOT NULL DEFAULT timezone('utc', now())
+);
+
+CREATE TRIGGER api_tokens_updated_at
+BEFORE UPDATE ON api_tokens
+FOR EACH ROW EXECUTE FUNCTION set_updated_at();
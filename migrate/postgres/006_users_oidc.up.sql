@@ -0,0 +1,6 @@
+-- Users provisioned through OpenID Connect are linked by the
+-- issuer's subject and don't have a local password
+
+ALTER TABLE users ADD COLUMN oidc_subject TEXT;
+
+create unique index if not EXISTS idx_users_oidc_subject on users(oidc_subject);
@@ -0,0 +1,37 @@
+-- Record of every change made through the UI or the API, rows are never
+-- updated or deleted. before/after hold the JSON state of the target
+
+CREATE TABLE audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    actor TEXT NOT NULL,
+    action TEXT NOT NULL,
+    target_type TEXT NOT NULL,
+    target_id TEXT,
+    before TEXT,
+    after TEXT,
+    client_ip TEXT,
+
+    created_at TIMESTAMP NOT NULL DEFAULT timezone('utc', now())
+);
+
+create index if not EXISTS idx_audit_log_created_at on audit_log(created_at);
+create index if not EXISTS idx_audit_log_actor on audit_log(actor);
+create index if not EXISTS idx_audit_log_target on audit_log(target_type, target_id);
+
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_no_update
+BEFORE UPDATE ON audit_log
+FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+
+CREATE TRIGGER audit_log_no_delete
+BEFORE DELETE ON audit_log
+FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+
+CREATE TRIGGER audit_log_no_truncate
+BEFORE TRUNCATE ON audit_log
+FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only();
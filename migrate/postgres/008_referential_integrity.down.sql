@@ -0,0 +1,26 @@
+-- the rows the way up moved to the *_conflicts tables are put back
+
+ALTER TABLE app_options DROP CONSTRAINT IF EXISTS app_options_app_id_fkey;
+
+DROP INDEX IF EXISTS idx_app_ports_app_id;
+DROP INDEX IF EXISTS idx_app_ports_dial;
+ALTER TABLE app_ports DROP CONSTRAINT IF EXISTS app_ports_domain_id_fkey;
+ALTER TABLE app_ports DROP CONSTRAINT IF EXISTS app_ports_app_id_fkey;
+ALTER TABLE app_ports ALTER COLUMN port DROP NOT NULL;
+
+DROP INDEX IF EXISTS idx_domains_app_id;
+DROP INDEX IF EXISTS idx_domains_domain;
+ALTER TABLE domains DROP CONSTRAINT IF EXISTS domains_app_id_fkey;
+ALTER TABLE domains ALTER COLUMN domain DROP NOT NULL;
+
+INSERT INTO app_options (id, app_id, name, value, created_at, updated_at)
+    SELECT id, app_id, name, value, created_at, updated_at FROM app_options_conflicts;
+DROP TABLE app_options_conflicts;
+
+INSERT INTO app_ports (id, port, app_id, domain_id, created_at, updated_at)
+    SELECT id, port, app_id, domain_id, created_at, updated_at FROM app_ports_conflicts;
+DROP TABLE app_ports_conflicts;
+
+INSERT INTO domains (id, domain, app_id, created_at, updated_at)
+    SELECT id, domain, app_id, created_at, updated_at FROM domains_conflicts;
+DROP TABLE domains_conflicts;
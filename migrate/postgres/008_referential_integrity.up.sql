@@ -0,0 +1,106 @@
+-- Domains, ports and options now belong to their app through foreign
+-- keys and go away with it. Rows that can't be kept (left behind by
+-- apps that were deleted, empty, or a hostname or upstream already used
+-- by an older row) are moved to the matching *_conflicts table with the
+-- reason first, they are listed in the log and the down migration puts
+-- them back
+
+CREATE TABLE domains_conflicts (
+    id BIGINT PRIMARY KEY,
+    domain TEXT,
+    app_id BIGINT,
+    reason TEXT NOT NULL,
+
+    created_at TIMESTAMP,
+    updated_at TIMESTAMP
+);
+
+INSERT INTO domains_conflicts (id, domain, app_id, reason, created_at, updated_at)
+    SELECT id, domain, app_id, 'app was deleted', created_at, updated_at FROM domains
+    WHERE app_id NOT IN (SELECT id FROM apps);
+DELETE FROM domains WHERE app_id NOT IN (SELECT id FROM apps);
+
+INSERT INTO domains_conflicts (id, domain, app_id, reason, created_at, updated_at)
+    SELECT id, domain, app_id, 'empty hostname', created_at, updated_at FROM domains
+    WHERE trim(coalesce(domain, '')) = '';
+DELETE FROM domains WHERE trim(coalesce(domain, '')) = '';
+
+INSERT INTO domains_conflicts (id, domain, app_id, reason, created_at, updated_at)
+    SELECT d.id, d.domain, d.app_id, 'duplicate of domain ' || min(o.id), d.created_at, d.updated_at
+    FROM domains d JOIN domains o
+        ON lower(trim(d.domain)) = lower(trim(o.domain)) AND d.id > o.id
+    GROUP BY d.id;
+DELETE FROM domains WHERE id IN (SELECT id FROM domains_conflicts);
+UPDATE domains SET domain = lower(trim(domain));
+
+ALTER TABLE domains ALTER COLUMN domain SET NOT NULL;
+ALTER TABLE domains ADD CONSTRAINT domains_app_id_fkey
+    FOREIGN KEY (app_id) REFERENCES apps(id) ON DELETE CASCADE;
+
+-- a hostname can only belong to one app
+create unique index if not EXISTS idx_domains_domain on domains(lower(domain));
+create index if not EXISTS idx_domains_app_id on domains(app_id);
+
+CREATE TABLE app_ports_conflicts (
+    id BIGINT PRIMARY KEY,
+    port TEXT,
+    app_id BIGINT,
+    domain_id BIGINT,
+    reason TEXT NOT NULL,
+
+    created_at TIMESTAMP,
+    updated_at TIMESTAMP
+);
+
+INSERT INTO app_ports_conflicts (id, port, app_id, domain_id, reason, created_at, updated_at)
+    SELECT id, port, app_id, domain_id, 'app was deleted', created_at, updated_at FROM app_ports
+    WHERE app_id NOT IN (SELECT id FROM apps);
+DELETE FROM app_ports WHERE app_id NOT IN (SELECT id FROM apps);
+
+INSERT INTO app_ports_conflicts (id, port, app_id, domain_id, reason, created_at, updated_at)
+    SELECT id, port, app_id, domain_id, 'empty upstream', created_at, updated_at FROM app_ports
+    WHERE trim(coalesce(port, '')) = '';
+DELETE FROM app_ports WHERE trim(coalesce(port, '')) = '';
+
+INSERT INTO app_ports_conflicts (id, port, app_id, domain_id, reason, created_at, updated_at)
+    SELECT p.id, p.port, p.app_id, p.domain_id, 'duplicate of upstream ' || min(o.id), p.created_at, p.updated_at
+    FROM app_ports p JOIN app_ports o
+        ON (CASE WHEN strpos(trim(p.port), ':') > 0 THEN lower(trim(p.port)) ELSE '127.0.0.1:' || trim(p.port) END)
+            = (CASE WHEN strpos(trim(o.port), ':') > 0 THEN lower(trim(o.port)) ELSE '127.0.0.1:' || trim(o.port) END)
+        AND p.id > o.id
+    GROUP BY p.id;
+DELETE FROM app_ports WHERE id IN (SELECT id FROM app_ports_conflicts);
+UPDATE app_ports SET port = trim(port);
+UPDATE app_ports SET domain_id = NULL WHERE domain_id NOT IN (SELECT id FROM domains);
+
+ALTER TABLE app_ports ALTER COLUMN port SET NOT NULL;
+ALTER TABLE app_ports ADD CONSTRAINT app_ports_app_id_fkey
+    FOREIGN KEY (app_id) REFERENCES apps(id) ON DELETE CASCADE;
+ALTER TABLE app_ports ADD CONSTRAINT app_ports_domain_id_fkey
+    FOREIGN KEY (domain_id) REFERENCES domains(id) ON DELETE SET NULL;
+
+-- an upstream (host and port, a bare port is on 127.0.0.1) can only be
+-- used by one app, keep in sync with app_ports.AppPorts.Dial
+create unique index if not EXISTS idx_app_ports_dial on app_ports(
+    (CASE WHEN strpos(port, ':') > 0 THEN lower(port) ELSE '127.0.0.1:' || port END)
+);
+create index if not EXISTS idx_app_ports_app_id on app_ports(app_id);
+
+CREATE TABLE app_options_conflicts (
+    id BIGINT PRIMARY KEY,
+    app_id BIGINT,
+    name TEXT,
+    value TEXT,
+    reason TEXT NOT NULL,
+
+    created_at TIMESTAMP,
+    updated_at TIMESTAMP
+);
+
+INSERT INTO app_options_conflicts (id, app_id, name, value, reason, created_at, updated_at)
+    SELECT id, app_id, name, value, 'app was deleted', created_at, updated_at FROM app_options
+    WHERE app_id NOT IN (SELECT id FROM apps);
+DELETE FROM app_options WHERE app_id NOT IN (SELECT id FROM apps);
+
+ALTER TABLE app_options ADD CONSTRAINT app_options_app_id_fkey
+    FOREIGN KEY (app_id) REFERENCES apps(id) ON DELETE CASCADE;
@@ -0,0 +1,25 @@
+-- Per app settings that don't fit the apps table, 
+-- ex: the root of a file server or the target of a redirect
+
+CREATE TABLE app_options (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    app_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    value TEXT,
+
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+create unique index if not EXISTS idx_app_options_app_id_name on app_options(app_id, name);
+
+DROP TRIGGER IF EXISTS app_options_updated_at;
+CREATE TRIGGER app_options_updated_at
+AFTER UPDATE ON app_options
+FOR EACH ROW
+WHEN NEW.updated_at = OLD.updated_at
+BEGIN
+    UPDATE app_options
+        SET updated_at = datetime('now')
+        WHERE id = NEW.id;
+END;
@@ -0,0 +1,23 @@
+-- Dashboard sessions, the cookie holds the token and only
+-- its sha256 is stored here
+
+CREATE TABLE sessions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token_hash TEXT NOT NULL UNIQUE,
+    instance_id INTEGER NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+DROP TRIGGER IF EXISTS sessions_updated_at;
+CREATE TRIGGER sessions_updated_at
+AFTER UPDATE ON sessions
+FOR EACH ROW
+WHEN NEW.updated_at = OLD.updated_at
+BEGIN
+    UPDATE sessions
+        SET updated_at = datetime('now')
+        WHERE id = NEW.id;
+END;
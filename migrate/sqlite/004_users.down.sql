@@ -0,0 +1,27 @@
+-- sessions go back to the instance, everyone logs in again
+
+DROP TABLE IF EXISTS sessions;
+
+CREATE TABLE sessions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token_hash TEXT NOT NULL UNIQUE,
+    instance_id INTEGER NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER sessions_updated_at
+AFTER UPDATE ON sessions
+FOR EACH ROW
+WHEN NEW.updated_at = OLD.updated_at
+BEGIN
+    UPDATE sessions
+        SET updated_at = datetime('now')
+        WHERE id = NEW.id;
+END;
+
+ALTER TABLE apps DROP COLUMN team;
+
+DROP TABLE IF EXISTS users;
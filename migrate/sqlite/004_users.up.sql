@@ -0,0 +1,59 @@
+-- Named users with a role, `team` is a free form name and users can 
+-- edit the apps that belong to the same team
+
+CREATE TABLE users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username TEXT NOT NULL UNIQUE,
+    password TEXT NOT NULL,
+    role TEXT NOT NULL DEFAULT 'viewer',
+    team TEXT,
+
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+DROP TRIGGER IF EXISTS users_updated_at;
+CREATE TRIGGER users_updated_at
+AFTER UPDATE ON users
+FOR EACH ROW
+WHEN NEW.updated_at = OLD.updated_at
+BEGIN
+    UPDATE users
+        SET updated_at = datetime('now')
+        WHERE id = NEW.id;
+END;
+
+-- the single instance password becomes the `admin` user
+
+INSERT INTO users (username, password, role)
+    SELECT 'admin', password, 'admin' FROM instances
+    WHERE is_primary = 1 AND password IS NOT NULL AND password != ''
+    ORDER BY id LIMIT 1;
+
+ALTER TABLE apps ADD COLUMN team TEXT;
+
+-- sessions now belong to users, existing ones are dropped and 
+-- everyone logs in again
+
+DROP TRIGGER IF EXISTS sessions_updated_at;
+DROP TABLE sessions;
+
+CREATE TABLE sessions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token_hash TEXT NOT NULL UNIQUE,
+    user_id INTEGER NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER sessions_updated_at
+AFTER UPDATE ON sessions
+FOR EACH ROW
+WHEN NEW.updated_at = OLD.updated_at
+BEGIN
+    UPDATE sessions
+        SET updated_at = datetime('now')
+        WHERE id = NEW.id;
+END;
@@ -0,0 +1,31 @@
+-- Tokens for automation, personal tokens act as their user (capped by 
+-- the scope) while service tokens have no user and act with the scope 
+-- alone, only the sha256 of the token is stored
+
+CREATE TABLE api_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    prefix TEXT NOT NULL,
+    kind TEXT NOT NULL DEFAULT 'personal',
+    user_id INTEGER,
+    scope TEXT NOT NULL DEFAULT 'read',
+    -- comma separated app ids, empty for every app
+    app_ids TEXT,
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+DROP TRIGGER IF EXISTS api_tokens_updated_at;
+CREATE TRIGGER api_tokens_updated_at
+AFTER UPDATE ON api_tokens
+FOR EACH ROW
+WHEN NEW.updated_at = OLD.updated_at
+BEGIN
+    UPDATE api_tokens
+        SET updated_at = datetime('now')
+        WHERE id = NEW.id;
+END;
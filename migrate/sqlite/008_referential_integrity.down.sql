@@ -0,0 +1,79 @@
+-- back to the tables without foreign keys, with the rows the way up
+-- moved to the *_conflicts tables. app_ports goes first since it
+-- references domains
+
+CREATE TABLE old_app_ports (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    port TEXT,
+    app_id INTEGER NOT NULL,
+    domain_id INTEGER,
+
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO old_app_ports SELECT id, port, app_id, domain_id, created_at, updated_at FROM app_ports;
+INSERT INTO old_app_ports SELECT id, port, app_id, domain_id, created_at, updated_at FROM app_ports_conflicts;
+DROP TABLE app_ports_conflicts;
+DROP TABLE app_ports;
+ALTER TABLE old_app_ports RENAME TO app_ports;
+
+CREATE TRIGGER app_ports_updated_at
+AFTER UPDATE ON app_ports
+FOR EACH ROW
+WHEN NEW.updated_at = OLD.updated_at
+BEGIN
+    UPDATE app_ports
+        SET updated_at = datetime('now')
+        WHERE id = NEW.id;
+END;
+
+CREATE TABLE old_domains (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    domain TEXT,
+    app_id INTEGER NOT NULL,
+
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO old_domains SELECT id, domain, app_id, created_at, updated_at FROM domains;
+INSERT INTO old_domains SELECT id, domain, app_id, created_at, updated_at FROM domains_conflicts;
+DROP TABLE domains_conflicts;
+DROP TABLE domains;
+ALTER TABLE old_domains RENAME TO domains;
+
+CREATE TRIGGER domains_updated_at
+AFTER UPDATE ON domains
+FOR EACH ROW
+WHEN NEW.updated_at = OLD.updated_at
+BEGIN
+    UPDATE domains
+        SET updated_at = datetime('now')
+        WHERE id = NEW.id;
+END;
+
+CREATE TABLE old_app_options (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    app_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    value TEXT,
+
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO old_app_options SELECT id, app_id, name, value, created_at, updated_at FROM app_options;
+INSERT INTO old_app_options SELECT id, app_id, name, value, created_at, updated_at FROM app_options_conflicts;
+DROP TABLE app_options_conflicts;
+DROP TABLE app_options;
+ALTER TABLE old_app_options RENAME TO app_options;
+
+create unique index if not EXISTS idx_app_options_app_id_name on app_options(app_id, name);
+
+CREATE TRIGGER app_options_updated_at
+AFTER UPDATE ON app_options
+FOR EACH ROW
+WHEN NEW.updated_at = OLD.updated_at
+BEGIN
+    UPDATE app_options
+        SET updated_at = datetime('now')
+        WHERE id = NEW.id;
+END;
@@ -0,0 +1,179 @@
+-- Domains, ports and options now belong to their app through foreign
+-- keys and go away with it. sqlite can't add constraints to an existing
+-- table so the three tables are rebuilt. Rows that can't be carried
+-- over (left behind by apps that were deleted, empty, or a hostname or
+-- upstream already used by an older row) are moved to the matching
+-- *_conflicts table with the reason, they are listed in the log and
+-- the down migration puts them back
+
+CREATE TABLE new_domains (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    domain TEXT NOT NULL,
+    app_id INTEGER NOT NULL REFERENCES apps(id) ON DELETE CASCADE,
+
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO new_domains (id, domain, app_id, created_at, updated_at)
+    SELECT id, lower(trim(domain)), app_id, created_at, updated_at FROM domains
+    WHERE app_id IN (SELECT id FROM apps)
+    AND trim(coalesce(domain, '')) != ''
+    AND id IN (
+        SELECT min(id) FROM domains
+        WHERE app_id IN (SELECT id FROM apps)
+        GROUP BY lower(trim(domain))
+    );
+
+CREATE TABLE domains_conflicts (
+    id INTEGER PRIMARY KEY,
+    domain TEXT,
+    app_id INTEGER,
+    reason TEXT NOT NULL,
+
+    created_at TIMESTAMP,
+    updated_at TIMESTAMP
+);
+
+INSERT INTO domains_conflicts (id, domain, app_id, reason, created_at, updated_at)
+    SELECT id, domain, app_id,
+        CASE
+            WHEN app_id NOT IN (SELECT id FROM apps) THEN 'app was deleted'
+            WHEN trim(coalesce(domain, '')) = '' THEN 'empty hostname'
+            ELSE 'duplicate of domain ' || (
+                SELECT n.id FROM new_domains n WHERE n.domain = lower(trim(d.domain))
+            )
+        END,
+        created_at, updated_at
+    FROM domains d
+    WHERE id NOT IN (SELECT id FROM new_domains);
+
+DROP TABLE domains;
+ALTER TABLE new_domains RENAME TO domains;
+
+-- a hostname can only belong to one app
+create unique index if not EXISTS idx_domains_domain on domains(lower(domain));
+create index if not EXISTS idx_domains_app_id on domains(app_id);
+
+CREATE TRIGGER domains_updated_at
+AFTER UPDATE ON domains
+FOR EACH ROW
+WHEN NEW.updated_at = OLD.updated_at
+BEGIN
+    UPDATE domains
+        SET updated_at = datetime('now')
+        WHERE id = NEW.id;
+END;
+
+CREATE TABLE new_app_ports (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    port TEXT NOT NULL,
+    app_id INTEGER NOT NULL REFERENCES apps(id) ON DELETE CASCADE,
+    domain_id INTEGER REFERENCES domains(id) ON DELETE SET NULL,
+
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO new_app_ports (id, port, app_id, domain_id, created_at, updated_at)
+    SELECT id, trim(port), app_id,
+        CASE WHEN domain_id IN (SELECT id FROM domains) THEN domain_id END,
+        created_at, updated_at
+    FROM app_ports
+    WHERE app_id IN (SELECT id FROM apps)
+    AND trim(coalesce(port, '')) != ''
+    AND id IN (
+        SELECT min(id) FROM app_ports
+        WHERE app_id IN (SELECT id FROM apps)
+        GROUP BY CASE WHEN instr(trim(port), ':') > 0 THEN lower(trim(port)) ELSE '127.0.0.1:' || trim(port) END
+    );
+
+CREATE TABLE app_ports_conflicts (
+    id INTEGER PRIMARY KEY,
+    port TEXT,
+    app_id INTEGER,
+    domain_id INTEGER,
+    reason TEXT NOT NULL,
+
+    created_at TIMESTAMP,
+    updated_at TIMESTAMP
+);
+
+INSERT INTO app_ports_conflicts (id, port, app_id, domain_id, reason, created_at, updated_at)
+    SELECT id, port, app_id, domain_id,
+        CASE
+            WHEN app_id NOT IN (SELECT id FROM apps) THEN 'app was deleted'
+            WHEN trim(coalesce(port, '')) = '' THEN 'empty upstream'
+            ELSE 'duplicate of upstream ' || (
+                SELECT n.id FROM new_app_ports n
+                WHERE (CASE WHEN instr(n.port, ':') > 0 THEN lower(n.port) ELSE '127.0.0.1:' || n.port END)
+                    = (CASE WHEN instr(trim(p.port), ':') > 0 THEN lower(trim(p.port)) ELSE '127.0.0.1:' || trim(p.port) END)
+            )
+        END,
+        created_at, updated_at
+    FROM app_ports p
+    WHERE id NOT IN (SELECT id FROM new_app_ports);
+
+DROP TABLE app_ports;
+ALTER TABLE new_app_ports RENAME TO app_ports;
+
+-- an upstream (host and port, a bare port is on 127.0.0.1) can only be
+-- used by one app, keep in sync with app_ports.AppPorts.Dial
+create unique index if not EXISTS idx_app_ports_dial on app_ports(
+    (CASE WHEN instr(port, ':') > 0 THEN lower(port) ELSE '127.0.0.1:' || port END)
+);
+create index if not EXISTS idx_app_ports_app_id on app_ports(app_id);
+
+CREATE TRIGGER app_ports_updated_at
+AFTER UPDATE ON app_ports
+FOR EACH ROW
+WHEN NEW.updated_at = OLD.updated_at
+BEGIN
+    UPDATE app_ports
+        SET updated_at = datetime('now')
+        WHERE id = NEW.id;
+END;
+
+CREATE TABLE new_app_options (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    app_id INTEGER NOT NULL REFERENCES apps(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    value TEXT,
+
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO new_app_options (id, app_id, name, value, created_at, updated_at)
+    SELECT id, app_id, name, value, created_at, updated_at FROM app_options
+    WHERE app_id IN (SELECT id FROM apps);
+
+CREATE TABLE app_options_conflicts (
+    id INTEGER PRIMARY KEY,
+    app_id INTEGER,
+    name TEXT,
+    value TEXT,
+    reason TEXT NOT NULL,
+
+    created_at TIMESTAMP,
+    updated_at TIMESTAMP
+);
+
+INSERT INTO app_options_conflicts (id, app_id, name, value, reason, created_at, updated_at)
+    SELECT id, app_id, name, value, 'app was deleted', created_at, updated_at FROM app_options
+    WHERE id NOT IN (SELECT id FROM new_app_options);
+
+DROP TABLE app_options;
+ALTER TABLE new_app_options RENAME TO app_options;
+
+create unique index if not EXISTS idx_app_options_app_id_name on app_options(app_id, name);
+
+CREATE TRIGGER app_options_updated_at
+AFTER UPDATE ON app_options
+FOR EACH ROW
+WHEN NEW.updated_at = OLD.updated_at
+BEGIN
+    UPDATE app_options
+        SET updated_at = datetime('now')
+        WHERE id = NEW.id;
+END;
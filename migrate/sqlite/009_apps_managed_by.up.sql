@@ -0,0 +1,5 @@
+-- Apps applied from an apps file are managed by that file (its path or
+-- repository), they are read-only in the UI. NULL for apps created in
+-- the UI or through the API
+
+ALTER TABLE apps ADD COLUMN managed_by TEXT;
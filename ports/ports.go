@@ -0,0 +1,136 @@
+// Package ports keeps track of the upstream ports of the apps and hands
+// out free ones from the configured range
+package ports
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/barelyhuman/caddy-ui/config"
+	"github.com/barelyhuman/caddy-ui/data/models/app_ports"
+	"github.com/barelyhuman/caddy-ui/data/store"
+)
+
+// ErrExhausted is returned when every port of the range is taken
+var ErrExhausted = errors.New("no free port left in the port range")
+
+// Entry is one upstream of the registry
+type Entry struct {
+	ID      int64  `json:"id"`
+	Port    string `json:"port"`
+	Dial    string `json:"dial"`
+	AppID   int64  `json:"app_id"`
+	AppName string `json:"app"`
+	// Local is true for upstreams on this host, the only ones that can be
+	// checked with Bound
+	Local bool `json:"local"`
+	// Bound is true when something listens on a local upstream, usually
+	// the app itself
+	Bound bool `json:"bound"`
+}
+
+// Bound tells if something on this host already listens on the port, by
+// trying to listen on it on every interface
+func Bound(port int) bool {
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return true
+	}
+	listener.Close()
+	return false
+}
+
+// Range is the allocation range from the config, both ends included
+func Range() (int, int, error) {
+	return config.ParsePortRange(config.Get().PortRange)
+}
+
+// Next returns the first port of the range that no app uses and that
+// nothing on the host listens on, used is keyed by app_ports.DialKey
+func Next(used map[string]int64, from, to int) (int, error) {
+	for port := from; port <= to; port++ {
+		if _, taken := used[app_ports.DialKey(strconv.Itoa(port))]; taken {
+			continue
+		}
+		if Bound(port) {
+			continue
+		}
+		return port, nil
+	}
+	return 0, ErrExhausted
+}
+
+// Allocate picks the next free port of the configured range, run it in
+// the transaction that saves the port so two apps can't get the same one
+// (the unique upstream index catches the rest)
+func Allocate(ctx context.Context, tx *store.Store) (int, error) {
+	from, to, err := Range()
+	if err != nil {
+		return 0, err
+	}
+	used, err := tx.Ports.AppIdsByDial(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return Next(used, from, to)
+}
+
+// local tells if the upstream is dialed on this host
+func local(dial string) (int, bool) {
+	host, portText, err := net.SplitHostPort(dial)
+	if err != nil {
+		return 0, false
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return 0, false
+	}
+	switch strings.ToLower(host) {
+	case "127.0.0.1", "localhost", "::1", "0.0.0.0", "":
+		return port, true
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return port, true
+	}
+	return 0, false
+}
+
+// List returns every upstream with its app, local ones are checked with
+// Bound
+func List(ctx context.Context, s *store.Store) ([]Entry, error) {
+	all, err := s.Ports.FindAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	appList, err := s.Apps.FindAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := map[int64]string{}
+	for _, app := range appList {
+		names[app.ID] = app.Name
+	}
+
+	entries := []Entry{}
+	for _, item := range all {
+		if len(item.Port) == 0 {
+			continue
+		}
+		entry := Entry{
+			ID:      item.ID,
+			Port:    item.Port,
+			Dial:    item.Dial(),
+			AppID:   item.AppId,
+			AppName: names[item.AppId],
+		}
+		if port, ok := local(entry.Dial); ok {
+			entry.Local = true
+			entry.Bound = Bound(port)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,90 @@
+package ports
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/barelyhuman/caddy-ui/data/models/app_ports"
+)
+
+// freePort returns a port nothing listens on, the kernel picks it so it
+// is very unlikely to be taken again during the test
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestNext(t *testing.T) {
+	port := freePort(t)
+	used := func(ports ...string) map[string]int64 {
+		m := map[string]int64{}
+		for i, p := range ports {
+			m[app_ports.DialKey(p)] = int64(i + 1)
+		}
+		return m
+	}
+
+	got, err := Next(used(), port, port)
+	if err != nil || got != port {
+		t.Fatalf("Next() = %v, %v, want %v", got, err, port)
+	}
+
+	// a bare port and 127.0.0.1 are the same upstream
+	for _, taken := range []string{strconv.Itoa(port), "127.0.0.1:" + strconv.Itoa(port)} {
+		if _, err := Next(used(taken), port, port); !errors.Is(err, ErrExhausted) {
+			t.Errorf("Next() with %v used = %v, want ErrExhausted", taken, err)
+		}
+	}
+	// an upstream on another host doesn't take the local port
+	if got, err := Next(used("10.0.0.5:"+strconv.Itoa(port)), port, port); err != nil || got != port {
+		t.Errorf("Next() = %v, %v, want %v", got, err, port)
+	}
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	bound := listener.Addr().(*net.TCPAddr).Port
+	if !Bound(bound) {
+		t.Errorf("Bound(%v) = false while listening on it", bound)
+	}
+	if _, err := Next(used(), bound, bound); !errors.Is(err, ErrExhausted) {
+		t.Errorf("Next() over a bound port = %v, want ErrExhausted", err)
+	}
+
+	if _, err := Next(used(), port, port-1); !errors.Is(err, ErrExhausted) {
+		t.Errorf("Next() over an empty range = %v, want ErrExhausted", err)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	tests := []struct {
+		dial      string
+		wantPort  int
+		wantLocal bool
+	}{
+		{"127.0.0.1:8080", 8080, true},
+		{"localhost:8080", 8080, true},
+		{"LOCALHOST:8080", 8080, true},
+		{"[::1]:8080", 8080, true},
+		{"127.0.0.2:8080", 8080, true},
+		{":8080", 8080, true},
+		{"10.0.0.5:8080", 0, false},
+		{"app.internal:8080", 0, false},
+		{"8080", 0, false},
+	}
+	for _, tt := range tests {
+		port, ok := local(tt.dial)
+		if port != tt.wantPort || ok != tt.wantLocal {
+			t.Errorf("local(%q) = %v, %v, want %v, %v", tt.dial, port, ok, tt.wantPort, tt.wantLocal)
+		}
+	}
+}
@@ -10,10 +10,29 @@ import (
 //go:embed **/*.html **/**/*.html
 var viewFS embed.FS
 
+// views is never executed, it's cloned for each render so the
+// request's csrf token can be bound to the template funcs
 var views *template.Template
 
+// csrfTokener is implemented by the response writer that auth.CSRF
+// hands to the handlers
+type csrfTokener interface {
+	CSRFToken() string
+}
+
+func funcs(token string) template.FuncMap {
+	return template.FuncMap{
+		"csrfToken": func() string {
+			return token
+		},
+		"csrfField": func() template.HTML {
+			return template.HTML(`<input type="hidden" name="csrf_token" value="` + template.HTMLEscapeString(token) + `" />`)
+		},
+	}
+}
+
 func init() {
-	_views, err := template.ParseFS(viewFS, "./**/*.html", "**/**/*.html")
+	_views, err := template.New("").Funcs(funcs("")).ParseFS(viewFS, "./**/*.html", "**/**/*.html")
 	if err != nil {
 		log.Fatalf("Failed to read templates with error: %v", err)
 	}
@@ -21,5 +40,13 @@ func init() {
 }
 
 func Render(w io.Writer, name string, v any) error {
-	return views.ExecuteTemplate(w, name, v)
+	token := ""
+	if t, ok := w.(csrfTokener); ok {
+		token = t.CSRFToken()
+	}
+	t, err := views.Clone()
+	if err != nil {
+		return err
+	}
+	return t.Funcs(funcs(token)).ExecuteTemplate(w, name, v)
 }